@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/mirror"
+	"github.com/phanirithvij/fate/f8/plan"
+	"gorm.io/gorm"
+)
+
+// bucketCmd inspects and repairs the buckets
+//
+//	fate bucket ls <entity_type> <entity_id> [bucket]
+//	fate bucket mirror <entity_type> <entity_id> <bucket> <dir>
+//	fate bucket mv|cp <entity_type> <entity_id> <bucket> <src> <dst>
+//	fate bucket rm <entity_type> <entity_id> <bucket> <path>
+//	fate bucket verify <entity_type> <entity_id> [bucket]
+//	fate bucket quota <entity_type> <entity_id> <bucket> [bytes]
+//
+// The commands changing a bucket ask for confirmation unless -yes
+// and only print what they would change with -dry-run
+func bucketCmd(args []string) {
+	if len(args) > 0 {
+		sub, ok := map[string]func([]string){
+			"ls":     bucketLs,
+			"mirror": bucketMirror,
+			"mv":     bucketMv,
+			"cp":     bucketCp,
+			"rm":     bucketRm,
+			"verify": bucketVerify,
+			"quota":  bucketQuota,
+		}[args[0]]
+		if ok {
+			sub(args[1:])
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: fate bucket ls|mirror|mv|cp|rm|verify|quota [flags] <entity_type> <entity_id> ..., fate bucket <command> -h for its arguments")
+	os.Exit(2)
+}
+
+// bucketMirror syncs a mirror of the bucket once, fate serve keeps the configured mirrors updated
+func bucketMirror(args []string) {
+	fs := flag.NewFlagSet("fate bucket mirror", flag.ExitOnError)
+	cfg := parse(fs, args)
+	if fs.NArg() < 4 {
+		log.Fatal("Usage: fate bucket mirror <entity_type> <entity_id> <bucket> <dir>")
+	}
+	storage := open(cfg)
+	m := mirror.New(db, storage.StorageDir)
+	t := mirror.Target{EntityType: fs.Arg(0), EntityID: fs.Arg(1), Bucket: fs.Arg(2), Dir: fs.Arg(3)}
+	report, err := m.Add(t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Mirrored", t.Bucket, "to", t.Dir, report.Copied, "copied", report.Removed, "removed")
+}
+
+// bucketLs lists the buckets of an entity or the files of a bucket
+func bucketLs(args []string) {
+	fs := flag.NewFlagSet("fate bucket ls", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "list only the paths starting with prefix")
+	limit := fs.Int("limit", buckets.DefaultListLimit, "number of files in a page")
+	cursor := fs.String("cursor", "", "cursor of the page, printed after the previous one")
+	sortBy := fs.String("sort", string(buckets.SortByName), "order of the files, name, path, size or mod_time")
+	cfg := parse(fs, args)
+	if fs.NArg() < 2 {
+		log.Fatal("Usage: fate bucket ls [flags] <entity_type> <entity_id> [bucket]")
+	}
+	open(cfg)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	if fs.NArg() == 2 {
+		// the buckets of the entity
+		bucks, err := buckets.Owned(db, fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(w, "BUCKET\tVISIBILITY\tUSED\tQUOTA\tLAYOUT")
+		for _, b := range bucks {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", b.ID, b.Visibility, b.Used, b.Quota, b.Layout)
+		}
+		return
+	}
+
+	b, err := buckets.Find(db, fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	if err != nil {
+		log.Fatal(err)
+	}
+	page, err := b.List(context.Background(), buckets.ListOptions{
+		Limit:  *limit,
+		Cursor: *cursor,
+		Prefix: *prefix,
+		SortBy: buckets.SortBy(*sortBy),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED\tTYPE")
+	for _, f := range page.Files {
+		ctype := f.ContentType
+		if f.IsDir {
+			ctype = "directory"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", f.Path, f.Size, f.ModTime.Format(time.RFC3339), ctype)
+	}
+	if page.NextCursor != "" {
+		w.Flush()
+		fmt.Println("\nNext page: -cursor", page.NextCursor)
+	}
+}
+
+// surgeryFlags the flags of the commands changing a bucket
+type surgeryFlags struct {
+	dryRun *bool
+	yes    *bool
+}
+
+func newSurgeryFlags(fs *flag.FlagSet) surgeryFlags {
+	return surgeryFlags{
+		dryRun: fs.Bool("dry-run", false, "only print what would change"),
+		yes:    fs.Bool("yes", false, "don't ask for confirmation"),
+	}
+}
+
+// confirm asks the operator whether to go ahead, exiting if not
+//
+// Returns false on a dry run, the caller stops there
+func (f surgeryFlags) confirm(format string, a ...interface{}) bool {
+	question := fmt.Sprintf(format, a...)
+	if *f.dryRun {
+		fmt.Println("Would", question)
+		return false
+	}
+	if *f.yes {
+		return true
+	}
+	fmt.Print(strings.ToUpper(question[:1]), question[1:], "? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	fmt.Println("Aborted")
+	os.Exit(1)
+	return false
+}
+
+// surgeryBucket returns the bucket of the arguments with the storage attached
+func surgeryBucket(storage *f8.StorageConfig, entityType, entityID, bID string) *buckets.Bucket {
+	b, err := buckets.Find(db, entityType, entityID, bID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.AttachStorage(storage.StorageDir)
+	return b
+}
+
+// printTree prints the files and directories of a tree with their total
+func printTree(fdirs []buckets.FileDir) string {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var files, size int64
+	for _, f := range fdirs {
+		if f.IsDir {
+			fmt.Fprintf(w, "%s/\t\n", f.Path)
+			continue
+		}
+		files++
+		size += f.Size
+		fmt.Fprintf(w, "%s\t%d\n", f.Path, f.Size)
+	}
+	w.Flush()
+	return fmt.Sprintf("%d files, %d bytes", files, size)
+}
+
+// bucketMv moves a file or directory inside a bucket
+func bucketMv(args []string) {
+	fs := flag.NewFlagSet("fate bucket mv", flag.ExitOnError)
+	sf := newSurgeryFlags(fs)
+	cfg := parse(fs, args)
+	if fs.NArg() < 5 {
+		log.Fatal("Usage: fate bucket mv [-dry-run] [-yes] <entity_type> <entity_id> <bucket> <src> <dst>")
+	}
+	storage := open(cfg)
+	b := surgeryBucket(storage, fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	src, dst := fs.Arg(3), fs.Arg(4)
+	fdirs, err := b.Tree(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	total := printTree(fdirs)
+	if !sf.confirm("move %s (%s) of %s/%s/%s to %s", src, total, b.EntityType, b.EntityID, b.ID, dst) {
+		return
+	}
+	_, err = b.Move(src, dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Moved", src, "to", dst)
+}
+
+// bucketCp copies a file or directory inside a bucket or to another one with -to
+func bucketCp(args []string) {
+	fs := flag.NewFlagSet("fate bucket cp", flag.ExitOnError)
+	sf := newSurgeryFlags(fs)
+	to := fs.String("to", "", "copy to the bucket <entity_type>/<entity_id>/<bucket> instead")
+	cfg := parse(fs, args)
+	if fs.NArg() < 5 {
+		log.Fatal("Usage: fate bucket cp [-dry-run] [-yes] [-to entity_type/entity_id/bucket] <entity_type> <entity_id> <bucket> <src> <dst>")
+	}
+	storage := open(cfg)
+	b := surgeryBucket(storage, fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	target := b
+	if *to != "" {
+		parts := strings.Split(*to, "/")
+		if len(parts) != 3 {
+			log.Fatal("-to must be <entity_type>/<entity_id>/<bucket>")
+		}
+		target = surgeryBucket(storage, parts[0], parts[1], parts[2])
+	}
+	src, dst := fs.Arg(3), fs.Arg(4)
+	fdirs, err := b.Tree(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	total := printTree(fdirs)
+	if !sf.confirm("copy %s (%s) of %s/%s/%s to %s/%s/%s %s", src, total, b.EntityType, b.EntityID, b.ID,
+		target.EntityType, target.EntityID, target.ID, dst) {
+		return
+	}
+	_, err = b.CopyTo(target, src, dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Copied", src, "to", dst)
+}
+
+// bucketRm removes a file or directory of a bucket, the gc purges it after the retention
+func bucketRm(args []string) {
+	fs := flag.NewFlagSet("fate bucket rm", flag.ExitOnError)
+	sf := newSurgeryFlags(fs)
+	cfg := parse(fs, args)
+	if fs.NArg() < 4 {
+		log.Fatal("Usage: fate bucket rm [-dry-run] [-yes] <entity_type> <entity_id> <bucket> <path>")
+	}
+	storage := open(cfg)
+	b := surgeryBucket(storage, fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	p := fs.Arg(3)
+	fdirs, err := b.Tree(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	total := printTree(fdirs)
+	if !sf.confirm("remove %s (%s) of %s/%s/%s", p, total, b.EntityType, b.EntityID, b.ID) {
+		steps, err := plan.Run(db, func(tx *gorm.DB) error {
+			// the bucket again, attached to the dry run
+			tb, err := buckets.Find(tx, b.EntityType, b.EntityID, b.ID)
+			if err != nil {
+				return err
+			}
+			tb.AttachStorage(storage.StorageDir)
+			return tb.Remove(p)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		steps.Print(os.Stdout)
+		return
+	}
+	err = b.Remove(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Removed", p)
+}
+
+// bucketVerify checks the buckets of an entity against the storage directory, repairing them with -fix
+func bucketVerify(args []string) {
+	fs := flag.NewFlagSet("fate bucket verify", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "repair the problems found, see buckets.Bucket.Repair")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	cfg := parse(fs, args)
+	if fs.NArg() < 2 {
+		log.Fatal("Usage: fate bucket verify [-fix] [-yes] <entity_type> <entity_id> [bucket]")
+	}
+	storage := open(cfg)
+	var bucks []*buckets.Bucket
+	if fs.NArg() > 2 {
+		bucks = []*buckets.Bucket{surgeryBucket(storage, fs.Arg(0), fs.Arg(1), fs.Arg(2))}
+	} else {
+		var err error
+		bucks, err = buckets.Owned(db, fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	sf := surgeryFlags{dryRun: new(bool), yes: yes}
+	problems := 0
+	for _, b := range bucks {
+		b.AttachStorage(storage.StorageDir)
+		report, err := b.Verify(cfg.Pacer(dbLatency))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range report.Problems {
+			log.Println("[verify]", p.EntityType, p.EntityID, p.BucketID, p.Path, p.Issue)
+		}
+		if report.OK() {
+			log.Println("Checked", b.ID, report.Files, "files")
+			continue
+		}
+		if !*fix || !sf.confirm("repair the %d problems of %s", len(report.Problems), b.ID) {
+			problems += len(report.Problems)
+			continue
+		}
+		fixed, err := b.Repair(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Repaired", fixed, "of the", len(report.Problems), "problems of", b.ID)
+		problems += len(report.Problems) - fixed
+	}
+	if problems > 0 {
+		log.Fatalf("Verify found %d problems\n", problems)
+	}
+}
+
+// bucketQuota prints the usage and quota of a bucket or sets the quota, 0 for unlimited
+func bucketQuota(args []string) {
+	fs := flag.NewFlagSet("fate bucket quota", flag.ExitOnError)
+	sf := newSurgeryFlags(fs)
+	cfg := parse(fs, args)
+	if fs.NArg() < 3 {
+		log.Fatal("Usage: fate bucket quota [-dry-run] [-yes] <entity_type> <entity_id> <bucket> [bytes]")
+	}
+	storage := open(cfg)
+	b := surgeryBucket(storage, fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	fmt.Println("Used", b.Used, "of", b.Quota, "bytes")
+	if fs.NArg() < 4 {
+		return
+	}
+	quota, err := strconv.ParseInt(fs.Arg(3), 10, 64)
+	if err != nil {
+		log.Fatal("The quota must be a number of bytes")
+	}
+	if quota > 0 && b.Used > quota {
+		log.Println("[f8][WARNING]: The bucket already uses", b.Used, "bytes, writes will fail until it's under the quota")
+	}
+	if !sf.confirm("set the quota of %s/%s/%s to %d bytes", b.EntityType, b.EntityID, b.ID, quota) {
+		return
+	}
+	err = b.SetQuota(quota)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Set the quota of", b.ID, "to", quota, "bytes")
+}
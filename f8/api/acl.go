@@ -0,0 +1,233 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/browser"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"github.com/phanirithvij/fate/f8/roles"
+)
+
+type visibilityRequest struct {
+	Visibility buckets.Visibility `json:"visibility"`
+}
+
+type grantRequest struct {
+	GranteeID   string       `json:"grantee_id"`
+	GranteeType string       `json:"grantee_type"`
+	Role        buckets.Role `json:"role"`
+}
+
+// ownedBucket returns the bucket if the request was made by its owner or an admin
+//
+// Read-only owners can only look
+func (s *Server) ownedBucket(r *http.Request, params []string) (*buckets.Bucket, error) {
+	actor, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if !b.IsOwner(actor) && !actor.IsAdmin() {
+		return nil, buckets.ErrForbidden
+	}
+	if readonly.Mutating(r.Method) && !actor.Role.CanWrite() {
+		return nil, buckets.ErrForbidden
+	}
+	return b, nil
+}
+
+// setVisibility changes who can access a bucket, only for the owner
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/visibility
+func (s *Server) setVisibility(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &visibilityRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if req.Visibility == buckets.PublicRead {
+		err = s.feature(flags.PublicSharing, b.EntityType, b.EntityID)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+	err = b.SetVisibility(req.Visibility)
+	if err != nil {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// listGrants lists the access granted on a bucket, only for the owner
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/grants
+func (s *Server) listGrants(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	grants, err := b.Grants()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, grants)
+}
+
+// grant grants access on a bucket to another entity, only for the owner
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/grants
+func (s *Server) grant(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &grantRequest{}
+	err = readJSON(r, req)
+	if err != nil || req.GranteeID == "" || req.GranteeType == "" {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	err = b.Grant(&buckets.Actor{ID: req.GranteeID, Type: req.GranteeType}, req.Role)
+	if err != nil {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, req)
+}
+
+// revoke revokes the access granted on a bucket, only for the owner
+//
+//	DELETE /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/grants/{grantee_type}/{grantee_id}
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.Revoke(&buckets.Actor{ID: params[4], Type: params[3]})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// browserPath matches the filebrowser api paths of the files, the path is relative to the user's scope
+//
+//	/admin/api/{resources,raw,preview/{size},subtitle,search,share}/{path}
+var browserPath = regexp.MustCompile(`^` + regexp.QuoteMeta(browser.BaseURL) + `/api/(resources|raw|preview/[^/]+|subtitle|search|share)(/.*)?$`)
+
+// Guard enforces the bucket access control lists on the filebrowser proxy
+//
+// Use it with browser.Middleware, the requesting entity is the one whose
+// directory is the scope of the filebrowser user of the session and the
+// filebrowser admins are admins. Only the admins see the other entities,
+// the entities see their own directory and the buckets they have the role
+// on: reads need the read role and anything else the write role. The
+// bucket directories themselves are only changed through the api.
+func (s *Server) Guard(next http.Handler) http.Handler {
+	return withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := browserPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, err := browser.SessionUser(r)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if u == nil {
+			// filebrowser refuses them
+			next.ServeHTTP(w, r)
+			return
+		}
+		want := buckets.Writer
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			want = buckets.Reader
+		}
+		err = s.authorizeBrowser(r, u, m[2], want)
+		if dst := r.URL.Query().Get("destination"); err == nil && dst != "" {
+			// filebrowser unescapes it once more
+			dst, err = url.QueryUnescape(dst)
+			if err != nil {
+				err = errBadRequest
+			} else {
+				err = s.authorizeBrowser(r, u, dst, buckets.Writer)
+			}
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// authorizeBrowser returns nil if the filebrowser user has the role on the path relative to its scope
+func (s *Server) authorizeBrowser(r *http.Request, u *browser.User, p string, want buckets.Role) error {
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return errs.New(errs.ErrInvalidPath, p)
+		}
+	}
+	if u.Admin {
+		return nil
+	}
+	actor, err := s.browserActor(u)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(strings.Trim(path.Join(u.Scope, p), "/"), "/")
+	switch {
+	case actor == nil || len(parts) < 2:
+		return errs.New(errs.ErrForbidden, "Only admins can see every entity")
+	case parts[0] != actor.Type || parts[1] != actor.ID:
+		return errs.ErrForbidden
+	case len(parts) == 2 && want == buckets.Reader:
+		return nil
+	case len(parts) <= 3 && want == buckets.Writer:
+		return errs.New(errs.ErrForbidden, "The buckets are managed through the api")
+	}
+	db, err := s.scope(r, actor)
+	if err != nil {
+		return err
+	}
+	_, err = buckets.FindFor(db, actor, parts[0], parts[1], parts[2], want)
+	return err
+}
+
+// browserActor the entity of the filebrowser user, the one whose directory is its scope
+//
+// Nil when the scope isn't an entity's directory
+func (s *Server) browserActor(u *browser.User) (*buckets.Actor, error) {
+	parts := strings.Split(strings.Trim(u.Scope, "/"), "/")
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	role, err := roles.Get(s.db, parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if !role.CanLogIn() {
+		return nil, errs.ErrDisabled
+	}
+	return &buckets.Actor{Type: parts[0], ID: parts[1], Role: role}, nil
+}
@@ -0,0 +1,352 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/browser"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/roles"
+)
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+	Name               string
+}
+
+// createUser saves a user with its default bucket
+func createUser(t *testing.T, env *fatetest.Env, id string) *entity.BaseEntity {
+	t.Helper()
+	e := env.Entity(t, "users", id)
+	env.Create(t, e, &user{BaseEntity: e, Name: id})
+	return e
+}
+
+func TestGuard(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, env, "bob")
+	createUser(t, env, "alice")
+	guard := env.API().Server.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	bob := &browser.User{Username: "bob", Scope: "/users/bob"}
+	root := &browser.User{Username: "carol", Scope: "/"}
+	admin := &browser.User{Username: "admin", Scope: "/", Admin: true}
+	escape := url.QueryEscape(url.QueryEscape("/../../alice/default/a.txt"))
+	tests := []struct {
+		name   string
+		user   *browser.User
+		method string
+		path   string
+		status int
+	}{
+		{"own directory", bob, "GET", "/resources/", http.StatusTeapot},
+		{"own file", bob, "PUT", "/resources/default/a.txt", http.StatusTeapot},
+		{"own bucket directory", bob, "DELETE", "/resources/default", http.StatusForbidden},
+		{"new directory", bob, "POST", "/resources/other/", http.StatusForbidden},
+		{"missing bucket", bob, "PUT", "/resources/other/a.txt", http.StatusNotFound},
+		{"dot dot", bob, "GET", "/raw/default/../../alice/default/a.txt", http.StatusBadRequest},
+		{"dot dot preview", bob, "GET", "/preview/thumb/../../../alice/default/a.jpg", http.StatusBadRequest},
+		{"dot dot destination", bob, "PATCH", "/resources/default/a.txt?action=rename&destination=" + escape, http.StatusBadRequest},
+		{"entities", root, "GET", "/resources/", http.StatusForbidden},
+		{"entity listing", root, "GET", "/search/users?query=a", http.StatusForbidden},
+		{"other's bucket", root, "GET", "/raw/users/alice/default/a.txt", http.StatusForbidden},
+		{"admin", admin, "GET", "/resources/users/alice/default/", http.StatusTeapot},
+		{"not a file", bob, "GET", "/settings", http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, browser.BaseURL+"/api"+tt.path, nil)
+			r = r.WithContext(browser.WithUser(r.Context(), tt.user))
+			w := httptest.NewRecorder()
+			guard.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("%s %s: got status %d want %d: %s", tt.method, tt.path, w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
+
+// teapot the status of the requests the guard lets through
+const teapot = http.StatusTeapot
+
+// guarded returns the guard of the env's api in front of a teapot
+func guarded(env *fatetest.Env) http.Handler {
+	return env.API().Server.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(teapot)
+	}))
+}
+
+// serveGuard sends the filebrowser api request of the user through the guard and returns the status
+func serveGuard(guard http.Handler, u *browser.User, method, p string) int {
+	r := httptest.NewRequest(method, browser.BaseURL+"/api"+p, nil)
+	r = r.WithContext(browser.WithUser(r.Context(), u))
+	w := httptest.NewRecorder()
+	guard.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGuardMatrix(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	for _, id := range []string{"alice", "bob", "carl", "dave"} {
+		createUser(t, env, id)
+	}
+	for id, role := range map[string]roles.Role{"carl": roles.ReadOnly, "dave": roles.Disabled} {
+		err := roles.Set(env.DB, "users", id, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	guard := guarded(env)
+
+	// the paths are relative to the directory of the entity, the
+	// users scoped to the root see it under prefix
+	type shape struct {
+		name string
+		path string
+	}
+	shapes := []shape{
+		{"entity", "/"},
+		{"bucket", "/default"},
+		{"file", "/default/a.txt"},
+		{"nested", "/default/d/b.txt"},
+		{"missing bucket", "/other/a.txt"},
+		{"dot dot", "/default/../../alice/default/a.txt"},
+		{"dot dot inside", "/default/d/../a.txt"},
+		{"escaped dot dot", "/default/%2E%2E/%2E%2E/alice/default/a.txt"},
+	}
+	// the statuses of the reads and the writes of each shape
+	type want struct{ read, write int }
+	const (
+		bad       = http.StatusBadRequest
+		forbidden = http.StatusForbidden
+		missing   = http.StatusNotFound
+	)
+	tests := []struct {
+		role   string
+		user   *browser.User
+		prefix string
+		want   map[string]want
+	}{
+		{"user", &browser.User{Username: "bob", Scope: "/users/bob"}, "", map[string]want{
+			"entity":         {teapot, forbidden},
+			"bucket":         {teapot, forbidden},
+			"file":           {teapot, teapot},
+			"nested":         {teapot, teapot},
+			"missing bucket": {missing, missing},
+		}},
+		{"readonly", &browser.User{Username: "carl", Scope: "/users/carl"}, "", map[string]want{
+			"entity":         {teapot, forbidden},
+			"bucket":         {teapot, forbidden},
+			"file":           {teapot, forbidden},
+			"nested":         {teapot, forbidden},
+			"missing bucket": {missing, missing},
+		}},
+		{"disabled", &browser.User{Username: "dave", Scope: "/users/dave"}, "", map[string]want{
+			"entity":         {forbidden, forbidden},
+			"bucket":         {forbidden, forbidden},
+			"file":           {forbidden, forbidden},
+			"nested":         {forbidden, forbidden},
+			"missing bucket": {forbidden, forbidden},
+		}},
+		{"admin", &browser.User{Username: "admin", Scope: "/", Admin: true}, "/users/bob", map[string]want{
+			"entity":         {teapot, teapot},
+			"bucket":         {teapot, teapot},
+			"file":           {teapot, teapot},
+			"nested":         {teapot, teapot},
+			"missing bucket": {teapot, teapot},
+		}},
+		{"unscoped", &browser.User{Username: "eve", Scope: "/"}, "/users/bob", map[string]want{
+			"entity":         {forbidden, forbidden},
+			"bucket":         {forbidden, forbidden},
+			"file":           {forbidden, forbidden},
+			"nested":         {forbidden, forbidden},
+			"missing bucket": {forbidden, forbidden},
+		}},
+	}
+	endpoints := []string{"/resources", "/raw", "/preview/thumb", "/subtitle", "/share"}
+	methods := []string{"GET", "HEAD", "PUT", "POST", "PATCH", "DELETE"}
+	for _, tt := range tests {
+		for _, sh := range shapes {
+			w, ok := tt.want[sh.name]
+			if !ok {
+				// every .. is refused before anything else
+				w = want{bad, bad}
+			}
+			for _, endpoint := range endpoints {
+				for _, method := range methods {
+					status := w.write
+					if method == "GET" || method == "HEAD" {
+						status = w.read
+					}
+					p := endpoint + tt.prefix + sh.path
+					if got := serveGuard(guard, tt.user, method, p); got != status {
+						t.Errorf("%s %s %s (%s): got status %d want %d", tt.role, method, p, sh.name, got, status)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGuardDestination(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, env, "alice")
+	createUser(t, env, "bob")
+	createUser(t, env, "carl")
+	err := roles.Set(env.DB, "users", "carl", roles.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := guarded(env)
+
+	bob := &browser.User{Username: "bob", Scope: "/users/bob"}
+	carl := &browser.User{Username: "carl", Scope: "/users/carl"}
+	eve := &browser.User{Username: "eve", Scope: "/"}
+	admin := &browser.User{Username: "admin", Scope: "/", Admin: true}
+	tests := []struct {
+		name string
+		user *browser.User
+		src  string
+		// dst the destination as filebrowser unescapes it
+		dst    string
+		status int
+	}{
+		{"same bucket", bob, "/default/a.txt", "/default/c.txt", teapot},
+		{"nested", bob, "/default/a.txt", "/default/d/c.txt", teapot},
+		{"onto the bucket", bob, "/default/a.txt", "/default", http.StatusForbidden},
+		{"onto the entity", bob, "/default/a.txt", "/", http.StatusForbidden},
+		{"missing bucket", bob, "/default/a.txt", "/other/c.txt", http.StatusNotFound},
+		{"dot dot", bob, "/default/a.txt", "/../alice/default/c.txt", http.StatusBadRequest},
+		{"dot dot in the bucket", bob, "/default/a.txt", "/default/../../alice/default/c.txt", http.StatusBadRequest},
+		{"readonly", carl, "/default/a.txt", "/default/c.txt", http.StatusForbidden},
+		{"unscoped into alice", eve, "/users/bob/default/a.txt", "/users/alice/default/c.txt", http.StatusForbidden},
+		{"admin into alice", admin, "/users/bob/default/a.txt", "/users/alice/default/c.txt", teapot},
+		{"admin dot dot", admin, "/users/bob/default/a.txt", "/users/bob/../alice/default/c.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for _, action := range []string{"rename", "copy"} {
+			// filebrowser escapes the destination before putting it in the query
+			q := url.Values{"action": {action}, "destination": {url.QueryEscape(tt.dst)}}
+			p := "/resources" + tt.src + "?" + q.Encode()
+			if got := serveGuard(guard, tt.user, "PATCH", p); got != tt.status {
+				t.Errorf("%s (%s): got status %d want %d", tt.name, action, got, tt.status)
+			}
+		}
+	}
+	// sent with escaped dots, and a destination which doesn't unescape
+	for _, dst := range []string{"%2Fdefault%2F%2E%2E%2F%2E%2E%2Falice%2Fdefault%2Fc.txt", "%zz"} {
+		q := url.Values{"action": {"rename"}, "destination": {dst}}
+		if got := serveGuard(guard, bob, "PATCH", "/resources/default/a.txt?"+q.Encode()); got != http.StatusBadRequest {
+			t.Errorf("destination %s: got status %d want %d", dst, got, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFileACL(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := createUser(t, env, "alice")
+	shared := env.Bucket(t, alice, "")
+	public := env.Bucket(t, alice, "public")
+	for b, v := range map[*buckets.Bucket]buckets.Visibility{shared: buckets.Shared, public: buckets.PublicRead} {
+		err := b.SetVisibility(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, role := range map[string]buckets.Role{"bob": buckets.Reader, "carol": buckets.Writer} {
+		err := shared.Grant(&buckets.Actor{Type: "users", ID: id}, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner := alice.Actor()
+	actor := func(id string, role roles.Role) *buckets.Actor {
+		return &buckets.Actor{Type: "users", ID: id, Role: role}
+	}
+
+	const (
+		ok           = 0
+		forbidden    = http.StatusForbidden
+		unauthorized = http.StatusUnauthorized
+	)
+	// the statuses of listing, reading, writing and removing in the shared and the public bucket
+	type want struct{ list, get, put, del int }
+	tests := []struct {
+		name           string
+		actor          *buckets.Actor
+		shared, public want
+	}{
+		{"owner", owner, want{ok, ok, ok, ok}, want{ok, ok, ok, ok}},
+		{"readonly owner", actor("alice", roles.ReadOnly), want{ok, ok, forbidden, forbidden}, want{ok, ok, forbidden, forbidden}},
+		{"disabled owner", actor("alice", roles.Disabled), want{forbidden, forbidden, forbidden, forbidden}, want{forbidden, forbidden, forbidden, forbidden}},
+		{"admin", actor("root", roles.Admin), want{ok, ok, ok, ok}, want{ok, ok, ok, ok}},
+		{"reader", actor("bob", roles.User), want{ok, ok, forbidden, forbidden}, want{ok, ok, forbidden, forbidden}},
+		{"writer", actor("carol", roles.User), want{ok, ok, ok, ok}, want{ok, ok, forbidden, forbidden}},
+		{"readonly writer", actor("carol", roles.ReadOnly), want{ok, ok, forbidden, forbidden}, want{ok, ok, forbidden, forbidden}},
+		{"stranger", actor("dan", roles.User), want{forbidden, forbidden, forbidden, forbidden}, want{ok, ok, forbidden, forbidden}},
+		{"anonymous", nil, want{unauthorized, unauthorized, unauthorized, unauthorized}, want{ok, ok, unauthorized, unauthorized}},
+	}
+	check := func(name, method, p string, w *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if status == ok && w.Code/100 != 2 || status != ok && w.Code != status {
+			t.Errorf("%s %s %s: got status %d want %d: %s", name, method, p, w.Code, status, w.Body.String())
+		}
+	}
+	for i, tt := range tests {
+		a := env.API().As(tt.actor)
+		for _, bw := range []struct {
+			b *buckets.Bucket
+			w want
+		}{{shared, tt.shared}, {public, tt.public}} {
+			base := "/users/alice/buckets/" + bw.b.ID
+			name := fmt.Sprintf("f%d.txt", i)
+			env.WriteFile(t, bw.b, name, "alice")
+			for _, p := range []string{name, "d/" + name} {
+				env.WriteFile(t, bw.b, p, "alice")
+				check(tt.name, "GET", base+"/files/", a.Do(t, "GET", base+"/files/", nil), bw.w.list)
+				check(tt.name, "GET", base+"/files/"+p, a.Do(t, "GET", base+"/files/"+p, nil), bw.w.get)
+				check(tt.name, "PUT", base+"/files/"+p, a.Do(t, "PUT", base+"/files/"+p, strings.NewReader("x")), bw.w.put)
+				check(tt.name, "DELETE", base+"/files/"+p, a.Do(t, "DELETE", base+"/files/"+p, nil), bw.w.del)
+			}
+		}
+	}
+}
+
+func TestFileDotDot(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := createUser(t, env, "alice")
+	bob := createUser(t, env, "bob")
+	env.WriteFile(t, env.Bucket(t, alice, ""), "a.txt", "alice")
+	env.WriteFile(t, env.Bucket(t, bob, ""), "a.txt", "bob")
+	a := env.API().As(alice.Actor())
+
+	// the paths are cleaned inside the bucket of the url
+	for _, p := range []string{
+		"/users/alice/buckets/default/files/../../../bob/buckets/default/files/a.txt",
+		"/users/alice/buckets/default/files/%2E%2E/%2E%2E/%2E%2E/bob/buckets/default/files/a.txt",
+		"/users/alice/buckets/default/files/d/../../../../../bob/default/a.txt",
+	} {
+		w := a.Do(t, "GET", p, nil)
+		if w.Code != http.StatusNotFound || w.Body.String() == "bob" {
+			t.Errorf("GET %s: got status %d: %s", p, w.Code, w.Body.String())
+		}
+		a.Do(t, "PUT", p, strings.NewReader("alice"))
+		a.Do(t, "DELETE", p, nil)
+	}
+	if got := env.ReadFile(t, env.Bucket(t, bob, ""), "a.txt"); got != "bob" {
+		t.Errorf("the file of bob changed to %q", got)
+	}
+	w := a.Do(t, "GET", "/users/alice/buckets/default/files/d/../a.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("a .. inside the bucket: got status %d: %s", w.Code, w.Body.String())
+	}
+}
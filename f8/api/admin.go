@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/readonly"
+)
+
+// AdminToken option lets the clients holding the token use the admin endpoints,
+// eg. the read-only switch, besides the entities with the admin role
+//
+// Clients must send the token as a bearer token
+func AdminToken(token string) Option {
+	return func(o *options) {
+		o.adminToken = token
+	}
+}
+
+// adminPrefix the path of the admin endpoints, they work in read-only mode
+const adminPrefix = Prefix + "/admin/"
+
+// tokenAuthorized whether the request carries the admin token, never without one configured
+func (s *Server) tokenAuthorized(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// authorizeAdmin returns nil if the request carries the admin token or was made by an admin
+func (s *Server) authorizeAdmin(r *http.Request) error {
+	if s.tokenAuthorized(r) {
+		return nil
+	}
+	actor, err := s.actor(r)
+	if err != nil {
+		return err
+	}
+	if actor == nil {
+		return errUnauthenticated
+	}
+	if !actor.IsAdmin() {
+		return errs.New(errs.ErrForbidden, "Only admins can do this")
+	}
+	return nil
+}
+
+// authorizeEntity returns nil if the request was made by the entity itself or an admin
+func (s *Server) authorizeEntity(r *http.Request, entityType, entityID string) error {
+	if s.tokenAuthorized(r) {
+		return nil
+	}
+	actor, err := s.actor(r)
+	if err != nil {
+		return err
+	}
+	if actor == nil {
+		return errUnauthenticated
+	}
+	if !actor.Role.CanLogIn() {
+		return errs.ErrDisabled
+	}
+	if !actor.IsAdmin() && (actor.Type != entityType || actor.ID != entityID) {
+		return errs.ErrForbidden
+	}
+	return nil
+}
+
+// readOnlyRequest the body of a read-only switch
+type readOnlyRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason"`
+	// RetryAfter in seconds, 0 for readonly.DefaultRetryAfter
+	RetryAfter int `json:"retry_after"`
+}
+
+// getReadOnly tells whether the service is read-only
+//
+//	GET /api/v1/admin/readonly
+func (s *Server) getReadOnly(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, readonly.Current())
+}
+
+// setReadOnly switches the read-only mode on or off
+//
+//	PUT /api/v1/admin/readonly {"enabled": true, "reason": "Failover", "retry_after": 300}
+func (s *Server) setReadOnly(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &readOnlyRequest{}
+	err := readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if req.Enabled {
+		readonly.Enable(req.Reason, time.Duration(req.RetryAfter)*time.Second)
+	} else {
+		readonly.Disable()
+	}
+	writeJSON(w, http.StatusOK, readonly.Current())
+}
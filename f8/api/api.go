@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/notify"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"github.com/phanirithvij/fate/f8/share"
+	"github.com/phanirithvij/fate/f8/usage"
+	"gorm.io/gorm"
+)
+
+const (
+	// Prefix the path under which the api is served
+	Prefix = "/api/v1"
+)
+
+// Server the http api for the entity buckets
+type Server struct {
+	storage *f8.StorageConfig
+	db      *gorm.DB
+	signer  *share.Signer
+	auth    Authenticator
+	router  *router
+	// migrationToken enables the migration endpoints when set
+	migrationToken string
+	// adminToken lets its holders use the admin endpoints when set
+	adminToken string
+	flags      *flags.Store
+	// maxUploadSize and routeUploadLimits cap the uploads, 0 for unlimited
+	maxUploadSize     int64
+	routeUploadLimits map[string]int64
+	// tenantHeader the header selecting the tenant, empty to only use the actor's
+	tenantHeader string
+	limits       *ratelimit.Limits
+	audit        *audit.Log
+	jobs         *jobs.Queue
+	usage        *usage.Meter
+	webdav       bool
+	davLocks     davLocks
+	notifier     notify.Notifier
+	verifyURL    string
+}
+
+// Authenticator returns the entity making the request
+//
+// Return a nil actor for anonymous requests and an error
+// if the request carried invalid credentials
+type Authenticator func(r *http.Request) (*buckets.Actor, error)
+
+// Option is a functional option to the api constructor New.
+type Option func(*options)
+type options struct {
+	auth              Authenticator
+	migrationToken    string
+	adminToken        string
+	flags             *flags.Store
+	maxUploadSize     int64
+	routeUploadLimits map[string]int64
+	tenantHeader      string
+	limits            *ratelimit.Limits
+	audit             *audit.Log
+	jobs              *jobs.Queue
+	usage             *usage.Meter
+	webdav            bool
+	notifier          notify.Notifier
+	verifyURL         string
+}
+
+// Auth option sets how the requests are authenticated
+//
+// By default every request is anonymous
+// so only public buckets and signed urls are accessible
+func Auth(auth Authenticator) Option {
+	return func(o *options) {
+		o.auth = auth
+	}
+}
+
+// MigrationToken option enables the endpoints migrate.Client pulls entities from
+//
+// Clients must send the token as a bearer token.
+// The endpoints expose every entity so keep the token secret.
+func MigrationToken(token string) Option {
+	return func(o *options) {
+		o.migrationToken = token
+	}
+}
+
+// New returns the http api for the storage
+func New(storage *f8.StorageConfig, opts ...Option) *Server {
+	o := options{
+		auth: func(r *http.Request) (*buckets.Actor, error) {
+			return nil, nil
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &Server{
+		storage: storage,
+		db:      storage.DB,
+		signer:  share.NewSigner(storage.Key(f8.KeyShare)),
+		auth:    o.auth,
+		router:  &router{},
+
+		migrationToken:    o.migrationToken,
+		adminToken:        o.adminToken,
+		flags:             o.flags,
+		maxUploadSize:     o.maxUploadSize,
+		routeUploadLimits: o.routeUploadLimits,
+		tenantHeader:      o.tenantHeader,
+		limits:            o.limits,
+		audit:             o.audit,
+		jobs:              o.jobs,
+		usage:             o.usage,
+		webdav:            o.webdav,
+		notifier:          o.notifier,
+		verifyURL:         o.verifyURL,
+	}
+	s.routes()
+	return s
+}
+
+// The parts of the route patterns, their groups name the parameters of the
+// openapi document and are passed to the handlers in order
+const (
+	// entityPath matches /{entity_type}/{entity_id}
+	entityPath = "/(?P<entity_type>[^/]+)/(?P<entity_id>[^/]+)"
+	// bucketPath matches /{entity_type}/{entity_id}/buckets/{bucket}
+	bucketPath = entityPath + "/buckets/(?P<bucket>[^/]+)"
+	// filePath matches /{path}, the path of a file may have slashes
+	filePath = "/(?P<path>.+)"
+)
+
+func (s *Server) routes() {
+	s.router.handle(http.MethodGet, Prefix+"/openapi.json", s.openAPI)
+	s.router.handle(http.MethodGet, Prefix+"/docs", s.docs)
+	s.router.handle(http.MethodGet, Prefix+"/public"+entityPath+"/(?P<bucket>[^/]+)"+filePath, s.publicFile)
+
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/files/?", s.listFiles)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/files"+filePath, s.getFile)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/files"+filePath, s.putFile)
+	s.router.handle(http.MethodDelete, Prefix+bucketPath+"/files"+filePath, s.deleteFile)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/thumbnails"+filePath, s.getThumbnail)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/search", s.searchFiles)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/share", s.shareFile)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/visibility", s.setVisibility)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/pipeline", s.getPipeline)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/pipeline", s.setPipeline)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/grants", s.listGrants)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/grants", s.grant)
+	s.router.handle(http.MethodDelete, Prefix+bucketPath+"/grants/(?P<grantee_type>[^/]+)/(?P<grantee_id>[^/]+)", s.revoke)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/batch/upload", s.batchUpload)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/batch/delete", s.batchDelete)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/batch/metadata", s.batchMetadata)
+	s.router.handle(http.MethodGet, Prefix+bucketPath+"/trash", s.listTrash)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/trash", s.setTrash)
+	s.router.handle(http.MethodPost, Prefix+bucketPath+"/trash/(?P<id>[^/]+)/restore", s.restoreTrash)
+	s.router.handle(http.MethodDelete, Prefix+bucketPath+"/trash/(?P<id>[^/]+)", s.purgeTrash)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/links", s.setLinks)
+
+	if s.jobs != nil {
+		s.router.handle(http.MethodPost, Prefix+bucketPath+"/archive", s.exportArchive)
+		s.router.handle(http.MethodPost, Prefix+bucketPath+"/sync", s.syncBucket)
+		s.router.handle(http.MethodGet, Prefix+"/jobs/(?P<id>[^/]+)", s.getJob)
+		s.router.handle(http.MethodGet, Prefix+"/jobs/(?P<id>[^/]+)/archive", s.jobArchive)
+		s.router.handle(http.MethodPost, adminPrefix+"entities"+entityPath+"/sync", s.syncEntity)
+		s.router.handle(http.MethodPost, adminPrefix+"gc", s.runGC)
+	}
+
+	if s.webdav {
+		s.router.handle("", davPrefix+entityPath+"/(?P<bucket>[^/]+)(/.*)?", s.serveDAV)
+	}
+
+	if s.migrationToken != "" {
+		s.router.handle(http.MethodGet, Prefix+"/migrate"+entityPath+"/manifest", s.migrationManifest)
+		s.router.handle(http.MethodGet, Prefix+"/migrate"+bucketPath+"/files"+filePath, s.migrationFile)
+	}
+	s.router.handle(http.MethodGet, adminPrefix+"readonly", s.getReadOnly)
+	s.router.handle(http.MethodPut, adminPrefix+"readonly", s.setReadOnly)
+	s.router.handle(http.MethodGet, adminPrefix+"?", s.dashboard)
+	s.router.handle(http.MethodGet, adminPrefix+"entities/(?P<entity_type>[^/]+)", s.listEntities)
+	s.router.handle(http.MethodGet, adminPrefix+"entities"+entityPath, s.getEntity)
+	s.router.handle(http.MethodPut, adminPrefix+"entities"+entityPath+"/disabled", s.setDisabled)
+	s.router.handle(http.MethodPut, adminPrefix+"roles"+entityPath, s.setRole)
+	s.router.handle(http.MethodPut, Prefix+bucketPath+"/quota", s.setQuota)
+	s.router.handle(http.MethodGet, Prefix+entityPath+"/stats", s.entityStats)
+	s.router.handle(http.MethodGet, adminPrefix+"stats", s.listStats)
+	if s.flags != nil {
+		s.router.handle(http.MethodGet, Prefix+entityPath+"/flags", s.entityFlags)
+		s.router.handle(http.MethodGet, adminPrefix+"flags", s.listFlags)
+		s.router.handle(http.MethodPut, adminPrefix+"flags/(?P<name>[^/]+)", s.saveFlag)
+		s.router.handle(http.MethodPut, adminPrefix+"flags/(?P<name>[^/]+)/overrides/(?P<entity_type>[^/]+)/?(?P<entity_id>[^/]*)", s.overrideFlag)
+		s.router.handle(http.MethodDelete, adminPrefix+"flags/(?P<name>[^/]+)/overrides/(?P<entity_type>[^/]+)/?(?P<entity_id>[^/]*)", s.clearOverride)
+	}
+	if s.audit != nil {
+		s.router.handle(http.MethodGet, Prefix+entityPath+"/audit", s.entityAudit)
+		s.router.handle(http.MethodGet, adminPrefix+"audit", s.listAudit)
+	}
+	if s.usage != nil {
+		s.router.handle(http.MethodGet, Prefix+entityPath+"/usage", s.entityUsage)
+		s.router.handle(http.MethodGet, adminPrefix+"usage", s.listUsage)
+	}
+	if s.notifier != nil {
+		s.router.handle(http.MethodPost, Prefix+entityPath+"/emails/verify", s.sendVerification)
+		s.router.handle(http.MethodGet, Prefix+entityPath+"/emails/verify", s.verifyEmail)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID(w, r)
+	// the handlers and the limits share the actor
+	r = r.WithContext(context.WithValue(r.Context(), authKey{}, &authResult{}))
+	if s.limits != nil {
+		if err := s.limit(r); err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+	if readonly.Mutating(r.Method) && !strings.HasPrefix(r.URL.Path, adminPrefix) {
+		if err := readonly.Check(); err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// authKey the context key of the authentication of a request, see actor
+type authKey struct{}
+
+// authResult the outcome of authenticating a request
+type authResult struct {
+	once  sync.Once
+	actor *buckets.Actor
+	err   error
+}
+
+// actor authenticates the request, nil when anonymous
+//
+// The Authenticator runs once per request however many times it's asked.
+// Invalid credentials are errUnauthenticated, a disabled entity errs.ErrDisabled,
+// a locked out one errs.ErrLocked and failing to check them errs.ErrDatabase.
+func (s *Server) actor(r *http.Request) (*buckets.Actor, error) {
+	a, _ := r.Context().Value(authKey{}).(*authResult)
+	if a == nil {
+		a = &authResult{}
+	}
+	a.once.Do(func() {
+		a.actor, a.err = s.auth(r)
+		if a.err != nil && !errors.Is(a.err, errs.ErrDisabled) &&
+			!errors.Is(a.err, errs.ErrLocked) && !errors.Is(a.err, errs.ErrDatabase) {
+			a.err = errUnauthenticated
+		}
+	})
+	return a.actor, a.err
+}
+
+// bucket returns the bucket with its storage attached
+func (s *Server) bucket(db *gorm.DB, entityType, entityID, bID string) (*buckets.Bucket, error) {
+	b, err := buckets.Find(db, entityType, entityID, bID)
+	if err != nil {
+		return nil, err
+	}
+	b.AttachStorage(s.storage.StorageDir)
+	return b, nil
+}
+
+// authorizedBucket authenticates the request and returns the bucket if the actor has the role on it
+func (s *Server) authorizedBucket(r *http.Request, params []string, want buckets.Role) (*buckets.Actor, *buckets.Bucket, error) {
+	actor, err := s.actor(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := s.scope(r, actor)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := buckets.FindFor(db, actor, params[0], params[1], params[2], want)
+	if err != nil {
+		if errors.Is(err, buckets.ErrForbidden) && actor == nil {
+			return nil, nil, errUnauthenticated
+		}
+		return nil, nil, err
+	}
+	b.AttachStorage(s.storage.StorageDir)
+	b.AttachOrigin(actor, s.clientIP(r))
+	return actor, b, nil
+}
+
+// serveFile writes the contents of the bucket file to the response
+//
+// Range requests get the parts asked for, conditional ones a 304 when unchanged
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, b *buckets.Bucket, p string) {
+	f, err := b.OpenReader(p)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer f.Close()
+	fdir := f.Info
+
+	ctype := fdir.ContentType
+	if ctype == "" {
+		// rows recorded before the content types were sniffed
+		ctype = mime.TypeByExtension(path.Ext(fdir.Name))
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, fdir.Name, fdir.ModTime, f)
+	if cw.n > 0 {
+		b.CountDownload(cw.n)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/audit"
+)
+
+// Audit option serves the audit log of the entities
+//
+// Only the entity itself and the admin can read an entity's entries
+func Audit(log *audit.Log) Option {
+	return func(o *options) {
+		o.audit = log
+	}
+}
+
+// auditPage a page of the audit log
+type auditPage struct {
+	Entries []audit.Entry `json:"entries"`
+	// NextBefore pass it as before to get the next page, 0 on the last one
+	NextBefore uint `json:"next_before,omitempty"`
+}
+
+// clientIP the ip the request came from, X-Forwarded-For is only trusted by the rate limits
+func (s *Server) clientIP(r *http.Request) string {
+	if s.limits != nil {
+		return s.limits.ClientIP(r)
+	}
+	return audit.RemoteIP(r)
+}
+
+// entityAudit lists the audit log of the entity, newest first
+//
+//	GET /api/v1/{entity_type}/{entity_id}/audit?action=file.written&since=&until=&before=&limit=100
+func (s *Server) entityAudit(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeEntity(r, params[0], params[1]); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	s.writeAudit(w, r, params[0], params[1])
+}
+
+// listAudit lists the audit log of every entity, newest first
+//
+//	GET /api/v1/admin/audit?entity_type=users&entity_id=&action=login&since=&until=&before=&limit=100
+func (s *Server) listAudit(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	s.writeAudit(w, r, q.Get("entity_type"), q.Get("entity_id"))
+}
+
+// writeAudit writes a page of the entries of the entity filtered by the query
+func (s *Server) writeAudit(w http.ResponseWriter, r *http.Request, entityType, entityID string) {
+	f, err := auditFilter(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	f.EntityType, f.EntityID = entityType, entityID
+	entries, err := s.audit.Query(*f)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	page := &auditPage{Entries: entries}
+	if f.Limit > 0 && len(entries) == f.Limit {
+		page.NextBefore = entries[len(entries)-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// auditFilter parses the audit query parameters
+func auditFilter(q url.Values) (*audit.Filter, error) {
+	f := &audit.Filter{Action: q.Get("action"), Limit: audit.DefaultLimit}
+	var err error
+	times := map[string]*time.Time{"since": &f.Since, "until": &f.Until}
+	for key, dst := range times {
+		if v := q.Get(key); v != "" {
+			*dst, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errBadRequest
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit <= 0 {
+			return nil, errBadRequest
+		}
+		if f.Limit > audit.MaxLimit {
+			f.Limit = audit.MaxLimit
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errBadRequest
+		}
+		f.Before = uint(before)
+	}
+	return f, nil
+}
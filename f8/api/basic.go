@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/roles"
+	"gorm.io/gorm"
+)
+
+// basicCacheTTL how long BasicAuth trusts a password which matched without hashing it again
+const basicCacheTTL = time.Minute
+
+// BasicAuth returns an Authenticator checking the basic auth credentials
+// of the requests against the passwords of the entities of entityType
+//
+// The username is the entity id, the requests without credentials are anonymous.
+// Failed checks count towards locking the entity out, see entity.Passwords.
+// The actor has the role of the entity, disabled entities are refused.
+//
+// The password of every request isn't hashed again for a minute after it
+// matched, changing it or a lockout takes effect right away
+func BasicAuth(db *gorm.DB, entityType string, opts ...entity.PasswordOption) Authenticator {
+	opts = append([]entity.PasswordOption{entity.CacheChecks(entity.NewCheckCache(basicCacheTTL))}, opts...)
+	return func(r *http.Request) (*buckets.Actor, error) {
+		id, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, nil
+		}
+		err := entity.NewPasswords(db, entityType, id, opts...).CheckPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		role, err := roles.Get(db, entityType, id)
+		if err != nil {
+			return nil, err
+		}
+		if !role.CanLogIn() {
+			return nil, errs.ErrDisabled
+		}
+		return &buckets.Actor{Type: entityType, ID: id, Role: role}, nil
+	}
+}
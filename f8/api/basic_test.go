@@ -0,0 +1,103 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+)
+
+// fastHash keeps the argon2id hashing of the tests quick
+var fastHash = entity.HashWith(entity.HashParams{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16})
+
+// basicAuthAPI returns the api of the env authenticating the users with their passwords
+func basicAuthAPI(t *testing.T, env *fatetest.Env, opts ...entity.PasswordOption) *fatetest.API {
+	t.Helper()
+	opts = append([]entity.PasswordOption{fastHash}, opts...)
+	err := entity.NewPasswords(env.DB, "users", "bob", opts...).SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := ratelimit.New(ratelimit.Options{IPRate: 100, UserRate: 100})
+	return env.API(api.Auth(api.BasicAuth(env.DB, "users", opts...)), api.RateLimit(limits))
+}
+
+// failures returns the failed checks in a row of bob's password
+func failures(t *testing.T, env *fatetest.Env) int {
+	t.Helper()
+	c := &entity.Credential{}
+	err := env.DB.First(c, "entity_type = ? AND entity_id = ?", "users", "bob").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Failures
+}
+
+func TestBasicAuthOncePerRequest(t *testing.T) {
+	env := fatetest.New(t)
+	a := basicAuthAPI(t, env)
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("bob", "wrong")
+	w := a.Header("Authorization", r.Header.Get("Authorization")).Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d want %d: %s", w.Code, http.StatusUnauthorized, w.Body.String())
+	}
+	if n := failures(t, env); n != 1 {
+		t.Errorf("a request counted %d failures want 1", n)
+	}
+}
+
+func TestBasicAuthLocked(t *testing.T) {
+	env := fatetest.New(t)
+	a := basicAuthAPI(t, env, entity.Lockout(1, time.Hour))
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("bob", "wrong")
+	a.Header("Authorization", r.Header.Get("Authorization")).Do(t, http.MethodGet, "/users/bob/stats", nil)
+	r.SetBasicAuth("bob", "correct horse")
+	w := a.Header("Authorization", r.Header.Get("Authorization")).Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d want %d for a locked out user: %s", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+}
+
+func TestBasicAuthCached(t *testing.T) {
+	env := fatetest.New(t)
+	a := basicAuthAPI(t, env)
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("bob", "correct horse")
+	bob := a.Header("Authorization", r.Header.Get("Authorization"))
+	w := bob.Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code == http.StatusUnauthorized {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	// hashing the password with these parameters wouldn't match anymore
+	err := env.DB.Model(&entity.Credential{}).Where("entity_id = ?", "bob").Update("params", "m=64,t=2,p=1,l=32").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = bob.Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code == http.StatusUnauthorized {
+		t.Errorf("the password was hashed again: got status %d", w.Code)
+	}
+
+	err = entity.NewPasswords(env.DB, "users", "bob", fastHash).SetPassword("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = bob.Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("the old password after changing it: got status %d want %d", w.Code, http.StatusUnauthorized)
+	}
+	r.SetBasicAuth("bob", "battery staple")
+	w = a.Header("Authorization", r.Header.Get("Authorization")).Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code == http.StatusUnauthorized {
+		t.Errorf("the new password: got status %d", w.Code)
+	}
+}
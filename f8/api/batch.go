@@ -0,0 +1,110 @@
+package api
+
+import (
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/metadata"
+)
+
+// batchUpload writes many files in one request
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/batch/upload
+//
+// The body is either multipart/form-data, every part with a filename
+// being written to that path, or a tar, tar.gz or zip archive.
+// The bucket's MaxUploadSize caps every file, not the whole body.
+func (s *Server) batchUpload(w http.ResponseWriter, r *http.Request, params []string) {
+	body, err := s.limitUpload(r, nil)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	var report *buckets.BatchReport
+	mediaType, mtParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if mtParams["boundary"] == "" {
+			httpError(w, r, errBadRequest)
+			return
+		}
+		mr := multipart.NewReader(body, mtParams["boundary"])
+		report, err = b.WriteFiles(func() (*buckets.BatchFile, error) {
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					return nil, err
+				}
+				// FileName drops the directories of the path
+				_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+				if name := disposition["filename"]; name != "" {
+					return &buckets.BatchFile{Path: name, Body: part}, nil
+				}
+			}
+		})
+	} else {
+		report, err = b.ImportArchive(body)
+	}
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, report)
+}
+
+// batchDelete removes the files matching a prefix or a glob
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/batch/delete {"prefix": "tmp/", "glob": "*.log"}
+func (s *Server) batchDelete(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	m := buckets.Match{}
+	err = readJSON(r, &m)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	report, err := b.RemoveMatching(m)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// batchMetadataRequest the metadata keys to set of every file, null deletes a key
+type batchMetadataRequest struct {
+	Files map[string]metadata.Metadata `json:"files"`
+}
+
+// batchMetadata sets the metadata of many files
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/batch/metadata {"files": {"a.jpg": {"album": "trip"}}}
+func (s *Server) batchMetadata(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &batchMetadataRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	report, err := b.UpdateFilesMetadata(req.Files)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
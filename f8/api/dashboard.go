@@ -0,0 +1,160 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/stats"
+)
+
+// dashboardPage the admin dashboard, a single page calling the admin endpoints
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// dashboard serves the admin dashboard, it asks for the admin token itself
+//
+//	GET /api/v1/admin/
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request, params []string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dashboardPage)
+}
+
+// entityDetails an entity with its role and the usage of its buckets
+type entityDetails struct {
+	EntityType string     `json:"entity_type"`
+	ID         string     `json:"id"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Role       roles.Role `json:"role"`
+	Disabled   bool       `json:"disabled"`
+	// Buckets the files, bytes and quotas of the buckets
+	Buckets []stats.Bucket `json:"buckets"`
+}
+
+// getEntity returns an entity with its role, buckets, their quotas and usage, only for the admins
+//
+//	GET /api/v1/admin/entities/{entity_type}/{entity_id}
+func (s *Server) getEntity(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	bucks, err := stats.Buckets(s.db.Where("buckets.entity_id = ? AND buckets.id NOT LIKE ?", params[1], ".%"),
+		stats.Filter{EntityType: params[0]})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if len(bucks) == 0 {
+		httpError(w, r, errs.New(errs.ErrEntityNotFound, params[0]+" "+params[1]))
+		return
+	}
+	role, err := roles.Get(s.db, params[0], params[1])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &entityDetails{
+		EntityType: params[0],
+		ID:         params[1],
+		Tenant:     bucks[0].Tenant,
+		Role:       role,
+		Disabled:   !role.CanLogIn(),
+		Buckets:    bucks,
+	})
+}
+
+// disableRequest the body of an account switch
+type disableRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+// setDisabled disables or enables the account of an entity, only for the admins
+//
+// A disabled entity can't log in nor access its buckets, its files are kept.
+// Enabling it makes it a user again whatever its role was.
+//
+//	PUT /api/v1/admin/entities/{entity_type}/{entity_id}/disabled {"disabled": true}
+func (s *Server) setDisabled(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &disableRequest{}
+	err := readJSON(r, req)
+	if err != nil {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	role := roles.User
+	if req.Disabled {
+		role = roles.Disabled
+	}
+	err = roles.Set(s.db, params[0], params[1], role)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// syncEntity queues the sync of every bucket of an entity, only for the admins
+//
+//	POST /api/v1/admin/entities/{entity_type}/{entity_id}/sync
+func (s *Server) syncEntity(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	actor, _ := s.actor(r)
+	bucks, err := buckets.Owned(s.db, params[0], params[1])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if len(bucks) == 0 {
+		httpError(w, r, errs.New(errs.ErrEntityNotFound, params[0]+" "+params[1]))
+		return
+	}
+	queued := []*jobs.Job{}
+	for _, b := range bucks {
+		if strings.HasPrefix(b.ID, ".") {
+			// the hidden buckets, eg. the thumbnails, have nothing on disk to sync
+			continue
+		}
+		b.AttachStorage(s.storage.StorageDir)
+		b.AttachOrigin(actor, s.clientIP(r))
+		job, err := s.jobs.Sync(b)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		queued = append(queued, job)
+	}
+	writeJSON(w, http.StatusAccepted, map[string][]*jobs.Job{"jobs": queued})
+}
+
+// runGC queues a gc run, only for the admins
+//
+//	POST /api/v1/admin/gc
+func (s *Server) runGC(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	actor, _ := s.actor(r)
+	job, err := s.jobs.GC(actor, s.clientIP(r))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJob(w, job)
+}
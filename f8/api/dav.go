@@ -0,0 +1,120 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/dav"
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix the path under which the buckets are served over WebDAV
+const davPrefix = Prefix + "/dav"
+
+// WebDAV option serves the buckets over WebDAV so they can be mounted as network drives
+//
+//	/api/v1/dav/{entity_type}/{entity_id}/{bucket}/
+//
+// The requests are authenticated and authorized like the rest of the api,
+// reading needs the read role on the bucket and everything else the write role.
+func WebDAV() Option {
+	return func(o *options) {
+		o.webdav = true
+	}
+}
+
+// davReads the WebDAV methods which only read the bucket
+var davReads = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// davLocks the WebDAV locks of every bucket, the paths of the locks are relative to the bucket
+type davLocks struct {
+	mu    sync.Mutex
+	locks map[string]webdav.LockSystem
+}
+
+// of returns the lock system of the bucket
+func (l *davLocks) of(b *buckets.Bucket) webdav.LockSystem {
+	key := path.Join(b.EntityType, b.EntityID, b.ID)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]webdav.LockSystem{}
+	}
+	ls, ok := l.locks[key]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.locks[key] = ls
+	}
+	return ls
+}
+
+// serveDAV serves a bucket over WebDAV
+//
+//	PROPFIND /api/v1/dav/{entity_type}/{entity_id}/{bucket}/{path}
+func (s *Server) serveDAV(w http.ResponseWriter, r *http.Request, params []string) {
+	want := buckets.Writer
+	if davReads[r.Method] {
+		want = buckets.Reader
+	}
+	_, b, err := s.authorizedBucket(r, params, want)
+	if err != nil {
+		if errors.Is(err, errUnauthenticated) {
+			// lets the clients mounting the bucket ask for credentials
+			w.Header().Set("WWW-Authenticate", `Basic realm="fate"`)
+		}
+		httpError(w, r, err)
+		return
+	}
+	if r.Method == http.MethodPut {
+		body, err := s.limitUpload(r, b)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+	}
+	h := &webdav.Handler{
+		Prefix:     path.Join(davPrefix, params[0], params[1], params[2]),
+		FileSystem: dav.New(b),
+		LockSystem: s.davLocks.of(b),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !davReads[r.Method] {
+				log.Println("[f8][WARNING]: WebDAV", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if r.Method != http.MethodGet {
+		h.ServeHTTP(w, r)
+		return
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	h.ServeHTTP(cw, r)
+	if cw.n > 0 {
+		b.CountDownload(cw.n)
+	}
+}
+
+// countingWriter counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"gorm.io/gorm"
+)
+
+const (
+	// RequestIDHeader the header carrying the id of the request
+	//
+	// A valid incoming id is kept so it can be traced across services
+	RequestIDHeader = "X-Request-Id"
+	// problemType the prefix of the problem type uris, followed by the code
+	problemType = "urn:fate:problem:"
+)
+
+var (
+	errUnauthenticated = errs.ErrUnauthenticated
+	errBadRequest      = errors.New("Bad request")
+
+	requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+)
+
+// Problem an RFC 7807 problem details error response
+//
+// Clients branch on Code, it's the same as errs.Code of the failure
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+// statusCodes the codes of the errors which aren't of an errs kind
+var statusCodes = map[int]string{
+	http.StatusBadRequest:       "bad_request",
+	http.StatusUnauthorized:     "unauthenticated",
+	http.StatusForbidden:        "forbidden",
+	http.StatusNotFound:         "not_found",
+	http.StatusMethodNotAllowed: "method_not_allowed",
+	http.StatusGone:             "gone",
+	http.StatusTooManyRequests:  "rate_limited",
+}
+
+// requestID returns the id of the request setting the response header
+//
+// The incoming header is used if it's valid, otherwise a new id is generated
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		return id
+	}
+	id := r.Header.Get(RequestIDHeader)
+	if !requestIDRe.MatchString(id) {
+		id = uuid.New().String()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// withRequestID makes sure every response carries a request id
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorStatus the status code matching the error
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound),
+		errors.Is(err, errs.ErrEntityNotFound),
+		errors.Is(err, errs.ErrBucketNotFound),
+		errors.Is(err, errs.ErrFileNotFound),
+		errors.Is(err, errs.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, errs.ErrForbidden), errors.Is(err, errs.ErrDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, errs.ErrInvalidOption),
+		errors.Is(err, errs.ErrInvalidPath),
+		errors.Is(err, errs.ErrInvalidName),
+		errors.Is(err, errs.ErrIsDir):
+		return http.StatusBadRequest
+	case errors.Is(err, errs.ErrEntityExists), errors.Is(err, errs.ErrBucketExists), errors.Is(err, errs.ErrFileExists):
+		return http.StatusConflict
+	case errors.Is(err, errs.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errs.ErrTooSlow):
+		return http.StatusRequestTimeout
+	case errors.Is(err, errs.ErrReadOnly):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errs.ErrRateLimited), errors.Is(err, errs.ErrLocked):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errs.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// httpError writes the error as a problem with a status code matching it
+//
+// Internal errors are logged with the request id and their details aren't sent
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	code, hint, detail := errs.Code(err), errs.Hint(err), err.Error()
+	if errors.Is(err, errs.ErrReadOnly) {
+		readonly.SetRetryAfter(w)
+	}
+	ratelimit.SetRetryAfter(w, err)
+	if status == http.StatusInternalServerError {
+		log.Println("[f8][WARNING]:", requestID(w, r), err)
+		code, detail = errs.CodeInternal, ""
+		hint = "Retry later and report the request id if it keeps failing"
+	}
+	writeProblem(w, r, status, code, detail, hint)
+}
+
+// writeProblem writes a problem+json response
+//
+// An empty code is derived from the status
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail, hint string) {
+	if code == "" || code == errs.CodeInternal && status != http.StatusInternalServerError {
+		code = statusCodes[status]
+	}
+	if code == "" {
+		code = errs.CodeInternal
+	}
+	p := &Problem{
+		Type:      problemType + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestID(w, r),
+		Hint:      hint,
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeJSON writes v as the json response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// readJSON decodes the json request body into v
+func readJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return errBadRequest
+	}
+	return nil
+}
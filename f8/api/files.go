@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+// getFile downloads a file from a bucket
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/files/{path}
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	s.serveFile(w, r, b, params[3])
+}
+
+// listFiles lists a page of the files of a bucket
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/files?limit=100&cursor=&prefix=docs/&sort=name
+//
+// Pass the next_cursor of the response as the cursor to get the next page
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	opts := buckets.ListOptions{
+		Cursor: q.Get("cursor"),
+		Prefix: q.Get("prefix"),
+		SortBy: buckets.SortBy(q.Get("sort")),
+	}
+	if v := q.Get("limit"); v != "" {
+		opts.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			httpError(w, r, errBadRequest)
+			return
+		}
+	}
+	page, err := b.List(r.Context(), opts)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// putFile uploads the request body as a file in a bucket
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/files/{path}
+func (s *Server) putFile(w http.ResponseWriter, r *http.Request, params []string) {
+	// reject what's too large for the route before looking up anything
+	_, err := s.limitUpload(r, nil)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	body, err := s.limitUpload(r, b)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fdir, err := b.WriteFile(params[3], body)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, fdir)
+}
+
+// deleteFile removes the file or directory with everything under it
+//
+// Directories are removed by a job when the server has a queue, see Jobs
+//
+//	DELETE /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/files/{path}
+func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fdir, err := b.Stat(params[3])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if fdir.IsDir && s.jobs != nil {
+		job, err := s.jobs.Remove(b, params[3])
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		writeJob(w, job)
+		return
+	}
+	err = b.Remove(params[3])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getThumbnail downloads the thumbnail of an image in a bucket
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/thumbnails/{path}?size=128
+func (s *Server) getThumbnail(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	size := 0
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil {
+			httpError(w, r, errBadRequest)
+			return
+		}
+	}
+	thumbs, fdir, err := b.Thumbnail(params[3], size)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	s.serveFile(w, r, thumbs, fdir.Path)
+}
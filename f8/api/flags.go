@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/flags"
+)
+
+// Flags option evaluates the feature flags of the entities with the store
+//
+// Without a store every feature is enabled
+func Flags(store *flags.Store) Option {
+	return func(o *options) {
+		o.flags = store
+	}
+}
+
+// feature fails with ErrForbidden if the flag is off for the entity
+func (s *Server) feature(name, entityType, entityID string) error {
+	if s.flags == nil {
+		return nil
+	}
+	on, err := s.flags.Enabled(name, entityType, entityID)
+	if err != nil {
+		return err
+	}
+	if !on {
+		return errs.New(errs.ErrForbidden, "Feature "+name+" is not enabled for "+entityType+" "+entityID)
+	}
+	return nil
+}
+
+// entityFlags evaluates the flags for the entity making the request
+//
+//	GET /api/v1/{entity_type}/{entity_id}/flags
+func (s *Server) entityFlags(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeEntity(r, params[0], params[1]); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	m, err := s.flags.Evaluate(params[0], params[1])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// listFlags lists the flags
+//
+//	GET /api/v1/admin/flags
+func (s *Server) listFlags(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fs, err := s.flags.List()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fs)
+}
+
+// saveFlag creates or updates a flag
+//
+//	PUT /api/v1/admin/flags/{name} {"enabled": false, "percentage": 10}
+func (s *Server) saveFlag(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	f := &flags.Flag{}
+	err := readJSON(r, f)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	f.Name = params[0]
+	err = s.flags.Save(f)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// overrideRequest the body of a flag override
+type overrideRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// overrideFlag forces a flag for an entity type or an entity
+//
+//	PUT /api/v1/admin/flags/{name}/overrides/{entity_type}[/{entity_id}] {"enabled": true}
+func (s *Server) overrideFlag(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &overrideRequest{}
+	err := readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	o, err := s.flags.Override(params[0], params[1], params[2], req.Enabled)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+// clearOverride removes the override of a flag
+//
+//	DELETE /api/v1/admin/flags/{name}/overrides/{entity_type}[/{entity_id}]
+func (s *Server) clearOverride(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err := s.flags.ClearOverride(params[0], params[1], params[2])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
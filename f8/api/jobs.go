@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/jobs"
+)
+
+// Jobs option runs the slow storage operations in the background jobs of the queue
+//
+// It enables the archive export and sync endpoints and the removal of
+// directories, they answer 202 with the job to poll at /api/v1/jobs/{id}
+func Jobs(q *jobs.Queue) Option {
+	return func(o *options) {
+		o.jobs = q
+	}
+}
+
+// writeJob answers that the job was queued
+func writeJob(w http.ResponseWriter, job *jobs.Job) {
+	w.Header().Set("Location", Prefix+"/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// exportArchive queues the export of the bucket as an archive
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/archive?format=zip
+func (s *Server) exportArchive(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	format := buckets.ArchiveFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		format = buckets.Zip
+	}
+	job, err := s.jobs.ExportArchive(b, format)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJob(w, job)
+}
+
+// syncBucket queues the reconciliation of the bucket with its directory on disk
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/sync
+func (s *Server) syncBucket(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	job, err := s.jobs.Sync(b)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJob(w, job)
+}
+
+// authorizedJob returns the job if the request is the admin's,
+// the entity's the job works on or its enqueuer's
+func (s *Server) authorizedJob(r *http.Request, id string) (*jobs.Job, error) {
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokenAuthorized(r) {
+		return job, nil
+	}
+	actor, err := s.actor(r)
+	if err != nil {
+		return nil, err
+	}
+	if actor == nil {
+		return nil, errUnauthenticated
+	}
+	if actor.IsAdmin() || (actor.Type == job.EntityType && actor.ID == job.EntityID) ||
+		(actor.Type == job.ActorType && actor.ID == job.ActorID) {
+		return job, nil
+	}
+	// don't tell the others it exists
+	return nil, errs.ErrJobNotFound
+}
+
+// getJob returns the status of the job
+//
+//	GET /api/v1/jobs/{id}
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request, params []string) {
+	job, err := s.authorizedJob(r, params[0])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// jobArchive serves the archive of a succeeded export job
+//
+//	GET /api/v1/jobs/{id}/archive
+func (s *Server) jobArchive(w http.ResponseWriter, r *http.Request, params []string) {
+	job, err := s.authorizedJob(r, params[0])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if job.Kind != jobs.ExportArchive {
+		httpError(w, r, errs.New(errs.ErrInvalidOption, "Only archive export jobs have an archive"))
+		return
+	}
+	if job.Status != jobs.Succeeded {
+		httpError(w, r, errs.New(errs.ErrFileNotFound, "Archive export is "+string(job.Status)))
+		return
+	}
+	p, _ := job.Result["path"].(string)
+	exports, err := s.bucket(s.db, job.EntityType, job.EntityID, buckets.ExportBucket)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	s.serveFile(w, r, exports, p)
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+)
+
+// MaxUploadSize option sets the largest upload accepted by the api, 0 for unlimited
+func MaxUploadSize(n int64) Option {
+	return func(o *options) {
+		o.maxUploadSize = n
+	}
+}
+
+// RouteUploadLimit option sets the largest upload accepted under a path prefix
+//
+//	api.RouteUploadLimit(api.Prefix+"/users/", 10<<20)
+//
+// The longest matching prefix is used
+func RouteUploadLimit(prefix string, n int64) Option {
+	return func(o *options) {
+		if o.routeUploadLimits == nil {
+			o.routeUploadLimits = map[string]int64{}
+		}
+		o.routeUploadLimits[prefix] = n
+	}
+}
+
+// RateLimit option limits the requests per client ip and per actor and their body size
+//
+// Share the limits with the proxy's ratelimit middleware for a budget
+// covering both. The actors are found with the Auth option.
+func RateLimit(limits *ratelimit.Limits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+// limit takes the request from the budgets of its ip and actor and limits its body
+//
+// The ip budget comes first so the clients over it can't make the server check credentials
+func (s *Server) limit(r *http.Request) error {
+	err := s.limits.AllowIP(r)
+	if err != nil {
+		return err
+	}
+	if actor, err := s.actor(r); err == nil && actor != nil {
+		err = s.limits.AllowUser(actor.Type + "/" + actor.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return s.limits.LimitBody(r)
+}
+
+// minLimit the smaller of two limits where 0 is unlimited
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// uploadLimit the limit of the request's route and the global one, 0 for unlimited
+func (s *Server) uploadLimit(r *http.Request) int64 {
+	limit, matched := int64(0), ""
+	for prefix, n := range s.routeUploadLimits {
+		if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > len(matched) {
+			limit, matched = n, prefix
+		}
+	}
+	return minLimit(s.maxUploadSize, limit)
+}
+
+// limitUpload applies the upload limits to the request body
+//
+// A Content-Length over the limit is rejected before anything is read,
+// chunked bodies fail as soon as they go over it.
+// Each of the global, route and bucket limits is a cap so the smallest one wins.
+func (s *Server) limitUpload(r *http.Request, b *buckets.Bucket) (io.Reader, error) {
+	limit := s.uploadLimit(r)
+	if b != nil {
+		limit = minLimit(limit, b.MaxUploadSize)
+	}
+	if limit == 0 {
+		return r.Body, nil
+	}
+	if r.ContentLength > limit {
+		return nil, errs.TooLarge(limit)
+	}
+	return &countingReader{r: r.Body, limit: limit}, nil
+}
+
+// countingReader fails once more than limit bytes were read
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.n > c.limit {
+		return 0, errs.TooLarge(c.limit)
+	}
+	if rest := c.limit - c.n + 1; int64(len(p)) > rest {
+		// a byte past the limit is enough to know it's too large
+		p = p[:rest]
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.n > c.limit {
+		return n, errs.TooLarge(c.limit)
+	}
+	return n, err
+}
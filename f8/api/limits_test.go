@@ -0,0 +1,36 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+)
+
+func TestLimitIPBeforeAuth(t *testing.T) {
+	env := fatetest.New(t)
+	err := entity.NewPasswords(env.DB, "users", "bob", fastHash).SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := ratelimit.New(ratelimit.Options{IPRate: 0.001, IPBurst: 1})
+	a := env.API(api.Auth(api.BasicAuth(env.DB, "users", fastHash)), api.RateLimit(limits))
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("bob", "wrong")
+	a = a.Header("Authorization", r.Header.Get("Authorization"))
+	a.Do(t, http.MethodGet, "/users/bob/stats", nil)
+	w := a.Do(t, http.MethodGet, "/users/bob/stats", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d want %d over the ip budget: %s", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+	if n := failures(t, env); n != 1 {
+		t.Errorf("the refused request was authenticated, %d failures want 1", n)
+	}
+}
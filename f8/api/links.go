@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+)
+
+type linksRequest struct {
+	// Policy preserve, follow or reject, see buckets.LinksPreserve
+	Policy string `json:"policy"`
+}
+
+// setLinks sets how a bucket handles its symlinks, only for the owner
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/links {"policy": "follow"}
+func (s *Server) setLinks(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &linksRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.SetLinks(req.Policy)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &linksRequest{Policy: b.LinkPolicy()})
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/migrate"
+)
+
+// migrationAuthorized whether the request carries the migration token
+func (s *Server) migrationAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.migrationToken)) == 1
+}
+
+// migrationManifest describes an entity for a migration client
+//
+//	GET /api/v1/migrate/{entity_type}/{entity_id}/manifest
+func (s *Server) migrationManifest(w http.ResponseWriter, r *http.Request, params []string) {
+	if !s.migrationAuthorized(r) {
+		httpError(w, r, errUnauthenticated)
+		return
+	}
+	m, err := migrate.BuildManifest(s.db, s.storage.StorageDir, params[0], params[1])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// migrationFile downloads a file for a migration client, range requests are supported
+//
+//	GET /api/v1/migrate/{entity_type}/{entity_id}/buckets/{bucket}/files/{path}
+func (s *Server) migrationFile(w http.ResponseWriter, r *http.Request, params []string) {
+	if !s.migrationAuthorized(r) {
+		httpError(w, r, errUnauthenticated)
+		return
+	}
+	b, err := s.bucket(s.db, params[0], params[1], params[2])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fdir, err := b.Stat(params[3])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	f, err := b.Open(fdir.Path)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, fdir.Name, fdir.ModTime, f)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/notify"
+	"github.com/phanirithvij/fate/f8/readonly"
+)
+
+// Notifier option serves the email verification endpoints, the links are sent through n
+//
+// The links point to verifyURL, a page of the app passing the token on,
+// or straight to the api when it's empty
+func Notifier(n notify.Notifier, verifyURL string) Option {
+	return func(o *options) {
+		o.notifier = n
+		o.verifyURL = verifyURL
+	}
+}
+
+// verificationRequest the body of a verification request
+type verificationRequest struct {
+	Email string `json:"email"`
+}
+
+// sendVerification emails a verification link to an email of the entity, only for the entity
+//
+//	POST /api/v1/{entity_type}/{entity_id}/emails/verify {"email": "a@b.c"}
+func (s *Server) sendVerification(w http.ResponseWriter, r *http.Request, params []string) {
+	actor, err := s.actor(r)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if actor == nil {
+		httpError(w, r, errUnauthenticated)
+		return
+	}
+	if actor.Type != params[0] || actor.ID != params[1] {
+		httpError(w, r, errs.ErrForbidden)
+		return
+	}
+	req := &verificationRequest{}
+	err = readJSON(r, req)
+	if err != nil || req.Email == "" {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	link := s.verifyURL
+	if link == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		link = scheme + "://" + r.Host + r.URL.Path
+	}
+	err = notify.SendVerification(s.notifier, entity.NewContacts(s.db, params[0], params[1]), req.Email, link)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyEmail verifies the email of the token, the token is the credential
+//
+//	GET /api/v1/{entity_type}/{entity_id}/emails/verify?token=
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request, params []string) {
+	err := readonly.Check()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	e, err := entity.NewContacts(s.db, params[0], params[1]).Verify(r.URL.Query().Get("token"))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
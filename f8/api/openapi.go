@@ -0,0 +1,491 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/migrate"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"github.com/phanirithvij/fate/f8/stats"
+	"github.com/phanirithvij/fate/f8/usage"
+)
+
+// The OpenAPI 3 document of the api is generated from the routes, their
+// named groups give the path parameters and the name of the handler the
+// operationId. What the patterns don't tell is in operations.
+
+// docsPage the api docs, a single page listing the operations of the openapi document
+//
+//go:embed docs.html
+var docsPage []byte
+
+// The content types of the bodies which aren't json
+const (
+	binaryContent = "application/octet-stream"
+	htmlContent   = "text/html"
+)
+
+// operation the details of an endpoint the route doesn't have
+type operation struct {
+	summary string
+	// query the query parameters, "name" for strings or "name:type" with its json schema type
+	query []string
+	// in the json request body, or the content type of a raw one
+	in interface{}
+	// out the json response, or the content type of a raw one
+	out interface{}
+	// status of a success, 200 if 0
+	status int
+	// queued whether it may answer 202 with the out job instead
+	queued bool
+	// public whether it's served without credentials
+	public bool
+}
+
+// operations the details of the endpoints by operationId, the name of their handler
+var operations = map[string]operation{
+	"openAPI": {summary: "Get this OpenAPI document", out: "application/json", public: true},
+	"docs":    {summary: "Browse the api docs", out: htmlContent, public: true},
+
+	"publicFile": {summary: "Download a file using a pre-signed url", query: []string{"expires:integer", "ip", "signature"}, out: binaryContent, public: true},
+
+	"listFiles":     {summary: "List the files of a bucket, pass the next_cursor of a page as the cursor of the next one", query: []string{"limit:integer", "cursor", "prefix", "sort"}, out: (*buckets.ListPage)(nil)},
+	"getFile":       {summary: "Download a file from a bucket, range requests are supported", out: binaryContent},
+	"putFile":       {summary: "Upload the request body as a file in a bucket", in: binaryContent, out: (*buckets.FileDir)(nil), status: http.StatusCreated},
+	"deleteFile":    {summary: "Remove a file or a directory with everything under it, directories are queued as a job when the server has jobs", out: (*jobs.Job)(nil), status: http.StatusNoContent, queued: true},
+	"getThumbnail":  {summary: "Download the thumbnail of an image in a bucket", query: []string{"size:integer"}, out: binaryContent},
+	"searchFiles":   {summary: "Search the files of a bucket, tag is repeatable and the times are RFC3339", query: []string{"name", "ext", "tag", "min_size:integer", "max_size:integer", "modified_after", "modified_before", "dirs:boolean", "limit:integer", "offset:integer"}, out: (*buckets.SearchResult)(nil)},
+	"shareFile":     {summary: "Mint a pre-signed url for a file the actor can read", in: (*shareRequest)(nil), out: (*shareResponse)(nil), status: http.StatusCreated},
+	"setVisibility": {summary: "Change who can access a bucket, only for the owner", in: (*visibilityRequest)(nil), out: (*visibilityRequest)(nil)},
+	"getPipeline":   {summary: "Get the post-processing steps of a bucket, only for the owner", out: (*pipelineRequest)(nil)},
+	"setPipeline":   {summary: "Replace the post-processing steps of a bucket, only for the owner", in: (*pipelineRequest)(nil), out: (*pipelineRequest)(nil)},
+	"listGrants":    {summary: "List the access granted on a bucket, only for the owner", out: []buckets.Grant(nil)},
+	"grant":         {summary: "Grant access on a bucket to another entity, only for the owner", in: (*grantRequest)(nil), out: (*grantRequest)(nil), status: http.StatusCreated},
+	"revoke":        {summary: "Revoke the access granted on a bucket, only for the owner", status: http.StatusNoContent},
+	"batchUpload":   {summary: "Upload many files as multipart/form-data parts with a filename or as a tar, tar.gz or zip archive", in: "multipart/form-data", out: (*buckets.BatchReport)(nil), status: http.StatusCreated},
+	"batchDelete":   {summary: "Remove the files matching a prefix or a glob", in: (*buckets.Match)(nil), out: (*buckets.BatchReport)(nil)},
+	"batchMetadata": {summary: "Set the metadata of many files", in: (*batchMetadataRequest)(nil), out: (*buckets.BatchReport)(nil)},
+	"listTrash":     {summary: "List the files in the trash of a bucket", out: (*trashResponse)(nil)},
+	"setTrash":      {summary: "Turn the trash of a bucket on or off, only for the owner", in: (*trashRequest)(nil), out: (*trashRequest)(nil)},
+	"restoreTrash":  {summary: "Put a file of the trash back in the bucket", in: (*restoreRequest)(nil), out: (*buckets.FileDir)(nil), status: http.StatusCreated},
+	"purgeTrash":    {summary: "Permanently delete a file of the trash, only for the owner", status: http.StatusNoContent},
+	"setLinks":      {summary: "Set how a bucket handles its symlinks, only for the owner", in: (*linksRequest)(nil), out: (*linksRequest)(nil)},
+	"setQuota":      {summary: "Change the quota of a bucket, only for the admins", in: (*quotaRequest)(nil), out: (*buckets.Bucket)(nil)},
+
+	"exportArchive": {summary: "Queue the export of a bucket as an archive", query: []string{"format"}, out: (*jobs.Job)(nil), status: http.StatusAccepted},
+	"syncBucket":    {summary: "Queue the reconciliation of a bucket with its directory on disk", out: (*jobs.Job)(nil), status: http.StatusAccepted},
+	"getJob":        {summary: "Get the status of a job", out: (*jobs.Job)(nil)},
+	"jobArchive":    {summary: "Download the archive of a succeeded export job", out: binaryContent},
+
+	"migrationManifest": {summary: "Describe an entity for a migration client", out: (*migrate.Manifest)(nil)},
+	"migrationFile":     {summary: "Download a file for a migration client, range requests are supported", out: binaryContent},
+
+	"entityStats":      {summary: "Get the file counts and sizes of an entity, its buckets, largest files and daily history", query: []string{"days:integer", "largest:integer"}, out: (*stats.Details)(nil)},
+	"entityFlags":      {summary: "Evaluate the flags for the entity", out: map[string]bool(nil)},
+	"entityAudit":      {summary: "List the audit log of the entity, newest first", query: []string{"action", "since", "until", "before:integer", "limit:integer"}, out: (*auditPage)(nil)},
+	"entityUsage":      {summary: "List the usage reports of the entity, csv with format=csv", query: []string{"month", "format"}, out: []usage.Report(nil)},
+	"sendVerification": {summary: "Email a verification link to an email of the entity, only for the entity", in: (*verificationRequest)(nil), status: http.StatusAccepted},
+	"verifyEmail":      {summary: "Verify the email of the token, the token is the credential", query: []string{"token"}, out: (*entity.Email)(nil), public: true},
+
+	"dashboard":     {summary: "Open the admin dashboard, it asks for the admin token itself", out: htmlContent, public: true},
+	"getReadOnly":   {summary: "Tell whether the service is read-only", out: (*readonly.State)(nil)},
+	"setReadOnly":   {summary: "Switch the read-only mode on or off", in: (*readOnlyRequest)(nil), out: (*readonly.State)(nil)},
+	"listEntities":  {summary: "List the entities of a type with their roles, only for the admins", query: []string{"tenant", "after", "limit:integer"}, out: (*entityPage)(nil)},
+	"getEntity":     {summary: "Get an entity with its role, buckets, their quotas and usage, only for the admins", out: (*entityDetails)(nil)},
+	"setDisabled":   {summary: "Disable or enable an entity, only for the admins", in: (*disableRequest)(nil), out: (*disableRequest)(nil)},
+	"setRole":       {summary: "Give an entity a role, only for the admins", in: (*roleRequest)(nil), out: (*roleRequest)(nil)},
+	"syncEntity":    {summary: "Queue the sync of every bucket of an entity, only for the admins", out: map[string][]*jobs.Job(nil), status: http.StatusAccepted},
+	"runGC":         {summary: "Queue a gc run, only for the admins", out: (*jobs.Job)(nil), status: http.StatusAccepted},
+	"listStats":     {summary: "List the entities storing the most, only for the admins", query: []string{"tenant", "entity_type", "limit:integer"}, out: []stats.Stats(nil)},
+	"listAudit":     {summary: "List the audit log of every entity, newest first", query: []string{"entity_type", "entity_id", "action", "since", "until", "before:integer", "limit:integer"}, out: (*auditPage)(nil)},
+	"listUsage":     {summary: "List the usage reports of every entity, csv with format=csv", query: []string{"tenant", "entity_type", "entity_id", "month", "format"}, out: []usage.Report(nil)},
+	"listFlags":     {summary: "List the flags", out: []flags.Flag(nil)},
+	"saveFlag":      {summary: "Create or update a flag", in: (*flags.Flag)(nil), out: (*flags.Flag)(nil)},
+	"overrideFlag":  {summary: "Force a flag for an entity type or an entity", in: (*overrideRequest)(nil), out: (*flags.Override)(nil)},
+	"clearOverride": {summary: "Remove the override of a flag", status: http.StatusNoContent},
+}
+
+// schema a json schema of the document
+type schema map[string]interface{}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Security   []map[string][]string                   `json:"security"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	// Security empty for the public operations, the document's if nil
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+	Schema      schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema schema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas         schemas           `json:"schemas"`
+	SecuritySchemes map[string]schema `json:"securitySchemes"`
+}
+
+// openAPI serves the OpenAPI 3 document of the routes of the server
+//
+//	GET /api/v1/openapi.json
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request, params []string) {
+	writeJSON(w, http.StatusOK, s.openAPIDocument())
+}
+
+// docs serves the api docs, they fetch the openapi document
+//
+//	GET /api/v1/docs
+func (s *Server) docs(w http.ResponseWriter, r *http.Request, params []string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(http.StatusOK)
+	w.Write(docsPage)
+}
+
+// openAPIDocument builds the document of the routes
+//
+// Only the routes enabled by the options are in it, the WebDAV ones aren't
+// as they take every method.
+func (s *Server) openAPIDocument() *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       "fate",
+			Version:     path.Base(Prefix),
+			Description: "The http api for the entity buckets. The errors are RFC 7807 problems, branch on their code.",
+		},
+		Servers:  []openAPIServer{{URL: "/"}},
+		Security: []map[string][]string{{"basic": {}}, {"bearer": {}}},
+		Paths:    map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: schemas{},
+			SecuritySchemes: map[string]schema{
+				"basic":  {"type": "http", "scheme": "basic", "description": "The id and password of an entity"},
+				"bearer": {"type": "http", "scheme": "bearer", "description": "The admin token for the admin endpoints, the migration token for the migration ones"},
+			},
+		},
+	}
+	problem := doc.Components.Schemas.of(reflect.TypeOf(Problem{}))
+	for _, rt := range s.router.routes {
+		if rt.method == "" {
+			continue
+		}
+		method := strings.ToLower(rt.method)
+		for _, t := range pathTemplates(rt.pattern) {
+			ops := doc.Paths[t.path]
+			if ops == nil {
+				ops = map[string]*openAPIOperation{}
+				doc.Paths[t.path] = ops
+			}
+			if ops[method] != nil {
+				// shadowed by an earlier route
+				continue
+			}
+			op := doc.operation(rt.handler, t)
+			op.Responses["default"] = &openAPIResponse{
+				Description: "The problem",
+				Content:     map[string]openAPIMedia{"application/problem+json": {Schema: problem}},
+			}
+			ops[method] = op
+		}
+	}
+	return doc
+}
+
+// operation describes the operation of the handler at the path
+func (doc *openAPIDocument) operation(handler handlerFunc, t pathTemplate) *openAPIOperation {
+	id := handlerName(handler)
+	o := operations[id]
+	op := &openAPIOperation{
+		OperationID: id,
+		Summary:     o.summary,
+		Tags:        []string{pathTag(t.path)},
+		Responses:   map[string]*openAPIResponse{},
+	}
+	if o.public {
+		op.Security = &[]map[string][]string{}
+	}
+	for _, name := range t.params {
+		p := openAPIParameter{Name: name, In: "path", Required: true, Schema: schema{"type": "string"}}
+		if name == "path" {
+			p.Description = "The slash separated path of the file, its slashes aren't escaped"
+		}
+		op.Parameters = append(op.Parameters, p)
+	}
+	for _, q := range o.query {
+		name, typ, ok := strings.Cut(q, ":")
+		if !ok {
+			typ = "string"
+		}
+		op.Parameters = append(op.Parameters, openAPIParameter{Name: name, In: "query", Schema: schema{"type": typ}})
+	}
+	if o.in != nil {
+		op.RequestBody = &openAPIBody{Required: true, Content: doc.content(o.in)}
+	}
+	status := o.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	res := &openAPIResponse{Description: http.StatusText(status)}
+	if o.out != nil && !o.queued {
+		res.Content = doc.content(o.out)
+	}
+	op.Responses[strconv.Itoa(status)] = res
+	if o.queued {
+		op.Responses[strconv.Itoa(http.StatusAccepted)] = &openAPIResponse{Description: http.StatusText(http.StatusAccepted), Content: doc.content(o.out)}
+	}
+	return op
+}
+
+// content the media of a body, see operation.in and out
+func (doc *openAPIDocument) content(v interface{}) map[string]openAPIMedia {
+	if ct, ok := v.(string); ok {
+		s := schema{"type": "string"}
+		if ct == binaryContent || strings.HasPrefix(ct, "multipart/") {
+			s["format"] = "binary"
+		}
+		if ct == "application/json" {
+			s = schema{"type": "object"}
+		}
+		return map[string]openAPIMedia{ct: {Schema: s}}
+	}
+	return map[string]openAPIMedia{"application/json": {Schema: doc.Components.Schemas.of(reflect.TypeOf(v))}}
+}
+
+// handlerName the name of the method of the Server the handler is
+func handlerName(handler handlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// pathTag groups the operations of the path, by the part of the api it's in
+func pathTag(p string) string {
+	first := strings.SplitN(strings.TrimPrefix(p, Prefix+"/"), "/", 2)[0]
+	switch first {
+	case "admin", "jobs", "migrate", "public", "docs":
+		return first
+	case "openapi.json":
+		return "docs"
+	}
+	if strings.Contains(p, "/buckets/") {
+		return "buckets"
+	}
+	return "entities"
+}
+
+// pathTemplate an openapi path with its parameters in order
+type pathTemplate struct {
+	path   string
+	params []string
+}
+
+// pathTemplates the openapi paths matched by a route pattern
+//
+// Its named groups become the parameters, a trailing /? is dropped and an
+// optional /?(?P<name>[^/]*) gives the path with and without it.
+// A pattern with unnamed groups has none.
+func pathTemplates(re *regexp.Regexp) []pathTemplate {
+	src := strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$")
+	var b strings.Builder
+	var params []string
+	optional := ""
+	for i := 0; i < len(src); i++ {
+		if src[i] != '(' {
+			b.WriteByte(src[i])
+			continue
+		}
+		if !strings.HasPrefix(src[i:], "(?P<") {
+			return nil
+		}
+		end := strings.IndexByte(src[i:], '>')
+		name := src[i+len("(?P<") : i+end]
+		depth := 0
+		j := i
+		for ; j < len(src); j++ {
+			if src[j] == '(' {
+				depth++
+			} else if src[j] == ')' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if strings.HasSuffix(src[i:j], "*") {
+			optional = name
+		}
+		b.WriteString("{" + name + "}")
+		params = append(params, name)
+		i = j
+	}
+	p := strings.TrimSuffix(b.String(), "/?")
+	if optional == "" {
+		return []pathTemplate{{path: p, params: params}}
+	}
+	group := "/?{" + optional + "}"
+	var without []string
+	for _, name := range params {
+		if name != optional {
+			without = append(without, name)
+		}
+	}
+	return []pathTemplate{
+		{path: strings.Replace(p, group, "", 1), params: without},
+		{path: strings.Replace(p, group, "/{"+optional+"}", 1), params: params},
+	}
+}
+
+// schemas the named schemas of the document, by package and type name
+type schemas map[string]schema
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// of the schema of the json encoding of values of t
+//
+// The named structs are added to the schemas and referenced.
+func (c schemas) of(t reflect.Type) schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		// encoded its own way, could be anything
+		return schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		s := schema{"type": "integer"}
+		if t.Bits() == 64 {
+			s["format"] = "int64"
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": c.of(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": c.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return c.object(t)
+		}
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		ref := schema{"$ref": "#/components/schemas/" + name}
+		if _, ok := c[name]; !ok {
+			// placeholder for the types referencing themselves
+			c[name] = schema{}
+			c[name] = c.object(t)
+		}
+		return ref
+	}
+	return schema{}
+}
+
+// object the schema of a struct
+func (c schemas) object(t reflect.Type) schema {
+	props := schema{}
+	c.fields(t, props, false)
+	return schema{"type": "object", "properties": props}
+}
+
+// fields adds the json fields of the struct to props
+//
+// Like encoding/json the fields of the embedded structs are promoted,
+// the ones of the struct win over them.
+func (c schemas) fields(t reflect.Type, props schema, embedded bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" && opts == "" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			c.fields(ft, props, true)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		switch ft.Kind() {
+		case reflect.Func, reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if _, ok := props[tag]; ok && embedded {
+			continue
+		}
+		props[tag] = c.of(f.Type)
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+type pipelineRequest struct {
+	Steps buckets.Pipeline `json:"steps"`
+}
+
+// getPipeline returns the post-processing steps of a bucket, only for the owner
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/pipeline
+func (s *Server) getPipeline(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	steps := b.Pipeline
+	if steps == nil {
+		steps = buckets.Pipeline{}
+	}
+	writeJSON(w, http.StatusOK, &pipelineRequest{Steps: steps})
+}
+
+// setPipeline replaces the post-processing steps of a bucket, only for the owner
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/pipeline {"steps": [{"processor": "checksum"}]}
+func (s *Server) setPipeline(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &pipelineRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.SetPipeline(req.Steps)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if req.Steps == nil {
+		req.Steps = buckets.Pipeline{}
+	}
+	writeJSON(w, http.StatusOK, req)
+}
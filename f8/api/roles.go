@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/validate"
+)
+
+const (
+	// defaultEntityLimit and maxEntityLimit the page sizes of the entities
+	defaultEntityLimit = 100
+	maxEntityLimit     = 1000
+)
+
+// entityRow an entity in the listing of the admins
+type entityRow struct {
+	ID     string     `json:"id"`
+	Tenant string     `json:"tenant,omitempty"`
+	Role   roles.Role `json:"role" gorm:"-"`
+}
+
+// entityPage a page of the entities
+type entityPage struct {
+	Entities []entityRow `json:"entities"`
+	// NextAfter pass it as after to get the next page, empty on the last one
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+// listEntities lists the entities of a type with their roles, only for the admins
+//
+//	GET /api/v1/admin/entities/{entity_type}?tenant=&after=&limit=100
+func (s *Server) listEntities(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	entityType := params[0]
+	if err := validate.EntityType(entityType); err != nil || !s.db.Migrator().HasTable(entityType) {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultEntityLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, r, errBadRequest)
+			return
+		}
+		if n > maxEntityLimit {
+			n = maxEntityLimit
+		}
+		limit = n
+	}
+	tx := s.db.Table(entityType).Select("id, tenant").Where("id > ?", q.Get("after"))
+	if s.db.Migrator().HasColumn(entityType, "deleted_at") {
+		tx = tx.Where("deleted_at IS NULL")
+	}
+	if t := q.Get("tenant"); t != "" {
+		tx = tx.Where("tenant = ?", t)
+	}
+	page := &entityPage{Entities: []entityRow{}}
+	err := tx.Order("id").Limit(limit).Scan(&page.Entities).Error
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	for i := range page.Entities {
+		e := &page.Entities[i]
+		e.Role, err = roles.Get(s.db, entityType, e.ID)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+	if len(page.Entities) == limit {
+		page.NextAfter = page.Entities[limit-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// roleRequest the body of a role change
+type roleRequest struct {
+	Role roles.Role `json:"role"`
+}
+
+// setRole gives an entity a role, only for the admins
+//
+//	PUT /api/v1/admin/roles/{entity_type}/{entity_id} {"role": "readonly"}
+func (s *Server) setRole(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &roleRequest{}
+	err := readJSON(r, req)
+	if err != nil {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	err = roles.Set(s.db, params[0], params[1], req.Role)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// quotaRequest the body of a quota change
+type quotaRequest struct {
+	// Quota in bytes, 0 for unlimited
+	Quota int64 `json:"quota"`
+}
+
+// setQuota changes the quota of a bucket, only for the admins
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/quota {"quota": 1073741824}
+func (s *Server) setQuota(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &quotaRequest{}
+	err := readJSON(r, req)
+	if err != nil {
+		httpError(w, r, errBadRequest)
+		return
+	}
+	b, err := s.bucket(s.db, params[0], params[1], params[2])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.SetQuota(req.Quota)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
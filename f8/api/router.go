@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// handlerFunc a handler receiving the submatches of the route's pattern
+type handlerFunc func(w http.ResponseWriter, r *http.Request, params []string)
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handler handlerFunc
+}
+
+// router a method aware version of browser.RegexpHandler
+type router struct {
+	routes []*route
+}
+
+// handle registers the handler for the method and the anchored pattern
+//
+// An empty method matches every method
+func (rt *router) handle(method, pattern string, handler handlerFunc) {
+	rt.routes = append(rt.routes, &route{
+		method:  method,
+		pattern: regexp.MustCompile("^" + pattern + "$"),
+		handler: handler,
+	})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methodMismatch := false
+	for _, route := range rt.routes {
+		m := route.pattern.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		if route.method != "" && route.method != r.Method && !(route.method == http.MethodGet && r.Method == http.MethodHead) {
+			methodMismatch = true
+			continue
+		}
+		route.handler(w, r, m[1:])
+		return
+	}
+	if methodMismatch {
+		writeProblem(w, r, http.StatusMethodNotAllowed, "", "", "")
+		return
+	}
+	writeProblem(w, r, http.StatusNotFound, "", "", "Check the api path, see the routes of api.Server")
+}
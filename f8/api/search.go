@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+// searchFiles searches the files of a bucket
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/search
+//
+// Query parameters name, ext, tag (repeatable), min_size, max_size,
+// modified_after, modified_before (RFC3339), dirs, limit and offset
+func (s *Server) searchFiles(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	opts, err := searchOptions(r.URL.Query())
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	res, err := b.Search(*opts)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// searchOptions parses the search query parameters
+func searchOptions(q url.Values) (*buckets.SearchOptions, error) {
+	opts := &buckets.SearchOptions{
+		Name: q.Get("name"),
+		Ext:  q.Get("ext"),
+		Tags: q["tag"],
+	}
+	var err error
+	ints := map[string]*int64{"min_size": &opts.MinSize, "max_size": &opts.MaxSize}
+	for key, dst := range ints {
+		if v := q.Get(key); v != "" {
+			*dst, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, errBadRequest
+			}
+		}
+	}
+	times := map[string]*time.Time{"modified_after": &opts.ModifiedAfter, "modified_before": &opts.ModifiedBefore}
+	for key, dst := range times {
+		if v := q.Get(key); v != "" {
+			*dst, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errBadRequest
+			}
+		}
+	}
+	page := map[string]*int{"limit": &opts.Limit, "offset": &opts.Offset}
+	for key, dst := range page {
+		if v := q.Get(key); v != "" {
+			*dst, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, errBadRequest
+			}
+		}
+	}
+	if v := q.Get("dirs"); v != "" {
+		opts.IncludeDirs, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errBadRequest
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/share"
+)
+
+// SignURL mints a pre-signed url for downloading a file without authentication
+//
+// The url expires after ttl and if ip is not empty it can only be used
+// from that client ip. The returned url is relative to the api's host.
+func (s *Server) SignURL(b *buckets.Bucket, p string, ttl time.Duration, ip string) (string, error) {
+	u, _, err := s.signLink(b, p, ttl, ip)
+	return u, err
+}
+
+// signLink is SignURL also returning the link the url is valid for
+func (s *Server) signLink(b *buckets.Bucket, p string, ttl time.Duration, ip string) (string, *share.Link, error) {
+	b.AttachStorage(s.storage.StorageDir)
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return "", nil, err
+	}
+	if fdir.IsDir {
+		return "", nil, errors.New("Cannot sign a directory " + fdir.Path)
+	}
+	u, link := s.signer.SignLink(publicPath(b, fdir.Path), ttl, ip)
+	return u, link, nil
+}
+
+func publicPath(b *buckets.Bucket, p string) string {
+	return Prefix + "/public/" + b.EntityType + "/" + b.EntityID + "/" + b.ID + "/" + p
+}
+
+// publicFile serves a file using a pre-signed url
+//
+//	GET /api/v1/public/{entity_type}/{entity_id}/{bucket}/{path}?expires=&signature=
+func (s *Server) publicFile(w http.ResponseWriter, r *http.Request, params []string) {
+	_, err := s.signer.Verify(r)
+	if err != nil {
+		status, code := http.StatusForbidden, "invalid_signature"
+		if errors.Is(err, share.ErrExpired) {
+			status, code = http.StatusGone, "url_expired"
+		}
+		writeProblem(w, r, status, code, err.Error(), "Ask for a new signed url")
+		return
+	}
+	db, err := s.scope(r, nil)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	b, err := s.bucket(db, params[0], params[1], params[2])
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, "", "", "")
+		return
+	}
+	s.serveFile(w, r, b, params[3])
+}
+
+type shareRequest struct {
+	Path string `json:"path"`
+	// TTL the lifetime of the url in seconds, default one hour
+	TTL int64 `json:"ttl"`
+	// BindIP only allow the requesting client's ip to use the url
+	BindIP bool `json:"bind_ip"`
+}
+
+type shareResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// shareFile mints a pre-signed url for a file the actor can read
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/share
+func (s *Server) shareFile(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Reader)
+	if err == nil {
+		err = s.feature(flags.PublicSharing, b.EntityType, b.EntityID)
+	}
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &shareRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	ttl := time.Hour
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	ip := ""
+	if req.BindIP {
+		ip = share.ClientIP(r)
+	}
+	u, link, err := s.signLink(b, req.Path, ttl, ip)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &shareResponse{URL: u, Expires: link.Expires})
+}
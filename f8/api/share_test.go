@@ -0,0 +1,48 @@
+package api_test
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+func TestShareExpires(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	env := fatetest.New(t, fatetest.Models(&user{}), fatetest.Clock(c))
+	alice := createUser(t, env, "alice")
+	env.WriteFile(t, env.Bucket(t, alice, ""), "a.txt", "hello")
+	a := env.API()
+
+	out := struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{}
+	in := map[string]interface{}{"path": "a.txt", "ttl": 90}
+	a.As(alice.Actor()).JSON(t, http.MethodPost, "/users/alice/buckets/default/share", in, &out, http.StatusCreated)
+	if want := now.Add(90 * time.Second); !out.Expires.Equal(want) {
+		t.Errorf("got the expiry %s want %s", out.Expires, want)
+	}
+	u, err := url.Parse(out.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("expires"); got != strconv.FormatInt(out.Expires.Unix(), 10) {
+		t.Errorf("the url expires at %s not at the returned %d", got, out.Expires.Unix())
+	}
+
+	w := a.Do(t, http.MethodGet, out.URL, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("got status %d and %q want 200 and hello", w.Code, w.Body.String())
+	}
+	c.Advance(91 * time.Second)
+	w = a.Do(t, http.MethodGet, out.URL, nil)
+	if w.Code != http.StatusGone {
+		t.Errorf("after the expiry: got status %d want %d", w.Code, http.StatusGone)
+	}
+}
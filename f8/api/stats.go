@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/phanirithvij/fate/f8/stats"
+)
+
+// entityStats returns the file counts and sizes of an entity, its buckets,
+// largest files and the history of the daily snapshots
+//
+//	GET /api/v1/{entity_type}/{entity_id}/stats?days=30&largest=10
+func (s *Server) entityStats(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeEntity(r, params[0], params[1]); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	opts := stats.Options{}
+	q := r.URL.Query()
+	for key, dst := range map[string]*int{"days": &opts.Days, "largest": &opts.Largest} {
+		if v := q.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				httpError(w, r, errBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	d, err := stats.Entity(s.db, params[0], params[1], opts)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// listStats lists the entities storing the most, only for the admins
+//
+//	GET /api/v1/admin/stats?tenant=&entity_type=&limit=20
+func (s *Server) listStats(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	f := stats.Filter{Tenant: q.Get("tenant"), EntityType: q.Get("entity_type")}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, r, errBadRequest)
+			return
+		}
+		f.Limit = n
+	}
+	top, err := stats.Entities(s.db, f)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, top)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"github.com/phanirithvij/fate/f8/validate"
+	"gorm.io/gorm"
+)
+
+// TenantHeader option selects the tenant of the requests with a header, eg. X-Fate-Tenant
+//
+// Only use it behind a proxy which sets the header itself, the clients
+// could otherwise pick any tenant. The tenant of an authenticated actor
+// takes precedence and a header naming another tenant is refused.
+// The db of the storage must have the tenant callbacks registered.
+func TenantHeader(header string) Option {
+	return func(o *options) {
+		o.tenantHeader = header
+	}
+}
+
+// scope returns the db restricted to the tenant of the request
+//
+// Requests without a tenant see every tenant like a single tenant deployment
+func (s *Server) scope(r *http.Request, actor *buckets.Actor) (*gorm.DB, error) {
+	name := ""
+	if actor != nil {
+		name = actor.Tenant
+	}
+	if s.tenantHeader != "" {
+		if h := r.Header.Get(s.tenantHeader); h != "" {
+			if name != "" && name != h {
+				return nil, errs.New(errs.ErrForbidden, "Actor doesn't belong to tenant "+h)
+			}
+			name = h
+		}
+	}
+	if name == "" {
+		return s.db, nil
+	}
+	if err := validate.Tenant(name); err != nil {
+		return nil, err
+	}
+	return tenant.Scope(s.db, name), nil
+}
@@ -0,0 +1,59 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/roles"
+)
+
+func TestTenantHeader(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := env.Entity(t, "users", "alice", entity.Tenant("acme"))
+	env.Create(t, alice, &user{BaseEntity: alice, Name: "alice"})
+	env.WriteFile(t, env.Bucket(t, alice, ""), "a.txt", "a")
+	public := env.Bucket(t, alice, "public")
+	if err := public.SetVisibility(buckets.PublicRead); err != nil {
+		t.Fatal(err)
+	}
+	env.WriteFile(t, public, "a.txt", "a")
+
+	admin := &buckets.Actor{Type: "users", ID: "root", Role: roles.Admin}
+	tests := []struct {
+		name   string
+		actor  *buckets.Actor
+		tenant string
+		path   string
+		status int
+	}{
+		{"own tenant", alice.Actor(), "", "/users/alice/buckets/default/files/a.txt", http.StatusOK},
+		{"own tenant header", alice.Actor(), "acme", "/users/alice/buckets/default/files/a.txt", http.StatusOK},
+		{"other tenant header", alice.Actor(), "umbrella", "/users/alice/buckets/default/files/a.txt", http.StatusForbidden},
+		{"admin without tenant", admin, "", "/users/alice/buckets/default/files/a.txt", http.StatusOK},
+		{"admin in the tenant", admin, "acme", "/users/alice/buckets/default/files/a.txt", http.StatusOK},
+		{"admin in another tenant", admin, "umbrella", "/users/alice/buckets/default/files/a.txt", http.StatusNotFound},
+		{"invalid tenant", admin, "not a tenant!", "/users/alice/buckets/default/files/a.txt", http.StatusBadRequest},
+		{"public file", nil, "acme", "/users/alice/buckets/public/files/a.txt", http.StatusOK},
+		{"public file of another tenant", nil, "umbrella", "/users/alice/buckets/public/files/a.txt", http.StatusNotFound},
+	}
+	a := env.API(api.TenantHeader("X-Fate-Tenant"))
+	for _, tt := range tests {
+		c := a.As(tt.actor)
+		if tt.tenant != "" {
+			c = c.Header("X-Fate-Tenant", tt.tenant)
+		}
+		if w := c.Do(t, http.MethodGet, tt.path, nil); w.Code != tt.status {
+			t.Errorf("%s: got %d want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	// without the option the header is ignored
+	w := env.API().As(admin).Header("X-Fate-Tenant", "umbrella").Do(t, http.MethodGet, "/users/alice/buckets/default/files/a.txt", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+type trashResponse struct {
+	Enabled bool                `json:"enabled"`
+	Items   []buckets.TrashItem `json:"items"`
+}
+
+type trashRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type restoreRequest struct {
+	// Path where to restore the file, where it was removed from if empty
+	Path string `json:"path"`
+}
+
+// listTrash returns the files in the trash of a bucket
+//
+//	GET /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/trash
+func (s *Server) listTrash(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	items, err := b.TrashItems()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if items == nil {
+		items = []buckets.TrashItem{}
+	}
+	writeJSON(w, http.StatusOK, &trashResponse{Enabled: b.Trash, Items: items})
+}
+
+// setTrash turns the trash of a bucket on or off, only for the owner
+//
+//	PUT /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/trash {"enabled": true}
+func (s *Server) setTrash(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &trashRequest{}
+	err = readJSON(r, req)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.SetTrash(req.Enabled)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// restoreTrash puts a file of the trash back in the bucket
+//
+//	POST /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/trash/{id}/restore {"path": ""}
+func (s *Server) restoreTrash(w http.ResponseWriter, r *http.Request, params []string) {
+	_, b, err := s.authorizedBucket(r, params, buckets.Writer)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	req := &restoreRequest{}
+	if r.ContentLength != 0 {
+		err = readJSON(r, req)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+	fdir, err := b.RestoreTrash(params[3], req.Path)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, fdir)
+}
+
+// purgeTrash permanently deletes a file of the trash, only for the owner
+//
+//	DELETE /api/v1/{entity_type}/{entity_id}/buckets/{bucket}/trash/{id}
+func (s *Server) purgeTrash(w http.ResponseWriter, r *http.Request, params []string) {
+	b, err := s.ownedBucket(r, params)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = b.PurgeTrash(params[3])
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/usage"
+)
+
+// Usage option serves the monthly usage reports of the meter
+//
+// Only the entity itself and the admin can read an entity's reports
+func Usage(meter *usage.Meter) Option {
+	return func(o *options) {
+		o.usage = meter
+	}
+}
+
+// entityUsage lists the usage reports of the entity
+//
+//	GET /api/v1/{entity_type}/{entity_id}/usage?month=2026-10&format=csv
+func (s *Server) entityUsage(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeEntity(r, params[0], params[1]); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	s.writeUsage(w, r, usage.Filter{EntityType: params[0], EntityID: params[1]})
+}
+
+// listUsage lists the usage reports of every entity, eg. to bill the tenants
+//
+//	GET /api/v1/admin/usage?month=2026-10&tenant=&entity_type=&entity_id=&format=csv
+func (s *Server) listUsage(w http.ResponseWriter, r *http.Request, params []string) {
+	if err := s.authorizeAdmin(r); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	s.writeUsage(w, r, usage.Filter{Tenant: q.Get("tenant"), EntityType: q.Get("entity_type"), EntityID: q.Get("entity_id")})
+}
+
+// writeUsage writes the reports matching the filter and the month of the query
+// as json or, with format=csv, as a csv download
+func (s *Server) writeUsage(w http.ResponseWriter, r *http.Request, f usage.Filter) {
+	q := r.URL.Query()
+	f.Month = q.Get("month")
+	if f.Month != "" {
+		if _, err := time.Parse(usage.MonthFormat, f.Month); err != nil {
+			httpError(w, r, errs.New(errs.ErrInvalidOption, "Month must be formatted as "+usage.MonthFormat))
+			return
+		}
+	}
+	reports, err := s.usage.List(f)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, reports)
+	case "csv":
+		name := "usage"
+		if f.Month != "" {
+			name += "-" + f.Month
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		err = usage.WriteCSV(w, reports)
+		if err != nil {
+			log.Println(err)
+		}
+	default:
+		httpError(w, r, errs.New(errs.ErrInvalidOption, "Unknown format "+q.Get("format")))
+	}
+}
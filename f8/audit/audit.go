@@ -0,0 +1,237 @@
+// Package audit the append-only trail of who did what to the entities and their files
+//
+// Logins through the filebrowser proxy, bucket creations, deletions and shares and
+// file writes and deletes are recorded along with the actor and its ip.
+// Entries are never updated, only pruned once older than the retention.
+//
+//	log := audit.New(db)
+//	events.Subscribe(log.Sink())
+//	entries, err := log.Query(audit.Filter{EntityType: "users", EntityID: "phano"})
+package audit
+
+import (
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+const (
+	// Login a login through the filebrowser proxy or sftp
+	Login = "login"
+	// LoginFailed a login through the filebrowser proxy or sftp with bad credentials
+	LoginFailed = "login.failed"
+	// Download a file read over sftp
+	Download = "file.downloaded"
+
+	// DefaultLimit the number of entries a query returns by default
+	DefaultLimit = 100
+	// MaxLimit the most entries a query returns
+	MaxLimit = 1000
+	// pruneBatch the number of entries deleted per query
+	pruneBatch = 500
+)
+
+// Entry something done to an entity or its buckets
+type Entry struct {
+	ID   uint      `gorm:"primaryKey" json:"id"`
+	Time time.Time `gorm:"index;not null" json:"time"`
+	// Action what was done, an events.Type or Login
+	Action string `gorm:"not null" json:"action"`
+	// ActorType and ActorID who did it, empty if unknown, eg. filebrowser writes
+	ActorType string `json:"actor_type,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	// Username the filebrowser user of the logins
+	Username string `json:"username,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	// EntityType and EntityID the entity it was done to
+	EntityType string `gorm:"index:audit_entity_idx" json:"entity_type,omitempty"`
+	EntityID   string `gorm:"index:audit_entity_idx" json:"entity_id,omitempty"`
+	BucketID   string `json:"bucket_id,omitempty"`
+	Path       string `json:"path,omitempty"`
+	// Data the details of the action, eg. the size of a written file
+	Data metadata.Metadata `json:"data,omitempty"`
+}
+
+// TableName of the entries
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+// AutoMigrate creates the table of the entries
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Entry{})
+}
+
+// Log the audit trail stored in the database
+type Log struct {
+	db *gorm.DB
+}
+
+// New returns the audit log of the database
+func New(db *gorm.DB) *Log {
+	return &Log{db: db}
+}
+
+// Record appends the entry, its time is now if missing
+//
+// The logins are published as events.Login and events.LoginFailed too
+func (l *Log) Record(e *Entry) error {
+	if e.Action == "" {
+		return errs.New(errs.ErrInvalidOption, "Audit entry has no action")
+	}
+	if e.Time.IsZero() {
+		e.Time = clock.Now().UTC()
+	}
+	publishLogin(e)
+	e.ID = 0
+	err := l.db.Create(e).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// loginEvents the event types of the login actions
+var loginEvents = map[string]events.Type{
+	Login:       events.Login,
+	LoginFailed: events.LoginFailed,
+}
+
+// publishLogin publishes the entry if it's a login
+func publishLogin(e *Entry) {
+	t, ok := loginEvents[e.Action]
+	if !ok {
+		return
+	}
+	data := map[string]interface{}{"username": e.Username}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	events.Publish(&events.Event{
+		Type:       t,
+		Time:       e.Time,
+		EntityType: e.ActorType,
+		EntityID:   e.ActorID,
+		ActorType:  e.ActorType,
+		ActorID:    e.ActorID,
+		IP:         e.IP,
+		Data:       data,
+	})
+}
+
+// recorded the events which go in the audit log
+var recorded = map[events.Type]bool{
+	events.BucketCreated: true,
+	events.BucketDeleted: true,
+	events.FileWritten:   true,
+	events.FileDeleted:   true,
+	events.BucketShared:  true,
+}
+
+// Sink returns the event sink recording the bucket and file events
+func (l *Log) Sink() events.Sink {
+	return events.SinkFunc(func(e *events.Event) error {
+		if !recorded[e.Type] {
+			return nil
+		}
+		return l.Record(&Entry{
+			Time:       e.Time,
+			Action:     string(e.Type),
+			ActorType:  e.ActorType,
+			ActorID:    e.ActorID,
+			IP:         e.IP,
+			EntityType: e.EntityType,
+			EntityID:   e.EntityID,
+			BucketID:   e.BucketID,
+			Path:       e.Path,
+			Data:       e.Data,
+		})
+	})
+}
+
+// Filter the entries to query, zero values match everything
+type Filter struct {
+	EntityType string
+	EntityID   string
+	Action     string
+	Since      time.Time
+	Until      time.Time
+	// Before only the entries older than the one with this id, to page through them
+	Before uint
+	// Limit the number of entries, DefaultLimit if 0 and at most MaxLimit
+	Limit int
+}
+
+// Query returns the entries matching the filter, newest first
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	tx := l.db.Model(&Entry{})
+	if f.EntityType != "" {
+		tx = tx.Where("entity_type = ?", f.EntityType)
+	}
+	if f.EntityID != "" {
+		tx = tx.Where("entity_id = ?", f.EntityID)
+	}
+	if f.Action != "" {
+		tx = tx.Where("action = ?", f.Action)
+	}
+	if !f.Since.IsZero() {
+		tx = tx.Where("time >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		tx = tx.Where("time < ?", f.Until)
+	}
+	if f.Before > 0 {
+		tx = tx.Where("id < ?", f.Before)
+	}
+	if f.Limit <= 0 {
+		f.Limit = DefaultLimit
+	}
+	if f.Limit > MaxLimit {
+		f.Limit = MaxLimit
+	}
+	entries := []Entry{}
+	err := tx.Order("id DESC").Limit(f.Limit).Find(&entries).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return entries, nil
+}
+
+// Prune deletes the entries older than the retention, 0 keeps them forever
+//
+// Returns the number of entries deleted. Pass a pacer to keep it from
+// competing with production traffic, nil runs it flat out.
+func (l *Log) Prune(retention time.Duration, p *pace.Pacer) (int64, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := clock.Now().UTC().Add(-retention)
+	var total int64
+	for {
+		var ids []uint
+		err := p.Do(func() error {
+			return l.db.Model(&Entry{}).Where("time < ?", cutoff).Order("id").Limit(pruneBatch).Pluck("id", &ids).Error
+		})
+		if err != nil {
+			return total, errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		var n int64
+		err = p.Do(func() error {
+			tx := l.db.Where("id IN ?", ids).Delete(&Entry{})
+			n = tx.RowsAffected
+			return tx.Error
+		})
+		if err != nil {
+			return total, errs.Wrap(errs.ErrDatabase, err)
+		}
+		total += n
+	}
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+)
+
+// maxLoginBody the largest login request read for its username
+const maxLoginBody = 64 << 10
+
+// statusRecorder remembers the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// RemoteIP the ip of the request's remote address
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Logins returns a middleware recording the filebrowser logins
+//
+// loginPath is the path of the login endpoint, eg. browser.BaseURL+"/api/login"
+// and ip finds the client ip of the requests, nil for RemoteIP.
+// Use it with browser.Middleware
+func (l *Log) Logins(loginPath string, ip func(r *http.Request) string) func(http.Handler) http.Handler {
+	if ip == nil {
+		ip = RemoteIP
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != loginPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoginBody))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+			var creds struct {
+				Username string `json:"username"`
+			}
+			// filebrowser answers malformed logins itself
+			_ = json.Unmarshal(data, &creds)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			action := Login
+			if rec.status >= 400 {
+				action = LoginFailed
+			}
+			err = l.Record(&Entry{Action: action, Username: creds.Username, IP: ip(r)})
+			if err != nil {
+				log.Println("[f8][WARNING]: Failed to record the login of", creds.Username, err)
+			}
+		})
+	}
+}
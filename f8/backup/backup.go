@@ -0,0 +1,294 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	manifestName = "manifest.json"
+	dbDir        = "db"
+	filesDir     = "files"
+	// idFormat sorts lexically in creation order
+	idFormat = "20060102T150405.000000000Z"
+)
+
+// Kind the kind of a backup
+type Kind string
+
+const (
+	// Full a backup holding the contents of every file
+	Full Kind = "full"
+	// Incremental a backup holding only the files changed since its parent
+	//
+	// The unchanged files are referenced from the earlier backups of the chain
+	Incremental Kind = "incremental"
+)
+
+// DefaultTables the tables of the buckets saved in every backup
+var DefaultTables = []string{"buckets", "file_dirs", "grants", "tags", "temp_objects", "trash_items", "flags", "flag_overrides", "audit_log", "jobs", "usage_reports", "stats_days", "ssh_keys", "emails", "credentials"}
+
+// FileEntry a file of the storage directory at the time of the backup
+type FileEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	// Backup the id of the backup holding the contents of the file
+	Backup string `json:"backup"`
+}
+
+// Manifest describes a backup
+//
+// Files is the complete listing of the storage directory
+// even for incremental backups, keyed by the slash separated path
+type Manifest struct {
+	ID        string               `json:"id"`
+	Kind      Kind                 `json:"kind"`
+	Parent    string               `json:"parent,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	Tables    []string             `json:"tables"`
+	Files     map[string]FileEntry `json:"files"`
+}
+
+// Options for Create
+type Options struct {
+	// Incremental only copy the files changed since the latest backup
+	//
+	// A full backup is made if there are no backups yet
+	Incremental bool
+	// Tables the database tables to dump, default DefaultTables
+	//
+	// Add the entity tables of the application here
+	Tables []string
+}
+
+// Create backs up the database tables and the storage directory into a new
+// directory under root
+//
+// The backup is written to a temporary directory first
+// so an interrupted backup never shows up in List
+func Create(db *gorm.DB, storageDir, root string, opts Options) (*Manifest, error) {
+	if len(opts.Tables) == 0 {
+		opts.Tables = DefaultTables
+	}
+	now := time.Now().UTC()
+	m := &Manifest{
+		ID:        now.Format(idFormat),
+		Kind:      Full,
+		CreatedAt: now,
+		Tables:    opts.Tables,
+		Files:     map[string]FileEntry{},
+	}
+	var parent *Manifest
+	if opts.Incremental {
+		all, err := List(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) > 0 {
+			parent = all[len(all)-1]
+			m.Kind = Incremental
+			m.Parent = parent.ID
+		}
+	}
+
+	err := os.MkdirAll(root, 0766)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(root, ".tmp-"+m.ID)
+	err = os.MkdirAll(filepath.Join(tmp, dbDir), 0766)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = dumpTables(db, filepath.Join(tmp, dbDir), m.Tables)
+	if err != nil {
+		return nil, err
+	}
+	err = copyFiles(storageDir, root, tmp, m, parent)
+	if err != nil {
+		return nil, err
+	}
+	err = writeManifest(tmp, m)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, filepath.Join(root, m.ID))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dumpTables writes the rows of every table as a json array
+func dumpTables(db *gorm.DB, dir string, tables []string) error {
+	// a single transaction so the tables are consistent with each other
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range tables {
+			rows := []map[string]interface{}{}
+			err := tx.Table(table).Find(&rows).Error
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				for k, v := range row {
+					if b, ok := v.([]byte); ok {
+						// eg. postgres jsonb, would be base64 encoded otherwise
+						row[k] = string(b)
+					}
+				}
+			}
+			b, err := json.Marshal(rows)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, table+".json"), b, 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// copyFiles copies the files of the storage directory changed since the parent
+func copyFiles(storageDir, root, dest string, m *Manifest, parent *Manifest) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(storageDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if abs, _ := filepath.Abs(name); abs == absRoot {
+				// backups kept inside the storage directory
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(storageDir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if parent != nil {
+			prev, ok := parent.Files[rel]
+			if ok && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime().UTC()) {
+				m.Files[rel] = prev
+				return nil
+			}
+		}
+		sum, err := copyFile(name, filepath.Join(dest, filesDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		m.Files[rel] = FileEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			SHA256:  sum,
+			Backup:  m.ID,
+		}
+		return nil
+	})
+}
+
+// copyFile copies src to dst and returns the hex sha256 of the contents
+func copyFile(src, dst string) (string, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0766)
+	if err != nil {
+		return "", err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, manifestName), b, 0644)
+}
+
+// Load reads the manifest of a backup
+func Load(root, id string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(root, id, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID != id {
+		return nil, errors.New("Manifest id doesn't match the backup directory " + id)
+	}
+	return m, nil
+}
+
+// List returns the backups under root, oldest first
+//
+// Directories starting with a dot are unfinished backups or being pruned
+func List(root string) ([]*Manifest, error) {
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ms := []*Manifest{}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		m, err := Load(root, info.Name())
+		if os.IsNotExist(err) {
+			// not a backup
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].ID < ms[j].ID
+	})
+	return ms, nil
+}
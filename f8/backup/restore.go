@@ -0,0 +1,205 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	// restoreBatch rows inserted per statement
+	restoreBatch = 100
+)
+
+var (
+	// ErrNotEmpty restoring would overwrite existing data
+	ErrNotEmpty = errors.New("Restore target is not empty")
+	// ErrCorrupt a file of the backup doesn't match its checksum
+	ErrCorrupt = errors.New("Backup file is corrupt")
+)
+
+// RestoreOptions for Restore and Drill
+type RestoreOptions struct {
+	// Migrate creates the schema of the tables before restoring the rows
+	//
+	// Drill defaults to buckets.AutoMigrate,
+	// tables without a schema are skipped
+	Migrate func(db *gorm.DB) error
+}
+
+// RestoreReport what a Restore wrote
+type RestoreReport struct {
+	Backup string `json:"backup"`
+	// Rows the number of rows restored per table
+	Rows map[string]int `json:"rows"`
+	// Skipped the tables missing in the target database
+	Skipped []string `json:"skipped"`
+	Files   int      `json:"files"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// Latest returns the id of the newest backup under root
+func Latest(root string) (string, error) {
+	ms, err := List(root)
+	if err != nil {
+		return "", err
+	}
+	if len(ms) == 0 {
+		return "", errors.New("No backups in " + root)
+	}
+	return ms[len(ms)-1].ID, nil
+}
+
+// Restore restores the backup id into an empty database and storage directory
+//
+// The contents of every file are checked against the manifest checksums
+func Restore(db *gorm.DB, storageDir, root, id string, opts RestoreOptions) (*RestoreReport, error) {
+	m, err := Load(root, id)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(storageDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(infos) > 0 {
+		return nil, ErrNotEmpty
+	}
+	if opts.Migrate != nil {
+		err = opts.Migrate(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	report := &RestoreReport{Backup: m.ID, Rows: map[string]int{}, Skipped: []string{}}
+	err = restoreTables(db, filepath.Join(root, m.ID, dbDir), m.Tables, report)
+	if err != nil {
+		return nil, err
+	}
+	for rel, f := range m.Files {
+		src := filepath.Join(root, f.Backup, filesDir, filepath.FromSlash(rel))
+		dst := filepath.Join(storageDir, filepath.FromSlash(rel))
+		sum, err := copyFile(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		if sum != f.SHA256 {
+			return nil, fmt.Errorf("%w %s %s", ErrCorrupt, f.Backup, rel)
+		}
+		err = os.Chtimes(dst, f.ModTime, f.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		report.Files++
+		report.Bytes += f.Size
+	}
+	return report, nil
+}
+
+// restoreTables inserts the dumped rows in a single transaction
+func restoreTables(db *gorm.DB, dir string, tables []string, report *RestoreReport) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range tables {
+			if !tx.Migrator().HasTable(table) {
+				report.Skipped = append(report.Skipped, table)
+				continue
+			}
+			var count int64
+			err := tx.Table(table).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("%w %s", ErrNotEmpty, table)
+			}
+			f, err := os.Open(filepath.Join(dir, table+".json"))
+			if err != nil {
+				return err
+			}
+			rows := []map[string]interface{}{}
+			dec := json.NewDecoder(f)
+			// keep the integers exact
+			dec.UseNumber()
+			err = dec.Decode(&rows)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(rows); i += restoreBatch {
+				end := i + restoreBatch
+				if end > len(rows) {
+					end = len(rows)
+				}
+				batch := rows[i:end]
+				err = tx.Table(table).Create(&batch).Error
+				if err != nil {
+					return err
+				}
+			}
+			report.Rows[table] = len(rows)
+		}
+		return nil
+	})
+}
+
+// DrillReport the result of a Drill
+type DrillReport struct {
+	Restore *RestoreReport      `json:"restore"`
+	Fsck    *buckets.FsckReport `json:"fsck"`
+	Took    time.Duration       `json:"took"`
+}
+
+// OK whether the backup restored cleanly
+func (r *DrillReport) OK() bool {
+	return r.Restore != nil && r.Fsck != nil && r.Fsck.OK()
+}
+
+// Drill restores the backup id into a throwaway sqlite database and storage
+// directory and checks the result with buckets.Fsck
+//
+// The production database and storage are never touched,
+// everything is deleted once the drill is over
+func Drill(root, id string, opts RestoreOptions) (*DrillReport, error) {
+	start := time.Now()
+	if opts.Migrate == nil {
+		opts.Migrate = buckets.AutoMigrate
+	}
+	tmp, err := ioutil.TempDir("", "fate-drill-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(tmp, "drill.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+
+	storageDir := filepath.Join(tmp, "storage")
+	report := &DrillReport{}
+	report.Restore, err = Restore(db, storageDir, root, id, opts)
+	if err != nil {
+		return nil, err
+	}
+	report.Fsck, err = buckets.Fsck(db, storageDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	report.Took = time.Since(start)
+	return report, nil
+}
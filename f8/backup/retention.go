@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Policy how many backups to keep, the rest expire
+//
+// Only the newest backup of a day, week or month counts for that period.
+// Backups an unexpired incremental backup depends on are always kept.
+type Policy struct {
+	// KeepLast the number of most recent backups to keep
+	KeepLast int
+	// KeepDaily the number of days to keep a backup for
+	KeepDaily int
+	// KeepWeekly the number of ISO weeks to keep a backup for
+	KeepWeekly int
+	// KeepMonthly the number of months to keep a backup for
+	KeepMonthly int
+}
+
+// ErrKeepsNothing a policy that would expire every backup
+var ErrKeepsNothing = errors.New("Retention policy keeps no backups")
+
+// PruneReport what Prune deleted or would delete
+type PruneReport struct {
+	// Kept the backups kept by the policy
+	Kept []string
+	// Referenced the expired backups kept because a kept backup depends on them
+	Referenced []string
+	// Removed the deleted backups
+	Removed []string
+	// DryRun nothing was deleted
+	DryRun bool
+}
+
+// keep returns the ids of the backups the policy keeps
+//
+// ms must be sorted oldest first like List returns them
+func (p Policy) keep(ms []*Manifest) map[string]bool {
+	kept := map[string]bool{}
+	periods := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{p.KeepLast, func(t time.Time) string { return t.Format(idFormat) }},
+		{p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return strconv.Itoa(y) + "-W" + strconv.Itoa(w)
+		}},
+		{p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		seen := map[string]bool{}
+		for i := len(ms) - 1; i >= 0 && len(seen) < period.n; i-- {
+			key := period.key(ms[i].CreatedAt.UTC())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept[ms[i].ID] = true
+		}
+	}
+	return kept
+}
+
+// dependencies returns the backups holding files of m or its parent chain
+func dependencies(m *Manifest) []string {
+	deps := []string{}
+	if m.Parent != "" {
+		deps = append(deps, m.Parent)
+	}
+	for _, f := range m.Files {
+		if f.Backup != m.ID {
+			deps = append(deps, f.Backup)
+		}
+	}
+	return deps
+}
+
+// Prune deletes the backups under root expired by the policy
+//
+// Pass dryRun to only report what would be deleted.
+// A backup is first renamed out of the way and then deleted
+// so an interrupted prune leaves no half deleted backups behind.
+func Prune(root string, p Policy, dryRun bool) (*PruneReport, error) {
+	if p.KeepLast <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0 {
+		return nil, ErrKeepsNothing
+	}
+	ms, err := List(root)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*Manifest{}
+	for _, m := range ms {
+		byID[m.ID] = m
+	}
+	report := &PruneReport{Kept: []string{}, Referenced: []string{}, Removed: []string{}, DryRun: dryRun}
+	kept := p.keep(ms)
+	// walk the chains of the kept backups
+	needed := map[string]bool{}
+	queue := []string{}
+	for id := range kept {
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if needed[id] {
+			continue
+		}
+		needed[id] = true
+		m, ok := byID[id]
+		if !ok {
+			return nil, errors.New("Backup " + id + " is referenced but missing, refusing to prune")
+		}
+		queue = append(queue, dependencies(m)...)
+	}
+
+	for _, m := range ms {
+		switch {
+		case kept[m.ID]:
+			report.Kept = append(report.Kept, m.ID)
+		case needed[m.ID]:
+			report.Referenced = append(report.Referenced, m.ID)
+		default:
+			report.Removed = append(report.Removed, m.ID)
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	// leftovers of an interrupted prune
+	leftovers, err := filepath.Glob(filepath.Join(root, ".prune-*"))
+	if err != nil {
+		return report, err
+	}
+	for _, name := range leftovers {
+		err = os.RemoveAll(name)
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, id := range report.Removed {
+		trash := filepath.Join(root, ".prune-"+id)
+		err = os.Rename(filepath.Join(root, id), trash)
+		if err != nil {
+			return report, err
+		}
+		err = os.RemoveAll(trash)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -1,43 +1,109 @@
 package browser
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"sync"
 
 	"github.com/asdine/storm"
 	"github.com/filebrowser/filebrowser/v2/auth"
 	"github.com/filebrowser/filebrowser/v2/diskcache"
+	fberrors "github.com/filebrowser/filebrowser/v2/errors"
 	fbhttp "github.com/filebrowser/filebrowser/v2/http"
 	"github.com/filebrowser/filebrowser/v2/img"
 	"github.com/filebrowser/filebrowser/v2/settings"
 	"github.com/filebrowser/filebrowser/v2/storage"
 	"github.com/filebrowser/filebrowser/v2/storage/bolt"
 	"github.com/filebrowser/filebrowser/v2/users"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/httpserver"
+	"github.com/phanirithvij/fate/f8/metrics"
+	"github.com/phanirithvij/fate/f8/roles"
 )
 
 const (
+	// BaseURL the path under which filebrowser is served
+	BaseURL = fbBaseURL
 	// TODO arg
 	fbBaseURL  = "/admin"
 	fbDBPath   = "filebrowser.db"
 	serverPort = "3000"
 )
 
+// Option is a functional option to StartBrowser
+type Option func(*options)
+type options struct {
+	routes      []*route
+	middlewares []func(http.Handler) http.Handler
+	server      httpserver.Options
+	proxyHeader string
+	roleOf      RoleFunc
+}
+
+// RoleFunc returns the role of the user logging in through the proxy
+type RoleFunc func(username string) (roles.Role, error)
+
+// Handle option serves the handler for the paths matching the pattern
+//
+// These are matched before the filebrowser routes
+func Handle(pattern string, handler http.Handler) Option {
+	return func(o *options) {
+		o.routes = append(o.routes, &route{regexp.MustCompile(pattern), handler})
+	}
+}
+
+// Middleware option wraps the filebrowser handler
+//
+// Middlewares are applied in order so the first one sees the request first,
+// they can find the filebrowser user of the request with SessionUser
+func Middleware(mw func(http.Handler) http.Handler) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, mw)
+	}
+}
+
+// Server option sets the timeouts and the slow client limits of the server
+func Server(opts httpserver.Options) Option {
+	return func(o *options) {
+		o.server = opts
+	}
+}
+
+// ProxyAuth option logs the requests in as the user named in the header
+//
+// The middlewares setting the header must drop the one sent by the clients,
+// the users missing in filebrowser are created on their first request
+func ProxyAuth(header string) Option {
+	return func(o *options) {
+		o.proxyHeader = header
+	}
+}
+
+// Roles option gives the users logging in through the proxy the permissions of their roles
+//
+// Admins can manage everything and see every bucket, read-only users can
+// only download, the others get the default permissions. Without it every
+// user has the default permissions
+func Roles(roleOf RoleFunc) Option {
+	return func(o *options) {
+		o.roleOf = roleOf
+	}
+}
+
 type pythonData struct {
 	hadDB bool
 	store *storage.Storage
 }
 
-func checkError(err error) {
+func quickSetup(d *pythonData, root string) error {
+	k, err := settings.GenerateKey()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-}
-
-func quickSetup(d *pythonData) {
-	k, err := settings.GenerateKey()
-	checkError(err)
 
 	set := &settings.Settings{
 		AuthMethod:    auth.MethodJSONAuth,
@@ -61,35 +127,41 @@ func quickSetup(d *pythonData) {
 		},
 	}
 	err = d.store.Auth.Save(&auth.JSONAuth{})
-	checkError(err)
+	if err != nil {
+		return err
+	}
 
 	err = d.store.Settings.Save(set)
-	checkError(err)
-
-	// TODO arg
-	wd, err := os.Getwd()
-	checkError(err)
+	if err != nil {
+		return err
+	}
 
+	// the entity layout keeps the buckets as
+	// <root>/<entity_type>/<entity_id>/<bucket> so users see their files
 	ser := &settings.Server{
 		BaseURL: fbBaseURL,
 		Port:    serverPort,
 		Log:     "stdout",
 		Address: "127.0.0.1",
-		Root:    wd,
+		Root:    root,
 	}
 
 	err = d.store.Settings.SaveServer(ser)
-	checkError(err)
+	if err != nil {
+		return err
+	}
 	username := "admin"
 	password := ""
 
 	if password == "" {
 		password, err = users.HashPwd("admin")
-		checkError(err)
+		if err != nil {
+			return err
+		}
 	}
 
 	if username == "" || password == "" {
-		log.Fatal("username and password cannot be empty during quick setup")
+		return errors.New("username and password cannot be empty during quick setup")
 	}
 
 	user := &users.User{
@@ -101,8 +173,125 @@ func quickSetup(d *pythonData) {
 	set.Defaults.Apply(user)
 	user.Perm.Admin = true
 
-	err = d.store.Users.Save(user)
-	checkError(err)
+	return d.store.Users.Save(user)
+}
+
+// useProxyAuth switches filebrowser to the proxy auth of the header
+func useProxyAuth(d *pythonData, header string) error {
+	set, err := d.store.Settings.Get()
+	if err != nil {
+		return err
+	}
+	err = d.store.Auth.Save(&auth.ProxyAuth{Header: header})
+	if err != nil {
+		return err
+	}
+	set.AuthMethod = auth.MethodProxyAuth
+	set.Signup = false
+	return d.store.Settings.Save(set)
+}
+
+// useJSONAuth switches filebrowser back to its own logins if a previous run used the proxy auth
+func useJSONAuth(d *pythonData) error {
+	set, err := d.store.Settings.Get()
+	if err != nil {
+		return err
+	}
+	if set.AuthMethod != auth.MethodProxyAuth {
+		return nil
+	}
+	err = d.store.Auth.Save(&auth.JSONAuth{})
+	if err != nil {
+		return err
+	}
+	// as quickSetup left them
+	set.AuthMethod = auth.MethodJSONAuth
+	set.Signup = true
+	return d.store.Settings.Save(set)
+}
+
+// proxyUsers creates the filebrowser users of the header on their first request
+// and keeps their permissions in line with their roles
+func proxyUsers(d *pythonData, server *settings.Server, header string, roleOf RoleFunc, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get(header)
+		if username != "" {
+			role := roles.User
+			var err error
+			if roleOf != nil {
+				role, err = roleOf(username)
+			}
+			if err == nil && !role.CanLogIn() {
+				http.Error(w, errs.ErrDisabled.Error(), http.StatusForbidden)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				err = syncUser(d, server, username, role)
+				mu.Unlock()
+			}
+			if err != nil {
+				log.Println("[f8][WARNING]: Failed to sync the filebrowser user", username, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// syncUser creates the filebrowser user if it's missing and gives it the permissions of the role
+//
+// Its password is random, it only logs in through the proxy
+func syncUser(d *pythonData, server *settings.Server, username string, role roles.Role) error {
+	user, err := d.store.Users.Get(server.Root, username)
+	if err != nil && err != fberrors.ErrNotExist {
+		return err
+	}
+	set, err := d.store.Settings.Get()
+	if err != nil {
+		return err
+	}
+	created := user == nil
+	if created {
+		user = &users.User{Username: username, LockPassword: true}
+		set.Defaults.Apply(user)
+		key, err := settings.GenerateKey()
+		if err != nil {
+			return err
+		}
+		user.Password, err = users.HashPwd(string(key))
+		if err != nil {
+			return err
+		}
+	}
+	perm := set.Defaults.Perm
+	switch role {
+	case roles.Admin:
+		perm = users.Permissions{Admin: true, Execute: true, Create: true, Rename: true, Modify: true, Delete: true, Share: true, Download: true}
+	case roles.ReadOnly:
+		perm = users.Permissions{Download: true}
+	}
+	if !created && user.Perm == perm && (role == roles.Admin) == (user.Scope == ".") {
+		return nil
+	}
+	user.Perm = perm
+	if role == roles.Admin {
+		// the admins see every entity's buckets
+		user.Scope = "."
+	} else {
+		user.Scope, err = set.MakeUserDir(user.Username, set.Defaults.Scope, server.Root)
+		if err != nil {
+			return err
+		}
+	}
+	if created {
+		log.Println("[f8][browser]: Created the filebrowser user", username, "as", role)
+		return d.store.Users.Save(user)
+	}
+	log.Println("[f8][browser]: Made the filebrowser user", username, role)
+	return d.store.Users.Update(user, "Perm", "Scope")
 }
 
 func otherRoutes(w http.ResponseWriter, req *http.Request) {
@@ -110,7 +299,13 @@ func otherRoutes(w http.ResponseWriter, req *http.Request) {
 }
 
 // StartBrowser starts the filebrowser instance
-func StartBrowser(dirname string) {
+//
+// Blocks until the server fails
+func StartBrowser(dirname string, opts ...Option) error {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	log.SetOutput(os.Stdout)
 	d := &pythonData{hadDB: true}
 
@@ -121,24 +316,53 @@ func StartBrowser(dirname string) {
 	}
 
 	db, err := storm.Open(fbDBPath)
-	checkError(err)
+	if err != nil {
+		return err
+	}
 	defer db.Close()
 
 	d.store, err = bolt.NewStorage(db)
-	checkError(err)
+	if err != nil {
+		return err
+	}
 
 	if !d.hadDB {
-		quickSetup(d)
+		err = quickSetup(d, dirname)
+		if err != nil {
+			return err
+		}
 	}
 
 	var fileCache diskcache.Interface = diskcache.NewNoOp()
 	server, err := d.store.Settings.GetServer()
-	checkError(err)
+	if err != nil {
+		return err
+	}
 
-	handler, err := fbhttp.NewHandler(img.New(4), fileCache, d.store, server)
-	checkError(err)
+	if o.proxyHeader != "" {
+		err = useProxyAuth(d, o.proxyHeader)
+	} else {
+		// anyone could send the header once nothing strips it
+		err = useJSONAuth(d)
+	}
+	if err != nil {
+		return err
+	}
+
+	var handler http.Handler
+	handler, err = fbhttp.NewHandler(img.New(4), fileCache, d.store, server)
+	if err != nil {
+		return err
+	}
+	if o.proxyHeader != "" {
+		handler = proxyUsers(d, server, o.proxyHeader, o.roleOf, handler)
+	}
+	for i := len(o.middlewares) - 1; i >= 0; i-- {
+		handler = o.middlewares[i](handler)
+	}
+	handler = withSession(d.store, server, handler)
 
-	reg := &RegexpHandler{}
+	reg := &RegexpHandler{routes: o.routes}
 	reg.Handler(fbBaseURL, handler)
 	reg.HandleFunc("/", otherRoutes)
 	PORT := os.Getenv("PORT")
@@ -146,6 +370,5 @@ func StartBrowser(dirname string) {
 		PORT = serverPort
 	}
 	log.Println("Running on port", PORT)
-	err = http.ListenAndServe(":"+PORT, reg)
-	checkError(err)
+	return httpserver.ListenAndServe(":"+PORT, metrics.Middleware(reg, reg.Route), o.server)
 }
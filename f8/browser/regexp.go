@@ -25,6 +25,16 @@ func (h *RegexpHandler) HandleFunc(pattern string, handler func(http.ResponseWri
 	h.routes = append(h.routes, &route{regexp.MustCompile(pattern), http.HandlerFunc(handler)})
 }
 
+// Route returns the pattern of the route matching the request, empty if none does
+func (h *RegexpHandler) Route(r *http.Request) string {
+	for _, route := range h.routes {
+		if route.pattern.MatchString(r.URL.Path) {
+			return route.pattern.String()
+		}
+	}
+	return ""
+}
+
 func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, route := range h.routes {
 		if route.pattern.MatchString(r.URL.Path) {
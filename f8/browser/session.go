@@ -0,0 +1,110 @@
+package browser
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	fberrors "github.com/filebrowser/filebrowser/v2/errors"
+	"github.com/filebrowser/filebrowser/v2/settings"
+	"github.com/filebrowser/filebrowser/v2/storage"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// User the filebrowser user of a session
+type User struct {
+	Username string
+	// Scope the directory the user sees as a slash path relative to the
+	// storage directory, eg. /users/alice, / for all of it
+	Scope string
+	// Admin whether the user has the filebrowser admin permission
+	Admin bool
+}
+
+type sessionKey struct{}
+
+// session what's needed to find the user of a filebrowser session
+type session struct {
+	store  *storage.Storage
+	server *settings.Server
+}
+
+// withSession lets the middlewares of the requests find their filebrowser user, see SessionUser
+func withSession(store *storage.Storage, server *settings.Server, next http.Handler) http.Handler {
+	s := &session{store: store, server: server}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	})
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of the context whose requests are the user's, eg. to test a middleware
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// SessionUser returns the filebrowser user of the request's token, nil without one
+//
+// The token is the one filebrowser checks, sent in the X-Auth header or
+// the auth query parameter. Only the middlewares of StartBrowser can find
+// it, an invalid or expired one is errs.ErrUnauthenticated.
+func SessionUser(r *http.Request) (*User, error) {
+	if u, ok := r.Context().Value(userKey{}).(*User); ok {
+		return u, nil
+	}
+	s, _ := r.Context().Value(sessionKey{}).(*session)
+	if s == nil {
+		return nil, nil
+	}
+	token := r.Header.Get("X-Auth")
+	if strings.Count(token, ".") != 2 {
+		token = r.URL.Query().Get("auth")
+	}
+	if token == "" {
+		return nil, nil
+	}
+	set, err := s.store.Settings.Get()
+	if err != nil {
+		return nil, err
+	}
+	claims := &sessionClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{"HS256"}}
+	_, err = parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return set.Key, nil
+	})
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrUnauthenticated, err)
+	}
+	u, err := s.store.Users.Get(s.server.Root, claims.User.ID)
+	if err == fberrors.ErrNotExist {
+		return nil, errs.ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &User{Username: u.Username, Scope: relScope(s.server.Root, u.Scope), Admin: u.Perm.Admin}, nil
+}
+
+// sessionClaims the claims of the filebrowser tokens
+type sessionClaims struct {
+	User struct {
+		ID uint `json:"id"`
+	} `json:"user"`
+	jwt.RegisteredClaims
+}
+
+// relScope the scope of a filebrowser user relative to the root, outside of it is an empty path
+func relScope(root, scope string) string {
+	if !filepath.IsAbs(scope) {
+		scope = filepath.Join(root, scope)
+	}
+	rel, err := filepath.Rel(root, scope)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
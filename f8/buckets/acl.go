@@ -0,0 +1,218 @@
+package buckets
+
+import (
+	"errors"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/roles"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrForbidden the actor is not allowed to access the bucket
+	ErrForbidden = errs.ErrForbidden
+)
+
+// Visibility who besides the owner can access a bucket
+type Visibility string
+
+const (
+	// Private only the owner can access the bucket
+	Private Visibility = "private"
+	// Shared the owner and the entities granted access
+	Shared Visibility = "shared"
+	// PublicRead anyone can read, the entities granted access can also write
+	PublicRead Visibility = "public-read"
+)
+
+// Role the access granted to an entity on a bucket
+type Role string
+
+const (
+	// Reader can read the files of the bucket
+	Reader Role = "read"
+	// Writer can read and write the files of the bucket
+	Writer Role = "write"
+)
+
+// allows whether the role includes the permissions of want
+func (r Role) allows(want Role) bool {
+	return r == want || r == Writer
+}
+
+// Actor the entity accessing a bucket
+type Actor struct {
+	ID   string
+	Type string
+	// Tenant the tenant the actor belongs to, empty for none
+	Tenant string
+	// Role of the entity, empty is a roles.User
+	Role roles.Role
+}
+
+// IsAdmin whether the actor is an admin
+func (a *Actor) IsAdmin() bool {
+	return a != nil && a.Role == roles.Admin
+}
+
+// Grant access to a bucket granted to an entity other than its owner
+type Grant struct {
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	BucketID   string `gorm:"primaryKey"`
+	EntityID   string `gorm:"primaryKey"`
+	EntityType string `gorm:"primaryKey"`
+	// GranteeID and GranteeType the entity the access is granted to
+	GranteeID   string `gorm:"primaryKey;index:grantee_idx"`
+	GranteeType string `gorm:"primaryKey;index:grantee_idx"`
+	Role        Role   `gorm:"not null"`
+}
+
+// IsOwner whether the actor owns the bucket
+func (b *Bucket) IsOwner(actor *Actor) bool {
+	return actor != nil && actor.ID == b.EntityID && actor.Type == b.EntityType
+}
+
+// SetVisibility changes who can access the bucket
+func (b *Bucket) SetVisibility(v Visibility) error {
+	switch v {
+	case Private, Shared, PublicRead:
+	default:
+		return errs.New(errs.ErrInvalidOption, "Unknown visibility "+string(v))
+	}
+	tx := b.pk().UpdateColumn("visibility", v)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	Forget(b)
+	b.Visibility = v
+	return nil
+}
+
+// Grant grants the role on the bucket to an entity
+//
+// Granting access on a private bucket makes it shared
+func (b *Bucket) Grant(grantee *Actor, role Role) error {
+	if role != Reader && role != Writer {
+		return errs.New(errs.ErrInvalidOption, "Unknown role "+string(role))
+	}
+	if b.IsOwner(grantee) {
+		return errs.New(errs.ErrInvalidOption, "Owner of the bucket cannot be granted access")
+	}
+	g := &Grant{
+		BucketID:    b.ID,
+		EntityID:    b.EntityID,
+		EntityType:  b.EntityType,
+		GranteeID:   grantee.ID,
+		GranteeType: grantee.Type,
+		Role:        role,
+	}
+	tx := b.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "bucket_id"}, {Name: "entity_id"}, {Name: "entity_type"},
+			{Name: "grantee_id"}, {Name: "grantee_type"},
+		},
+		DoUpdates: clause.AssignmentColumns([]string{"role", "updated_at"}),
+	}).Create(g)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	b.publish(events.BucketShared, "", map[string]interface{}{
+		"grantee_type": grantee.Type,
+		"grantee_id":   grantee.ID,
+		"role":         string(role),
+	})
+	if b.Visibility == "" || b.Visibility == Private {
+		return b.SetVisibility(Shared)
+	}
+	return nil
+}
+
+// Revoke revokes all access granted on the bucket to an entity
+func (b *Bucket) Revoke(grantee *Actor) error {
+	tx := b.db.Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ? AND grantee_id = ? AND grantee_type = ?",
+		b.ID, b.EntityID, b.EntityType, grantee.ID, grantee.Type,
+	).Delete(&Grant{})
+	return errs.Wrap(errs.ErrDatabase, tx.Error)
+}
+
+// Grants returns the access granted on the bucket
+func (b *Bucket) Grants() (grants []Grant, err error) {
+	tx := b.db.Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ?",
+		b.ID, b.EntityID, b.EntityType,
+	).Find(&grants)
+	return grants, errs.Wrap(errs.ErrDatabase, tx.Error)
+}
+
+// Authorize checks if the actor has the role on the bucket
+//
+// A nil actor is an anonymous one which can only read public buckets.
+// Admins can access every bucket, read-only actors can't write any
+// and disabled ones can't access any, not even their own
+func (b *Bucket) Authorize(actor *Actor, want Role) error {
+	if actor != nil && !actor.Role.CanLogIn() {
+		return errs.ErrDisabled
+	}
+	if actor != nil && !actor.Role.CanWrite() && want != Reader {
+		return errs.New(errs.ErrForbidden, "Read-only actors can't change buckets")
+	}
+	if b.IsOwner(actor) || actor.IsAdmin() {
+		return nil
+	}
+	if b.Visibility == PublicRead && want == Reader {
+		return nil
+	}
+	if actor == nil || b.Visibility == "" || b.Visibility == Private {
+		return ErrForbidden
+	}
+	g := &Grant{}
+	tx := b.db.Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ? AND grantee_id = ? AND grantee_type = ?",
+		b.ID, b.EntityID, b.EntityType, actor.ID, actor.Type,
+	).First(g)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return ErrForbidden
+	}
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if !g.Role.allows(want) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// FindFor returns an entity's bucket if the actor has the role on it
+func FindFor(db *gorm.DB, actor *Actor, entityType, entityID, bID string, want Role) (*Bucket, error) {
+	b, err := Find(db, entityType, entityID, bID)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Authorize(actor, want)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SharedWith returns the buckets of other entities the actor was granted access to
+func SharedWith(db *gorm.DB, actor *Actor) (bucks []*Bucket, err error) {
+	tx := db.Joins(
+		"JOIN grants ON grants.bucket_id = buckets.id AND grants.entity_id = buckets.entity_id AND grants.entity_type = buckets.entity_type",
+	).Where(
+		"grants.grantee_id = ? AND grants.grantee_type = ? AND buckets.visibility <> ?",
+		actor.ID, actor.Type, Private,
+	).Find(&bucks)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	for _, b := range bucks {
+		b.AttatchDB(db)
+	}
+	return bucks, nil
+}
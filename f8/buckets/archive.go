@@ -0,0 +1,428 @@
+package buckets
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/workers"
+)
+
+// ArchiveFormat the format of a bucket archive
+type ArchiveFormat string
+
+const (
+	// Zip a zip archive
+	Zip ArchiveFormat = "zip"
+	// Tar an uncompressed tar archive
+	Tar ArchiveFormat = "tar"
+	// TarGz a gzip compressed tar archive
+	TarGz ArchiveFormat = "tar.gz"
+)
+
+// ExportArchive writes the whole bucket to w as an archive of the given format
+//
+// The archive is streamed directly from the bucket's files
+// so no temporary files are created. The links follow the bucket's
+// LinkPolicy, preserved they're the archive's symlinks and hard links.
+func (b *Bucket) ExportArchive(w io.Writer, format ArchiveFormat) error {
+	return b.ExportArchiveContext(context.Background(), w, format, workers.Options{})
+}
+
+// ExportArchiveContext is ExportArchive reading the next files with workers
+// while the current one is written, see Concurrency
+//
+// opts.Progress counts the entries written. Once ctx is done the export
+// stops and returns its error, the archive is left incomplete.
+func (b *Bucket) ExportArchiveContext(ctx context.Context, w io.Writer, format ArchiveFormat, opts workers.Options) error {
+	switch format {
+	case Zip, Tar, TarGz:
+	default:
+		return errs.New(errs.ErrInvalidOption, "Unknown archive format "+string(format))
+	}
+	fdirs, err := b.Files()
+	if err != nil {
+		return err
+	}
+	fdirs = b.exportable(fdirs)
+	entries := workers.Map(ctx, withConcurrency(opts), fdirs, b.openEntry)
+	defer entries.Close()
+	switch format {
+	case Zip:
+		return b.exportZip(w, entries)
+	case Tar:
+		return b.exportTar(w, entries)
+	default:
+		gw := gzip.NewWriter(w)
+		err = b.exportTar(gw, entries)
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+}
+
+// archiveEntry a file or directory of an export, the contents of a file prefetched
+type archiveEntry struct {
+	fdir FileDir
+	body *prefetched
+}
+
+// openEntry opens the contents of a file to export
+func (b *Bucket) openEntry(ctx context.Context, fdir FileDir) (*archiveEntry, error) {
+	e := &archiveEntry{fdir: fdir}
+	if fdir.IsDir || fdir.IsSymlink() {
+		return e, nil
+	}
+	f, err := b.Open(fdir.Path)
+	if err != nil {
+		return nil, err
+	}
+	e.body, err = prefetch(f, fdir.Size)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	return e, nil
+}
+
+// Close closes the contents of the entry
+func (e *archiveEntry) Close() error {
+	if e.body == nil {
+		return nil
+	}
+	return e.body.Close()
+}
+
+// ExportBucket the hidden bucket of an entity holding the archives exported in the background
+const ExportBucket = ".exports"
+
+// ExportArchiveFile exports the bucket into a file of the ExportBucket
+//
+// The file is named after the bucket and the format, a previous export
+// of the bucket is replaced. Open it with the returned export bucket.
+// Once ctx is done the export stops, the previous one is kept.
+func (b *Bucket) ExportArchiveFile(ctx context.Context, format ArchiveFormat) (*Bucket, *FileDir, error) {
+	switch format {
+	case Zip, Tar, TarGz:
+	default:
+		return nil, nil, errs.New(errs.ErrInvalidOption, "Unknown archive format "+string(format))
+	}
+	exports, err := b.derived(ExportBucket)
+	if err != nil {
+		return nil, nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(b.ExportArchiveContext(ctx, pw, format, workers.Options{}))
+	}()
+	fdir, err := exports.WriteFile(b.ID+"."+string(format), pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exports, fdir, nil
+}
+
+// exportable the rows to export following the link policy
+//
+// The symlinks the bucket follows are exported as the files they point to,
+// the ones it rejects and the ones pointing to nothing or a directory are left out
+func (b *Bucket) exportable(fdirs []FileDir) []FileDir {
+	policy := b.LinkPolicy()
+	out := fdirs[:0]
+	for _, fdir := range fdirs {
+		switch {
+		case !fdir.IsSymlink():
+			if policy != LinksPreserve {
+				fdir.LinkType, fdir.LinkTarget = "", ""
+			}
+		case policy == LinksReject:
+			continue
+		case policy == LinksFollow:
+			target, err := b.follow(&fdir)
+			if err != nil || target.IsDir {
+				continue
+			}
+			fdir.Size, fdir.Mode, fdir.ModTime = target.Size, target.Mode, target.ModTime
+			fdir.LinkType, fdir.LinkTarget = "", ""
+		}
+		out = append(out, fdir)
+	}
+	return out
+}
+
+func (b *Bucket) exportZip(w io.Writer, entries *workers.Results[*archiveEntry]) error {
+	zw := zip.NewWriter(w)
+	for {
+		e, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = writeZipEntry(zw, e)
+		e.Close()
+		if err != nil {
+			return err
+		}
+		entries.Done(e.fdir.Size)
+	}
+	return zw.Close()
+}
+
+// writeZipEntry writes a file or directory to the zip archive
+func writeZipEntry(zw *zip.Writer, e *archiveEntry) error {
+	fdir := e.fdir
+	hdr := &zip.FileHeader{
+		Name:     fdir.Path,
+		Modified: fdir.ModTime,
+		Method:   zip.Deflate,
+	}
+	hdr.SetMode(fdir.Mode)
+	if fdir.IsDir {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+		hdr.SetMode(os.ModeDir | fdir.Mode.Perm())
+	}
+	if fdir.IsSymlink() {
+		// the target is the contents of a zip symlink
+		hdr.Method = zip.Store
+		hdr.SetMode(os.ModeSymlink | 0777)
+	}
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fdir.IsDir:
+		return nil
+	case fdir.IsSymlink():
+		_, err = io.WriteString(fw, fdir.RelTarget())
+		return err
+	}
+	_, err = io.Copy(fw, e.body)
+	return err
+}
+
+func (b *Bucket) exportTar(w io.Writer, entries *workers.Results[*archiveEntry]) error {
+	tw := tar.NewWriter(w)
+	exported := map[string]bool{}
+	for {
+		e, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		exported[e.fdir.Path] = true
+		err = writeTarEntry(tw, e, exported)
+		e.Close()
+		if err != nil {
+			return err
+		}
+		entries.Done(e.fdir.Size)
+	}
+	return tw.Close()
+}
+
+// writeTarEntry writes a file or directory to the tar archive
+func writeTarEntry(tw *tar.Writer, e *archiveEntry, exported map[string]bool) error {
+	fdir := e.fdir
+	hdr := &tar.Header{
+		Name:     fdir.Path,
+		Mode:     int64(fdir.Mode.Perm()),
+		ModTime:  fdir.ModTime,
+		Size:     fdir.Size,
+		Typeflag: tar.TypeReg,
+	}
+	switch {
+	case fdir.IsDir:
+		hdr.Name += "/"
+		hdr.Size = 0
+		hdr.Typeflag = tar.TypeDir
+	case fdir.IsSymlink():
+		hdr.Size = 0
+		hdr.Mode = 0777
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = fdir.RelTarget()
+	case fdir.LinkType == LinkHard && exported[fdir.LinkTarget]:
+		// its target is earlier in the archive
+		hdr.Size = 0
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = fdir.LinkTarget
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil || hdr.Typeflag != tar.TypeReg {
+		return err
+	}
+	_, err = io.Copy(tw, e.body)
+	return err
+}
+
+// ImportArchive extracts a zip, tar or tar.gz archive into the bucket
+//
+// The format is detected from the contents and every extracted entry
+// is recorded in the FileDir table. Tar archives are streamed, zip
+// archives need random access so if r is not an io.ReaderAt (eg. *os.File)
+// the archive will be buffered in memory. The files are written in
+// batches, see WriteFiles.
+func (b *Bucket) ImportArchive(r io.Reader) (*BatchReport, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		if ra, size, ok := readerAt(r); ok {
+			return b.importZip(ra, size)
+		}
+		buf, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return b.importZip(bytes.NewReader(buf), int64(len(buf)))
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return b.importTar(gr)
+	default:
+		return b.importTar(br)
+	}
+}
+
+// readerAt returns r as an io.ReaderAt along with its size if possible
+func readerAt(r io.Reader) (io.ReaderAt, int64, bool) {
+	switch v := r.(type) {
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil {
+			return nil, 0, false
+		}
+		return v, info.Size(), true
+	case *bytes.Reader:
+		return v, v.Size(), true
+	}
+	return nil, 0, false
+}
+
+// importZip writes the files of the zip in batches, see WriteFiles
+func (b *Bucket) importZip(r io.ReaderAt, size int64) (*BatchReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	i := 0
+	var rc io.ReadCloser
+	defer func() {
+		if rc != nil {
+			rc.Close()
+		}
+	}()
+	return b.WriteFiles(func() (*BatchFile, error) {
+		if rc != nil {
+			rc.Close()
+			rc = nil
+		}
+		for ; i < len(zr.File); i++ {
+			zf := zr.File[i]
+			if zf.FileInfo().IsDir() {
+				_, err := b.mkdir(zf.Name, zf.Mode(), zf.Modified)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if zf.Mode()&os.ModeSymlink != 0 {
+				err = b.importLink(zf.Name, func() (string, error) {
+					rc, err := zf.Open()
+					if err != nil {
+						return "", err
+					}
+					defer rc.Close()
+					target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+					return string(target), err
+				})
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if !zf.Mode().IsRegular() {
+				// special files are skipped
+				continue
+			}
+			opened, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			rc = opened
+			i++
+			return &BatchFile{Path: zf.Name, Body: rc, Mode: zf.Mode(), ModTime: zf.Modified}, nil
+		}
+		return nil, io.EOF
+	})
+}
+
+// importLink creates the symlink of an archive unless the bucket rejects
+// the links, the ones pointing outside of the bucket are skipped
+func (b *Bucket) importLink(p string, target func() (string, error)) error {
+	if b.LinkPolicy() == LinksReject {
+		return nil
+	}
+	t, err := target()
+	if err != nil {
+		return err
+	}
+	_, err = b.Symlink(t, p)
+	if errors.Is(err, errs.ErrInvalidPath) {
+		return nil
+	}
+	return err
+}
+
+// importTar writes the files of the tar stream in batches, see WriteFiles
+func (b *Bucket) importTar(r io.Reader) (*BatchReport, error) {
+	tr := tar.NewReader(r)
+	return b.WriteFiles(func() (*BatchFile, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			modTime := hdr.ModTime
+			if modTime.IsZero() {
+				modTime = clock.Now()
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				_, err = b.mkdir(hdr.Name, os.FileMode(hdr.Mode), modTime)
+				if err != nil {
+					return nil, err
+				}
+			case tar.TypeReg, tar.TypeRegA:
+				return &BatchFile{Path: hdr.Name, Body: tr, Mode: os.FileMode(hdr.Mode), ModTime: modTime}, nil
+			case tar.TypeSymlink:
+				err = b.importLink(hdr.Name, func() (string, error) { return hdr.Linkname, nil })
+				if err != nil {
+					return nil, err
+				}
+			}
+			// hard links and other special files are skipped
+		}
+	})
+}
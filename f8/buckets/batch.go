@@ -0,0 +1,442 @@
+package buckets
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BatchSize the number of files the batch operations change per transaction
+var BatchSize = 500
+
+// BatchReport what a batch operation did
+type BatchReport struct {
+	// Files the number of files written, removed or updated
+	Files int `json:"files"`
+	// Bytes the size of the files written or removed
+	Bytes int64 `json:"bytes"`
+}
+
+// Match selects the files of a bucket by path, when both are set both must match
+type Match struct {
+	// Prefix the paths start with, eg. "photos/2021-"
+	Prefix string `json:"prefix,omitempty"`
+	// Glob the paths match, see path.Match, eg. "photos/*.jpg"
+	Glob string `json:"glob,omitempty"`
+}
+
+// validate refuses the matches selecting every file by accident
+func (m Match) validate() error {
+	if strings.Trim(m.Prefix, "/") == "" && m.Glob == "" {
+		return errs.New(errs.ErrInvalidOption, "A prefix or a glob is needed, remove the bucket to empty it")
+	}
+	if _, err := path.Match(m.Glob, ""); err != nil {
+		return errs.New(errs.ErrInvalidOption, "Bad glob "+m.Glob)
+	}
+	return nil
+}
+
+// Matching returns the files, not the directories, matching m ordered by path
+func (b *Bucket) Matching(m Match) ([]FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	err := m.validate()
+	if err != nil {
+		return nil, err
+	}
+	q := b.scope().Where("is_dir = ?", false)
+	if prefix := strings.TrimPrefix(m.Prefix, "/"); prefix != "" {
+		q = q.Where("SUBSTR(path, 1, ?) = ?", len(prefix), prefix)
+	}
+	var fdirs []FileDir
+	tx := q.Order("path").Find(&fdirs)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if m.Glob == "" {
+		return fdirs, nil
+	}
+	glob := strings.TrimPrefix(m.Glob, "/")
+	matched := fdirs[:0]
+	for _, f := range fdirs {
+		if ok, _ := path.Match(glob, f.Path); ok {
+			matched = append(matched, f)
+		}
+	}
+	return matched, nil
+}
+
+// lockAll takes the in-process locks of the clean paths, returning the function releasing them
+//
+// The advisory locks aren't taken, a batch would need a connection per file
+func (b *Bucket) lockAll(paths []string) (release func()) {
+	sorted := append([]string{}, paths...)
+	// always in the same order so two batches can't deadlock
+	sort.Strings(sorted)
+	releases := make([]func(), 0, len(sorted))
+	for _, p := range sorted {
+		releases = append(releases, localLock(b.lockKey(p)))
+	}
+	return func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+}
+
+// BatchFile a file written by WriteFiles
+type BatchFile struct {
+	Path string
+	// Body the contents, only read until the next file is asked for
+	Body io.Reader
+	// Link when set the file at this path is hard linked into the
+	// storage instead of reading Body, keeping its mode and times
+	Link string
+	// Mode and ModTime of the file, 0644 and now when zero
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// NextFunc returns the next file of a WriteFiles, io.EOF once there are none
+type NextFunc func() (*BatchFile, error)
+
+// WriteFiles writes the files next returns, BatchSize at a time
+//
+// Every file is checked and written to the storage like WriteFile does
+// but the rows and the usage of a batch are saved in one transaction.
+// The first failure stops the writes, the report counts the files
+// written until then. Nothing is published before its batch is saved.
+func (b *Bucket) WriteFiles(next NextFunc) (*BatchReport, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	report := &BatchReport{}
+	w := &batchWriter{b: b, report: report, staged: map[string]bool{}}
+	for {
+		f, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, w.stop(err)
+		}
+		p, err := cleanPath(f.Path)
+		if err != nil {
+			return report, w.stop(err)
+		}
+		if w.staged[p] || len(w.files) >= BatchSize {
+			// a file written twice waits for the first write to be saved
+			err = w.flush()
+			if err != nil {
+				return report, err
+			}
+		}
+		release, ok := tryLocalLock(b.lockKey(p))
+		if !ok {
+			// waiting holding the locks of the batch could deadlock with another batch
+			err = w.flush()
+			if err != nil {
+				return report, err
+			}
+			release = localLock(b.lockKey(p))
+		}
+		w.releases = append(w.releases, release)
+		w.staged[p] = true
+		mode, modTime := f.Mode, f.ModTime
+		if mode == 0 {
+			mode = 0644
+		}
+		if modTime.IsZero() {
+			modTime = clock.Now()
+		}
+		var fdir *FileDir
+		var oldSize int64
+		if f.Link != "" {
+			fdir, oldSize, err = b.stageLink(p, f.Link)
+		} else {
+			fdir, oldSize, err = b.stage(p, f.Body, mode, modTime)
+		}
+		if err != nil {
+			return report, w.stop(err)
+		}
+		b.Used += fdir.Size - oldSize
+		w.delta += fdir.Size - oldSize
+		w.files = append(w.files, fdir)
+	}
+	return report, w.flush()
+}
+
+// batchWriter the files a WriteFiles staged and has yet to save
+type batchWriter struct {
+	b        *Bucket
+	report   *BatchReport
+	files    []*FileDir
+	staged   map[string]bool
+	releases []func()
+	// delta the change of the usage of the staged files
+	delta int64
+}
+
+// stop saves what was staged and returns err
+func (w *batchWriter) stop(err error) error {
+	if ferr := w.flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// flush saves the staged files in a transaction and publishes them
+func (w *batchWriter) flush() error {
+	defer func() {
+		for _, r := range w.releases {
+			r()
+		}
+		w.files, w.releases, w.delta = nil, nil, 0
+		w.staged = map[string]bool{}
+	}()
+	if len(w.files) == 0 {
+		return nil
+	}
+	b := w.b
+	err := b.db.Transaction(func(tx *gorm.DB) error {
+		dirs := map[string]*FileDir{}
+		var created []*FileDir
+		for _, f := range w.files {
+			for dir := path.Dir(f.Path); dir != "." && dirs[dir] == nil; dir = path.Dir(dir) {
+				d := b.newFileDir(dir)
+				d.IsDir = true
+				d.Mode = os.ModeDir | 0766
+				d.ModTime = f.ModTime
+				dirs[dir] = d
+			}
+			if f.ID != 0 {
+				// existing row from lookup, this also restores soft deleted rows
+				if err := tx.Unscoped().Save(f).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			created = append(created, f)
+		}
+		if len(dirs) > 0 {
+			parents := make([]*FileDir, 0, len(dirs))
+			for _, d := range dirs {
+				parents = append(parents, d)
+			}
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&parents).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(created) > 0 {
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{
+					{Name: "path"}, {Name: "bucket_id"},
+					{Name: "entity_id"}, {Name: "entity_type"},
+				},
+				DoUpdates: clause.AssignmentColumns([]string{
+					"updated_at", "deleted_at", "name", "size", "mode", "mod_time", "is_dir", "content_type",
+				}),
+			}).Create(&created).Error
+			if err != nil {
+				return err
+			}
+		}
+		if w.delta == 0 {
+			return nil
+		}
+		return tx.Model(&Bucket{}).Where(
+			"id = ? AND entity_id = ? AND entity_type = ?", b.ID, b.EntityID, b.EntityType,
+		).UpdateColumn("used", gorm.Expr("used + ?", w.delta)).Error
+	})
+	if err != nil {
+		b.Used -= w.delta
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	Forget(b)
+	for _, f := range w.files {
+		w.report.Files++
+		w.report.Bytes += f.Size
+		b.written(f)
+	}
+	return nil
+}
+
+// RemoveMatching removes the files matching m, BatchSize at a time
+//
+// The rows of a batch and the usage are updated in one transaction,
+// the directories stay even once empty. Like Remove the rows are soft
+// deleted and the files of entity layout buckets are removed from disk,
+// or moved to the trash of the bucket if it has one.
+func (b *Bucket) RemoveMatching(m Match) (*BatchReport, error) {
+	fdirs, err := b.Matching(m)
+	if err != nil {
+		return nil, err
+	}
+	report := &BatchReport{}
+	for start := 0; start < len(fdirs); start += BatchSize {
+		end := start + BatchSize
+		if end > len(fdirs) {
+			end = len(fdirs)
+		}
+		err = b.removeBatch(fdirs[start:end], report)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// removeBatch removes a batch of files holding their locks
+func (b *Bucket) removeBatch(fdirs []FileDir, report *BatchReport) error {
+	paths := make([]string, len(fdirs))
+	for i := range fdirs {
+		paths[i] = fdirs[i].Path
+	}
+	release := b.lockAll(paths)
+	defer release()
+	var removed []FileDir
+	var size int64
+	err := b.db.Transaction(func(tx *gorm.DB) error {
+		// what's still there now that they're locked
+		tb := *b
+		tb.db = tx
+		err := tb.scope().Where("is_dir = ? AND path IN ?", false, paths).Find(&removed).Error
+		if err != nil {
+			return err
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+		for _, f := range removed {
+			size += f.Size
+		}
+		err = tb.scope().Where("is_dir = ? AND path IN ?", false, paths).Delete(&FileDir{}).Error
+		if err != nil {
+			return err
+		}
+		err = tb.pk().UpdateColumn("used", gorm.Expr("used - ?", size)).Error
+		if err != nil || !b.trashes() {
+			return err
+		}
+		// last so the objects are put back if it fails
+		return tb.toTrash(tx, removed)
+	})
+	var kindErr *errs.Error
+	if errors.As(err, &kindErr) {
+		return err
+	}
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	Forget(b)
+	b.Used -= size
+	entityLayout := b.layout().Name() == EntityLayoutName && !b.trashes()
+	for i := range removed {
+		f := &removed[i]
+		if entityLayout {
+			if err := removeFile(b.db, b.objectPath(f)); err != nil && !os.IsNotExist(err) {
+				// the row is gone, fsck finds the untracked file
+				log.Println("[f8][WARNING]: Failed to remove", f.Path, err)
+			}
+		}
+		b.forgetThumbnails(f.Path)
+		b.publish(events.FileDeleted, f.Path, nil)
+		report.Files++
+		report.Bytes += f.Size
+	}
+	return nil
+}
+
+// UpdateFilesMetadata sets the metadata keys of many files, BatchSize files per transaction
+//
+// updates maps the paths to the keys to set, a nil value deletes the key.
+// Fails with errs.ErrFileNotFound before changing anything if a path isn't a file or directory.
+func (b *Bucket) UpdateFilesMetadata(updates map[string]metadata.Metadata) (*BatchReport, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	byPath := make(map[string]metadata.Metadata, len(updates))
+	for p, md := range updates {
+		clean, err := cleanPath(p)
+		if err != nil {
+			return nil, err
+		}
+		byPath[clean] = md
+	}
+	paths := make([]string, 0, len(byPath))
+	for p := range byPath {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	report := &BatchReport{}
+	for start := 0; start < len(paths); start += BatchSize {
+		end := start + BatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		batch := paths[start:end]
+		err := b.db.Transaction(func(tx *gorm.DB) error {
+			tb := *b
+			tb.db = tx
+			var fdirs []FileDir
+			err := tb.scope().Where("path IN ?", batch).Find(&fdirs).Error
+			if err != nil {
+				return errs.Wrap(errs.ErrDatabase, err)
+			}
+			if len(fdirs) != len(batch) {
+				return errs.New(errs.ErrFileNotFound, missing(batch, fdirs))
+			}
+			for i := range fdirs {
+				f := &fdirs[i]
+				for k, v := range byPath[f.Path] {
+					if v == nil {
+						f.Metadata.Delete(k)
+						continue
+					}
+					f.Metadata.Set(k, v)
+				}
+				err = tb.scope().Where("path = ?", f.Path).UpdateColumn("metadata", f.Metadata).Error
+				if err != nil {
+					return errs.Wrap(errs.ErrDatabase, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Files += len(batch)
+	}
+	return report, nil
+}
+
+// missing the first of the paths without a row in fdirs
+func missing(paths []string, fdirs []FileDir) string {
+	found := make(map[string]bool, len(fdirs))
+	for _, f := range fdirs {
+		found[f.Path] = true
+	}
+	for _, p := range paths {
+		if !found[p] {
+			return p
+		}
+	}
+	return ""
+}
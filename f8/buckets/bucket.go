@@ -8,6 +8,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"github.com/phanirithvij/fate/f8/validate"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -24,14 +30,28 @@ type XFileSystem struct {
 type FileDir struct {
 	gorm.Model
 	// TODO: Once a file or dir is created it is our job to populate these fields
-	Name       string      // base name of the file
-	Path       string      `gorm:"primarykey"` // absolute path of the file
-	Size       int64       // length in bytes for regular files; system-dependent for others
-	Mode       os.FileMode // file mode bits
-	ModTime    time.Time   // modification time
-	IsDir      bool        // abbreviation for Mode.IsDir
-	BucketID   string      `gorm:"primarykey"`
+	Name    string      `gorm:"index:bucket_name_idx,priority:4"`       // base name of the file
+	Path    string      `gorm:"primarykey;uniqueIndex:bucket_path_idx"` // slash separated path of the file inside the bucket
+	Size    int64       // length in bytes for regular files; system-dependent for others
+	Mode    os.FileMode // file mode bits
+	ModTime time.Time   // modification time
+	IsDir   bool        // abbreviation for Mode.IsDir
+	// ContentType the sniffed MIME type of the file, empty for directories
+	ContentType string
+	// Metadata application defined details of the file
+	Metadata metadata.Metadata
+	// LinkType LinkSymlink or LinkHard for the links, empty for the other files
+	LinkType string
+	// LinkTarget the path in the bucket the link points to
+	LinkTarget string
+	BucketID   string `gorm:"primarykey;uniqueIndex:bucket_path_idx;index:bucket_name_idx,priority:1"`
 	BucketType string
+	// EntityID and EntityType of the bucket's owner
+	//
+	// Bucket IDs are only unique per entity so these are needed
+	// to tell apart the `default` buckets of two entities
+	EntityID   string `gorm:"uniqueIndex:bucket_path_idx;index:bucket_name_idx,priority:2"`
+	EntityType string `gorm:"uniqueIndex:bucket_path_idx;index:bucket_name_idx,priority:3"`
 	*os.File   `gorm:"-"`
 }
 
@@ -53,10 +73,40 @@ type Bucket struct {
 
 	// The Name of the bucket or the bucket name
 	// Name       string `gorm:"uniqueIndex:buk_ent_idx;unique;primaryKey"`
-	ID         string   `gorm:"uniqueIndex:buk_ent_idx;primaryKey"`
-	EntityID   string   `gorm:"uniqueIndex:buk_ent_idx;primaryKey"`
-	EntityType string   `gorm:"primaryKey"`
+	ID         string `gorm:"uniqueIndex:buk_ent_idx;primaryKey"`
+	EntityID   string `gorm:"uniqueIndex:buk_ent_idx;primaryKey"`
+	EntityType string `gorm:"primaryKey"`
+	// Tenant the application the bucket belongs to, empty for none
+	//
+	// It's the tenant of the owner, see the tenant package
+	Tenant string `gorm:"index"`
+	// Layout the name of the registered Layout used to store the bucket's files
+	Layout string `gorm:"default:entity"`
+	// Quota the maximum number of bytes the bucket can hold, 0 for unlimited
+	Quota int64
+	// MaxUploadSize the largest file that can be written to the bucket, 0 for unlimited
+	MaxUploadSize int64
+	// Metadata application defined details of the bucket
+	Metadata metadata.Metadata
+	// Pipeline the post-processing steps of the written files, see SetPipeline
+	Pipeline Pipeline
+	// Visibility who besides the owner can access the bucket
+	Visibility Visibility `gorm:"default:private"`
+	// Trash whether the removed files go to the trash of the bucket, see SetTrash
+	Trash bool
+	// Links how the symlinks of the bucket are handled, see SetLinks
+	Links string
+	// Used the number of bytes used by the files in the bucket
+	//
+	// This is a counter maintained on writes, use Recount to verify it
+	Used       int64
 	db         *gorm.DB `gorm:"-" json:"-"`
+	storageDir string   `gorm:"-"`
+	// actor and ip the origin of the changes, see AttachOrigin
+	actor *Actor `gorm:"-"`
+	ip    string `gorm:"-"`
+	// held the clean paths locked by WithLock on this copy of the bucket
+	held map[string]bool `gorm:"-"`
 	// Deleted to keep track of deleted buckets
 	Deleted bool `gorm:"-"`
 }
@@ -81,26 +131,221 @@ func NewBucket(bID string, db *gorm.DB) *Bucket {
 	return buck
 }
 
+// Find returns an entity's bucket from the database
+//
+// The bucket comes from the cache when one is in use, see the cache package
+func Find(db *gorm.DB, entityType, entityID, bID string) (*Bucket, error) {
+	key := CacheKey(entityType, entityID, bID)
+	cached := cacheable(db)
+	buck := &Bucket{}
+	if cached && cache.Load(key, buck) {
+		// a scoped db must not find the buckets of the other tenants
+		if t, ok := tenant.Of(db); !ok || buck.Tenant == t {
+			buck.AttatchDB(db)
+			return buck, nil
+		}
+		buck = &Bucket{}
+	}
+	tx := db.Where(
+		"id = ? AND entity_id = ? AND entity_type = ?",
+		bID, entityID, entityType,
+	).First(buck)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrBucketNotFound)
+	}
+	if cached {
+		cache.Store(key, buck)
+	}
+	buck.AttatchDB(db)
+	return buck, nil
+}
+
+// CacheKey the key of the bucket in the cache
+//
+// Writes changing a bucket row outside of its methods must Forget it
+func CacheKey(entityType, entityID, bID string) string {
+	return cache.Key("bucket", entityType, entityID, bID)
+}
+
+// Forget drops the cached copies of the buckets
+func Forget(bucks ...*Bucket) {
+	keys := make([]string, 0, len(bucks))
+	for _, b := range bucks {
+		keys = append(keys, CacheKey(b.EntityType, b.EntityID, b.ID))
+	}
+	cache.Forget(keys...)
+}
+
+// cacheable whether a lookup on db may use the cache
+//
+// Transactions must see their own writes and unscoped
+// lookups the deleted rows, both go to the database
+func cacheable(db *gorm.DB) bool {
+	if !cache.Enabled() || db.Statement.Unscoped {
+		return false
+	}
+	_, inTx := db.Statement.ConnPool.(gorm.TxCommitter)
+	return !inTx
+}
+
+// Owned returns an entity's buckets from the database
+func Owned(db *gorm.DB, entityType, entityID string) (bucks []*Bucket, err error) {
+	tx := db.Where(
+		"entity_id = ? AND entity_type = ?", entityID, entityType,
+	).Order("id").Find(&bucks)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	for _, b := range bucks {
+		b.AttatchDB(db)
+	}
+	return bucks, nil
+}
+
+// OwnerExists whether the entity has a row in its table, soft deleted or not
+//
+// The answer comes from the cache when one is in use,
+// entity Create forgets it once the entity is created
+func OwnerExists(db *gorm.DB, entityType, entityID string) (bool, error) {
+	key := OwnerCacheKey(entityType, entityID)
+	cached := cacheable(db)
+	var exists bool
+	if cached && cache.Load(key, &exists) {
+		return exists, nil
+	}
+	var n int64
+	err := db.Table(entityType).Where("id = ?", entityID).Count(&n).Error
+	if err != nil {
+		return false, errs.Wrap(errs.ErrDatabase, err)
+	}
+	if cached {
+		cache.Store(key, n > 0)
+	}
+	return n > 0, nil
+}
+
+// OwnerCacheKey the key of whether the entity exists in the cache
+func OwnerCacheKey(entityType, entityID string) string {
+	return cache.Key("entity", entityType, entityID)
+}
+
+// pk returns a query matching the bucket's row
+func (b *Bucket) pk() *gorm.DB {
+	return b.db.Model(&Bucket{}).Where(
+		"id = ? AND entity_id = ? AND entity_type = ?",
+		b.ID, b.EntityID, b.EntityType,
+	)
+}
+
+// addUsed atomically adds delta bytes to the bucket's usage counter
+func (b *Bucket) addUsed(delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	tx := b.pk().UpdateColumn("used", gorm.Expr("used + ?", delta))
+	if tx.Error != nil {
+		return tx.Error
+	}
+	Forget(b)
+	b.Used += delta
+	return nil
+}
+
+// reserve atomically adds delta bytes to the usage counter if it stays within the quota
+//
+// The database checks the quota so the writes through other copies of the
+// bucket can't both fit. Shrinking always fits, even over a lowered quota.
+// Doesn't change b.Used, the caller does once its transaction commits.
+func (b *Bucket) reserve(delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	tx := b.pk().Where("? <= 0 OR quota = 0 OR used + ? <= quota", delta, delta).
+		UpdateColumn("used", gorm.Expr("used + ?", delta))
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if tx.RowsAffected > 0 {
+		return nil
+	}
+	var n int64
+	err := b.pk().Count(&n).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	if n == 0 {
+		// not saved yet, there's no counter
+		return nil
+	}
+	return errs.New(errs.ErrQuotaExceeded, "Writing to bucket "+b.ID)
+}
+
+// Recount recomputes the usage counter of the bucket from its files
+//
+// Returns true if the stored counter had drifted and was fixed
+func (b *Bucket) Recount() (bool, error) {
+	var used int64
+	tx := b.scope().Where("is_dir = ?", false).Select("COALESCE(SUM(size), 0)").Scan(&used)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	stored := b.Used
+	tx = b.pk().Select("used").Scan(&stored)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	b.Used = used
+	if stored == used {
+		return false, nil
+	}
+	tx = b.pk().UpdateColumn("used", used)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	Forget(b)
+	return true, nil
+}
+
+// SetQuota sets the maximum number of bytes the bucket can hold, 0 for unlimited
+//
+// The files already in the bucket stay even if they're over the new quota
+func (b *Bucket) SetQuota(quota int64) error {
+	if quota < 0 {
+		return errs.New(errs.ErrInvalidOption, "Quota can't be negative")
+	}
+	tx := b.pk().UpdateColumn("quota", quota)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	Forget(b)
+	b.Quota = quota
+	return nil
+}
+
 // AttatchDB attaches the given db to the bucket
 func (b *Bucket) AttatchDB(db *gorm.DB) {
 	b.db = db
 }
 
+// AttachStorage attaches the storage directory under which the bucket's files live
+func (b *Bucket) AttachStorage(dir string) {
+	b.storageDir = dir
+}
+
 // Exists checks if the bucket already exists
-func (b *Bucket) Exists() bool {
+func (b *Bucket) Exists() (bool, error) {
 	if b == nil {
 		log.Println("Bucket is nil handle error checking properly")
-		return false
+		return false, nil
 	}
 	tx := b.db.First(b)
 	if tx.Error != nil {
 		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-			return false
+			return false, nil
 		}
-		log.Println("?")
-		log.Fatal(tx.Error)
+		return false, errs.Wrap(errs.ErrDatabase, tx.Error)
 	}
-	return true
+	return true, nil
 }
 
 // Delete deletes the bucket
@@ -116,17 +361,20 @@ func (b *Bucket) Delete() bool {
 		log.Println("Bucket DB is nil AttachDB call missed somewhere")
 		return false
 	}
-	tx := b.db.Delete(b)
-	// it doesn't exist at all
-	if tx.RowsAffected == 0 {
-		return false
-	}
+	// the composite primary key IN (...) gorm generates isn't supported by sqlite
+	tx := b.pk().Delete(&Bucket{})
 	if tx.Error != nil {
 		log.Println(tx.Error)
 		return false
 	}
+	Forget(b)
+	// it doesn't exist at all
+	if tx.RowsAffected == 0 {
+		return false
+	}
 	log.Println("Deleted bucket", b.ID)
 	b.Deleted = true
+	b.publish(events.BucketDeleted, "", nil)
 	return true
 }
 
@@ -143,13 +391,13 @@ func (b *Bucket) String() string {
 // GetDeletedBuckets returns the list of soft deleted buckets
 //
 // Use CleanupBuckets to permanently delete those
-func GetDeletedBuckets(db *gorm.DB) (delbuckets []*Bucket) {
+func GetDeletedBuckets(db *gorm.DB) (delbuckets []*Bucket, err error) {
 	// get deleted buckets
 	tx := db.Unscoped().Where("deleted_at IS NOT NULL").Find(&delbuckets)
 	if tx.Error != nil {
-		log.Fatal(tx.Error)
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
 	}
-	return delbuckets
+	return delbuckets, nil
 }
 
 // CleanupBuckets cleans up the bucket table
@@ -166,8 +414,8 @@ func CleanupBuckets(db *gorm.DB) bool {
 
 // NewFile retuns a new file
 func NewFile(name string) (*FileDir, error) {
-	if name == "" {
-		return nil, errors.New("FileName was empty")
+	if err := validate.Path(name); err != nil {
+		return nil, err
 	}
 	fdir := &FileDir{
 		Name:  name,
@@ -176,7 +424,7 @@ func NewFile(name string) (*FileDir, error) {
 
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDONLY, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, errs.FS(err)
 	}
 	defer f.Close()
 
@@ -185,8 +433,8 @@ func NewFile(name string) (*FileDir, error) {
 
 // NewDir returns a new directory
 func NewDir(name string) (*FileDir, error) {
-	if name == "" {
-		return nil, errors.New("Directory name was empty")
+	if err := validate.Path(name); err != nil {
+		return nil, err
 	}
 	fdir := &FileDir{
 		Name:  name,
@@ -194,7 +442,7 @@ func NewDir(name string) (*FileDir, error) {
 	}
 	err := os.MkdirAll(name, 0766)
 	if err != nil {
-		return nil, err
+		return nil, errs.FS(err)
 	}
 	return fdir, nil
 }
@@ -206,7 +454,7 @@ func (f *FileDir) Move(dest string) (bool, error) {
 
 // AutoMigrate for xfs
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&Bucket{}, &FileDir{})
+	return db.AutoMigrate(&Bucket{}, &FileDir{}, &Grant{}, &Tag{}, &TempObject{}, &TrashItem{})
 }
 
 // BeforeCreate before creating fix the conflicts for primarykey
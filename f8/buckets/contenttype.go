@@ -0,0 +1,61 @@
+package buckets
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// sniffLen the number of bytes http.DetectContentType looks at
+	sniffLen = 512
+)
+
+// sniffer captures the first bytes written through it
+type sniffer struct {
+	w    io.Writer
+	head []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if n := sniffLen - len(s.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		s.head = append(s.head, p[:n]...)
+	}
+	return s.w.Write(p)
+}
+
+// detectContentType returns the content type of a file from its first bytes
+//
+// The content is sniffed first. Sniffing can't tell apart text formats
+// (css, js, json, svg...) so the extension decides when the sniffed type is generic.
+func detectContentType(name string, head []byte) string {
+	ctype := http.DetectContentType(head)
+	generic := ctype == "application/octet-stream" || strings.HasPrefix(ctype, "text/plain")
+	if generic {
+		if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+			return byExt
+		}
+	}
+	return ctype
+}
+
+// sniffFile returns the content type of the file on disk
+func sniffFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return detectContentType(name, head[:n]), nil
+}
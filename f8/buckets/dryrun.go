@@ -0,0 +1,65 @@
+package buckets
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/plan"
+	"gorm.io/gorm"
+)
+
+// The changes to the storage directory of the gc, the removals and the
+// imports, a dry run of db only records them, see plan.Run
+
+// removeFile removes the file or empty directory at name
+//
+// A dry run fails like os.Remove would if it's missing
+func removeFile(db *gorm.DB, name string) error {
+	if p := plan.Of(db); p != nil {
+		if _, err := os.Lstat(name); err != nil {
+			return err
+		}
+		p.Record(plan.Remove, name)
+		return nil
+	}
+	return os.Remove(name)
+}
+
+// removeAll removes the directory at name with everything under it, if it's there
+func removeAll(db *gorm.DB, name string) error {
+	if p := plan.Of(db); p != nil {
+		if _, err := os.Lstat(name); err == nil {
+			p.Record(plan.RemoveAll, name)
+		}
+		return nil
+	}
+	return os.RemoveAll(name)
+}
+
+// mkdirAll creates the directory at name and its parents
+func mkdirAll(db *gorm.DB, name string) error {
+	if p := plan.Of(db); p != nil {
+		if info, err := os.Stat(name); err != nil || !info.IsDir() {
+			p.Record(plan.Mkdir, name)
+		}
+		return nil
+	}
+	return os.MkdirAll(name, 0766)
+}
+
+// rename moves a file to newName creating its parents
+func rename(db *gorm.DB, oldName, newName string) error {
+	if p := plan.Of(db); p != nil {
+		if _, err := os.Lstat(oldName); err != nil {
+			return errs.FS(err)
+		}
+		p.Record(plan.Rename, oldName+" -> "+newName)
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(newName), 0766)
+	if err == nil {
+		err = os.Rename(oldName, newName)
+	}
+	return errs.FS(err)
+}
@@ -0,0 +1,61 @@
+package buckets
+
+import (
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/plan"
+)
+
+// publish publishes an event about the bucket to the default event bus
+//
+// Nothing is published for the hidden buckets nor by a dry run
+func (b *Bucket) publish(t events.Type, p string, data map[string]interface{}) {
+	if b.Hidden() || plan.Of(b.db) != nil {
+		return
+	}
+	events.Publish(b.event(t, p, data))
+}
+
+// event returns an event about the path p of the bucket attributed to its origin
+func (b *Bucket) event(t events.Type, p string, data map[string]interface{}) *events.Event {
+	e := &events.Event{
+		ID:         clock.NewID(),
+		Type:       t,
+		Version:    events.SchemaVersion,
+		Time:       clock.Now().UTC(),
+		EntityType: b.EntityType,
+		EntityID:   b.EntityID,
+		BucketID:   b.ID,
+		Path:       p,
+		IP:         b.ip,
+		Data:       data,
+	}
+	if b.actor != nil {
+		e.ActorType, e.ActorID = b.actor.Type, b.actor.ID
+	}
+	return e
+}
+
+// AttachOrigin attaches who is using the bucket and from which ip
+//
+// The events of what they do with it are attributed to them
+func (b *Bucket) AttachOrigin(actor *Actor, ip string) {
+	b.actor = actor
+	b.ip = ip
+}
+
+// Origin returns who is using the bucket and from which ip, see AttachOrigin
+func (b *Bucket) Origin() (*Actor, string) {
+	return b.actor, b.ip
+}
+
+// PublishCreated publishes the bucket created event
+//
+// Only once the insert of the bucket is committed, the upsert of
+// BeforeCreate inserts nothing when the bucket exists
+func (b *Bucket) PublishCreated() {
+	b.publish(events.BucketCreated, "", map[string]interface{}{
+		"layout": b.Layout,
+		"quota":  b.Quota,
+	})
+}
@@ -0,0 +1,551 @@
+package buckets
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/plan"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// bucketType is the polymorphic type stored in FileDir.BucketType
+	bucketType = "buckets"
+	// tempPrefix the prefix of the files being written, they are ignored by Sync
+	tempPrefix = ".f8-upload-"
+)
+
+// isTemp whether the file on disk is a write in progress
+func isTemp(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), tempPrefix)
+}
+
+// Dir returns the directory of the bucket on disk for the entity layout
+//
+//	eg: <storage>/users/phano/default
+//
+// Buckets with other layouts don't keep their files under this directory
+func (b *Bucket) Dir() string {
+	return filepath.Join(b.storageDir, b.EntityType, b.EntityID, b.ID)
+}
+
+// objectPath returns the path on disk of the file's object
+//
+// Returns an empty string if the file has no object in the bucket's layout
+func (b *Bucket) objectPath(f *FileDir) string {
+	key := b.layout().Key(b, f)
+	if key == "" {
+		return ""
+	}
+	return filepath.Join(b.storageDir, filepath.FromSlash(key))
+}
+
+// cleanPath converts p into a slash separated path relative to the bucket root
+//
+// Any leading slashes and `..` elements are resolved against the root
+// so the result never points outside the bucket
+func cleanPath(p string) (string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if p == "" {
+		return "", errs.New(errs.ErrInvalidPath, "Path was empty")
+	}
+	return p, nil
+}
+
+// scope returns a query over the FileDirs of this bucket
+func (b *Bucket) scope() *gorm.DB {
+	return b.db.Model(&FileDir{}).Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ?",
+		b.ID, b.EntityID, b.EntityType,
+	)
+}
+
+// newFileDir returns a FileDir row for the path p owned by the bucket
+func (b *Bucket) newFileDir(p string) *FileDir {
+	return &FileDir{
+		Model:      gorm.Model{CreatedAt: clock.Now()},
+		Name:       path.Base(p),
+		Path:       p,
+		BucketID:   b.ID,
+		BucketType: bucketType,
+		EntityID:   b.EntityID,
+		EntityType: b.EntityType,
+	}
+}
+
+// lookup returns the existing row for the clean path p or a new one
+//
+// Layouts may derive the object key from the row (eg. CreatedAt)
+// so overwrites must reuse the existing row. Paths under a symlink
+// are refused, see writable.
+func (b *Bucket) lookup(p string) (*FileDir, error) {
+	err := b.writable(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir := &FileDir{}
+	tx := b.scope().Unscoped().Where("path = ?", p).First(fdir)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return b.newFileDir(p), nil
+	}
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if fdir.DeletedAt.Valid {
+		// deleted rows no longer count towards the bucket usage
+		fdir.Size = 0
+		fdir.DeletedAt = gorm.DeletedAt{}
+	}
+	return fdir, nil
+}
+
+// Stat returns the FileDir row of the file or directory at p
+func (b *Bucket) Stat(p string) (*FileDir, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir := &FileDir{}
+	tx := b.scope().Where("path = ?", p).First(fdir)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrFileNotFound)
+	}
+	return fdir, nil
+}
+
+// save upserts the FileDir row for the bucket
+func (b *Bucket) save(fdir *FileDir) error {
+	if fdir.ID != 0 {
+		// existing row from lookup, this also restores soft deleted rows
+		return b.db.Unscoped().Save(fdir).Error
+	}
+	tx := b.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "path"}, {Name: "bucket_id"},
+			{Name: "entity_id"}, {Name: "entity_type"},
+		},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"updated_at", "deleted_at", "name", "size", "mode", "mod_time", "is_dir", "content_type",
+		}),
+	}).Create(fdir)
+	return tx.Error
+}
+
+// ensureParents records the parent directories of p if they are missing
+func (b *Bucket) ensureParents(p string, modTime time.Time) error {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		fdir := b.newFileDir(dir)
+		fdir.IsDir = true
+		fdir.Mode = os.ModeDir | 0766
+		fdir.ModTime = modTime
+		tx := b.db.Clauses(clause.OnConflict{DoNothing: true}).Create(fdir)
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+	return nil
+}
+
+// WriteFile writes the contents of r to the file at p inside the bucket
+//
+// Parent directories are created as needed and the FileDir rows
+// are recorded for the file and all of its parents.
+// The contents are written to a temporary file first so a failed write
+// leaves the existing file untouched. Returns errs.ErrQuotaExceeded
+// if the bucket has a quota and the file doesn't fit and errs.ErrTooLarge
+// if the file is larger than the bucket's MaxUploadSize.
+func (b *Bucket) WriteFile(p string, r io.Reader) (*FileDir, error) {
+	return b.writeFile(p, r, 0644, clock.Now())
+}
+
+// WriteFileInfo is WriteFile keeping the given mode and modification time
+//
+// Meant for imports from other storages
+func (b *Bucket) WriteFileInfo(p string, r io.Reader, mode os.FileMode, modTime time.Time) (*FileDir, error) {
+	return b.writeFile(p, r, mode, modTime)
+}
+
+func (b *Bucket) writeFile(p string, r io.Reader, mode os.FileMode, modTime time.Time) (*FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	var fdir *FileDir
+	err = b.WithLock(p, func(b *Bucket) (err error) {
+		fdir, err = b.writeLocked(p, r, mode, modTime)
+		return err
+	})
+	return fdir, err
+}
+
+// writeLocked writes the clean path p holding its lock
+//
+// The usage is reserved against the quota in the transaction saving the
+// row, the writes racing through other copies of the bucket can't both
+// fit. The object replaces the old one last, it's removed if anything failed.
+func (b *Bucket) writeLocked(p string, r io.Reader, mode os.FileMode, modTime time.Time) (*FileDir, error) {
+	fdir, oldSize, tmp, err := b.stageTemp(p, r, mode, modTime)
+	if err != nil {
+		return nil, err
+	}
+	if tmp != "" {
+		// a no-op once in place
+		defer os.Remove(tmp)
+	}
+	delta := fdir.Size - oldSize
+	err = b.db.Transaction(func(tx *gorm.DB) error {
+		tb := *b
+		tb.db = tx
+		err := tb.reserve(delta)
+		if err != nil {
+			return err
+		}
+		err = tb.ensureParents(p, modTime)
+		if err != nil {
+			return err
+		}
+		err = tb.save(fdir)
+		if err != nil {
+			return err
+		}
+		if tmp == "" {
+			return nil
+		}
+		// last so a failed rename rolls the row and the usage back
+		return tb.place(fdir, tmp)
+	})
+	if errors.Is(err, errs.ErrQuotaExceeded) {
+		b.publish(events.QuotaExceeded, fdir.Path, map[string]interface{}{"quota": b.Quota, "used": b.Used})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if delta != 0 {
+		Forget(b)
+		b.Used += delta
+	}
+	b.written(fdir)
+	return fdir, nil
+}
+
+// stage writes the contents of r to the object of the clean path p
+//
+// Returns the row of the file, not saved yet, and the size it had before.
+// The quota is checked against b.Used which the caller keeps up to date.
+func (b *Bucket) stage(p string, r io.Reader, mode os.FileMode, modTime time.Time) (*FileDir, int64, error) {
+	fdir, oldSize, tmp, err := b.stageTemp(p, r, mode, modTime)
+	if err != nil || tmp == "" {
+		return fdir, oldSize, err
+	}
+	err = b.place(fdir, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, 0, err
+	}
+	return fdir, oldSize, nil
+}
+
+// place renames the staged temporary file over the object of the file
+func (b *Bucket) place(fdir *FileDir, tmp string) error {
+	return errs.FS(os.Rename(tmp, b.objectPath(fdir)))
+}
+
+// stageTemp writes the contents of r to a temporary file next to the object
+// of the clean path p, see stage and place
+//
+// The temporary file is empty in a dry run, the caller removes it otherwise
+func (b *Bucket) stageTemp(p string, r io.Reader, mode os.FileMode, modTime time.Time) (fdir *FileDir, oldSize int64, tmp string, err error) {
+	fdir, err = b.lookup(p)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	oldSize = fdir.Size
+	fdir.IsDir = false
+	fdir.LinkType, fdir.LinkTarget = "", ""
+	name := b.objectPath(fdir)
+	dry := plan.Of(b.db)
+	var f *os.File
+	var dst io.Writer = ioutil.Discard
+	if dry == nil {
+		err = os.MkdirAll(filepath.Dir(name), 0766)
+		if err != nil {
+			return nil, 0, "", errs.FS(err)
+		}
+		f, err = ioutil.TempFile(filepath.Dir(name), tempPrefix+"*")
+		if err != nil {
+			return nil, 0, "", errs.FS(err)
+		}
+		defer func() {
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}()
+		dst = f
+	}
+	var src io.Reader = r
+	limit := int64(-1)
+	if b.Quota > 0 {
+		limit = b.Quota - (b.Used - oldSize)
+	}
+	if b.MaxUploadSize > 0 && (limit < 0 || b.MaxUploadSize < limit) {
+		limit = b.MaxUploadSize
+	}
+	if limit >= 0 {
+		// a byte more than allowed to tell an exact fit from an overflow
+		src = io.LimitReader(r, limit+1)
+	}
+	sn := &sniffer{w: dst}
+	size, err := io.Copy(sn, src)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return nil, 0, "", errs.FS(err)
+	}
+	if b.MaxUploadSize > 0 && size > b.MaxUploadSize {
+		return nil, 0, "", errs.TooLarge(b.MaxUploadSize)
+	}
+	if b.Quota > 0 && b.Used-oldSize+size > b.Quota {
+		b.publish(events.QuotaExceeded, fdir.Path, map[string]interface{}{"quota": b.Quota, "used": b.Used})
+		return nil, 0, "", errs.New(errs.ErrQuotaExceeded, "Writing "+p+" to bucket "+b.ID)
+	}
+	if dry != nil {
+		dry.Record(plan.Write, name)
+	} else {
+		err = os.Chmod(f.Name(), mode.Perm())
+		if err == nil {
+			err = os.Chtimes(f.Name(), modTime, modTime)
+		}
+		if err != nil {
+			return nil, 0, "", errs.FS(err)
+		}
+		tmp = f.Name()
+	}
+	fdir.Size = size
+	fdir.Mode = mode.Perm()
+	fdir.ModTime = modTime
+	fdir.ContentType = detectContentType(fdir.Name, sn.head)
+	return fdir, oldSize, tmp, nil
+}
+
+// written runs the pipeline of the saved file and publishes its write
+func (b *Bucket) written(fdir *FileDir) {
+	if plan.Of(b.db) != nil {
+		// a dry run, nothing was written
+		return
+	}
+	UploadedBytes.Add(float64(fdir.Size), b.labels()...)
+	b.process(fdir)
+	b.publish(events.FileWritten, fdir.Path, map[string]interface{}{"size": fdir.Size})
+}
+
+// Mkdir creates the directory p inside the bucket along with its parents
+func (b *Bucket) Mkdir(p string) (*FileDir, error) {
+	return b.mkdir(p, os.ModeDir|0766, clock.Now())
+}
+
+func (b *Bucket) mkdir(p string, mode os.FileMode, modTime time.Time) (*FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir.IsDir = true
+	fdir.LinkType, fdir.LinkTarget = "", ""
+	if name := b.objectPath(fdir); name != "" {
+		err = mkdirAll(b.db, name)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+	}
+	err = b.ensureParents(p, modTime)
+	if err != nil {
+		return nil, err
+	}
+	fdir.Mode = os.ModeDir | mode.Perm()
+	fdir.ModTime = modTime
+	return fdir, b.save(fdir)
+}
+
+// Open opens the file at p inside the bucket for reading
+//
+// Symlinks are only read through if the bucket follows them, see LinksFollow
+func (b *Bucket) Open(p string) (*os.File, error) {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir, err = b.follow(fdir)
+	if err != nil {
+		return nil, err
+	}
+	if fdir.IsDir {
+		return nil, errs.New(errs.ErrIsDir, "Cannot open a directory "+fdir.Path)
+	}
+	f, err := os.Open(b.objectPath(fdir))
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	return f, nil
+}
+
+// FileReader a file of a bucket open for reading at any offset
+//
+// It's an io.ReadSeeker for http.ServeContent and an io.ReaderAt,
+// players seeking in the media files only read the ranges they need
+type FileReader struct {
+	f *os.File
+	// Info the row of the file
+	Info *FileDir
+}
+
+// OpenReader opens the file at p inside the bucket for random access reads
+func (b *Bucket) OpenReader(p string) (*FileReader, error) {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir, err = b.follow(fdir)
+	if err != nil {
+		return nil, err
+	}
+	if fdir.IsDir {
+		return nil, errs.New(errs.ErrIsDir, "Cannot open a directory "+fdir.Path)
+	}
+	f, err := os.Open(b.objectPath(fdir))
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	return &FileReader{f: f, Info: fdir}, nil
+}
+
+// Read reads from the current offset
+func (r *FileReader) Read(p []byte) (int, error) {
+	return r.f.Read(p)
+}
+
+// ReadAt reads len(p) bytes at off, it doesn't move the offset of Read
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off)
+}
+
+// Seek sets the offset of the next Read
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	return r.f.Seek(offset, whence)
+}
+
+// Size the size of the file in bytes
+func (r *FileReader) Size() int64 {
+	return r.Info.Size
+}
+
+// Section returns a reader of the n bytes at off
+func (r *FileReader) Section(off, n int64) *io.SectionReader {
+	return io.NewSectionReader(r.f, off, n)
+}
+
+// Close closes the file
+func (r *FileReader) Close() error {
+	return r.f.Close()
+}
+
+// Files returns all the files and directories of the bucket ordered by path
+func (b *Bucket) Files() (fdirs []FileDir, err error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	tx := b.scope().Order("path").Find(&fdirs)
+	return fdirs, errs.DB(tx.Error, errs.ErrFileNotFound)
+}
+
+// ReadDir returns the files and directories directly inside the directory at p ordered by name
+//
+// An empty p or "/" reads the root of the bucket
+func (b *Bucket) ReadDir(p string) (fdirs []FileDir, err error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	prefix := ""
+	if strings.Trim(p, "/") != "" {
+		dir, err := b.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !dir.IsDir {
+			return nil, errs.New(errs.ErrInvalidPath, dir.Path+" is not a directory")
+		}
+		prefix = dir.Path + "/"
+	}
+	tx := b.scope().Where("path = ? || name", prefix).Order("name").Find(&fdirs)
+	return fdirs, errs.DB(tx.Error, errs.ErrFileNotFound)
+}
+
+// Tree returns the file or directory at p and everything under it ordered by path
+func (b *Bucket) Tree(p string) (fdirs []FileDir, err error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	p, err = cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	tx := underPath(b.scope(), p).Order("path").Find(&fdirs)
+	if tx.Error == nil && len(fdirs) == 0 {
+		return nil, errs.New(errs.ErrFileNotFound, p)
+	}
+	return fdirs, errs.DB(tx.Error, errs.ErrFileNotFound)
+}
+
+// Remove deletes the file or directory at p along with everything under it
+//
+// The rows are soft deleted so GC purges them later, for entity layout
+// buckets the files are removed from disk right away. The files of
+// a bucket with a trash are moved to it instead, see SetTrash.
+func (b *Bucket) Remove(p string) error {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return err
+	}
+	return b.WithLock(fdir.Path, func(b *Bucket) error {
+		return b.removeLocked(fdir)
+	})
+}
+
+// removeLocked removes the file or directory holding its lock
+func (b *Bucket) removeLocked(fdir *FileDir) error {
+	if b.trashes() {
+		return b.trashLocked(fdir)
+	}
+	if b.layout().Name() == EntityLayoutName {
+		err := removeAll(b.db, b.objectPath(fdir))
+		if err != nil {
+			return errs.FS(err)
+		}
+	}
+	err := b.forget(fdir.Path)
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
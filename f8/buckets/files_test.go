@@ -0,0 +1,40 @@
+package buckets_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+func TestNewFileDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, bad := range []string{"", "..", dir + "/../a.txt", dir + "/a\x00.txt"} {
+		if _, err := buckets.NewFile(bad); !errors.Is(err, errs.ErrInvalidPath) {
+			t.Errorf("file %q: got %v want %v", bad, err, errs.ErrInvalidPath)
+		}
+		if _, err := buckets.NewDir(bad); !errors.Is(err, errs.ErrInvalidPath) {
+			t.Errorf("dir %q: got %v want %v", bad, err, errs.ErrInvalidPath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("created a file outside of the directory: %v", err)
+	}
+
+	f, err := buckets.NewFile(filepath.Join(dir, "a.txt"))
+	if err != nil || f.IsDir {
+		t.Fatalf("got %+v: %v", f, err)
+	}
+	d, err := buckets.NewDir(filepath.Join(dir, "notes"))
+	if err != nil || !d.IsDir {
+		t.Fatalf("got %+v: %v", d, err)
+	}
+	for _, p := range []string{"a.txt", "notes"} {
+		if _, err = os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Error(err)
+		}
+	}
+}
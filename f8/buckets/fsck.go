@@ -0,0 +1,190 @@
+package buckets
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+// Problem an inconsistency found by Fsck
+type Problem struct {
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	BucketID   string `json:"bucket_id"`
+	Path       string `json:"path,omitempty"`
+	Issue      string `json:"issue"`
+}
+
+// FsckReport the result of a Fsck
+type FsckReport struct {
+	Buckets  int       `json:"buckets"`
+	Files    int       `json:"files"`
+	Problems []Problem `json:"problems"`
+}
+
+// OK whether no problems were found
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Fsck checks the FileDir rows of every bucket against the storage directory
+//
+// Nothing is fixed, use Sync and Recount for that.
+// Reported are missing objects, size mismatches, drifted usage counters
+// and files on disk without a row (entity layout only).
+// Pass a pacer to keep it from competing with production traffic, nil runs it flat out.
+func Fsck(db *gorm.DB, storageDir string, p *pace.Pacer) (*FsckReport, error) {
+	bucks := []*Bucket{}
+	tx := db.Find(&bucks)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	report := &FsckReport{Problems: []Problem{}}
+	for _, b := range bucks {
+		b.AttatchDB(db)
+		b.AttachStorage(storageDir)
+		err := b.fsck(report, p)
+		if err != nil {
+			return nil, err
+		}
+		report.Buckets++
+	}
+	return report, nil
+}
+
+// Verify is Fsck for the bucket only, it needs its storage attached
+func (b *Bucket) Verify(p *pace.Pacer) (*FsckReport, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	report := &FsckReport{Buckets: 1, Problems: []Problem{}}
+	err := b.fsck(report, p)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Repair fixes the problems of the bucket found by Verify, returning how many were fixed
+//
+// Entity layout buckets are synced with their directory, the rows of the
+// missing objects of the other layouts are forgotten and the usage counter
+// recounted. Their size mismatches can't be fixed, the objects were changed
+// behind the bucket's back.
+func (b *Bucket) Repair(report *FsckReport) (fixed int, err error) {
+	if b.db == nil {
+		return 0, errs.ErrNotAttached
+	}
+	synced, drifted := false, false
+	for _, problem := range report.Problems {
+		if problem.EntityType != b.EntityType || problem.EntityID != b.EntityID || problem.BucketID != b.ID {
+			continue
+		}
+		switch {
+		case problem.Issue == IssueUsageDrift:
+			drifted = true
+			continue
+		case b.layout().Name() == EntityLayoutName:
+			if !synced {
+				_, err = b.Sync()
+				if err != nil {
+					return fixed, err
+				}
+				synced = true
+			}
+		case problem.Issue == IssueMissingObject:
+			err = b.forget(problem.Path)
+			if err != nil {
+				return fixed, errs.Wrap(errs.ErrDatabase, err)
+			}
+		default:
+			continue
+		}
+		fixed++
+	}
+	if drifted || synced {
+		_, err := b.Recount()
+		if err != nil {
+			return fixed, errs.Wrap(errs.ErrDatabase, err)
+		}
+		if drifted {
+			fixed++
+		}
+	}
+	return fixed, nil
+}
+
+func (b *Bucket) fsck(report *FsckReport, pacer *pace.Pacer) error {
+	problem := func(p, issue string) {
+		report.Problems = append(report.Problems, Problem{
+			EntityType: b.EntityType,
+			EntityID:   b.EntityID,
+			BucketID:   b.ID,
+			Path:       p,
+			Issue:      issue,
+		})
+	}
+	var fdirs []FileDir
+	err := pacer.Do(func() (err error) {
+		fdirs, err = b.Files()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	rows := make(map[string]bool, len(fdirs))
+	var used int64
+	for _, fdir := range fdirs {
+		rows[fdir.Path] = true
+		if fdir.IsDir || fdir.IsSymlink() {
+			continue
+		}
+		report.Files++
+		used += fdir.Size
+		name := b.objectPath(&fdir)
+		var info os.FileInfo
+		err := pacer.Do(func() (err error) {
+			info, err = os.Stat(name)
+			return err
+		})
+		if os.IsNotExist(err) {
+			problem(fdir.Path, IssueMissingObject)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size() != fdir.Size {
+			problem(fdir.Path, IssueSizeMismatch)
+		}
+	}
+	if used != b.Used {
+		problem("", IssueUsageDrift)
+	}
+	if b.layout().Name() != EntityLayoutName {
+		return nil
+	}
+	root := b.Dir()
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if name == root || isTemp(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if p := filepath.ToSlash(rel); !rows[p] {
+			problem(p, IssueUntrackedFile)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,250 @@
+package buckets
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+// gcBatch the number of rows purged per query
+const gcBatch = 100
+
+// GCReport what was purged by a GC
+type GCReport struct {
+	Buckets int `json:"buckets"`
+	Files   int `json:"files"`
+	Objects int `json:"objects"`
+	Temps   int `json:"temps"`
+	Trash   int `json:"trash"`
+	// Parts the files of the writes abandoned midway, eg. by a crash
+	Parts int   `json:"parts"`
+	Bytes int64 `json:"bytes"`
+}
+
+// GC permanently deletes the soft deleted files and buckets, the trash, the expired
+// temp objects and the parts of the abandoned writes
+//
+// The objects still on disk are removed along with their tags and grants,
+// for entity layout buckets the whole bucket directory goes.
+// Pass a pacer to keep it from competing with production traffic, nil runs it flat out.
+func GC(db *gorm.DB, storageDir string, p *pace.Pacer) (*GCReport, error) {
+	return GCOlderThan(db, storageDir, 0, p)
+}
+
+// GCOlderThan is GC only purging the files, buckets and trash deleted more than age ago
+//
+// Until then they can be restored, eg. with their entity by entity.Restore
+func GCOlderThan(db *gorm.DB, storageDir string, age time.Duration, p *pace.Pacer) (*GCReport, error) {
+	report := &GCReport{}
+	now := clock.Now()
+	err := purgeTemps(db, storageDir, report, p, "expires_at <= ?", now)
+	if err != nil {
+		return nil, err
+	}
+	err = purgeTrash(db, storageDir, report, p, "deleted_at <= ?", now.Add(-age))
+	if err != nil {
+		return nil, err
+	}
+	err = purgeParts(db, storageDir, report, p)
+	if err != nil {
+		return nil, err
+	}
+	deleted := db.Unscoped().Where("deleted_at IS NOT NULL")
+	if age > 0 {
+		deleted = deleted.Where("deleted_at < ?", now.Add(-age))
+	}
+	deleted = deleted.Session(&gorm.Session{})
+	owners := map[[3]string]*Bucket{}
+	owner := func(f *FileDir) (*Bucket, error) {
+		key := [3]string{f.EntityType, f.EntityID, f.BucketID}
+		if b, ok := owners[key]; ok {
+			return b, nil
+		}
+		b := &Bucket{}
+		tx := db.Unscoped().Where(
+			"id = ? AND entity_id = ? AND entity_type = ?",
+			f.BucketID, f.EntityID, f.EntityType,
+		).First(b)
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			// the bucket row is gone (CleanupBuckets), assume the default layout
+			b = &Bucket{ID: f.BucketID, EntityID: f.EntityID, EntityType: f.EntityType}
+		} else if tx.Error != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+		}
+		b.AttatchDB(db)
+		b.AttachStorage(storageDir)
+		owners[key] = b
+		return b, nil
+	}
+
+	for {
+		var fdirs []FileDir
+		err := p.Do(func() error {
+			return deleted.Order("entity_type, entity_id, bucket_id, path").Limit(gcBatch).Find(&fdirs).Error
+		})
+		if err != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(fdirs) == 0 {
+			break
+		}
+		for i := range fdirs {
+			b, err := owner(&fdirs[i])
+			if err != nil {
+				return nil, err
+			}
+			err = b.purge(&fdirs[i], report, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var bucks []*Bucket
+	tx := deleted.Find(&bucks)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	for _, b := range bucks {
+		b.AttatchDB(db)
+		b.AttachStorage(storageDir)
+		err := b.purgeBucket(report, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// removeObject removes the object of the file from disk if it's still there
+func (b *Bucket) removeObject(fdir *FileDir, report *GCReport, p *pace.Pacer) error {
+	if fdir.IsDir {
+		return nil
+	}
+	name := b.objectPath(fdir)
+	if name == "" {
+		return nil
+	}
+	err := p.Do(func() error {
+		return removeFile(b.db, name)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errs.FS(err)
+	}
+	report.Objects++
+	report.Bytes += fdir.Size
+	return nil
+}
+
+// purge removes the object, the tags and the row of a soft deleted file
+//
+// Visible entity layout buckets are what filebrowser shows, their files are
+// only forgotten once they are gone from disk, so their objects are left alone
+func (b *Bucket) purge(fdir *FileDir, report *GCReport, p *pace.Pacer) error {
+	if b.Hidden() || b.layout().Name() != EntityLayoutName {
+		err := b.removeObject(fdir, report, p)
+		if err != nil {
+			return err
+		}
+	}
+	return p.Do(func() error {
+		err := b.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Where(
+				"bucket_id = ? AND entity_id = ? AND entity_type = ? AND path = ?",
+				b.ID, b.EntityID, b.EntityType, fdir.Path,
+			).Delete(&Tag{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Unscoped().Where(
+				"bucket_id = ? AND entity_id = ? AND entity_type = ? AND path = ? AND deleted_at IS NOT NULL",
+				b.ID, b.EntityID, b.EntityType, fdir.Path,
+			).Delete(&FileDir{}).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		report.Files++
+		return nil
+	})
+}
+
+// purgeBucket removes the files, tags, grants and the row of a soft deleted bucket
+func (b *Bucket) purgeBucket(report *GCReport, p *pace.Pacer) error {
+	for {
+		var fdirs []FileDir
+		err := p.Do(func() error {
+			return b.scope().Unscoped().Order("path").Limit(gcBatch).Find(&fdirs).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(fdirs) == 0 {
+			break
+		}
+		paths := make([]string, len(fdirs))
+		for i := range fdirs {
+			paths[i] = fdirs[i].Path
+			err = b.removeObject(&fdirs[i], report, p)
+			if err != nil {
+				return err
+			}
+		}
+		err = p.Do(func() error {
+			return b.scope().Unscoped().Where("path IN ?", paths).Delete(&FileDir{}).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		report.Files += len(fdirs)
+	}
+	err := purgeTemps(b.db, b.storageDir, report, p,
+		"bucket_id = ? AND entity_id = ? AND entity_type = ?", b.ID, b.EntityID, b.EntityType,
+	)
+	if err == nil {
+		err = purgeTrash(b.db, b.storageDir, report, p,
+			"bucket_id = ? AND entity_id = ? AND entity_type = ?", b.ID, b.EntityID, b.EntityType,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if b.layout().Name() == EntityLayoutName {
+		err := p.Do(func() error {
+			return removeAll(b.db, b.Dir())
+		})
+		if err != nil {
+			return errs.FS(err)
+		}
+	}
+	return p.Do(func() error {
+		scope := "bucket_id = ? AND entity_id = ? AND entity_type = ?"
+		err := b.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Where(scope, b.ID, b.EntityID, b.EntityType).Delete(&Grant{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Where(scope, b.ID, b.EntityID, b.EntityType).Delete(&Tag{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Unscoped().Where(
+				"id = ? AND entity_id = ? AND entity_type = ? AND deleted_at IS NOT NULL",
+				b.ID, b.EntityID, b.EntityType,
+			).Delete(&Bucket{}).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		report.Buckets++
+		return nil
+	})
+}
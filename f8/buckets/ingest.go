@@ -0,0 +1,302 @@
+package buckets
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/plan"
+	"github.com/phanirithvij/fate/f8/validate"
+	"github.com/phanirithvij/fate/f8/workers"
+	"gorm.io/gorm"
+)
+
+// IngestOptions the options of Ingest
+type IngestOptions struct {
+	// Link hard links the files into the storage instead of copying them
+	//
+	// The bucket and the directory then share the contents of the files,
+	// they are copied anyway across filesystems
+	Link bool
+	// Layout of the bucket if Ingest creates it, default EntityLayoutName
+	Layout string
+	// Workers how many files are read at once, see Concurrency, and the
+	// progress of the files written
+	Workers workers.Options
+}
+
+// IngestReport what an Ingest did
+type IngestReport struct {
+	BatchReport
+	// Created whether the bucket was created
+	Created bool `json:"created"`
+	// Dirs the number of directories
+	Dirs int `json:"dirs"`
+	// Skipped the files which were already in the bucket with the same
+	// size and modification time and the symlinks and special files
+	Skipped int `json:"skipped"`
+}
+
+// Ingest imports the directory tree at dir into a bucket of an existing entity
+//
+// The bucket is created if it's missing. The files are written BatchSize
+// at a time like WriteFiles does, keeping their modes and modification times,
+// and the files already ingested are skipped so an interrupted Ingest can be
+// run again. The files in the bucket but not in dir are left alone.
+func Ingest(db *gorm.DB, storageDir, entityType, entityID, bID, dir string, opts IngestOptions) (*IngestReport, error) {
+	return IngestContext(context.Background(), db, storageDir, entityType, entityID, bID, dir, opts)
+}
+
+// IngestContext is Ingest reading the next files with workers while the
+// current one is written
+//
+// Once ctx is done the ingest stops and returns its error, the files
+// written until then are kept and a next run skips them.
+func IngestContext(ctx context.Context, db *gorm.DB, storageDir, entityType, entityID, bID, dir string, opts IngestOptions) (*IngestReport, error) {
+	err := validate.BucketName(bID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	if !info.IsDir() {
+		return nil, errs.New(errs.ErrInvalidOption, dir+" isn't a directory")
+	}
+	exists, err := OwnerExists(db, entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errs.New(errs.ErrEntityNotFound, entityType+" "+entityID)
+	}
+	report := &IngestReport{}
+	b, err := Find(db, entityType, entityID, bID)
+	if errors.Is(err, errs.ErrBucketNotFound) {
+		if opts.Layout != "" {
+			if _, ok := LookupLayout(opts.Layout); !ok {
+				return nil, errs.New(errs.ErrInvalidOption, "Unknown layout "+opts.Layout)
+			}
+		}
+		b = NewBucket(bID, db)
+		b.EntityID, b.EntityType, b.Layout = entityID, entityType, opts.Layout
+		tx := db.Create(b)
+		if tx.Error != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+		}
+		report.Created = tx.RowsAffected > 0
+		if report.Created {
+			b.PublishCreated()
+		} else {
+			// another ingest created it since
+			b, err = Find(db, entityType, entityID, bID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	b.AttachStorage(storageDir)
+	if b.layout().Name() == EntityLayoutName {
+		err = mkdirAll(db, b.Dir())
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+	}
+
+	// what's already there, to skip it
+	var have []FileDir
+	err = b.scope().Select("path", "size", "mod_time").Where("is_dir = ?", false).Find(&have).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	ingested := make(map[string]FileDir, len(have))
+	for _, f := range have {
+		ingested[f.Path] = f
+	}
+
+	type dirInfo struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirInfo
+	var todo []*ingestFile
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, dirInfo{p, info.Mode(), info.ModTime()})
+			return nil
+		}
+		f, ok := ingested[p]
+		if !info.Mode().IsRegular() || ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime()) {
+			report.Skipped++
+			return nil
+		}
+		todo = append(todo, &ingestFile{
+			BatchFile: BatchFile{Path: p, Link: name, Mode: info.Mode().Perm(), ModTime: info.ModTime()},
+			size:      info.Size(),
+		})
+		return nil
+	})
+	if cerr := ctx.Err(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	// the sources copied are opened by the workers, a few files ahead of WriteFiles
+	files := workers.Map(ctx, withConcurrency(opts.Workers), todo, func(ctx context.Context, f *ingestFile) (*ingestFile, error) {
+		if opts.Link {
+			return f, nil
+		}
+		src, err := os.Open(f.Link)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		f.body, err = prefetch(src, f.size)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		f.Body, f.Link = f.body, ""
+		return f, nil
+	})
+	defer files.Close()
+	var last *ingestFile
+	batch, err := b.WriteFiles(func() (*BatchFile, error) {
+		if last != nil {
+			// asking for the next one, it was written
+			last.Close()
+			files.Done(last.size)
+			last = nil
+		}
+		f, err := files.Next()
+		if err != nil {
+			return nil, err
+		}
+		last = f
+		return &f.BatchFile, nil
+	})
+	if last != nil {
+		last.Close()
+	}
+	report.BatchReport = *batch
+	if err != nil {
+		return report, err
+	}
+	// after the files so their writes don't change the times of the directories
+	for _, d := range dirs {
+		_, err = b.mkdir(d.path, d.mode, d.modTime)
+		if err != nil {
+			return report, err
+		}
+		report.Dirs++
+	}
+	return report, nil
+}
+
+// ingestFile a file of the tree of an Ingest, its source prefetched once it's copied
+type ingestFile struct {
+	BatchFile
+	size int64
+	body *prefetched
+}
+
+// Close closes the source of the file
+func (f *ingestFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+// stageLink stages the file at the clean path p by hard linking src into the storage
+//
+// The source keeps its mode and times, they're the object's too.
+// Falls back to copying src when it's on another filesystem.
+func (b *Bucket) stageLink(p, src string) (*FileDir, int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, 0, errs.FS(err)
+	}
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	oldSize := fdir.Size
+	fdir.IsDir = false
+	fdir.LinkType, fdir.LinkTarget = "", ""
+	size := info.Size()
+	if b.MaxUploadSize > 0 && size > b.MaxUploadSize {
+		return nil, 0, errs.TooLarge(b.MaxUploadSize)
+	}
+	if b.Quota > 0 && b.Used-oldSize+size > b.Quota {
+		b.publish(events.QuotaExceeded, fdir.Path, map[string]interface{}{"quota": b.Quota, "used": b.Used})
+		return nil, 0, errs.New(errs.ErrQuotaExceeded, "Writing "+p+" to bucket "+b.ID)
+	}
+	name := b.objectPath(fdir)
+	r, err := os.Open(src)
+	if err != nil {
+		return nil, 0, errs.FS(err)
+	}
+	defer r.Close()
+	if dry := plan.Of(b.db); dry != nil {
+		dry.Record(plan.Link, name+" <- "+src)
+	} else {
+		err = link(src, name)
+		if errors.Is(err, syscall.EXDEV) {
+			return b.stage(p, r, info.Mode(), info.ModTime())
+		}
+		if err != nil {
+			return nil, 0, errs.FS(err)
+		}
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(r, head)
+	fdir.Size = size
+	fdir.Mode = info.Mode().Perm()
+	fdir.ModTime = info.ModTime()
+	fdir.ContentType = detectContentType(fdir.Name, head[:n])
+	return fdir, oldSize, nil
+}
+
+// link hard links src to name creating its parents
+func link(src, name string) error {
+	err := os.MkdirAll(filepath.Dir(name), 0766)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(name), tempPrefix+filepath.Base(name))
+	// left behind by an interrupted link
+	os.Remove(tmp)
+	err = os.Link(src, tmp)
+	if err != nil {
+		return err
+	}
+	// a no-op once renamed
+	defer os.Remove(tmp)
+	return os.Rename(tmp, name)
+}
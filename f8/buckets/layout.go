@@ -0,0 +1,124 @@
+package buckets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"path"
+	"sync"
+)
+
+// Names of the builtin layouts
+const (
+	// EntityLayoutName files live at <entity_type>/<entity_id>/<bucket>/<path>
+	EntityLayoutName = "entity"
+	// FlatLayoutName files live at objects/flat/ab/cd/<hash>
+	FlatLayoutName = "flat"
+	// DateLayoutName files live at objects/date/2006/01/02/<hash>
+	DateLayoutName = "date"
+)
+
+// Layout maps the files of a bucket to object keys in the storage backend
+//
+// The layout of a bucket is recorded in the bucket's row so it must not
+// change once the bucket has files in it
+type Layout interface {
+	// Name the name under which the layout is registered
+	Name() string
+	// Key returns the slash separated object key of the file
+	//
+	// An empty key means the file has no object of its own
+	// which is the case for directories in non hierarchical layouts
+	Key(b *Bucket, f *FileDir) string
+}
+
+var (
+	layoutsMu sync.RWMutex
+	layouts   = map[string]Layout{
+		EntityLayoutName: EntityLayout{},
+		FlatLayoutName:   FlatLayout{},
+		DateLayoutName:   DateLayout{},
+	}
+)
+
+// RegisterLayout registers a layout so buckets can refer to it by name
+//
+// Registering a layout with an existing name replaces it
+func RegisterLayout(l Layout) {
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
+	layouts[l.Name()] = l
+}
+
+// LookupLayout returns the layout registered for the name
+func LookupLayout(name string) (Layout, bool) {
+	layoutsMu.RLock()
+	defer layoutsMu.RUnlock()
+	l, ok := layouts[name]
+	return l, ok
+}
+
+// layout returns the bucket's layout falling back to the entity layout
+func (b *Bucket) layout() Layout {
+	if b.Layout == "" {
+		return EntityLayout{}
+	}
+	l, ok := LookupLayout(b.Layout)
+	if !ok {
+		log.Println("[f8][WARNING]: Unknown layout", b.Layout, "for bucket", b.ID, "using", EntityLayoutName)
+		return EntityLayout{}
+	}
+	return l
+}
+
+// EntityLayout keeps a real directory tree per entity and bucket
+//
+// This is the default layout and it's what filebrowser sees on disk
+type EntityLayout struct{}
+
+// Name of the layout
+func (EntityLayout) Name() string { return EntityLayoutName }
+
+// Key of the file
+func (EntityLayout) Key(b *Bucket, f *FileDir) string {
+	return path.Join(b.EntityType, b.EntityID, b.ID, f.Path)
+}
+
+// FlatLayout spreads the files over a fixed two level fanout of hashes
+//
+// Avoids huge directories on disk and hot prefixes on S3
+type FlatLayout struct{}
+
+// Name of the layout
+func (FlatLayout) Name() string { return FlatLayoutName }
+
+// Key of the file
+func (FlatLayout) Key(b *Bucket, f *FileDir) string {
+	if f.IsDir {
+		return ""
+	}
+	h := objectHash(b, f)
+	return path.Join("objects", FlatLayoutName, h[:2], h[2:4], h)
+}
+
+// DateLayout groups the files by the day they were created
+//
+// Useful for append mostly buckets where old days can be archived together
+type DateLayout struct{}
+
+// Name of the layout
+func (DateLayout) Name() string { return DateLayoutName }
+
+// Key of the file
+func (DateLayout) Key(b *Bucket, f *FileDir) string {
+	if f.IsDir {
+		return ""
+	}
+	return path.Join("objects", DateLayoutName, f.CreatedAt.UTC().Format("2006/01/02"), objectHash(b, f))
+}
+
+// objectHash a hash unique to the file inside the storage
+func objectHash(b *Bucket, f *FileDir) string {
+	sum := sha256.Sum256([]byte(path.Join(b.EntityType, b.EntityID, b.ID, f.Path)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,397 @@
+package buckets
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+)
+
+const (
+	// LinkSymlink a symbolic link, its LinkTarget the path it points to
+	LinkSymlink = "symlink"
+	// LinkHard a file sharing its contents on disk with the file at its LinkTarget
+	LinkHard = "hardlink"
+)
+
+const (
+	// LinksPreserve keeps the symlinks as links, the default
+	//
+	// They're synced and exported as links, mirrored as symlinks and
+	// can't be downloaded
+	LinksPreserve = "preserve"
+	// LinksFollow reads the symlinks as the files they point to
+	LinksFollow = "follow"
+	// LinksReject refuses the symlinks, syncs skip them, exports
+	// and mirrors leave them out and they can't be created
+	LinksReject = "reject"
+)
+
+// maxLinkHops the most symlinks followed to reach a file, more is a loop
+const maxLinkHops = 8
+
+// ValidLinkPolicy whether p is a link policy, empty being the default
+func ValidLinkPolicy(p string) bool {
+	switch p {
+	case "", LinksPreserve, LinksFollow, LinksReject:
+		return true
+	}
+	return false
+}
+
+// LinkPolicy how the bucket handles its symlinks, LinksPreserve unless set
+func (b *Bucket) LinkPolicy() string {
+	if b.Links == "" {
+		return LinksPreserve
+	}
+	return b.Links
+}
+
+// SetLinks sets how the bucket handles its symlinks, see LinksPreserve
+//
+// The symlinks already recorded are refused from then on
+// with LinksReject, the next Sync forgets them
+func (b *Bucket) SetLinks(policy string) error {
+	if !ValidLinkPolicy(policy) {
+		return errs.New(errs.ErrInvalidOption, "Unknown link policy "+policy)
+	}
+	tx := b.pk().UpdateColumn("links", policy)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	Forget(b)
+	b.Links = policy
+	return nil
+}
+
+// IsSymlink whether the row is a symbolic link
+func (f *FileDir) IsSymlink() bool {
+	return f.LinkType == LinkSymlink
+}
+
+// RelTarget the slash separated target of the link relative to its directory, eg. to recreate it on disk
+func (f *FileDir) RelTarget() string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(f.Path)), filepath.FromSlash(f.LinkTarget))
+	if err != nil {
+		return f.LinkTarget
+	}
+	return filepath.ToSlash(rel)
+}
+
+// linkTarget resolves the target of a link at the clean path p to a clean path of the bucket
+//
+// Relative targets are relative to the directory of the link, absolute ones
+// to the root of the bucket. Targets outside of the bucket are refused.
+func linkTarget(p, target string) (string, error) {
+	target = filepath.ToSlash(target)
+	if target == "" {
+		return "", errs.New(errs.ErrInvalidPath, "Link "+p+" has no target")
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join(path.Dir(p), target)
+	}
+	target = path.Clean(strings.TrimPrefix(target, "/"))
+	if target == "." || target == ".." || strings.HasPrefix(target, "../") {
+		return "", errs.New(errs.ErrInvalidPath, "Link "+p+" points outside of the bucket")
+	}
+	if target == p {
+		return "", errs.New(errs.ErrInvalidPath, "Link "+p+" points to itself")
+	}
+	return target, nil
+}
+
+// writable refuses the clean path p when one of its parents is a symlink
+//
+// What's written there would land wherever the link points. The entity
+// layout buckets also check that the parents on disk resolve inside the
+// bucket's directory, the links sync left out are there too.
+func (b *Bucket) writable(p string) error {
+	var parents []string
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	if len(parents) == 0 {
+		return nil
+	}
+	var links []FileDir
+	tx := b.scope().Select("path").Where("path IN ? AND link_type = ?", parents, LinkSymlink).Limit(1).Find(&links)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if len(links) > 0 {
+		return errs.New(errs.ErrInvalidPath, p+" is under the link "+links[0].Path)
+	}
+	if b.storageDir == "" || b.layout().Name() != EntityLayoutName {
+		return nil
+	}
+	err := b.inDir(filepath.Join(b.Dir(), filepath.FromSlash(path.Dir(p))))
+	if err != nil {
+		return errs.New(errs.ErrInvalidPath, p+" is under a link on disk")
+	}
+	return nil
+}
+
+// inDir returns an error unless name resolves inside the bucket's directory
+//
+// The symlinks of the existing part of name are followed, the rest is taken as is
+func (b *Bucket) inDir(name string) error {
+	root, err := filepath.EvalSymlinks(b.Dir())
+	if os.IsNotExist(err) {
+		// nothing on disk yet, nothing to follow
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			name = filepath.Join(real, rest)
+			break
+		}
+		parent := filepath.Dir(name)
+		if !os.IsNotExist(err) || parent == name {
+			return err
+		}
+		if _, err := os.Lstat(name); err == nil {
+			// a dangling link, where it goes can change
+			return errs.ErrInvalidPath
+		}
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errs.ErrInvalidPath
+	}
+	return nil
+}
+
+// Symlink creates a symbolic link at p pointing to target
+//
+// The target is relative to the directory of p, or to the root of the bucket
+// if it starts with a slash, and must stay inside the bucket. It doesn't
+// have to exist. Entity layout buckets get the link on disk too.
+func (b *Bucket) Symlink(target, p string) (*FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	if b.LinkPolicy() == LinksReject {
+		return nil, errs.New(errs.ErrInvalidOption, "Bucket "+b.ID+" doesn't allow links")
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	target, err = linkTarget(p, target)
+	if err != nil {
+		return nil, err
+	}
+	var fdir *FileDir
+	err = b.WithLock(p, func(b *Bucket) (err error) {
+		fdir, err = b.symlinkLocked(target, p, clock.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.publish(events.FileWritten, fdir.Path, map[string]interface{}{"link": fdir.LinkTarget})
+	return fdir, nil
+}
+
+// symlinkLocked records the link at the clean path p to the clean target holding its lock
+func (b *Bucket) symlinkLocked(target, p string, modTime time.Time) (*FileDir, error) {
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if fdir.IsDir {
+		return nil, errs.New(errs.ErrIsDir, p+" is a directory")
+	}
+	oldSize := fdir.Size
+	fdir.IsDir = false
+	fdir.Size = 0
+	fdir.Mode = os.ModeSymlink | 0777
+	fdir.ModTime = modTime
+	fdir.ContentType = ""
+	fdir.LinkType = LinkSymlink
+	fdir.LinkTarget = target
+	if b.layout().Name() == EntityLayoutName {
+		name := b.objectPath(fdir)
+		// the target on disk, lexically inside the bucket may not be
+		err = b.inDir(filepath.Join(filepath.Dir(name), filepath.FromSlash(fdir.RelTarget())))
+		if err != nil {
+			return nil, errs.New(errs.ErrInvalidPath, "Link "+p+" points outside of the bucket")
+		}
+		err = os.MkdirAll(filepath.Dir(name), 0766)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		tmp := filepath.Join(filepath.Dir(name), tempPrefix+filepath.Base(name))
+		os.Remove(tmp)
+		err = os.Symlink(filepath.FromSlash(fdir.RelTarget()), tmp)
+		if err == nil {
+			err = os.Rename(tmp, name)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return nil, errs.FS(err)
+		}
+		// the time of the link on disk so Sync sees it unchanged
+		if info, err := os.Lstat(name); err == nil {
+			fdir.ModTime = info.ModTime()
+		}
+	}
+	err = b.ensureParents(p, modTime)
+	if err != nil {
+		return nil, err
+	}
+	err = b.save(fdir)
+	if err != nil {
+		return nil, err
+	}
+	return fdir, b.addUsed(-oldSize)
+}
+
+// Readlink returns the target of the symlink at p, a path of the bucket
+func (b *Bucket) Readlink(p string) (string, error) {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fdir.IsSymlink() {
+		return "", errs.New(errs.ErrInvalidPath, fdir.Path+" is not a link")
+	}
+	return fdir.LinkTarget, nil
+}
+
+// Resolve returns the row of the file at p reads go to
+//
+// Symlinks are followed if the bucket follows them and refused otherwise
+func (b *Bucket) Resolve(p string) (*FileDir, error) {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return b.follow(fdir)
+}
+
+// follow returns the row the file reads from following the link policy
+//
+// Only LinksFollow reads through the symlinks, the other policies refuse them
+func (b *Bucket) follow(fdir *FileDir) (*FileDir, error) {
+	for hops := 0; fdir.IsSymlink(); hops++ {
+		if b.LinkPolicy() != LinksFollow {
+			return nil, errs.New(errs.ErrInvalidOption, fdir.Path+" is a link to "+fdir.LinkTarget)
+		}
+		if hops == maxLinkHops {
+			return nil, errs.New(errs.ErrInvalidPath, "Too many links to reach "+fdir.Path)
+		}
+		next, err := b.Stat(fdir.LinkTarget)
+		if err != nil {
+			return nil, err
+		}
+		fdir = next
+	}
+	return fdir, nil
+}
+
+// recordLink records the symlink found on disk at the clean path p
+//
+// Returns false if it's left out, when the bucket rejects the links or
+// it points outside of the bucket, its row if any is then forgotten.
+// A link to another link is recorded as is, reads follow the chain.
+func (b *Bucket) recordLink(p string, info os.FileInfo) (bool, error) {
+	if b.LinkPolicy() == LinksReject {
+		return false, b.forgetLink(p)
+	}
+	dest, err := os.Readlink(filepath.Join(b.Dir(), filepath.FromSlash(p)))
+	if err != nil {
+		return false, errs.FS(err)
+	}
+	if filepath.IsAbs(dest) {
+		// only the absolute links into the bucket's directory stay in it
+		rel, err := filepath.Rel(b.Dir(), dest)
+		if err != nil {
+			return false, b.forgetLink(p)
+		}
+		dest = "/" + filepath.ToSlash(rel)
+	}
+	target, err := linkTarget(p, dest)
+	if err != nil {
+		return false, b.forgetLink(p)
+	}
+	cur, err := b.Stat(p)
+	if err == nil && cur.IsSymlink() && cur.LinkTarget == target && cur.ModTime.Equal(info.ModTime()) {
+		return true, nil
+	}
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return false, err
+	}
+	oldSize := fdir.Size
+	fdir.IsDir = false
+	fdir.Size = 0
+	fdir.Mode = os.ModeSymlink | info.Mode().Perm()
+	fdir.ModTime = info.ModTime()
+	fdir.ContentType = ""
+	fdir.LinkType = LinkSymlink
+	fdir.LinkTarget = target
+	err = b.ensureParents(p, clock.Now())
+	if err != nil {
+		return false, err
+	}
+	err = b.save(fdir)
+	if err != nil {
+		return false, err
+	}
+	return true, b.addUsed(-oldSize)
+}
+
+// forgetLink forgets the row of a symlink left out of the bucket
+func (b *Bucket) forgetLink(p string) error {
+	_, err := b.Stat(p)
+	if err != nil {
+		return nil
+	}
+	return b.forget(p)
+}
+
+// hardlinks finds the files of the bucket's directory sharing their contents
+//
+// Returns the path of the first file of every group for the others,
+// only the files of the same size are compared
+func hardlinks(files map[string]os.FileInfo) map[string]string {
+	bySize := map[int64][]string{}
+	for p, info := range files {
+		bySize[info.Size()] = append(bySize[info.Size()], p)
+	}
+	links := map[string]string{}
+	for _, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		for i, p := range paths {
+			if _, ok := links[p]; ok {
+				continue
+			}
+			for _, q := range paths[i+1:] {
+				if _, ok := links[q]; !ok && os.SameFile(files[p], files[q]) {
+					links[q] = p
+				}
+			}
+		}
+	}
+	return links
+}
@@ -0,0 +1,75 @@
+package buckets_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+	Name               string
+}
+
+// bucket returns the default bucket of a new user
+func bucket(t *testing.T, env *fatetest.Env) *buckets.Bucket {
+	t.Helper()
+	e := env.Entity(t, "users", "bob")
+	env.Create(t, e, &user{BaseEntity: e, Name: "bob"})
+	return env.Bucket(t, e, "")
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	b := bucket(t, env)
+	env.WriteFile(t, b, "t/x", "x")
+
+	_, err := b.Symlink("../../../t", "top/a/b/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Symlink("../../../../OUTSIDE.txt", "top/a/b/s/e")
+	if !errors.Is(err, errs.ErrInvalidPath) {
+		t.Errorf("a link under a link: got %v want %v", err, errs.ErrInvalidPath)
+	}
+	_, err = b.WriteFile("top/a/b/s/f", strings.NewReader("f"))
+	if !errors.Is(err, errs.ErrInvalidPath) {
+		t.Errorf("a write under a link: got %v want %v", err, errs.ErrInvalidPath)
+	}
+	for _, name := range []string{"e", "f"} {
+		if _, err := os.Lstat(filepath.Join(b.Dir(), "t", name)); err == nil {
+			t.Errorf("t/%s was created through the link", name)
+		}
+	}
+}
+
+func TestWriteUnderDiskLink(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	b := bucket(t, env)
+	outside := t.TempDir()
+	// left on disk by another app, never synced
+	err := os.Symlink(outside, filepath.Join(b.Dir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.WriteFile("out/f", strings.NewReader("f"))
+	if !errors.Is(err, errs.ErrInvalidPath) {
+		t.Errorf("a write under a link on disk: got %v want %v", err, errs.ErrInvalidPath)
+	}
+	_, err = b.Symlink("/out/g", "g")
+	if !errors.Is(err, errs.ErrInvalidPath) {
+		t.Errorf("a link through a link on disk: got %v want %v", err, errs.ErrInvalidPath)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "f")); err == nil {
+		t.Error("f was written outside of the bucket")
+	}
+}
@@ -0,0 +1,154 @@
+package buckets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+const (
+	// DefaultListLimit the page size used when ListOptions.Limit is 0
+	DefaultListLimit = 100
+	// MaxListLimit the largest page size allowed
+	MaxListLimit = 1000
+)
+
+// SortBy the order of the files in a List
+type SortBy string
+
+const (
+	// SortByName orders by the base name then the path
+	SortByName SortBy = "name"
+	// SortByPath orders by the path, a depth first walk of the bucket
+	SortByPath SortBy = "path"
+	// SortBySize orders by the size then the path
+	SortBySize SortBy = "size"
+	// SortByModTime orders by the modification time then the path
+	SortByModTime SortBy = "mod_time"
+)
+
+// ListOptions the options of a List
+type ListOptions struct {
+	// Limit the page size, default DefaultListLimit and at most MaxListLimit
+	Limit int
+	// Cursor the NextCursor of the previous page, empty for the first page
+	Cursor string
+	// Prefix only lists the files whose path starts with it, eg. "docs/"
+	Prefix string
+	// SortBy the order of the files, default SortByName
+	SortBy SortBy
+}
+
+// ListPage a page of files
+type ListPage struct {
+	Files []FileDir `json:"files"`
+	// NextCursor the cursor of the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursor the sort key of the last file of a page
+type cursor struct {
+	SortBy  SortBy    `json:"s"`
+	Path    string    `json:"p"`
+	Name    string    `json:"n,omitempty"`
+	Size    int64     `json:"z,omitempty"`
+	ModTime time.Time `json:"t,omitempty"`
+}
+
+func (c *cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string, sortBy SortBy) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	c := &cursor{}
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		return nil, errs.New(errs.ErrInvalidOption, "Invalid cursor")
+	}
+	if c.SortBy != sortBy {
+		return nil, errs.New(errs.ErrInvalidOption, "Cursor is for sorting by "+string(c.SortBy))
+	}
+	return c, nil
+}
+
+// List returns a page of the files and directories of the bucket
+//
+// Pages are fetched with keyset pagination so only a page is ever loaded
+// and files written between pages are neither skipped nor repeated
+func (b *Bucket) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+	if opts.SortBy == "" {
+		opts.SortBy = SortByName
+	}
+	col := ""
+	switch opts.SortBy {
+	case SortByName, SortBySize, SortByModTime:
+		col = string(opts.SortBy)
+	case SortByPath:
+	default:
+		return nil, errs.New(errs.ErrInvalidOption, "Cannot sort by "+string(opts.SortBy))
+	}
+
+	tx := b.scope().WithContext(ctx)
+	if prefix := strings.TrimPrefix(opts.Prefix, "/"); prefix != "" {
+		tx = tx.Where("SUBSTR(path, 1, ?) = ?", len(prefix), prefix)
+	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor, opts.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		var last interface{}
+		switch opts.SortBy {
+		case SortByName:
+			last = c.Name
+		case SortBySize:
+			last = c.Size
+		case SortByModTime:
+			last = c.ModTime
+		}
+		if col == "" {
+			tx = tx.Where("path > ?", c.Path)
+		} else {
+			tx = tx.Where("("+col+" > ? OR ("+col+" = ? AND path > ?))", last, last, c.Path)
+		}
+	}
+	if col != "" {
+		tx = tx.Order(col)
+	}
+
+	page := &ListPage{}
+	// one more to know whether there is a next page
+	tx = tx.Order("path").Limit(opts.Limit + 1).Find(&page.Files)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if len(page.Files) > opts.Limit {
+		page.Files = page.Files[:opts.Limit]
+		last := page.Files[opts.Limit-1]
+		page.NextCursor = (&cursor{
+			SortBy:  opts.SortBy,
+			Path:    last.Path,
+			Name:    last.Name,
+			Size:    last.Size,
+			ModTime: last.ModTime,
+		}).encode()
+	}
+	return page, nil
+}
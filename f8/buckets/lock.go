@@ -0,0 +1,175 @@
+package buckets
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"path"
+	"sync"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// fileLock a lock of one file and the number of goroutines holding or waiting for it
+type fileLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+var (
+	locksMu sync.Mutex
+	locks   = map[string]*fileLock{}
+	// advisory also take postgres advisory locks, see AdvisoryLocks
+	advisory bool
+)
+
+// AdvisoryLocks has WithLock also take a postgres advisory lock of the file
+//
+// Needed when several instances write to the same database and storage,
+// the in-process locks only keep the goroutines of one instance apart.
+// It's ignored on the other databases.
+func AdvisoryLocks(enabled bool) {
+	advisory = enabled
+}
+
+// lockKey the key of the file of the bucket shared by every instance
+func (b *Bucket) lockKey(p string) string {
+	return path.Join(b.EntityType, b.EntityID, b.ID, p)
+}
+
+// WithLock runs fn holding the lock of the file at name
+//
+// Writes and removals of the file by other goroutines, or other instances
+// with AdvisoryLocks, wait for fn to return. fn gets a copy of the bucket
+// which already holds the lock, the writes of the file have to go through it.
+// The lock is advisory, files are locked by their path only so a removal
+// of a directory doesn't wait on the writes under it.
+func (b *Bucket) WithLock(name string, fn func(b *Bucket) error) error {
+	if b.db == nil {
+		return errs.ErrNotAttached
+	}
+	p, err := cleanPath(name)
+	if err != nil {
+		return err
+	}
+	if b.held[p] {
+		return fn(b)
+	}
+	unlock, err := b.lock(p)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	locked := *b
+	locked.held = make(map[string]bool, len(b.held)+1)
+	for k := range b.held {
+		locked.held[k] = true
+	}
+	locked.held[p] = true
+	err = fn(&locked)
+	b.Used = locked.Used
+	return err
+}
+
+// lock locks the clean path p, returning the function unlocking it
+func (b *Bucket) lock(p string) (unlock func(), err error) {
+	key := b.lockKey(p)
+	release := localLock(key)
+	if !advisory || b.db.Dialector.Name() != "postgres" {
+		return release, nil
+	}
+	conn, err := b.advisoryLock(key)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		b.advisoryUnlock(conn, key)
+		release()
+	}, nil
+}
+
+// localLock takes the in-process lock of the key, returning the function releasing it
+func localLock(key string) (release func()) {
+	locksMu.Lock()
+	l, ok := locks[key]
+	if !ok {
+		l = &fileLock{}
+		locks[key] = l
+	}
+	l.refs++
+	locksMu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(locks, key)
+		}
+		locksMu.Unlock()
+	}
+}
+
+// tryLocalLock takes the in-process lock of the key if it's free
+func tryLocalLock(key string) (release func(), ok bool) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l, held := locks[key]
+	if !held {
+		l = &fileLock{}
+	}
+	if !l.mu.TryLock() {
+		return nil, false
+	}
+	locks[key] = l
+	l.refs++
+	return func() {
+		l.mu.Unlock()
+		locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(locks, key)
+		}
+		locksMu.Unlock()
+	}, true
+}
+
+// advisoryID the postgres advisory lock id of the key
+func advisoryID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// advisoryLock takes the session advisory lock of the key on a connection of its own
+//
+// The lock belongs to the connection, it's released on the same one by advisoryUnlock
+func (b *Bucket) advisoryLock(key string) (*sql.Conn, error) {
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", advisoryID(key))
+	if err != nil {
+		conn.Close()
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return conn, nil
+}
+
+// advisoryUnlock releases the advisory lock of the key and the connection holding it
+func (b *Bucket) advisoryUnlock(conn *sql.Conn, key string) {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryID(key))
+	if err != nil {
+		// closing the connection releases it anyway, make sure it's not reused
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	conn.Close()
+}
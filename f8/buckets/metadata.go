@@ -0,0 +1,43 @@
+package buckets
+
+import (
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"gorm.io/gorm"
+)
+
+// SetMetadata sets a metadata key of the bucket and saves it
+func (b *Bucket) SetMetadata(key string, value interface{}) error {
+	b.Metadata.Set(key, value)
+	err := b.pk().UpdateColumn("metadata", b.Metadata).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	Forget(b)
+	return nil
+}
+
+// SetFileMetadata sets a metadata key of the file at p and saves it
+func (b *Bucket) SetFileMetadata(p, key string, value interface{}) (*FileDir, error) {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir.Metadata.Set(key, value)
+	tx := b.scope().Where("path = ?", fdir.Path).UpdateColumn("metadata", fdir.Metadata)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	return fdir, nil
+}
+
+// FilesWithMetadata returns the files of the bucket whose metadata key is set to value
+func (b *Bucket) FilesWithMetadata(key string, value interface{}) (fdirs []FileDir, err error) {
+	tx := b.scope().Scopes(WhereMetadata(key, value)).Order("path").Find(&fdirs)
+	return fdirs, errs.Wrap(errs.ErrDatabase, tx.Error)
+}
+
+// WhereMetadata a scope filtering buckets or files by a metadata key and value
+func WhereMetadata(key string, value interface{}) func(*gorm.DB) *gorm.DB {
+	return metadata.Where("metadata", key, value)
+}
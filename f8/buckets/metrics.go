@@ -0,0 +1,71 @@
+package buckets
+
+import (
+	"github.com/phanirithvij/fate/f8/metrics"
+	"gorm.io/gorm"
+)
+
+// UploadedBytes the bytes written to each bucket
+var UploadedBytes = metrics.Default.NewCounter("fate_bucket_uploaded_bytes_total",
+	"Bytes written to the bucket", "entity_type", "entity_id", "bucket")
+
+// DownloadedBytes the bytes read from each bucket, counted by the servers of the files
+var DownloadedBytes = metrics.Default.NewCounter("fate_bucket_downloaded_bytes_total",
+	"Bytes read from the bucket", "entity_type", "entity_id", "bucket")
+
+// labels the label values of the bucket's series
+func (b *Bucket) labels() []string {
+	return []string{b.EntityType, b.EntityID, b.ID}
+}
+
+// downloadMeter counts the downloads for the usage reports, nil for none
+var downloadMeter func(b *Bucket, n int64)
+
+// MeterDownloads has CountDownload also call meter, eg. usage.Meter.Download
+func MeterDownloads(meter func(b *Bucket, n int64)) {
+	downloadMeter = meter
+}
+
+// CountDownload adds n bytes read from the bucket to DownloadedBytes
+func (b *Bucket) CountDownload(n int64) {
+	DownloadedBytes.Add(float64(n), b.labels()...)
+	if meter := downloadMeter; meter != nil && !b.Hidden() {
+		meter(b, n)
+	}
+}
+
+// RegisterMetrics registers the file count and usage gauges of every bucket
+//
+// They are read from db on every scrape, call it once
+func RegisterMetrics(db *gorm.DB) {
+	type row struct {
+		EntityType string
+		EntityID   string
+		BucketID   string
+		N          float64
+	}
+	gauge := func(query func() *gorm.DB) func() ([]metrics.Sample, error) {
+		return func() ([]metrics.Sample, error) {
+			rows := []row{}
+			tx := query().Scan(&rows)
+			if tx.Error != nil {
+				return nil, tx.Error
+			}
+			samples := make([]metrics.Sample, len(rows))
+			for i, r := range rows {
+				samples[i] = metrics.Sample{LabelValues: []string{r.EntityType, r.EntityID, r.BucketID}, Value: r.N}
+			}
+			return samples, nil
+		}
+	}
+	metrics.Default.NewGaugeFunc("fate_bucket_files", "Files in the bucket",
+		gauge(func() *gorm.DB {
+			return db.Model(&FileDir{}).Where("is_dir = ?", false).
+				Select("entity_type, entity_id, bucket_id, COUNT(*) AS n").
+				Group("entity_type, entity_id, bucket_id")
+		}), "entity_type", "entity_id", "bucket")
+	metrics.Default.NewGaugeFunc("fate_bucket_used_bytes", "Bytes used by the files of the bucket",
+		gauge(func() *gorm.DB {
+			return db.Model(&Bucket{}).Select("entity_type, entity_id, id AS bucket_id, used AS n")
+		}), "entity_type", "entity_id", "bucket")
+}
@@ -0,0 +1,230 @@
+package buckets
+
+import (
+	"errors"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+)
+
+// Move renames the file or directory at src to dst along with everything under it
+//
+// The parents of dst are created as needed. Returns errs.ErrFileExists if dst
+// exists and errs.ErrInvalidPath when moving a directory into itself.
+// The files keep their rows, so their metadata and tags, and the usage is unchanged.
+func (b *Bucket) Move(src, dst string) (*FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	src, err := cleanPath(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return nil, err
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return nil, errs.New(errs.ErrInvalidPath, "Cannot move "+src+" into itself")
+	}
+	// always locked in the same order so opposite moves don't deadlock
+	first, second := src, dst
+	if second < first {
+		first, second = second, first
+	}
+	var moved *FileDir
+	err = b.WithLock(first, func(b *Bucket) error {
+		return b.WithLock(second, func(b *Bucket) (err error) {
+			moved, err = b.moveLocked(src, dst)
+			return err
+		})
+	})
+	return moved, err
+}
+
+// underPath narrows the query to the rows of the clean path p and everything under it
+func underPath(tx *gorm.DB, p string) *gorm.DB {
+	prefix := p + "/"
+	return tx.Where("path = ? OR SUBSTR(path, 1, ?) = ?", p, len(prefix), prefix)
+}
+
+// absent returns errs.ErrFileExists if there's a file or directory at p
+func (b *Bucket) absent(p string) error {
+	_, err := b.Stat(p)
+	if err == nil {
+		return errs.New(errs.ErrFileExists, p)
+	}
+	if errors.Is(err, errs.ErrFileNotFound) {
+		return nil
+	}
+	return err
+}
+
+// moveLocked moves the clean path src to dst holding the locks of both
+func (b *Bucket) moveLocked(src, dst string) (*FileDir, error) {
+	fdirs, err := b.Tree(src)
+	if err != nil {
+		return nil, err
+	}
+	err = b.absent(dst)
+	if err != nil {
+		return nil, err
+	}
+	err = b.writable(dst)
+	if err != nil {
+		return nil, err
+	}
+	err = b.ensureParents(dst, clock.Now())
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	entityLayout := b.layout().Name() == EntityLayoutName
+	// the objects renamed so far, put back if the move fails
+	var renamed [][2]string
+	err = b.db.Transaction(func(tx *gorm.DB) error {
+		scope := "bucket_id = ? AND entity_id = ? AND entity_type = ?"
+		// the deleted files at the destination are in the way of the unique paths
+		err := underPath(tx.Unscoped().Where(scope+" AND deleted_at IS NOT NULL", b.ID, b.EntityID, b.EntityType), dst).Delete(&FileDir{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range fdirs {
+			f := &fdirs[i]
+			oldPath, oldName := f.Path, b.objectPath(f)
+			f.Path = dst + strings.TrimPrefix(f.Path, src)
+			f.Name = path.Base(f.Path)
+			err := tx.Model(&FileDir{}).Where(scope+" AND path = ?", b.ID, b.EntityID, b.EntityType, oldPath).
+				UpdateColumns(map[string]interface{}{"path": f.Path, "name": f.Name}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&Tag{}).Where(scope+" AND path = ?", b.ID, b.EntityID, b.EntityType, oldPath).
+				UpdateColumn("path", f.Path).Error
+			if err != nil {
+				return err
+			}
+			if entityLayout || f.IsDir {
+				continue
+			}
+			newName := b.objectPath(f)
+			err = rename(b.db, oldName, newName)
+			if err != nil {
+				return err
+			}
+			renamed = append(renamed, [2]string{oldName, newName})
+		}
+		if entityLayout {
+			oldName := filepath.Join(b.Dir(), filepath.FromSlash(src))
+			newName := filepath.Join(b.Dir(), filepath.FromSlash(dst))
+			err := rename(b.db, oldName, newName)
+			if err != nil {
+				return err
+			}
+			renamed = append(renamed, [2]string{oldName, newName})
+		}
+		return nil
+	})
+	if err != nil {
+		for i := len(renamed) - 1; i >= 0; i-- {
+			if rerr := rename(b.db, renamed[i][1], renamed[i][0]); rerr != nil {
+				log.Println("[f8][WARNING]: Failed to put back", renamed[i][0], rerr)
+			}
+		}
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	// subscribers see the move as src deleted and the files written at dst,
+	// with where they went or came from
+	b.forgetThumbnails(src)
+	b.publish(events.FileDeleted, src, map[string]interface{}{"to": dst})
+	for i := range fdirs {
+		if !fdirs[i].IsDir {
+			b.thumbnail(&fdirs[i])
+			b.publish(events.FileWritten, fdirs[i].Path, map[string]interface{}{
+				"size": fdirs[i].Size,
+				"from": src + strings.TrimPrefix(fdirs[i].Path, dst),
+			})
+		}
+	}
+	return &fdirs[0], nil
+}
+
+// Copy copies the file or directory at src to dst along with everything under it
+//
+// See CopyTo
+func (b *Bucket) Copy(src, dst string) (*FileDir, error) {
+	return b.CopyTo(b, src, dst)
+}
+
+// CopyTo copies the file or directory at src to dst in the bucket to, which can be of another entity
+//
+// Like Move dst can't exist and its parents are created as needed. The copies
+// keep the modes, modification times, metadata and tags of the files and
+// count towards the quota of to. A failed copy leaves what was copied so far.
+func (b *Bucket) CopyTo(to *Bucket, src, dst string) (*FileDir, error) {
+	if b.db == nil || to.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	src, err := cleanPath(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return nil, err
+	}
+	same := b.ID == to.ID && b.EntityID == to.EntityID && b.EntityType == to.EntityType
+	if same && (dst == src || strings.HasPrefix(dst, src+"/")) {
+		return nil, errs.New(errs.ErrInvalidPath, "Cannot copy "+src+" into itself")
+	}
+	fdirs, err := b.Tree(src)
+	if err != nil {
+		return nil, err
+	}
+	err = to.absent(dst)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fdirs {
+		f := &fdirs[i]
+		target := dst + strings.TrimPrefix(f.Path, src)
+		if f.IsDir {
+			_, err = to.mkdir(target, f.Mode, f.ModTime)
+		} else {
+			err = b.copyTo(to, f, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(f.Metadata) > 0 {
+			err = to.scope().Where("path = ?", target).UpdateColumn("metadata", f.Metadata).Error
+			if err != nil {
+				return nil, errs.Wrap(errs.ErrDatabase, err)
+			}
+		}
+		tags, err := b.Tags(f.Path)
+		if err == nil {
+			err = to.Tag(target, tags...)
+		}
+		if err != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, err)
+		}
+	}
+	return to.Stat(dst)
+}
+
+// copyTo copies the contents of the file to the path p of the bucket to
+func (b *Bucket) copyTo(to *Bucket, f *FileDir, p string) error {
+	r, err := b.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = to.WriteFileInfo(p, r, f.Mode, f.ModTime)
+	return err
+}
@@ -0,0 +1,324 @@
+package buckets
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+const (
+	// IssueMissingObject a file row whose object isn't on disk
+	IssueMissingObject = "missing object"
+	// IssueUntrackedFile a file in an entity layout bucket directory without a row
+	IssueUntrackedFile = "untracked file"
+	// IssueSizeMismatch a file row whose size isn't the size of its object
+	IssueSizeMismatch = "size mismatch"
+	// IssueUsageDrift a bucket whose usage counter isn't the sum of its files
+	IssueUsageDrift = "usage counter drifted"
+	// IssueUntrackedBucket a bucket directory without a bucket row
+	IssueUntrackedBucket = "untracked bucket directory"
+	// IssueUnreferencedObject an object of the flat or date layouts no file row points to
+	IssueUnreferencedObject = "unreferenced object"
+	// IssueOrphanBucket a bucket whose entity row was hard deleted
+	IssueOrphanBucket = "orphan bucket"
+)
+
+// orphanGrace files on disk younger than this are left alone,
+// their rows may not be written yet
+const orphanGrace = time.Hour
+
+// OrphanOptions the options of CollectOrphans
+type OrphanOptions struct {
+	// DryRun only reports the orphans, nothing is changed
+	DryRun bool
+	// Pacer keeps it from competing with production traffic, nil runs it flat out
+	Pacer *pace.Pacer
+}
+
+// OrphanReport the orphans found by CollectOrphans
+type OrphanReport struct {
+	Problems []Problem `json:"problems"`
+	// Fixed the number of problems cleaned up, always 0 on a dry run
+	Fixed int `json:"fixed"`
+}
+
+// CollectOrphans finds what the database and the storage directory disagree on and cleans it up
+//
+// The rows of missing objects are forgotten and the untracked files of entity
+// layout buckets synced in. Bucket directories without a row and unreferenced
+// objects are removed from disk. The buckets of hard deleted entities are soft
+// deleted, the regular GC purges them after the retention.
+func CollectOrphans(db *gorm.DB, storageDir string, opts OrphanOptions) (*OrphanReport, error) {
+	p := opts.Pacer
+	report := &OrphanReport{Problems: []Problem{}}
+	problem := func(b *Bucket, path, issue string) {
+		report.Problems = append(report.Problems, Problem{
+			EntityType: b.EntityType,
+			EntityID:   b.EntityID,
+			BucketID:   b.ID,
+			Path:       path,
+			Issue:      issue,
+		})
+	}
+	fixed := func(err error) error {
+		if err == nil {
+			report.Fixed++
+		}
+		return err
+	}
+
+	var bucks []*Bucket
+	err := p.Do(func() error {
+		return db.Unscoped().Find(&bucks).Error
+	})
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	known := make(map[[3]string]bool, len(bucks))
+	types := map[string]bool{}
+	referenced := map[string]bool{}
+	entities := map[[2]string]bool{}
+	for _, b := range bucks {
+		b.AttatchDB(db)
+		b.AttachStorage(storageDir)
+		known[[3]string{b.EntityType, b.EntityID, b.ID}] = true
+		types[b.EntityType] = true
+		if b.layout().Name() != EntityLayoutName {
+			// the rows of deleted files still own their objects until the GC purges them
+			err := b.referencedObjects(referenced, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if b.DeletedAt.Valid {
+			continue
+		}
+
+		key := [2]string{b.EntityType, b.EntityID}
+		exists, ok := entities[key]
+		if !ok {
+			exists, err = entityExists(db, b.EntityType, b.EntityID, p)
+			if err != nil {
+				return nil, err
+			}
+			entities[key] = exists
+		}
+		if !exists {
+			problem(b, "", IssueOrphanBucket)
+			if !opts.DryRun {
+				if !b.Delete() {
+					return nil, errs.New(errs.ErrDatabase, "Failed to delete bucket "+b.ID)
+				}
+				report.Fixed++
+			}
+			continue
+		}
+
+		found := len(report.Problems)
+		var fdirs []FileDir
+		err = p.Do(func() (err error) {
+			fdirs, err = b.Files()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		rows := make(map[string]bool, len(fdirs))
+		for i := range fdirs {
+			fdir := &fdirs[i]
+			rows[fdir.Path] = true
+			if fdir.IsDir {
+				continue
+			}
+			name := b.objectPath(fdir)
+			err := p.Do(func() error {
+				_, err := os.Stat(name)
+				return err
+			})
+			if os.IsNotExist(err) {
+				problem(b, fdir.Path, IssueMissingObject)
+				if !opts.DryRun && b.layout().Name() != EntityLayoutName {
+					err = fixed(p.Do(func() error {
+						return b.forget(fdir.Path)
+					}))
+					if err != nil {
+						return nil, errs.Wrap(errs.ErrDatabase, err)
+					}
+				}
+				continue
+			}
+			if err != nil {
+				return nil, errs.FS(err)
+			}
+		}
+		if b.layout().Name() != EntityLayoutName {
+			continue
+		}
+		root := b.Dir()
+		err = walkOld(root, func(name string, info os.FileInfo) error {
+			rel, err := filepath.Rel(root, name)
+			if err != nil {
+				return err
+			}
+			if p := filepath.ToSlash(rel); !rows[p] {
+				problem(b, p, IssueUntrackedFile)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		if n := len(report.Problems) - found; n > 0 && !opts.DryRun {
+			// Sync forgets the missing files and adopts the untracked ones in one go
+			err := p.Do(func() error {
+				_, err := b.Sync()
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			report.Fixed += n
+		}
+	}
+
+	for t := range types {
+		err := untrackedBuckets(storageDir, t, known, func(b *Bucket) error {
+			problem(b, "", IssueUntrackedBucket)
+			if opts.DryRun {
+				return nil
+			}
+			return fixed(p.Do(func() error {
+				return os.RemoveAll(b.Dir())
+			}))
+		})
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+	}
+
+	for _, name := range []string{FlatLayoutName, DateLayoutName} {
+		root := filepath.Join(storageDir, "objects", name)
+		err := walkOld(root, func(name string, info os.FileInfo) error {
+			if info.IsDir() || referenced[name] {
+				return nil
+			}
+			rel, err := filepath.Rel(storageDir, name)
+			if err != nil {
+				return err
+			}
+			problem(&Bucket{}, filepath.ToSlash(rel), IssueUnreferencedObject)
+			if opts.DryRun {
+				return nil
+			}
+			return fixed(p.Do(func() error {
+				return os.Remove(name)
+			}))
+		})
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+	}
+	return report, nil
+}
+
+// referencedObjects adds the objects of every file row of the bucket, deleted or not
+func (b *Bucket) referencedObjects(referenced map[string]bool, p *pace.Pacer) error {
+	var fdirs []FileDir
+	err := p.Do(func() error {
+		return b.scope().Unscoped().Where("is_dir = ?", false).Find(&fdirs).Error
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	for i := range fdirs {
+		if name := b.objectPath(&fdirs[i]); name != "" {
+			referenced[name] = true
+		}
+	}
+	return nil
+}
+
+// entityExists whether the row of the entity is still in its table, soft deleted or not
+//
+// Types without a table are assumed to exist, the bucket may belong to a schema not loaded
+func entityExists(db *gorm.DB, entityType, id string, p *pace.Pacer) (bool, error) {
+	if !db.Migrator().HasTable(entityType) {
+		log.Println("[f8][WARNING]: No table for entity type", entityType, "skipping its orphan buckets")
+		return true, nil
+	}
+	var n int64
+	err := p.Do(func() error {
+		return db.Unscoped().Table(entityType).Where("id = ?", id).Count(&n).Error
+	})
+	if err != nil {
+		return false, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return n > 0, nil
+}
+
+// untrackedBuckets calls fn with the bucket of every <storage>/<type>/<id>/<bucket>
+// directory older than orphanGrace without a bucket row
+func untrackedBuckets(storageDir, entityType string, known map[[3]string]bool, fn func(*Bucket) error) error {
+	root := filepath.Join(storageDir, entityType)
+	ids, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	old := clock.Now().Add(-orphanGrace)
+	for _, id := range ids {
+		if !id.IsDir() {
+			continue
+		}
+		dirs, err := os.ReadDir(filepath.Join(root, id.Name()))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() || known[[3]string{entityType, id.Name(), dir.Name()}] {
+				continue
+			}
+			info, err := dir.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(old) {
+				continue
+			}
+			b := &Bucket{ID: dir.Name(), EntityID: id.Name(), EntityType: entityType}
+			b.AttachStorage(storageDir)
+			err = fn(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkOld walks the files under root older than orphanGrace, skipping the temp files
+//
+// A missing root has nothing to walk
+func walkOld(root string, fn func(name string, info os.FileInfo) error) error {
+	old := clock.Now().Add(-orphanGrace)
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if name == root || isTemp(name) || info.ModTime().After(old) {
+			return nil
+		}
+		return fn(name, info)
+	})
+}
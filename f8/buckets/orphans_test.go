@@ -0,0 +1,158 @@
+package buckets_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+// mkfile writes the file, creating its directories
+func mkfile(t *testing.T, name string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err == nil {
+		err = os.WriteFile(name, []byte("x"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exists whether the name is on disk, links aren't followed
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// issues returns the sorted "bucket path issue" of the problems
+func issues(report *buckets.OrphanReport) []string {
+	var found []string
+	for _, p := range report.Problems {
+		found = append(found, p.EntityID+"/"+p.BucketID+" "+p.Path+" "+p.Issue)
+	}
+	sort.Strings(found)
+	return found
+}
+
+func TestCollectOrphans(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	env := fatetest.New(t, fatetest.Models(&user{}), fatetest.Clock(c))
+	alice := env.Entity(t, "users", "alice")
+	env.Create(t, alice, &user{BaseEntity: alice, Name: "alice"})
+	b := env.Bucket(t, alice, "")
+	env.Files(t, b, map[string]string{"a.txt": "a", "gone.txt": "gone"})
+	carol := env.Entity(t, "users", "carol")
+	env.Create(t, carol, &user{BaseEntity: carol, Name: "carol"})
+	env.WriteFile(t, env.Bucket(t, carol, ""), "c.txt", "c")
+	dave := env.Entity(t, "users", "dave", entity.BucketLayout(buckets.FlatLayoutName))
+	env.Create(t, dave, &user{BaseEntity: dave, Name: "dave"})
+	flat := env.Bucket(t, dave, "")
+	env.WriteFile(t, flat, "d.txt", "d")
+
+	users := filepath.Join(env.Dir, "users")
+	outside := t.TempDir()
+	mkfile(t, filepath.Join(outside, "bucket", "keep.txt"))
+	mkfile(t, filepath.Join(b.Dir(), "untracked.txt"))
+	if err := os.Remove(filepath.Join(b.Dir(), "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	mkfile(t, filepath.Join(users, "alice", "stale", "s.txt"))
+	mkfile(t, filepath.Join(users, "bob", "default", "b.txt"))
+	mkfile(t, filepath.Join(users, "alice", "young", "y.txt"))
+	mkfile(t, filepath.Join(env.Dir, "objects", buckets.FlatLayoutName, "stray"))
+	mkfile(t, filepath.Join(env.Dir, "other", "x", "y", "z.txt"))
+	// the links are never followed, what they point to isn't the storage's
+	for link, target := range map[string]string{
+		filepath.Join(users, "alice", "linked"): filepath.Join(outside, "bucket"),
+		filepath.Join(users, "mallory"):         outside,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// carol's row is hard deleted behind f8's back
+	if err := env.DB.Exec("DELETE FROM users WHERE id = ?", "carol").Error; err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(2 * time.Hour)
+	young := filepath.Join(users, "alice", "young")
+	if err := os.Chtimes(young, c.Now(), c.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"/ objects/flat/stray unreferenced object",
+		"alice/default gone.txt missing object",
+		"alice/default untracked.txt untracked file",
+		"alice/stale  untracked bucket directory",
+		"bob/default  untracked bucket directory",
+		"carol/default  orphan bucket",
+	}
+	report, err := buckets.CollectOrphans(env.DB, env.Dir, buckets.OrphanOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issues(report); len(got) != len(want) || report.Fixed != 0 {
+		t.Fatalf("dry run: got %q fixing %d want %q", got, report.Fixed, want)
+	}
+	for i, issue := range issues(report) {
+		if issue != want[i] {
+			t.Errorf("got %q want %q", issue, want[i])
+		}
+	}
+	for _, name := range []string{filepath.Join(users, "alice", "stale"), filepath.Join(users, "bob"), filepath.Join(env.Dir, "objects", "flat", "stray")} {
+		if !exists(name) {
+			t.Errorf("the dry run removed %s", name)
+		}
+	}
+
+	report, err = buckets.CollectOrphans(env.DB, env.Dir, buckets.OrphanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Fixed != len(want) {
+		t.Errorf("fixed %d of %q", report.Fixed, issues(report))
+	}
+	for name, kept := range map[string]bool{
+		filepath.Join(users, "alice", "stale"):             false,
+		filepath.Join(users, "bob", "default"):             false,
+		filepath.Join(env.Dir, "objects", "flat", "stray"): false,
+		filepath.Join(b.Dir(), "a.txt"):                    true,
+		filepath.Join(b.Dir(), "untracked.txt"):            true,
+		filepath.Join(users, "carol", "default", "c.txt"):  true,
+		young:                                              true,
+		filepath.Join(users, "alice", "linked"):            true,
+		filepath.Join(users, "mallory"):                    true,
+		filepath.Join(outside, "bucket", "keep.txt"):       true,
+		filepath.Join(env.Dir, "other", "x", "y", "z.txt"): true,
+	} {
+		if exists(name) != kept {
+			t.Errorf("%s: got kept %v want %v", name, !kept, kept)
+		}
+	}
+	if got := env.ReadFile(t, flat, "d.txt"); got != "d" {
+		t.Errorf("the flat object was changed to %q", got)
+	}
+	if _, err = b.Stat("untracked.txt"); err != nil {
+		t.Errorf("the untracked file wasn't synced in: %v", err)
+	}
+	if _, err = b.Stat("gone.txt"); err == nil {
+		t.Error("the missing file is still there")
+	}
+	if _, err = buckets.Find(env.DB, "users", "carol", "default"); err == nil {
+		t.Error("the orphan bucket isn't deleted")
+	}
+
+	// what's left is consistent
+	report, err = buckets.CollectOrphans(env.DB, env.Dir, buckets.OrphanOptions{DryRun: true})
+	if err != nil || len(report.Problems) != 0 {
+		t.Errorf("after the cleanup: %q %v", issues(report), err)
+	}
+}
@@ -0,0 +1,52 @@
+package buckets
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/phanirithvij/fate/f8/workers"
+)
+
+// readAhead the most bytes of a file read by a worker before it's written
+//
+// The small files are read whole, the workers hold Concurrency of them at most
+const readAhead = 256 << 10
+
+// concurrency the number of files Sync, Ingest and ExportArchive read at once, see Concurrency
+var concurrency int
+
+// Concurrency sets the number of files Sync, Ingest and ExportArchive read at once
+//
+// Their rows and archive entries are still written one at a time.
+// 0 for workers.DefaultConcurrency, 1 to read them one after the other.
+func Concurrency(n int) {
+	concurrency = n
+}
+
+// withConcurrency the options with the Concurrency set if they have none
+func withConcurrency(opts workers.Options) workers.Options {
+	if opts.Concurrency == 0 {
+		opts.Concurrency = concurrency
+	}
+	return opts
+}
+
+// prefetched a file opened by a worker, its first bytes already read
+type prefetched struct {
+	io.Reader
+	io.Closer
+}
+
+// prefetch reads up to readAhead bytes of the file of the given size
+func prefetch(f io.ReadCloser, size int64) (*prefetched, error) {
+	if size > readAhead {
+		size = readAhead
+	}
+	head := make([]byte, size)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	return &prefetched{Reader: io.MultiReader(bytes.NewReader(head[:n]), f), Closer: f}, nil
+}
@@ -0,0 +1,197 @@
+package buckets
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Step a step of a pipeline, the registered processor and its options
+type Step struct {
+	Processor string            `json:"processor"`
+	Options   metadata.Metadata `json:"options,omitempty"`
+}
+
+// Pipeline the ordered steps the files written to a bucket go through
+//
+// Buckets without a pipeline only get their images thumbnailed
+type Pipeline []Step
+
+// Value serializes the pipeline for the database
+func (p Pipeline) Value() (driver.Value, error) {
+	if p == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]Step(p))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan deserializes the pipeline from the database
+func (p *Pipeline) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.New("Unsupported pipeline value")
+	}
+	var out Pipeline
+	if len(b) > 0 {
+		err := json.Unmarshal(b, &out)
+		if err != nil {
+			return err
+		}
+	}
+	*p = out
+	return nil
+}
+
+// GormDataType the general data type of the pipeline
+func (Pipeline) GormDataType() string {
+	return "json"
+}
+
+// GormDBDataType the column type of the pipeline for the database
+func (Pipeline) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return metadata.Metadata{}.GormDBDataType(db, field)
+}
+
+// Processor a post-processing step the written files can go through
+type Processor interface {
+	// Name the name under which the processor is registered
+	Name() string
+	// Validate checks the options of a step before it's saved
+	Validate(opts metadata.Metadata) error
+	// Process processes the file written to the bucket
+	//
+	// Return an ErrRejected error to stop the pipeline, eg. after removing the file
+	Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error
+}
+
+// ErrRejected a processor rejected the file, the rest of the pipeline is skipped
+var ErrRejected = errors.New("File rejected")
+
+var (
+	processorsMu sync.RWMutex
+	processors   = map[string]Processor{}
+)
+
+// RegisterProcessor registers a processor so pipelines can refer to it by name
+//
+// Registering a processor with an existing name replaces it
+func RegisterProcessor(p Processor) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	processors[p.Name()] = p
+}
+
+// LookupProcessor returns the processor registered for the name
+func LookupProcessor(name string) (Processor, bool) {
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	p, ok := processors[name]
+	return p, ok
+}
+
+// pipelineQueue queues the processing of the written files, nil processes them in the write
+var pipelineQueue func(b *Bucket, p string) error
+
+// QueuePipeline has the written files of the buckets with a pipeline processed by
+// queue instead of in the write, eg. by a background job calling RunPipeline
+//
+// When queue fails they're processed in the write. nil restores that for every write.
+func QueuePipeline(queue func(b *Bucket, p string) error) {
+	pipelineQueue = queue
+}
+
+// SetPipeline validates the steps and saves them as the pipeline of the bucket
+//
+// An empty pipeline restores the default of only thumbnailing the images
+func (b *Bucket) SetPipeline(steps Pipeline) error {
+	if b.db == nil {
+		return errs.ErrNotAttached
+	}
+	for _, step := range steps {
+		proc, ok := LookupProcessor(step.Processor)
+		if !ok {
+			return errs.New(errs.ErrInvalidOption, "Unknown processor "+step.Processor)
+		}
+		err := proc.Validate(step.Options)
+		if err != nil {
+			return err
+		}
+	}
+	tx := b.pk().UpdateColumn("pipeline", steps)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	Forget(b)
+	b.Pipeline = steps
+	return nil
+}
+
+// process runs the bucket's pipeline on the written file, or queues it
+func (b *Bucket) process(fdir *FileDir) {
+	if len(b.Pipeline) == 0 {
+		b.thumbnail(fdir)
+		return
+	}
+	if b.Hidden() {
+		return
+	}
+	if queue := pipelineQueue; queue != nil {
+		err := queue(b, fdir.Path)
+		if err == nil {
+			return
+		}
+		log.Println("[f8][WARNING]: Failed to queue the processing of", fdir.Path, err)
+	}
+	err := b.RunPipeline(fdir.Path)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to process", fdir.Path, err)
+	}
+}
+
+// RunPipeline runs the steps of the bucket's pipeline on the file at p in order
+//
+// A step failing stops the pipeline, the steps before it have to be safe to run
+// again. A file rejected by a step or removed since isn't an error.
+func (b *Bucket) RunPipeline(p string) error {
+	for _, step := range b.Pipeline {
+		fdir, err := b.Stat(p)
+		if errors.Is(err, errs.ErrFileNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		proc, ok := LookupProcessor(step.Processor)
+		if !ok {
+			return errs.New(errs.ErrInvalidOption, "Unknown processor "+step.Processor)
+		}
+		err = proc.Process(b, fdir, step.Options)
+		if errors.Is(err, ErrRejected) {
+			log.Println("[f8][WARNING]: File", p, "rejected by", step.Processor, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
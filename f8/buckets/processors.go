@@ -0,0 +1,305 @@
+package buckets
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"image"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/metadata"
+)
+
+// Names of the builtin processors
+const (
+	// ChecksumProcessorName records the checksum of the file in its metadata
+	ChecksumProcessorName = "checksum"
+	// ThumbnailProcessorName generates the thumbnails of the images
+	ThumbnailProcessorName = "thumbnail"
+	// MetadataProcessorName records the width and height of the images in their metadata
+	MetadataProcessorName = "metadata"
+	// ModerationProcessorName removes the files not allowed in the bucket
+	ModerationProcessorName = "moderation"
+	// WebhookProcessorName POSTs the file's details to an endpoint
+	WebhookProcessorName = "webhook"
+)
+
+func init() {
+	for _, p := range []Processor{
+		ChecksumProcessor{},
+		ThumbnailProcessor{},
+		MetadataProcessor{},
+		ModerationProcessor{},
+		WebhookProcessor{},
+	} {
+		RegisterProcessor(p)
+	}
+}
+
+// optString the string option key, def if it isn't set
+func optString(opts metadata.Metadata, key, def string) (string, error) {
+	v, ok := opts[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", errs.New(errs.ErrInvalidOption, "Option "+key+" must be a string")
+	}
+	return s, nil
+}
+
+// optStrings the list of strings option key
+func optStrings(opts metadata.Metadata, key string) ([]string, error) {
+	v, ok := opts[key]
+	if !ok {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		out := make([]string, len(v))
+		for i := range v {
+			s, ok := v[i].(string)
+			if !ok {
+				return nil, errs.New(errs.ErrInvalidOption, "Option "+key+" must be a list of strings")
+			}
+			out[i] = s
+		}
+		return out, nil
+	}
+	return nil, errs.New(errs.ErrInvalidOption, "Option "+key+" must be a list of strings")
+}
+
+// optInt the integer option key, 0 if it isn't set
+func optInt(opts metadata.Metadata, key string) (int64, error) {
+	switch v := opts[key].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		// numbers decoded from json
+		if v == float64(int64(v)) {
+			return int64(v), nil
+		}
+	}
+	return 0, errs.New(errs.ErrInvalidOption, "Option "+key+" must be an integer")
+}
+
+// ChecksumProcessor records the hex checksum of the file in its metadata under the algorithm's name
+//
+// Options: {"algorithm": "sha256"}, one of md5, sha1, sha256 and sha512
+type ChecksumProcessor struct{}
+
+// Name of the processor
+func (ChecksumProcessor) Name() string { return ChecksumProcessorName }
+
+// checksumHash the hash of the algorithm option
+func checksumHash(opts metadata.Metadata) (string, hash.Hash, error) {
+	algorithm, err := optString(opts, "algorithm", "sha256")
+	if err != nil {
+		return "", nil, err
+	}
+	switch algorithm {
+	case "md5":
+		return algorithm, md5.New(), nil
+	case "sha1":
+		return algorithm, sha1.New(), nil
+	case "sha256":
+		return algorithm, sha256.New(), nil
+	case "sha512":
+		return algorithm, sha512.New(), nil
+	}
+	return "", nil, errs.New(errs.ErrInvalidOption, "Unknown checksum algorithm "+algorithm)
+}
+
+// Validate the options
+func (ChecksumProcessor) Validate(opts metadata.Metadata) error {
+	_, _, err := checksumHash(opts)
+	return err
+}
+
+// Process the file
+func (ChecksumProcessor) Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error {
+	algorithm, h, err := checksumHash(opts)
+	if err != nil {
+		return err
+	}
+	f, err := b.Open(fdir.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return errs.FS(err)
+	}
+	_, err = b.SetFileMetadata(fdir.Path, algorithm, hex.EncodeToString(h.Sum(nil)))
+	return err
+}
+
+// ThumbnailProcessor generates the thumbnails of the images, what buckets without a pipeline get
+type ThumbnailProcessor struct{}
+
+// Name of the processor
+func (ThumbnailProcessor) Name() string { return ThumbnailProcessorName }
+
+// Validate the options, there are none
+func (ThumbnailProcessor) Validate(opts metadata.Metadata) error { return nil }
+
+// Process the file
+func (ThumbnailProcessor) Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error {
+	err := b.GenerateThumbnails(fdir.Path)
+	if err != nil && !errors.Is(err, errs.ErrDatabase) {
+		// the image doesn't decode, trying again won't help
+		log.Println("[f8][WARNING]: Failed to generate the thumbnails of", fdir.Path, err)
+		return nil
+	}
+	return err
+}
+
+// MetadataProcessor records the "width" and "height" of the images in their metadata
+//
+// The other files are left alone
+type MetadataProcessor struct{}
+
+// Name of the processor
+func (MetadataProcessor) Name() string { return MetadataProcessorName }
+
+// Validate the options, there are none
+func (MetadataProcessor) Validate(opts metadata.Metadata) error { return nil }
+
+// Process the file
+func (MetadataProcessor) Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error {
+	if !strings.HasPrefix(fdir.ContentType, "image/") {
+		return nil
+	}
+	f, err := b.Open(fdir.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		// not a format we can decode
+		return nil
+	}
+	_, err = b.SetFileMetadata(fdir.Path, "width", cfg.Width)
+	if err != nil {
+		return err
+	}
+	_, err = b.SetFileMetadata(fdir.Path, "height", cfg.Height)
+	return err
+}
+
+// ModerationProcessor removes the files the bucket doesn't allow and rejects them
+//
+// Options: {"content_types": ["image/*", "application/pdf"], "deny_extensions": [".exe"], "max_size": 1048576}
+// Unset options allow everything.
+type ModerationProcessor struct{}
+
+// Name of the processor
+func (ModerationProcessor) Name() string { return ModerationProcessorName }
+
+// Validate the options
+func (ModerationProcessor) Validate(opts metadata.Metadata) error {
+	_, err := moderationReason(&FileDir{}, opts)
+	return err
+}
+
+// moderationReason why the file isn't allowed, empty if it is
+func moderationReason(fdir *FileDir, opts metadata.Metadata) (string, error) {
+	types, err := optStrings(opts, "content_types")
+	if err != nil {
+		return "", err
+	}
+	denied, err := optStrings(opts, "deny_extensions")
+	if err != nil {
+		return "", err
+	}
+	maxSize, err := optInt(opts, "max_size")
+	if err != nil {
+		return "", err
+	}
+	if maxSize > 0 && fdir.Size > maxSize {
+		return fmt.Sprintf("larger than %d bytes", maxSize), nil
+	}
+	ext := strings.ToLower(path.Ext(fdir.Name))
+	for _, d := range denied {
+		if ext != "" && ext == strings.ToLower(d) {
+			return "extension " + ext + " is denied", nil
+		}
+	}
+	if len(types) == 0 {
+		return "", nil
+	}
+	for _, t := range types {
+		if t == fdir.ContentType || strings.HasSuffix(t, "/*") && strings.HasPrefix(fdir.ContentType, strings.TrimSuffix(t, "*")) {
+			return "", nil
+		}
+	}
+	return "content type " + fdir.ContentType + " isn't allowed", nil
+}
+
+// Process the file
+func (ModerationProcessor) Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error {
+	reason, err := moderationReason(fdir, opts)
+	if err != nil || reason == "" {
+		return err
+	}
+	err = b.Remove(fdir.Path)
+	if err != nil && !errors.Is(err, errs.ErrFileNotFound) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrRejected, reason)
+}
+
+// WebhookProcessor POSTs a signed events.FileProcessed event with the file's details to an endpoint
+//
+// Options: {"url": "https://example.com/hook", "secret": "..."}, see events.Webhook.
+// The event's data has the size, content type and metadata recorded by the steps before it.
+type WebhookProcessor struct{}
+
+// Name of the processor
+func (WebhookProcessor) Name() string { return WebhookProcessorName }
+
+// Validate the options
+func (WebhookProcessor) Validate(opts metadata.Metadata) error {
+	raw, err := optString(opts, "url", "")
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errs.New(errs.ErrInvalidOption, "Webhook needs an http or https url")
+	}
+	_, err = optString(opts, "secret", "")
+	return err
+}
+
+// Process the file
+func (WebhookProcessor) Process(b *Bucket, fdir *FileDir, opts metadata.Metadata) error {
+	raw, _ := optString(opts, "url", "")
+	secret, _ := optString(opts, "secret", "")
+	w := &events.Webhook{URL: raw, Secret: []byte(secret)}
+	return w.Send(b.event(events.FileProcessed, fdir.Path, map[string]interface{}{
+		"size":         fdir.Size,
+		"content_type": fdir.ContentType,
+		"metadata":     fdir.Metadata,
+	}))
+}
@@ -0,0 +1,125 @@
+package buckets_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"gorm.io/gorm"
+)
+
+// used returns the stored usage counter of the bucket
+func used(t *testing.T, env *fatetest.Env, b *buckets.Bucket) int64 {
+	t.Helper()
+	var n int64
+	err := env.DB.Model(&buckets.Bucket{}).
+		Where("id = ? AND entity_id = ? AND entity_type = ?", b.ID, b.EntityID, b.EntityType).
+		Select("used").Scan(&n).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// temps returns the temporary files left in the bucket's directory
+func temps(t *testing.T, b *buckets.Bucket) []string {
+	t.Helper()
+	var left []string
+	err := filepath.Walk(b.Dir(), func(name string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), ".f8-upload-") {
+			left = append(left, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return left
+}
+
+func TestQuotaAcrossCopies(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	a := bucket(t, env)
+	err := a.SetQuota(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another request's copy of the bucket, it doesn't see the writes of a
+	b := env.Bucket(t, env.Entity(t, "users", "bob"), "")
+
+	_, err = a.WriteFile("a.txt", strings.NewReader("aaaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.WriteFile("b.txt", strings.NewReader("bbbbbb"))
+	if !errors.Is(err, errs.ErrQuotaExceeded) {
+		t.Errorf("the second write: got %v want %v", err, errs.ErrQuotaExceeded)
+	}
+	if n := used(t, env, a); n != 6 {
+		t.Errorf("got the usage %d want 6", n)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir(), "b.txt")); err == nil {
+		t.Error("the refused b.txt was left in the bucket")
+	}
+	if left := temps(t, b); len(left) > 0 {
+		t.Errorf("the refused write left %v", left)
+	}
+
+	// shrinking a file always fits
+	_, err = b.WriteFile("a.txt", strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := used(t, env, a); n != 1 {
+		t.Errorf("got the usage %d want 1", n)
+	}
+}
+
+func TestWriteFailureRollsBack(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	b := bucket(t, env)
+	env.WriteFile(t, b, "x", "old")
+	fail := errors.New("the save failed")
+	failing := false
+	for _, c := range []interface {
+		Register(string, func(*gorm.DB)) error
+	}{env.DB.Callback().Create().Before("gorm:create"), env.DB.Callback().Update().Before("gorm:update")} {
+		err := c.Register("test:fail_saves", func(tx *gorm.DB) {
+			if failing && tx.Statement.Table == "file_dirs" {
+				tx.AddError(fail)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failing = true
+	_, err := b.WriteFile("x", strings.NewReader("a longer one"))
+	if !errors.Is(err, fail) {
+		t.Errorf("overwriting x: got %v want %v", err, fail)
+	}
+	_, err = b.WriteFile("y", strings.NewReader("new"))
+	if !errors.Is(err, fail) {
+		t.Errorf("writing y: got %v want %v", err, fail)
+	}
+	failing = false
+
+	if n := used(t, env, b); n != 3 {
+		t.Errorf("got the usage %d want the 3 bytes of the old x", n)
+	}
+	if got := env.ReadFile(t, b, "x"); got != "old" {
+		t.Errorf("x was replaced by %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir(), "y")); err == nil {
+		t.Error("the object of the unsaved y was left in the bucket")
+	}
+	if left := temps(t, b); len(left) > 0 {
+		t.Errorf("the failed writes left %v", left)
+	}
+}
@@ -0,0 +1,134 @@
+package buckets
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultSearchLimit the page size when SearchOptions.Limit is 0
+	DefaultSearchLimit = 100
+	// MaxSearchLimit the largest page size Search returns
+	MaxSearchLimit = 1000
+)
+
+// SearchOptions the filters of a Search, zero values are ignored
+type SearchOptions struct {
+	// EntityType, EntityID and BucketID restrict the package level Search
+	// they are ignored by Bucket.Search
+	EntityType string
+	EntityID   string
+	BucketID   string
+	// Name a case insensitive substring of the base name
+	Name string
+	// Ext the file extension with or without the leading dot
+	Ext string
+	// Tags the files must have all of these tags
+	Tags []string
+	// MinSize and MaxSize the size range in bytes, MaxSize 0 for no upper bound
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter and ModifiedBefore the modification time range
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// IncludeDirs also match directories
+	IncludeDirs bool
+	// Limit and Offset the page of results
+	Limit  int
+	Offset int
+}
+
+// SearchResult a page of files matching a search
+type SearchResult struct {
+	Files []FileDir `json:"files"`
+	// Total the number of matches across all pages
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Search returns the files of the bucket matching the options ordered by path
+func (b *Bucket) Search(opts SearchOptions) (*SearchResult, error) {
+	return search(b.scope(), opts)
+}
+
+// Search returns the files across all buckets matching the options
+// ordered by entity, bucket and path
+func Search(db *gorm.DB, opts SearchOptions) (*SearchResult, error) {
+	q := db.Model(&FileDir{})
+	if opts.EntityType != "" {
+		q = q.Where("entity_type = ?", opts.EntityType)
+	}
+	if opts.EntityID != "" {
+		q = q.Where("entity_id = ?", opts.EntityID)
+	}
+	if opts.BucketID != "" {
+		q = q.Where("bucket_id = ?", opts.BucketID)
+	}
+	return search(q, opts)
+}
+
+func search(q *gorm.DB, opts SearchOptions) (*SearchResult, error) {
+	if !opts.IncludeDirs {
+		q = q.Where("is_dir = ?", false)
+	}
+	if opts.Name != "" {
+		q = q.Where(`LOWER(name) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(opts.Name))+"%")
+	}
+	if opts.Ext != "" {
+		ext := strings.ToLower(strings.TrimPrefix(opts.Ext, "."))
+		q = q.Where(`LOWER(name) LIKE ? ESCAPE '\'`, "%."+escapeLike(ext))
+	}
+	for _, name := range opts.Tags {
+		name, err := cleanTag(name)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where(
+			"EXISTS (SELECT 1 FROM tags WHERE tags.bucket_id = file_dirs.bucket_id"+
+				" AND tags.entity_id = file_dirs.entity_id AND tags.entity_type = file_dirs.entity_type"+
+				" AND tags.path = file_dirs.path AND tags.name = ?)",
+			name,
+		)
+	}
+	if opts.MinSize > 0 {
+		q = q.Where("size >= ?", opts.MinSize)
+	}
+	if opts.MaxSize > 0 {
+		q = q.Where("size <= ?", opts.MaxSize)
+	}
+	if !opts.ModifiedAfter.IsZero() {
+		q = q.Where("mod_time >= ?", opts.ModifiedAfter)
+	}
+	if !opts.ModifiedBefore.IsZero() {
+		q = q.Where("mod_time < ?", opts.ModifiedBefore)
+	}
+
+	res := &SearchResult{Files: []FileDir{}, Limit: opts.Limit, Offset: opts.Offset}
+	if res.Limit <= 0 {
+		res.Limit = DefaultSearchLimit
+	}
+	if res.Limit > MaxSearchLimit {
+		res.Limit = MaxSearchLimit
+	}
+	if res.Offset < 0 {
+		res.Offset = 0
+	}
+	tx := q.Session(&gorm.Session{}).Count(&res.Total)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	tx = q.Order("entity_type, entity_id, bucket_id, path").
+		Limit(res.Limit).Offset(res.Offset).Find(&res.Files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return res, nil
+}
@@ -0,0 +1,267 @@
+package buckets
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/workers"
+	"gorm.io/gorm"
+)
+
+// SyncReport what a Sync changed in the FileDir table
+type SyncReport struct {
+	// Added files found on disk without a row
+	Added int
+	// Updated rows whose size or modification time didn't match the disk
+	Updated int
+	// Removed rows whose files were missing on disk
+	Removed int
+	// Links the symlinks left out, rejected by the bucket or pointing outside of it
+	Links int
+}
+
+// errNotSyncable only buckets with the entity layout mirror a real directory tree
+var errNotSyncable = errs.New(errs.ErrInvalidOption, "Only buckets with the entity layout can be synced")
+
+// Sync reconciles the FileDir rows of the bucket with its directory on disk
+//
+// Needed while other processes (eg. filebrowser) write to the storage directory.
+// The symlinks are recorded as links following the bucket's LinkPolicy, never
+// the files they point to, and the files sharing their contents as hard links.
+func (b *Bucket) Sync() (*SyncReport, error) {
+	return b.SyncContext(context.Background(), workers.Options{})
+}
+
+// SyncContext is Sync reading the changed files with workers, see Concurrency
+//
+// The rows are written in the order of the walk as the files are read,
+// opts.Progress counts the changed paths. Once ctx is done the sync stops
+// and returns its error, what was recorded until then is kept.
+func (b *Bucket) SyncContext(ctx context.Context, opts workers.Options) (*SyncReport, error) {
+	if b.layout().Name() != EntityLayoutName {
+		return nil, errNotSyncable
+	}
+	fdirs, err := b.Files()
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]FileDir, len(fdirs))
+	for _, fdir := range fdirs {
+		rows[fdir.Path] = fdir
+	}
+
+	// the regular files, to find the hard links
+	files := map[string]os.FileInfo{}
+	var changed []*syncEntry
+	root := b.Dir()
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name == root || isTemp(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		row, ok := rows[p]
+		delete(rows, p)
+		if info.Mode()&os.ModeSymlink != 0 {
+			if ok && row.IsSymlink() && row.ModTime.Equal(info.ModTime()) && b.LinkPolicy() != LinksReject {
+				return nil
+			}
+		} else {
+			if info.Mode().IsRegular() {
+				files[p] = info
+			}
+			if ok && !row.IsSymlink() && row.IsDir == info.IsDir() && (info.IsDir() || row.Size == info.Size() && row.ModTime.Equal(info.ModTime())) {
+				return nil
+			}
+		}
+		changed = append(changed, &syncEntry{name: name, p: p, info: info, existed: ok})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SyncReport{}
+	results := workers.Map(ctx, withConcurrency(opts), changed, func(ctx context.Context, e *syncEntry) (*syncEntry, error) {
+		if !e.info.Mode().IsRegular() {
+			return e, nil
+		}
+		var err error
+		e.contentType, err = sniffFile(e.name)
+		return e, err
+	})
+	defer results.Close()
+	for {
+		e, err := results.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.info.Mode()&os.ModeSymlink != 0 {
+			recorded, err := b.recordLink(e.p, e.info)
+			if err != nil {
+				return nil, err
+			}
+			if !recorded {
+				report.Links++
+				results.Done(0)
+				continue
+			}
+		} else {
+			err = b.record(e.p, e.info, e.contentType)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if e.existed {
+			report.Updated++
+		} else {
+			report.Added++
+		}
+		if e.info.Mode().IsRegular() {
+			results.Done(e.info.Size())
+		} else {
+			results.Done(0)
+		}
+	}
+
+	// whatever is left was not found on disk
+	for p := range rows {
+		err = b.forget(p)
+		if err != nil {
+			return nil, err
+		}
+		report.Removed++
+	}
+	return report, b.syncHardlinks(fdirs, files)
+}
+
+// syncEntry a path of a Sync whose row is out of date
+type syncEntry struct {
+	// name the path on disk, p the clean path in the bucket
+	name string
+	p    string
+	info os.FileInfo
+	// existed whether it had a row
+	existed bool
+	// contentType of a regular file, sniffed by a worker
+	contentType string
+}
+
+// syncHardlinks records which of the regular files on disk share their contents
+func (b *Bucket) syncHardlinks(fdirs []FileDir, files map[string]os.FileInfo) error {
+	links := hardlinks(files)
+	for _, fdir := range fdirs {
+		if _, ok := links[fdir.Path]; !ok && fdir.LinkType == LinkHard {
+			links[fdir.Path] = ""
+		}
+	}
+	for p, target := range links {
+		linkType := LinkHard
+		if target == "" {
+			linkType = ""
+		}
+		tx := b.scope().Where("path = ?", p).Updates(map[string]interface{}{"link_type": linkType, "link_target": target})
+		if tx.Error != nil {
+			return errs.Wrap(errs.ErrDatabase, tx.Error)
+		}
+	}
+	return nil
+}
+
+// record upserts the row for the clean path p from the file info on disk
+//
+// The content type of a file is sniffed unless it's given
+func (b *Bucket) record(p string, info os.FileInfo, contentType string) error {
+	cur, err := b.Stat(p)
+	if err == nil && !cur.IsSymlink() && cur.IsDir == info.IsDir() && (cur.IsDir || cur.Size == info.Size() && cur.ModTime.Equal(info.ModTime())) {
+		// already up to date eg. written through the bucket
+		return nil
+	}
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return err
+	}
+	oldSize := fdir.Size
+	fdir.IsDir = info.IsDir()
+	fdir.ModTime = info.ModTime()
+	fdir.LinkType, fdir.LinkTarget = "", ""
+	if fdir.IsDir {
+		fdir.Size = 0
+		fdir.Mode = os.ModeDir | info.Mode().Perm()
+		fdir.ContentType = ""
+	} else {
+		fdir.Size = info.Size()
+		fdir.Mode = info.Mode().Perm()
+		fdir.ContentType = contentType
+		if contentType == "" {
+			fdir.ContentType, err = sniffFile(b.objectPath(fdir))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = b.ensureParents(p, clock.Now())
+	if err != nil {
+		return err
+	}
+	err = b.save(fdir)
+	if err != nil {
+		return err
+	}
+	err = b.addUsed(fdir.Size - oldSize)
+	if err != nil {
+		return err
+	}
+	if !fdir.IsDir {
+		b.process(fdir)
+		b.publish(events.FileWritten, p, map[string]interface{}{"size": fdir.Size})
+	}
+	return nil
+}
+
+// forget soft deletes the rows of the clean path p and everything under it
+//
+// The files on disk are not touched
+func (b *Bucket) forget(p string) error {
+	under := underPath(b.scope(), p)
+	var size int64
+	tx := under.Session(&gorm.Session{}).Where("is_dir = ?", false).Select("COALESCE(SUM(size), 0)").Scan(&size)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	tx = under.Session(&gorm.Session{}).Delete(&FileDir{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil
+	}
+	err := b.addUsed(-size)
+	if err != nil {
+		return err
+	}
+	b.forgetThumbnails(p)
+	b.publish(events.FileDeleted, p, nil)
+	return nil
+}
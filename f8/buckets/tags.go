@@ -0,0 +1,91 @@
+package buckets
+
+import (
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Tag a label attached to a file or directory
+//
+// Tags point at the FileDir by its bucket and path,
+// the same columns that make up the FileDir unique index
+type Tag struct {
+	CreatedAt  time.Time
+	BucketID   string `gorm:"primaryKey"`
+	EntityID   string `gorm:"primaryKey"`
+	EntityType string `gorm:"primaryKey"`
+	Path       string `gorm:"primaryKey"`
+	Name       string `gorm:"primaryKey;index"`
+}
+
+// cleanTag normalizes a tag name, tags are case insensitive
+func cleanTag(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", errs.New(errs.ErrInvalidOption, "Tag was empty")
+	}
+	return name, nil
+}
+
+// tagScope returns a query over the tags of the file at the clean path p
+func (b *Bucket) tagScope(p string) *gorm.DB {
+	return b.db.Model(&Tag{}).Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ? AND path = ?",
+		b.ID, b.EntityID, b.EntityType, p,
+	)
+}
+
+// Tag adds the tags to the file or directory at p
+func (b *Bucket) Tag(p string, names ...string) error {
+	fdir, err := b.Stat(p)
+	if err != nil {
+		return err
+	}
+	tags := []Tag{}
+	for _, name := range names {
+		name, err = cleanTag(name)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, Tag{
+			BucketID:   b.ID,
+			EntityID:   b.EntityID,
+			EntityType: b.EntityType,
+			Path:       fdir.Path,
+			Name:       name,
+		})
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return b.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error
+}
+
+// Untag removes the tags from the file or directory at p
+func (b *Bucket) Untag(p string, names ...string) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		names[i], err = cleanTag(name)
+		if err != nil {
+			return err
+		}
+	}
+	return b.tagScope(p).Where("name IN ?", names).Delete(&Tag{}).Error
+}
+
+// Tags returns the tags of the file or directory at p
+func (b *Bucket) Tags(p string) (names []string, err error) {
+	p, err = cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	tx := b.tagScope(p).Order("name").Pluck("name", &names)
+	return names, errs.Wrap(errs.ErrDatabase, tx.Error)
+}
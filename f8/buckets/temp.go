@@ -0,0 +1,252 @@
+package buckets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultTempTTL how long a temp object lives unless it's promoted
+	DefaultTempTTL = 24 * time.Hour
+	// tempDir where the temp objects are kept, under objects so Sync and Watch skip them
+	tempDir = "objects/temp"
+)
+
+// TempObject the row of a temp object, GC removes it once it expires
+type TempObject struct {
+	CreatedAt time.Time
+	// ID the name of the object on disk
+	ID         string `gorm:"primaryKey"`
+	BucketID   string `gorm:"index:temp_bucket_idx"`
+	EntityID   string `gorm:"index:temp_bucket_idx"`
+	EntityType string `gorm:"index:temp_bucket_idx"`
+	Size       int64
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+// Temp a scratch object of a bucket being written
+//
+// It doesn't show up in the bucket until it's promoted to a path,
+// objects that aren't promoted within their TTL are removed by GC
+type Temp struct {
+	obj    *TempObject
+	b      *Bucket
+	f      *os.File
+	closed bool
+	done   bool
+}
+
+// tempPath returns the path on disk of the temp object
+func tempPath(storageDir, id string) string {
+	return filepath.Join(storageDir, filepath.FromSlash(tempDir), id)
+}
+
+// CreateTemp creates a temp object in the bucket living for DefaultTempTTL
+//
+// The name of the object starts with prefix, which can't contain a separator
+func (b *Bucket) CreateTemp(prefix string) (*Temp, error) {
+	return b.CreateTempTTL(prefix, DefaultTempTTL)
+}
+
+// CreateTempTTL is CreateTemp with the given TTL
+func (b *Bucket) CreateTempTTL(prefix string, ttl time.Duration) (*Temp, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	if strings.ContainsAny(prefix, `/\`) {
+		return nil, errs.New(errs.ErrInvalidPath, "Temp prefix can't contain a separator "+prefix)
+	}
+	if ttl <= 0 {
+		ttl = DefaultTempTTL
+	}
+	dir := filepath.Dir(tempPath(b.storageDir, "x"))
+	err := os.MkdirAll(dir, 0766)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	f, err := ioutil.TempFile(dir, prefix+"*")
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	now := clock.Now()
+	obj := &TempObject{
+		CreatedAt:  now,
+		ID:         filepath.Base(f.Name()),
+		BucketID:   b.ID,
+		EntityID:   b.EntityID,
+		EntityType: b.EntityType,
+		ExpiresAt:  now.Add(ttl),
+	}
+	err = b.db.Create(obj).Error
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return &Temp{obj: obj, b: b, f: f}, nil
+}
+
+// ID the id of the temp object
+func (t *Temp) ID() string {
+	return t.obj.ID
+}
+
+// ExpiresAt when the temp object is removed unless promoted
+func (t *Temp) ExpiresAt() time.Time {
+	return t.obj.ExpiresAt
+}
+
+// Write appends to the temp object
+//
+// Returns errs.ErrTooLarge once it's larger than the bucket's MaxUploadSize
+func (t *Temp) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, errs.New(errs.ErrInvalidOption, "Temp object "+t.obj.ID+" is closed")
+	}
+	if max := t.b.MaxUploadSize; max > 0 && t.obj.Size+int64(len(p)) > max {
+		return 0, errs.TooLarge(max)
+	}
+	n, err := t.f.Write(p)
+	t.obj.Size += int64(n)
+	if err != nil {
+		return n, errs.FS(err)
+	}
+	return n, nil
+}
+
+// WriteAt writes at the offset of the temp object, eg. for the pipelined writes of sftp
+//
+// Returns errs.ErrTooLarge if it'd grow larger than the bucket's MaxUploadSize
+func (t *Temp) WriteAt(p []byte, off int64) (int, error) {
+	if t.closed {
+		return 0, errs.New(errs.ErrInvalidOption, "Temp object "+t.obj.ID+" is closed")
+	}
+	if max := t.b.MaxUploadSize; max > 0 && off+int64(len(p)) > max {
+		return 0, errs.TooLarge(max)
+	}
+	n, err := t.f.WriteAt(p, off)
+	if end := off + int64(n); end > t.obj.Size {
+		t.obj.Size = end
+	}
+	if err != nil {
+		return n, errs.FS(err)
+	}
+	return n, nil
+}
+
+// Close finishes writing, the object stays until it's promoted or expires
+func (t *Temp) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.f.Close()
+	if err != nil {
+		return errs.FS(err)
+	}
+	err = t.b.db.Model(t.obj).Update("size", t.obj.Size).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// Promote moves the temp object to the path p of the bucket
+//
+// The write is the same as WriteFile, quotas and events included
+func (t *Temp) Promote(p string) (*FileDir, error) {
+	if t.done {
+		return nil, errs.New(errs.ErrFileNotFound, "Temp object "+t.obj.ID+" is gone")
+	}
+	err := t.Close()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(t.f.Name())
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	fdir, err := t.b.WriteFile(p, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return fdir, t.Discard()
+}
+
+// Discard removes the temp object without promoting it
+func (t *Temp) Discard() error {
+	if t.done {
+		return nil
+	}
+	if !t.closed {
+		t.closed = true
+		t.f.Close()
+	}
+	t.done = true
+	return removeTemp(t.b.db, t.b.storageDir, t.obj, nil)
+}
+
+// removeTemp removes the object from disk and its row
+func removeTemp(db *gorm.DB, storageDir string, obj *TempObject, p *pace.Pacer) error {
+	err := p.Do(func() error {
+		return removeFile(db, tempPath(storageDir, obj.ID))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return errs.FS(err)
+	}
+	err = p.Do(func() error {
+		return db.Where("id = ?", obj.ID).Delete(&TempObject{}).Error
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// Temps returns the temp objects of the bucket which haven't expired
+func (b *Bucket) Temps() (objs []TempObject, err error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	tx := b.db.Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ? AND expires_at > ?",
+		b.ID, b.EntityID, b.EntityType, clock.Now(),
+	).Order("created_at").Find(&objs)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	return objs, nil
+}
+
+// purgeTemps removes the temp objects matching the query, eg. the expired ones
+func purgeTemps(db *gorm.DB, storageDir string, report *GCReport, p *pace.Pacer, query string, args ...interface{}) error {
+	for {
+		var objs []TempObject
+		err := p.Do(func() error {
+			return db.Where(query, args...).Order("expires_at").Limit(gcBatch).Find(&objs).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(objs) == 0 {
+			return nil
+		}
+		for i := range objs {
+			err = removeTemp(db, storageDir, &objs[i], p)
+			if err != nil {
+				return err
+			}
+			report.Temps++
+			report.Bytes += objs[i].Size
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package buckets
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+)
+
+const (
+	// ThumbnailBucket the hidden bucket of an entity holding its thumbnails
+	ThumbnailBucket = ".thumbnails"
+)
+
+var (
+	// ThumbnailSizes the bounding boxes in pixels thumbnails are generated for
+	ThumbnailSizes = []int{128, 512}
+	// MaxThumbnailSource images larger than this many bytes are not thumbnailed
+	MaxThumbnailSource int64 = 50 << 20
+)
+
+// thumbnailQueue queues the thumbnailing of the written images, nil generates them in the write
+var thumbnailQueue func(b *Bucket, p string) error
+
+// QueueThumbnails has the thumbnails of the written images generated by
+// queue instead of in the write, eg. by a background job calling GenerateThumbnails
+//
+// When queue fails they're generated in the write. nil restores that for every write.
+func QueueThumbnails(queue func(b *Bucket, p string) error) {
+	thumbnailQueue = queue
+}
+
+// ErrNoThumbnail the file has no thumbnails, it's not an image or it failed to decode
+//
+// It's also an errs.ErrFileNotFound
+var ErrNoThumbnail = errs.New(errs.ErrFileNotFound, "No thumbnail for the file")
+
+// Hidden whether the bucket is an internal bucket derived from the entity's other buckets
+//
+// Hidden buckets start with a dot and are not listed by the entity
+func (b *Bucket) Hidden() bool {
+	return strings.HasPrefix(b.ID, ".")
+}
+
+// derived returns the hidden bucket id of the same entity, creating it if needed
+func (b *Bucket) derived(id string) (*Bucket, error) {
+	d, err := Find(b.db, b.EntityType, b.EntityID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		d = NewBucket(id, b.db)
+		d.EntityID = b.EntityID
+		d.EntityType = b.EntityType
+		d.Layout = EntityLayoutName
+		err = b.db.Create(d).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.AttachStorage(b.storageDir)
+	return d, nil
+}
+
+// thumbnailable whether thumbnails can be generated for the content type
+func thumbnailable(ctype string) bool {
+	switch ctype {
+	case "image/jpeg", "image/png", "image/gif", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// thumbnailDir the directory in the ThumbnailBucket with the thumbnails of p
+func (b *Bucket) thumbnailDir(p string) string {
+	return b.ID + "/" + p
+}
+
+// thumbnail generates or queues the thumbnails of the file if it's an image
+//
+// Failures are only logged, the file itself was written fine
+func (b *Bucket) thumbnail(fdir *FileDir) {
+	if b.Hidden() || !thumbnailable(fdir.ContentType) || fdir.Size > MaxThumbnailSource {
+		return
+	}
+	if queue := thumbnailQueue; queue != nil {
+		err := queue(b, fdir.Path)
+		if err == nil {
+			return
+		}
+		log.Println("[f8][WARNING]: Failed to queue the thumbnails of", fdir.Path, err)
+	}
+	err := b.generateThumbnails(fdir)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to generate the thumbnails of", fdir.Path, err)
+	}
+}
+
+// GenerateThumbnails generates the thumbnails of the image at p
+//
+// Files which aren't images or are too large have none, nor do removed ones
+func (b *Bucket) GenerateThumbnails(p string) error {
+	fdir, err := b.Stat(p)
+	if errors.Is(err, errs.ErrFileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if b.Hidden() || !thumbnailable(fdir.ContentType) || fdir.Size > MaxThumbnailSource {
+		return nil
+	}
+	return b.generateThumbnails(fdir)
+}
+
+// generateThumbnails generates the thumbnails of the image, only decoding it can fail
+//
+// The sizes which failed to be written are logged
+func (b *Bucket) generateThumbnails(fdir *FileDir) error {
+	src, err := imaging.Open(b.objectPath(fdir), imaging.AutoOrientation(true))
+	if err != nil {
+		return err
+	}
+	format := imaging.JPEG
+	if fdir.ContentType == "image/png" || fdir.ContentType == "image/gif" {
+		// keep the transparency
+		format = imaging.PNG
+	}
+	thumbs, err := b.derived(ThumbnailBucket)
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	for _, size := range ThumbnailSizes {
+		var buf bytes.Buffer
+		err = imaging.Encode(&buf, imaging.Fit(src, size, size, imaging.Lanczos), format)
+		if err == nil {
+			_, err = thumbs.WriteFile(path.Join(b.thumbnailDir(fdir.Path), strconv.Itoa(size)), &buf)
+		}
+		if err != nil {
+			log.Println("[f8][WARNING]: Failed to generate thumbnail", fdir.Path, size, err)
+		}
+	}
+	return nil
+}
+
+// forgetThumbnails removes the thumbnail rows of p and everything under it
+func (b *Bucket) forgetThumbnails(p string) {
+	if b.Hidden() {
+		return
+	}
+	thumbs, err := Find(b.db, b.EntityType, b.EntityID, ThumbnailBucket)
+	if err != nil {
+		return
+	}
+	err = thumbs.forget(b.thumbnailDir(p))
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to remove thumbnails", p, err)
+	}
+}
+
+// Thumbnail returns the thumbnail of the image at p that best fits size
+//
+// That's the smallest thumbnail at least size pixels wide or the largest one.
+// Open it with the returned thumbnail bucket.
+func (b *Bucket) Thumbnail(p string, size int) (*Bucket, *FileDir, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbs, err := Find(b.db, b.EntityType, b.EntityID, ThumbnailBucket)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNoThumbnail
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbs.AttachStorage(b.storageDir)
+	sizes := append([]int{}, ThumbnailSizes...)
+	sort.Ints(sizes)
+	pick := sizes[len(sizes)-1]
+	for _, s := range sizes {
+		if s >= size {
+			pick = s
+			break
+		}
+	}
+	fdir, err := thumbs.Stat(path.Join(b.thumbnailDir(p), strconv.Itoa(pick)))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNoThumbnail
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return thumbs, fdir, nil
+}
@@ -0,0 +1,297 @@
+package buckets
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+// trashDir where the trashed objects are kept, under objects so Sync and Watch skip them
+const trashDir = "objects/trash"
+
+// TrashItem a file removed from a bucket with a trash, see SetTrash
+//
+// It can be restored until the GC purges it after the delete retention
+type TrashItem struct {
+	// ID the name of the object in the trash
+	ID         string `gorm:"primaryKey" json:"id"`
+	BucketID   string `gorm:"index:trash_bucket_idx" json:"bucket_id"`
+	EntityID   string `gorm:"index:trash_bucket_idx" json:"entity_id"`
+	EntityType string `gorm:"index:trash_bucket_idx" json:"entity_type"`
+	// Path where the file was when it was removed
+	Path        string            `json:"path"`
+	Size        int64             `json:"size"`
+	Mode        os.FileMode       `json:"mode"`
+	ModTime     time.Time         `json:"mod_time"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    metadata.Metadata `json:"metadata,omitempty"`
+	DeletedAt   time.Time         `gorm:"index" json:"deleted_at"`
+}
+
+// trashPath returns the path on disk of the trashed object
+func trashPath(storageDir, id string) string {
+	return filepath.Join(storageDir, filepath.FromSlash(trashDir), id)
+}
+
+// SetTrash whether the files removed from the bucket go to its trash
+//
+// Only the removals through f8 do, the files deleted on disk
+// (eg. in filebrowser) are gone. Hidden buckets never have a trash.
+func (b *Bucket) SetTrash(enabled bool) error {
+	if b.Hidden() {
+		return errs.New(errs.ErrInvalidOption, "Hidden bucket "+b.ID+" can't have a trash")
+	}
+	tx := b.pk().UpdateColumn("trash", enabled)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	Forget(b)
+	b.Trash = enabled
+	return nil
+}
+
+// trashes whether the removed files go to the trash
+func (b *Bucket) trashes() bool {
+	return b.Trash && !b.Hidden()
+}
+
+// toTrash moves the objects of the files to the trash and records them with tx
+//
+// The objects are put back if recording them fails, directories are skipped
+func (b *Bucket) toTrash(tx *gorm.DB, fdirs []FileDir) error {
+	now := clock.Now()
+	items := make([]*TrashItem, 0, len(fdirs))
+	moved := [][2]string{}
+	putBack := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if rerr := rename(tx, moved[i][1], moved[i][0]); rerr != nil {
+				log.Println("[f8][WARNING]: Failed to put back", moved[i][0], rerr)
+			}
+		}
+	}
+	for i := range fdirs {
+		f := &fdirs[i]
+		if f.IsDir {
+			continue
+		}
+		item := &TrashItem{
+			ID:          clock.NewID(),
+			BucketID:    b.ID,
+			EntityID:    b.EntityID,
+			EntityType:  b.EntityType,
+			Path:        f.Path,
+			Size:        f.Size,
+			Mode:        f.Mode,
+			ModTime:     f.ModTime,
+			ContentType: f.ContentType,
+			Metadata:    f.Metadata,
+			DeletedAt:   now,
+		}
+		name := b.objectPath(f)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			// nothing left to restore
+			continue
+		}
+		err := rename(tx, name, trashPath(b.storageDir, item.ID))
+		if err != nil {
+			putBack()
+			return err
+		}
+		moved = append(moved, [2]string{name, trashPath(b.storageDir, item.ID)})
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	err := tx.Create(&items).Error
+	if err != nil {
+		putBack()
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// trashLocked moves the file or directory to the trash holding its lock
+func (b *Bucket) trashLocked(fdir *FileDir) error {
+	var fdirs []FileDir
+	tx := underPath(b.scope(), fdir.Path).Where("is_dir = ?", false).Find(&fdirs)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	err := b.toTrash(b.db, fdirs)
+	if err != nil {
+		return err
+	}
+	if b.layout().Name() == EntityLayoutName {
+		// the directories left behind
+		err = removeAll(b.db, b.objectPath(fdir))
+		if err != nil {
+			return errs.FS(err)
+		}
+	}
+	err = b.forget(fdir.Path)
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// TrashItems returns the files in the trash of the bucket, the latest removed first
+func (b *Bucket) TrashItems() (items []TrashItem, err error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	tx := b.trashScope().Order("deleted_at DESC, path").Find(&items)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	return items, nil
+}
+
+// trashScope returns a query over the trash items of this bucket
+func (b *Bucket) trashScope() *gorm.DB {
+	return b.db.Model(&TrashItem{}).Where(
+		"bucket_id = ? AND entity_id = ? AND entity_type = ?",
+		b.ID, b.EntityID, b.EntityType,
+	)
+}
+
+// trashItem returns the item of the bucket's trash
+func (b *Bucket) trashItem(id string) (*TrashItem, error) {
+	item := &TrashItem{}
+	tx := b.trashScope().Where("id = ?", id).First(item)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrFileNotFound)
+	}
+	return item, nil
+}
+
+// RestoreTrash puts a file of the trash back at to, its original path if empty
+//
+// Returns errs.ErrFileExists if there's a file at the path
+// and errs.ErrQuotaExceeded if it doesn't fit in the bucket anymore
+func (b *Bucket) RestoreTrash(id, to string) (*FileDir, error) {
+	if b.db == nil {
+		return nil, errs.ErrNotAttached
+	}
+	item, err := b.trashItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if to == "" {
+		to = item.Path
+	}
+	p, err := cleanPath(to)
+	if err != nil {
+		return nil, err
+	}
+	var fdir *FileDir
+	err = b.WithLock(p, func(b *Bucket) (err error) {
+		fdir, err = b.restoreLocked(item, p)
+		return err
+	})
+	return fdir, err
+}
+
+// restoreLocked restores the item to the clean path p holding its lock
+func (b *Bucket) restoreLocked(item *TrashItem, p string) (*FileDir, error) {
+	err := b.absent(p)
+	if err != nil {
+		return nil, err
+	}
+	if b.Quota > 0 && b.Used+item.Size > b.Quota {
+		b.publish(events.QuotaExceeded, p, map[string]interface{}{"quota": b.Quota, "used": b.Used})
+		return nil, errs.New(errs.ErrQuotaExceeded, "Restoring "+p+" to bucket "+b.ID)
+	}
+	fdir, err := b.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	fdir.IsDir = false
+	fdir.Size = item.Size
+	fdir.Mode = item.Mode
+	fdir.ModTime = item.ModTime
+	fdir.ContentType = item.ContentType
+	fdir.Metadata = item.Metadata
+	name := b.objectPath(fdir)
+	err = rename(b.db, trashPath(b.storageDir, item.ID), name)
+	if err != nil {
+		return nil, err
+	}
+	err = b.ensureParents(p, item.ModTime)
+	if err == nil {
+		err = b.save(fdir)
+	}
+	if err == nil {
+		err = b.addUsed(fdir.Size)
+	}
+	if err == nil {
+		err = b.db.Where("id = ?", item.ID).Delete(&TrashItem{}).Error
+	}
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	b.publish(events.FileWritten, p, map[string]interface{}{"size": fdir.Size, "restored": item.ID})
+	return fdir, nil
+}
+
+// PurgeTrash permanently deletes a file of the trash before the GC does
+func (b *Bucket) PurgeTrash(id string) error {
+	if b.db == nil {
+		return errs.ErrNotAttached
+	}
+	item, err := b.trashItem(id)
+	if err != nil {
+		return err
+	}
+	return removeTrash(b.db, b.storageDir, item, nil)
+}
+
+// removeTrash removes the trashed object from disk and its row
+func removeTrash(db *gorm.DB, storageDir string, item *TrashItem, p *pace.Pacer) error {
+	err := p.Do(func() error {
+		return removeFile(db, trashPath(storageDir, item.ID))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return errs.FS(err)
+	}
+	err = p.Do(func() error {
+		return db.Where("id = ?", item.ID).Delete(&TrashItem{}).Error
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// purgeTrash removes the trash items matching the query, eg. the ones past the retention
+func purgeTrash(db *gorm.DB, storageDir string, report *GCReport, p *pace.Pacer, query string, args ...interface{}) error {
+	for {
+		var items []TrashItem
+		err := p.Do(func() error {
+			return db.Where(query, args...).Order("deleted_at").Limit(gcBatch).Find(&items).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for i := range items {
+			err = removeTrash(db, storageDir, &items[i], p)
+			if err != nil {
+				return err
+			}
+			report.Trash++
+			report.Bytes += items[i].Size
+		}
+	}
+}
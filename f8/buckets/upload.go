@@ -0,0 +1,168 @@
+package buckets
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+// uploadPrefix the prefix of the temp objects of the uploads
+const uploadPrefix = "upload-"
+
+// Upload a file streamed into a bucket, nothing changes at its path until Commit
+//
+// The contents go to a temp object, a failed write or read aborts the
+// upload so an interrupted stream never replaces the file with a part of it.
+// The temp objects of the uploads never committed or aborted, eg. when
+// the process dies, are removed by GC once they expire.
+//
+//	u, err := b.NewUpload("docs/report.pdf")
+//	_, err = io.Copy(u, r.Body)
+//	if err != nil {
+//		return u.Abort()
+//	}
+//	fdir, err := u.Commit()
+type Upload struct {
+	temp *Temp
+	path string
+	// failed the error the upload was aborted with
+	failed error
+}
+
+// NewUpload starts an upload to the path p
+func (b *Bucket) NewUpload(p string) (*Upload, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	t, err := b.CreateTemp(uploadPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{temp: t, path: p}, nil
+}
+
+// Path the path the upload is committed to
+func (u *Upload) Path() string {
+	return u.path
+}
+
+// Size the number of bytes written so far
+func (u *Upload) Size() int64 {
+	return u.temp.obj.Size
+}
+
+// Write appends to the upload, a failed write aborts it
+func (u *Upload) Write(p []byte) (int, error) {
+	if u.failed != nil {
+		return 0, u.failed
+	}
+	n, err := u.temp.Write(p)
+	if err != nil {
+		u.abort(err)
+	}
+	return n, err
+}
+
+// ReadFrom appends r to the upload until EOF, a failed read aborts it too
+//
+// io.Copy uses it, so a client going away midway fails the upload
+func (u *Upload) ReadFrom(r io.Reader) (int64, error) {
+	if u.failed != nil {
+		return 0, u.failed
+	}
+	n, err := io.Copy(writerOnly{u.temp}, r)
+	if err != nil {
+		u.abort(err)
+	}
+	return n, err
+}
+
+// writerOnly hides the ReadFrom of the writer so io.Copy doesn't loop back into it
+type writerOnly struct {
+	io.Writer
+}
+
+// Commit replaces the file at the path with what was written like WriteFile
+//
+// The upload is gone afterwards, committed or not
+func (u *Upload) Commit() (*FileDir, error) {
+	if u.failed != nil {
+		return nil, u.failed
+	}
+	fdir, err := u.temp.Promote(u.path)
+	if err != nil {
+		u.abort(err)
+		return nil, err
+	}
+	u.failed = errs.New(errs.ErrInvalidOption, "Upload of "+u.path+" was committed")
+	return fdir, nil
+}
+
+// Abort discards what was written, the file at the path is left untouched
+//
+// A no-op once committed or aborted
+func (u *Upload) Abort() error {
+	if u.failed != nil {
+		return nil
+	}
+	return u.abort(errs.New(errs.ErrInvalidOption, "Upload of "+u.path+" was aborted"))
+}
+
+func (u *Upload) abort(err error) error {
+	u.failed = err
+	return u.temp.Discard()
+}
+
+// purgeParts removes the parts of the writes abandoned without cleaning up, eg. on a crash
+//
+// Those are the staged files of the writes and the temp objects without
+// a row, older than orphanGrace so the writes in progress are left alone
+func purgeParts(db *gorm.DB, storageDir string, report *GCReport, p *pace.Pacer) error {
+	old := clock.Now().Add(-orphanGrace)
+	temps := filepath.Join(storageDir, filepath.FromSlash(tempDir))
+	err := filepath.Walk(storageDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.ModTime().After(old) {
+			return nil
+		}
+		if !isTemp(name) {
+			if filepath.Dir(name) != temps {
+				return nil
+			}
+			var n int64
+			err = p.Do(func() error {
+				return db.Model(&TempObject{}).Where("id = ?", filepath.Base(name)).Count(&n).Error
+			})
+			if err != nil {
+				return errs.Wrap(errs.ErrDatabase, err)
+			}
+			if n > 0 {
+				return nil
+			}
+		}
+		err = p.Do(func() error {
+			return removeFile(db, name)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return errs.FS(err)
+		}
+		report.Parts++
+		report.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errs.FS(err)
+	}
+	return nil
+}
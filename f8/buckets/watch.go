@@ -0,0 +1,177 @@
+package buckets
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gorm.io/gorm"
+)
+
+const (
+	// watchDebounce how long events for a path are collected before reconciling
+	watchDebounce = 200 * time.Millisecond
+)
+
+// Watcher keeps the FileDir rows honest when other processes
+// write to the storage directory of the entity layout buckets
+//
+// Meant for the migration period where filebrowser still writes directly
+// to the disk. Buckets with other layouts are ignored.
+type Watcher struct {
+	db         *gorm.DB
+	storageDir string
+	fsw        *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Watch starts watching the storage directory for out of band changes
+//
+// All the entity layout directories are watched recursively,
+// call Close to stop watching
+func Watch(db *gorm.DB, storageDir string) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		db:         db,
+		storageDir: storageDir,
+		fsw:        fsw,
+		pending:    make(map[string]struct{}),
+		done:       make(chan struct{}),
+	}
+	err = w.addRecursive(storageDir)
+	if err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() error {
+	close(w.done)
+	err := w.fsw.Close()
+	w.wg.Wait()
+	return err
+}
+
+// addRecursive watches the directory and all the directories under it
+func (w *Watcher) addRecursive(dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if name == filepath.Join(w.storageDir, "objects") {
+			// the non hierarchical layouts live here
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(name)
+	})
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(watchDebounce)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.mu.Lock()
+			w.pending[ev.Name] = struct{}{}
+			w.mu.Unlock()
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Println("[f8][watch]:", err)
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// flush reconciles all the pending paths
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]struct{})
+	w.mu.Unlock()
+	for name := range pending {
+		err := w.reconcile(name)
+		if err != nil {
+			log.Println("[f8][watch]: Failed to reconcile", name, err)
+		}
+	}
+}
+
+// reconcile updates the rows for a path on disk that has changed
+func (w *Watcher) reconcile(name string) error {
+	if isTemp(name) {
+		// renamed into place once complete
+		return nil
+	}
+	rel, err := filepath.Rel(w.storageDir, name)
+	if err != nil {
+		return err
+	}
+	// <entity_type>/<entity_id>/<bucket>/<path>
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 4)
+	info, statErr := os.Lstat(name)
+	if statErr == nil && info.IsDir() {
+		err = w.addRecursive(name)
+		if err != nil {
+			return err
+		}
+	}
+	if len(parts) < 3 || parts[0] == "objects" {
+		return nil
+	}
+	b, err := Find(w.db, parts[0], parts[1], parts[2])
+	if err != nil {
+		// not a bucket we know about
+		return nil
+	}
+	b.AttachStorage(w.storageDir)
+	if b.layout().Name() != EntityLayoutName {
+		return nil
+	}
+	if len(parts) == 3 || info != nil && info.IsDir() {
+		// a whole directory appeared or was moved in
+		_, err = b.Sync()
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		return b.forget(parts[3])
+	}
+	if statErr != nil {
+		return statErr
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		_, err = b.recordLink(parts[3], info)
+		return err
+	}
+	return b.record(parts[3], info, "")
+}
@@ -0,0 +1,117 @@
+// Package cache an optional cache in front of the hot lookups of f8
+//
+// The filebrowser proxy, the sftp server and the api ask which bucket an
+// entity owns and what role it has on almost every request. When a cache is
+// in Use those answers are kept in it and the writes changing them forget
+// them, until then every lookup goes to the database.
+//
+//	defer cache.Use(cache.NewLRU(10000), time.Minute)()
+//
+// The LRU is per process, run several instances with a shared Redis
+// or the writes of one leave the others stale for up to the ttl
+package cache
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the keys of f8, so a Redis can be shared with other applications
+const Prefix = "f8:"
+
+// Cache stores short lived values
+//
+// Failures are the cache's to log, a Get failing is a miss
+type Cache interface {
+	// Get returns the value of the key, false if it's missing or expired
+	Get(key string) ([]byte, bool)
+	// Set stores the value for ttl, 0 keeps it until it's evicted
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete forgets the keys
+	Delete(keys ...string)
+}
+
+var (
+	mu      sync.RWMutex
+	current Cache
+	ttl     time.Duration
+)
+
+// Use makes c the cache of the lookups, nil disables caching
+//
+// The values are kept for ttl at most, it bounds how stale a value
+// changed behind f8's back (eg. by a restored backup) can get.
+// Returns a function restoring the previous cache.
+func Use(c Cache, d time.Duration) (restore func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	prevC, prevTTL := current, ttl
+	current, ttl = c, d
+	return func() {
+		mu.Lock()
+		current, ttl = prevC, prevTTL
+		mu.Unlock()
+	}
+}
+
+// Enabled whether a cache is in use
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current != nil
+}
+
+// Key joins the parts into a key of f8
+func Key(parts ...string) string {
+	return Prefix + strings.Join(parts, ":")
+}
+
+// Load decodes the cached value of the key into v, false on a miss
+func Load(key string, v interface{}) bool {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+	if c == nil {
+		return false
+	}
+	data, ok := c.Get(key)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Println("[f8][WARNING]: Dropping the undecodable cached", key, err)
+		c.Delete(key)
+		return false
+	}
+	return true
+}
+
+// Store caches v for the key
+func Store(key string, v interface{}) {
+	mu.RLock()
+	c, d := current, ttl
+	mu.RUnlock()
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to encode", key, "for the cache", err)
+		return
+	}
+	c.Set(key, data, d)
+}
+
+// Forget drops the keys, call it once a write changing them succeeded
+func Forget(keys ...string) {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+	if c == nil || len(keys) == 0 {
+		return
+	}
+	c.Delete(keys...)
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultSize the number of values an LRU of size 0 holds
+const DefaultSize = 10000
+
+// LRU an in memory cache evicting the least recently used values
+type LRU struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+// lruItem a value of the LRU
+type lruItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an LRU holding at most size values, 0 for DefaultSize
+func NewLRU(size int) *LRU {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &LRU{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the value of the key, false if it's missing or expired
+func (c *LRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	it := el.Value.(*lruItem)
+	if !it.expires.IsZero() && time.Now().After(it.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return it.value, true
+}
+
+// Set stores the value for ttl, evicting the least recently used one when full
+func (c *LRU) Set(key string, value []byte, ttl time.Duration) {
+	it := &lruItem{key: key, value: value}
+	if ttl > 0 {
+		it.expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value = it
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(it)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete forgets the keys
+func (c *LRU) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// Len the number of values held, expired ones included until they're looked up
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRU) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruItem).key)
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// Problem an RFC 7807 error response of the api
+//
+// Branch on Code, the codes are the ones of the errs package
+//
+//	var p *client.Problem
+//	if errors.As(err, &p) && p.Code == "quota_exceeded" { ... }
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	msg := p.Title
+	if p.Detail != "" {
+		msg += ": " + p.Detail
+	}
+	if p.RequestID != "" {
+		msg += " (request " + p.RequestID + ")"
+	}
+	return msg
+}
+
+// ReadProblem returns the problem of a failed response
+//
+// Responses which aren't problem+json get a Problem with only the status
+// and the title, the body is left unread in that case
+func ReadProblem(res *http.Response) *Problem {
+	p := &Problem{}
+	ctype, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if ctype == "application/problem+json" {
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+		if err == nil {
+			json.Unmarshal(data, p)
+		}
+	}
+	if p.Status == 0 {
+		p.Status = res.StatusCode
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(res.StatusCode)
+	}
+	if p.RequestID == "" {
+		p.RequestID = res.Header.Get("X-Request-Id")
+	}
+	return p
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/events"
+)
+
+var (
+	// ErrInvalidSignature the webhook was not signed with the endpoint's secret
+	ErrInvalidSignature = errors.New("Invalid webhook signature")
+	// ErrStaleWebhook the webhook timestamp is outside the tolerance, possibly a replay
+	ErrStaleWebhook = errors.New("Webhook timestamp outside the tolerance")
+	// ErrUnsupportedVersion the payload uses a newer schema than this client understands
+	ErrUnsupportedVersion = errors.New("Unsupported event schema version")
+)
+
+const (
+	// SupportedSchemaVersion the newest event schema this client can decode
+	SupportedSchemaVersion = events.SchemaVersion
+	// DefaultTolerance the allowed clock difference for webhook timestamps
+	DefaultTolerance = 5 * time.Minute
+)
+
+// VerifyWebhook verifies the signature of a webhook request sent by fate
+// and returns the decoded event
+//
+// A tolerance of 0 uses DefaultTolerance.
+// The request body is consumed.
+func VerifyWebhook(r *http.Request, secret []byte, tolerance time.Duration) (*events.Event, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyPayload(
+		body, secret,
+		r.Header.Get(events.HeaderTimestamp),
+		r.Header.Get(events.HeaderSignature),
+		tolerance,
+	)
+}
+
+// VerifyPayload verifies a webhook payload with its timestamp and signature headers
+//
+// Useful when the body was already read by a framework
+func VerifyPayload(body, secret []byte, timestamp, signature string, tolerance time.Duration) (*events.Event, error) {
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	expected := events.Sign(secret, ts, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrInvalidSignature
+	}
+	diff := time.Since(time.Unix(ts, 0))
+	if diff > tolerance || diff < -tolerance {
+		return nil, ErrStaleWebhook
+	}
+	e := &events.Event{}
+	err = json.Unmarshal(body, e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Version > SupportedSchemaVersion {
+		return e, ErrUnsupportedVersion
+	}
+	return e, nil
+}
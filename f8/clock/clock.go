@@ -0,0 +1,144 @@
+// Package clock the time and id sources of f8
+//
+// The timestamps, expiries and generated ids of the entities, files, events
+// and shared urls come from the Default clock and id generator, tests replace
+// them to get deterministic values
+//
+//	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+//	defer clock.Use(c, clock.NewSequence("id"))()
+//	c.Advance(time.Hour)
+//
+// Besides the random uuids the ids can be ulids, ksuids or snowflakes which
+// sort by creation time, see Generator, with a prefix with Prefixed.
+//
+// Durations (latencies, rate limits, timeouts) always use the real time
+package clock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator generates unique ids
+type IDGenerator interface {
+	NewID() string
+}
+
+// System the real clock
+type System struct{}
+
+// Now returns time.Now
+func (System) Now() time.Time {
+	return time.Now()
+}
+
+// UUIDs generates random uuids
+type UUIDs struct{}
+
+// NewID returns a new random uuid
+func (UUIDs) NewID() string {
+	return uuid.New().String()
+}
+
+var (
+	mu         sync.RWMutex
+	defaultC   Clock       = System{}
+	defaultIDs IDGenerator = UUIDs{}
+)
+
+// Now the time of the Default clock
+func Now() time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultC.Now()
+}
+
+// NewID a new id of the default generator
+func NewID() string {
+	mu.RLock()
+	ids := defaultIDs
+	mu.RUnlock()
+	// the time based generators read the default clock
+	return ids.NewID()
+}
+
+// Use replaces the default clock and id generator, nil keeps the current one
+//
+// Returns a function restoring the previous ones. They're shared by the whole
+// process so tests replacing them can't run in parallel.
+func Use(c Clock, ids IDGenerator) (restore func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	prevC, prevIDs := defaultC, defaultIDs
+	if c != nil {
+		defaultC = c
+	}
+	if ids != nil {
+		defaultIDs = ids
+	}
+	return func() {
+		mu.Lock()
+		defaultC, defaultIDs = prevC, prevIDs
+		mu.Unlock()
+	}
+}
+
+// Fake a clock which only moves when told to
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock stopped at t
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the time the clock is stopped at
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock d forward
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+// Set stops the clock at t
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	f.now = t
+	f.mu.Unlock()
+}
+
+// Sequence generates the ids prefix-1, prefix-2, ...
+type Sequence struct {
+	prefix string
+	mu     sync.Mutex
+	n      int
+}
+
+// NewSequence returns a sequence of ids starting at prefix-1
+func NewSequence(prefix string) *Sequence {
+	return &Sequence{prefix: prefix}
+}
+
+// NewID returns the next id of the sequence
+func (s *Sequence) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	return fmt.Sprintf("%s-%d", s.prefix, s.n)
+}
@@ -0,0 +1,234 @@
+package clock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// The names of the generators Generator knows
+const (
+	UUID      = "uuid"
+	ULID      = "ulid"
+	KSUID     = "ksuid"
+	Snowflake = "snowflake"
+)
+
+var (
+	genMu sync.Mutex
+	// generators the generators Generator returned, by name
+	generators = map[string]IDGenerator{}
+	// node the node of the snowflakes of Generator, -1 until SetNode
+	node = -1
+)
+
+// SetNode sets the node of the snowflakes Generator returns
+//
+// Every process generating snowflakes for the same tables needs its own
+// node, it can't change once the first snowflake generator was returned
+func SetNode(n int) error {
+	if n < 0 || n > MaxNode {
+		return errs.New(errs.ErrInvalidOption, fmt.Sprintf("The snowflake node must be between 0 and %d", MaxNode))
+	}
+	genMu.Lock()
+	defer genMu.Unlock()
+	if _, ok := generators[Snowflake]; ok && n != node {
+		return errs.New(errs.ErrInvalidOption, fmt.Sprintf("The snowflake node is already %d", node))
+	}
+	node = n
+	return nil
+}
+
+// Generator returns the generator called name, eg. from a config file
+//
+// Every call with the same name returns the same generator so the ids of
+// a millisecond don't repeat. The snowflakes need a node, see SetNode.
+//
+// The ulids, ksuids and snowflakes sort by the time they were generated
+// at, they keep the keyset pages and the audit log in creation order
+func Generator(name string) (IDGenerator, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		name = UUID
+	}
+	genMu.Lock()
+	defer genMu.Unlock()
+	if ids, ok := generators[name]; ok {
+		return ids, nil
+	}
+	var ids IDGenerator
+	switch name {
+	case UUID:
+		ids = UUIDs{}
+	case ULID:
+		ids = NewULIDs()
+	case KSUID:
+		ids = KSUIDs{}
+	case Snowflake:
+		if node < 0 {
+			return nil, errs.New(errs.ErrInvalidOption, "Snowflake ids need a node unique to the process, see SetNode")
+		}
+		ids = NewSnowflakes(node)
+	default:
+		return nil, errs.New(errs.ErrInvalidOption, "Unknown id generator "+name)
+	}
+	generators[name] = ids
+	return ids, nil
+}
+
+// random fills b with random bytes
+func random(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("clock: reading random bytes failed " + err.Error())
+	}
+}
+
+// crockford the alphabet of the ulids, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDs generates ulids, 26 characters sorting by their millisecond
+//
+// The ids of the same millisecond increment the random part of
+// the previous one so they sort in the order they were generated
+type ULIDs struct {
+	mu   sync.Mutex
+	ms   uint64
+	rand [10]byte
+}
+
+// NewULIDs returns a generator of ulids
+func NewULIDs() *ULIDs {
+	return &ULIDs{}
+}
+
+// NewID returns a new ulid at the time of the default clock
+func (u *ULIDs) NewID() string {
+	ms := uint64(Now().UnixNano() / int64(time.Millisecond))
+	u.mu.Lock()
+	if ms <= u.ms {
+		// the same millisecond, or the clock went back
+		ms = u.ms
+		for i := len(u.rand) - 1; i >= 0; i-- {
+			u.rand[i]++
+			if u.rand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		u.ms = ms
+		random(u.rand[:])
+	}
+	var id [16]byte
+	id[0], id[1], id[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	id[3], id[4], id[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	copy(id[6:], u.rand[:])
+	u.mu.Unlock()
+	// 128 bits in 26 characters of 5 bits, the first one only has 3
+	n := new(big.Int).SetBytes(id[:])
+	out := make([]byte, 26)
+	mask := big.NewInt(31)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(out)
+}
+
+// ksuidEpoch the epoch of the ksuid timestamps, 2014-05-13
+const ksuidEpoch = 1400000000
+
+// base62 the alphabet of the ksuids
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// KSUIDs generates ksuids, 27 characters sorting by their second
+type KSUIDs struct{}
+
+// NewID returns a new ksuid at the time of the default clock
+func (KSUIDs) NewID() string {
+	var id [20]byte
+	binary.BigEndian.PutUint32(id[:4], uint32(Now().Unix()-ksuidEpoch))
+	random(id[4:])
+	n := new(big.Int).SetBytes(id[:])
+	out := make([]byte, 27)
+	base, rem := big.NewInt(62), new(big.Int)
+	for i := len(out) - 1; i >= 0; i-- {
+		n.DivMod(n, base, rem)
+		out[i] = base62[rem.Int64()]
+	}
+	return string(out)
+}
+
+// snowflakeEpoch the epoch of the snowflakes, 2020-01-01
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	// MaxNode the largest node of a snowflake
+	MaxNode = 1<<10 - 1
+	// maxSequence the most snowflakes of a node in a millisecond
+	maxSequence = 1<<12 - 1
+)
+
+// Snowflakes generates snowflakes, 64 bit numbers made of the millisecond,
+// the node and a sequence, zero padded to 19 digits so they sort as strings
+//
+// Every process generating ids for the same tables needs its own node
+type Snowflakes struct {
+	node int64
+	mu   sync.Mutex
+	ms   int64
+	seq  int64
+}
+
+// NewSnowflakes returns a generator of snowflakes for the node, at most MaxNode
+func NewSnowflakes(node int) *Snowflakes {
+	return &Snowflakes{node: int64(node) & MaxNode}
+}
+
+// NewID returns a new snowflake at the time of the default clock
+//
+// Past the 4096th id of a millisecond the next one is borrowed
+func (s *Snowflakes) NewID() string {
+	ms := Now().Sub(snowflakeEpoch).Milliseconds()
+	s.mu.Lock()
+	if ms <= s.ms {
+		ms = s.ms
+		s.seq++
+		if s.seq > maxSequence {
+			ms++
+			s.seq = 0
+		}
+	} else {
+		s.seq = 0
+	}
+	s.ms = ms
+	id := ms<<22 | s.node<<12 | s.seq
+	s.mu.Unlock()
+	return fmt.Sprintf("%019d", id)
+}
+
+// Prefixed generates the ids of another generator with a prefix, eg. usr_01ARZ3NDEKTSV4RRFFQ69G5FAV
+type Prefixed struct {
+	Prefix string
+	// IDs the generator of the rest of the id, the default one if nil
+	IDs IDGenerator
+}
+
+// NewPrefixed returns a generator of the ids of ids prefixed with prefix and an underscore
+func NewPrefixed(prefix string, ids IDGenerator) *Prefixed {
+	return &Prefixed{Prefix: prefix + "_", IDs: ids}
+}
+
+// NewID returns a new id of the generator with the prefix
+func (p *Prefixed) NewID() string {
+	if p.IDs == nil {
+		return p.Prefix + NewID()
+	}
+	return p.Prefix + p.IDs.NewID()
+}
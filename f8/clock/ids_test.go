@@ -0,0 +1,132 @@
+package clock
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// resetGenerators forgets the generators and the node of Generator
+func resetGenerators(t *testing.T) {
+	t.Helper()
+	genMu.Lock()
+	generators, node = map[string]IDGenerator{}, -1
+	genMu.Unlock()
+	t.Cleanup(func() {
+		genMu.Lock()
+		generators, node = map[string]IDGenerator{}, -1
+		genMu.Unlock()
+	})
+}
+
+func TestGeneratorUnique(t *testing.T) {
+	resetGenerators(t)
+	err := SetNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	for _, name := range []string{UUID, ULID, KSUID, Snowflake} {
+		t.Run(name, func(t *testing.T) {
+			seen := make(map[string]bool, n)
+			for i := 0; i < n; i++ {
+				// like entity.Entity, every id asks for the generator again
+				ids, err := Generator(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				id := ids.NewID()
+				if seen[id] {
+					t.Fatalf("the id %s was generated twice, %d ids in", id, i)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestGeneratorConcurrent(t *testing.T) {
+	resetGenerators(t)
+	err := SetNode(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const goroutines, n = 8, 2000
+	for _, name := range []string{ULID, Snowflake} {
+		var mu sync.Mutex
+		seen := make(map[string]bool, goroutines*n)
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					ids, err := Generator(name)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					id := ids.NewID()
+					mu.Lock()
+					if seen[id] {
+						t.Errorf("%s: the id %s was generated twice", name, id)
+					}
+					seen[id] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestGeneratorShared(t *testing.T) {
+	resetGenerators(t)
+	a, err := Generator("ULID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generator(ULID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("Generator returned two ulid generators")
+	}
+	_, err = Generator("nope")
+	if !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("an unknown generator: got %v want %v", err, errs.ErrInvalidOption)
+	}
+}
+
+func TestSnowflakeNode(t *testing.T) {
+	resetGenerators(t)
+	_, err := Generator(Snowflake)
+	if !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("without a node: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	for _, n := range []int{-1, MaxNode + 1} {
+		if err := SetNode(n); !errors.Is(err, errs.ErrInvalidOption) {
+			t.Errorf("SetNode(%d): got %v want %v", n, err, errs.ErrInvalidOption)
+		}
+	}
+	err = SetNode(MaxNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := Generator(Snowflake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids.(*Snowflakes).node; got != MaxNode {
+		t.Errorf("got the node %d want %d", got, MaxNode)
+	}
+	if err := SetNode(3); !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("changing the node: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	if err := SetNode(MaxNode); err != nil {
+		t.Errorf("setting the same node again: %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+// Package config the configuration of the fate command
+//
+// Options are layered, each overriding the previous one
+//
+//	defaults < config file (fate.json) < environment (FATE_*) < flags
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/httpserver"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/mirror"
+	"github.com/phanirithvij/fate/f8/oidc"
+	"github.com/phanirithvij/fate/f8/pace"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+	"github.com/phanirithvij/fate/f8/retry"
+)
+
+// DefaultFile the config file read when none is given
+const DefaultFile = "fate.json"
+
+// Duration a time.Duration written as a string like "10m" in the config file
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Database the database options
+type Database struct {
+	// Mode sqlite or postgres
+	Mode       f8.DBKind `json:"mode"`
+	SqlitePath string    `json:"sqlite_path"`
+	Host       string    `json:"host"`
+	Port       int       `json:"port"`
+	User       string    `json:"user"`
+	Password   string    `json:"password"`
+	Name       string    `json:"name"`
+	// AdvisoryLocks lock the files being written across the instances sharing the database, postgres only
+	AdvisoryLocks bool `json:"advisory_locks"`
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime and ConnMaxIdleTime tune the connection pool, 0 for the defaults
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time"`
+	// ConnectAttempts how often connecting to postgres is tried at startup, 0 for retry.Connect's
+	ConnectAttempts int `json:"connect_attempts"`
+	// ReadDSN the postgres dsn of a read replica the repositories list and get from, empty for none
+	ReadDSN string `json:"read_dsn"`
+}
+
+// Maintenance the options of the gc and fsck
+type Maintenance struct {
+	// GCEvery run the gc in the background of the server this often, 0 to disable
+	GCEvery   Duration `json:"gc_every"`
+	MinRate   float64  `json:"min_rate"`
+	MaxRate   float64  `json:"max_rate"`
+	TargetP95 Duration `json:"target_p95"`
+	// AuditRetention how long the audit log is kept, 0 forever
+	AuditRetention Duration `json:"audit_retention"`
+	// MirrorEvery resync the mirrors this often to catch up on dropped events, 0 to only follow the events
+	MirrorEvery Duration `json:"mirror_every"`
+	// DeleteRetention how long the deleted entities, buckets and files can be restored before the gc purges them
+	DeleteRetention Duration `json:"delete_retention"`
+	// UsageEvery flush the usage reports this often, 0 to not meter the usage
+	UsageEvery Duration `json:"usage_every"`
+	// StatsRetention how long the daily snapshots of the stats are kept, 0 forever
+	StatsRetention Duration `json:"stats_retention"`
+}
+
+// Jobs the options of the background job workers of the server
+type Jobs struct {
+	// Workers the number of jobs run at once
+	Workers int `json:"workers"`
+	// MaxAttempts the number of times a failing job is tried
+	MaxAttempts int `json:"max_attempts"`
+	// Retention how long finished jobs are kept, the gc prunes them, 0 forever
+	Retention Duration `json:"retention"`
+}
+
+// SFTP the options of the sftp server of the buckets
+type SFTP struct {
+	// Addr the address the sftp server listens on, eg. :2022, empty to disable it
+	Addr string `json:"addr"`
+	// HostKey the file of the private host key, generated if it's missing
+	HostKey string `json:"host_key"`
+}
+
+// Forward a TCP port forwarded to another address
+type Forward struct {
+	// Listen the address to listen on, eg. :5000
+	Listen string `json:"listen"`
+	// Target the address the connections are forwarded to, eg. 127.0.0.1:8080
+	Target string `json:"target"`
+	// MaxConns the most connections forwarded at once, 0 for no limit
+	MaxConns int `json:"max_conns"`
+	// IdleTimeout closes the connections idle for this long, 0 for forward.DefaultIdleTimeout
+	IdleTimeout Duration `json:"idle_timeout"`
+}
+
+// SMTP the smtp server the verification links and notifications are emailed through
+type SMTP struct {
+	// Addr the host:port of the server, empty to send no emails
+	Addr     string `json:"addr"`
+	From     string `json:"from"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// VerifyURL the page the verification links point to, the api's if empty
+	VerifyURL string `json:"verify_url"`
+}
+
+// OIDC the provider the filebrowser proxy logs in through besides the passwords
+type OIDC struct {
+	// Issuer the provider, eg. https://accounts.google.com, empty to only log in with passwords
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL the callback registered at the provider, eg. https://fate.example.com/admin/oidc/callback
+	RedirectURL string   `json:"redirect_url"`
+	Scopes      []string `json:"scopes"`
+	// AuthURL, TokenURL and UserInfoURL the endpoints of the OAuth2 only providers, eg. GitHub
+	AuthURL      string `json:"auth_url"`
+	TokenURL     string `json:"token_url"`
+	UserInfoURL  string `json:"userinfo_url"`
+	SubjectClaim string `json:"subject_claim"`
+	// Provision create a user for the unknown subjects on their first login
+	Provision  bool     `json:"provision"`
+	SessionTTL Duration `json:"session_ttl"`
+}
+
+// Config the oidc provider config
+func (o OIDC) Config() oidc.Config {
+	return oidc.Config{
+		Issuer:       o.Issuer,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       o.Scopes,
+		AuthURL:      o.AuthURL,
+		TokenURL:     o.TokenURL,
+		UserInfoURL:  o.UserInfoURL,
+		SubjectClaim: o.SubjectClaim,
+	}
+}
+
+// Server the timeouts and slow client limits of the http server
+//
+// Zero values use the httpserver defaults, negative rates disable the checks
+type Server struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+	// MinReadRate and MinWriteRate in bytes per second
+	MinReadRate  int64    `json:"min_read_rate"`
+	MinWriteRate int64    `json:"min_write_rate"`
+	SlowGrace    Duration `json:"slow_grace"`
+}
+
+// Options the httpserver options of the server
+func (s Server) Options() httpserver.Options {
+	return httpserver.Options{
+		ReadHeaderTimeout: time.Duration(s.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(s.ReadTimeout),
+		WriteTimeout:      time.Duration(s.WriteTimeout),
+		IdleTimeout:       time.Duration(s.IdleTimeout),
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+		MinReadRate:       s.MinReadRate,
+		MinWriteRate:      s.MinWriteRate,
+		Grace:             time.Duration(s.SlowGrace),
+	}
+}
+
+// RateLimit the request limits of the api and the filebrowser proxy, zero values are unlimited
+type RateLimit struct {
+	// IPRate and IPBurst the requests per second and the burst of every client ip
+	IPRate  float64 `json:"ip_rate"`
+	IPBurst int     `json:"ip_burst"`
+	// UserRate and UserBurst the requests per second and the burst of every api actor
+	UserRate  float64 `json:"user_rate"`
+	UserBurst int     `json:"user_burst"`
+	// TrustForwarded use X-Forwarded-For as the client ip, only behind a proxy setting it
+	TrustForwarded bool `json:"trust_forwarded"`
+	// MaxBodySize the largest request body in bytes
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+// Options the ratelimit options of the limits
+func (l RateLimit) Options() ratelimit.Options {
+	return ratelimit.Options{
+		IPRate:         l.IPRate,
+		IPBurst:        l.IPBurst,
+		UserRate:       l.UserRate,
+		UserBurst:      l.UserBurst,
+		TrustForwarded: l.TrustForwarded,
+		MaxBodySize:    l.MaxBodySize,
+	}
+}
+
+// Mirror a bucket the server mirrors to a directory for the tools which only understand paths
+type Mirror struct {
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	Bucket     string `json:"bucket"`
+	Dir        string `json:"dir"`
+}
+
+// Target the mirror target
+func (m Mirror) Target() mirror.Target {
+	return mirror.Target{EntityType: m.EntityType, EntityID: m.EntityID, Bucket: m.Bucket, Dir: m.Dir}
+}
+
+// Sink an event sink the server forwards the events to
+type Sink struct {
+	// Kind webhook, kafka-rest or nats
+	Kind string `json:"kind"`
+	// URL the webhook endpoint, the Kafka REST proxy or the NATS server
+	URL string `json:"url"`
+	// Topic the Kafka topic or the NATS subject
+	Topic      string          `json:"topic"`
+	Encoding   events.Encoding `json:"encoding"`
+	Partitions int             `json:"partitions"`
+	// Secret the key the webhook and NATS payloads are signed with
+	Secret string        `json:"secret"`
+	Types  []events.Type `json:"types"`
+	// Attempts the number of times an event is sent, default events.DefaultAttempts, 1 never retries
+	Attempts int `json:"attempts"`
+	// Backoff the wait before the first retry, doubled on every retry
+	Backoff Duration `json:"backoff"`
+}
+
+// Sink the events sink, retrying the failed sends
+func (s Sink) Sink() (events.Sink, error) {
+	var sink events.Sink
+	switch s.Kind {
+	case "webhook":
+		sink = &events.Webhook{URL: s.URL, Secret: []byte(s.Secret), Types: s.Types}
+	case "kafka-rest":
+		sink = &events.KafkaREST{URL: s.URL, Topic: s.Topic, Encoding: s.Encoding, Partitions: s.Partitions, Types: s.Types}
+	case "nats":
+		sink = &events.NATS{URL: s.URL, Subject: s.Topic, Encoding: s.Encoding, Partitions: s.Partitions, Types: s.Types, Secret: []byte(s.Secret)}
+	case "kafka":
+		return nil, errs.New(errs.ErrInvalidOption, "The kafka sink needs a Kafka REST proxy, use the kafka-rest kind with its url")
+	default:
+		return nil, errs.New(errs.ErrInvalidOption, "Unknown event sink "+s.Kind)
+	}
+	if s.Attempts == 1 {
+		return sink, nil
+	}
+	return &events.Retry{Sink: sink, Attempts: s.Attempts, Backoff: time.Duration(s.Backoff)}, nil
+}
+
+// Cache the cache in front of the bucket, entity and role lookups
+type Cache struct {
+	// Kind lru or redis, empty disables the cache
+	Kind string `json:"kind"`
+	// URL of the redis server, eg. redis://:pass@localhost:6379/0
+	URL string `json:"url"`
+	// Size the number of values the lru holds
+	Size int `json:"size"`
+	// TTL how long a value is kept at most
+	TTL Duration `json:"ttl"`
+}
+
+// Cache the cache, nil if it's disabled
+func (c Cache) Cache() (cache.Cache, error) {
+	switch c.Kind {
+	case "":
+		return nil, nil
+	case "lru":
+		return cache.NewLRU(c.Size), nil
+	case "redis":
+		if c.URL == "" {
+			return nil, errs.New(errs.ErrInvalidOption, "The redis cache needs a url")
+		}
+		return &cache.Redis{URL: c.URL}, nil
+	}
+	return nil, errs.New(errs.ErrInvalidOption, "Unknown cache "+c.Kind)
+}
+
+// Config the options of the fate command
+type Config struct {
+	// StorageDir where the buckets are kept, empty for the user config directory
+	StorageDir string   `json:"storage_dir"`
+	Database   Database `json:"database"`
+	// SigningKey the key shared urls are signed with, random on every start if empty
+	SigningKey string `json:"signing_key"`
+	// MigrationToken enables the migration endpoints and authenticates pulls
+	MigrationToken string `json:"migration_token"`
+	// AdminToken enables the admin endpoints of the api, eg. the read-only switch
+	AdminToken string `json:"admin_token"`
+	// ReadOnly start the server in read-only maintenance mode
+	ReadOnly bool `json:"read_only"`
+	// MaxUploadSize the largest upload the api accepts in bytes, 0 for unlimited
+	MaxUploadSize int64       `json:"max_upload_size"`
+	BackupDir     string      `json:"backup_dir"`
+	Maintenance   Maintenance `json:"maintenance"`
+	Server        Server      `json:"server"`
+	RateLimit     RateLimit   `json:"rate_limit"`
+	Jobs          Jobs        `json:"jobs"`
+	// Events the sinks the events are forwarded to
+	Events []Sink `json:"events"`
+	// Mirrors the buckets kept mirrored to directories
+	Mirrors []Mirror `json:"mirrors"`
+	// IDs the generator of the ids of the new entities, uuid (default), ulid, ksuid or snowflake
+	IDs string `json:"ids"`
+	// IDNode the node of the snowflake ids, unique to every process sharing the database, -1 for none
+	IDNode int `json:"id_node"`
+	// IOWorkers the number of files the syncs, imports and exports read at once, 0 for the default
+	IOWorkers int `json:"io_workers"`
+	// Forwards the TCP ports forwarded by the server
+	Forwards []Forward `json:"forwards"`
+	// Manifest the file declaring the entity types, applied by fate migrate
+	Manifest string `json:"manifest"`
+	// TenantHeader the header a trusted proxy selects the tenant of the api requests with
+	TenantHeader string `json:"tenant_header"`
+	// WebDAV serves the buckets over WebDAV under /api/v1/dav
+	WebDAV bool  `json:"webdav"`
+	SFTP   SFTP  `json:"sftp"`
+	SMTP   SMTP  `json:"smtp"`
+	OIDC   OIDC  `json:"oidc"`
+	Cache  Cache `json:"cache"`
+}
+
+// Default the configuration used for what isn't set anywhere
+func Default() *Config {
+	return &Config{
+		Database: Database{
+			Mode:       f8.Sqlite,
+			SqlitePath: "f8.db",
+			Host:       "localhost",
+			Port:       5432,
+			Name:       "f8",
+		},
+		BackupDir: "backups",
+		IDNode:    -1,
+		SFTP:      SFTP{HostKey: "fate_host_key"},
+		OIDC:      OIDC{SessionTTL: Duration(oidc.DefaultSessionTTL)},
+		Cache:     Cache{TTL: Duration(time.Minute)},
+		Maintenance: Maintenance{
+			MinRate:     pace.DefaultMinRate,
+			MaxRate:     pace.DefaultMaxRate,
+			TargetP95:   Duration(pace.DefaultTargetP95),
+			MirrorEvery: Duration(15 * time.Minute),
+			UsageEvery:  Duration(time.Hour),
+		},
+		Jobs: Jobs{
+			Workers:     jobs.DefaultWorkers,
+			MaxAttempts: jobs.DefaultMaxAttempts,
+			Retention:   Duration(7 * 24 * time.Hour),
+		},
+	}
+}
+
+// durationValue a flag.Value for a Duration
+type durationValue Duration
+
+func (d *durationValue) String() string { return time.Duration(*d).String() }
+
+func (d *durationValue) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = durationValue(v)
+	return err
+}
+
+// flags registers the flags of the options on fs
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.StorageDir, "storage-dir", c.StorageDir, "directory the buckets are kept in")
+	fs.StringVar((*string)(&c.Database.Mode), "db", string(c.Database.Mode), "database, sqlite or postgres")
+	fs.StringVar(&c.Database.SqlitePath, "db-path", c.Database.SqlitePath, "sqlite database file")
+	fs.StringVar(&c.Database.Host, "db-host", c.Database.Host, "postgres host")
+	fs.IntVar(&c.Database.Port, "db-port", c.Database.Port, "postgres port")
+	fs.StringVar(&c.Database.User, "db-user", c.Database.User, "postgres user")
+	fs.StringVar(&c.Database.Name, "db-name", c.Database.Name, "postgres database name")
+	fs.IntVar(&c.Database.MaxOpenConns, "db-max-open", c.Database.MaxOpenConns, "most database connections open at once, 0 for unlimited")
+	fs.IntVar(&c.Database.MaxIdleConns, "db-max-idle", c.Database.MaxIdleConns, "most idle database connections kept, 0 for the default")
+	fs.IntVar(&c.Database.ConnectAttempts, "db-connect-attempts", c.Database.ConnectAttempts, "times connecting to postgres is tried at startup, 0 for the default")
+	fs.StringVar(&c.Cache.Kind, "cache", c.Cache.Kind, "cache of the bucket and entity lookups, lru or redis, empty for none")
+	fs.StringVar(&c.BackupDir, "backup-dir", c.BackupDir, "directory the backups are kept in")
+	fs.StringVar(&c.Manifest, "manifest", c.Manifest, "json or yaml file declaring the entity types")
+	fs.StringVar(&c.IDs, "ids", c.IDs, "generator of the ids of the new entities, uuid, ulid, ksuid or snowflake")
+	fs.IntVar(&c.IDNode, "id-node", c.IDNode, "node of the snowflake ids, unique to every process sharing the database")
+	fs.StringVar(&c.TenantHeader, "tenant-header", c.TenantHeader, "header selecting the tenant of the api requests, only behind a proxy setting it")
+	fs.StringVar(&c.SFTP.Addr, "sftp", c.SFTP.Addr, "address the buckets are served over sftp on, eg. :2022")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "start in read-only maintenance mode")
+	fs.Int64Var(&c.MaxUploadSize, "max-upload", c.MaxUploadSize, "largest upload the api accepts in bytes, 0 for unlimited")
+	fs.Float64Var(&c.RateLimit.IPRate, "ip-rate", c.RateLimit.IPRate, "requests per second allowed per client ip, 0 for unlimited")
+	fs.Float64Var(&c.RateLimit.UserRate, "user-rate", c.RateLimit.UserRate, "api requests per second allowed per actor, 0 for unlimited")
+	fs.Int64Var(&c.RateLimit.MaxBodySize, "max-body", c.RateLimit.MaxBodySize, "largest request body in bytes, 0 for unlimited")
+	fs.Var((*durationValue)(&c.Maintenance.GCEvery), "gc-every", "run the gc in the background of the server this often, 0 to disable")
+	fs.IntVar(&c.Jobs.Workers, "job-workers", c.Jobs.Workers, "number of background jobs the server runs at once")
+	fs.IntVar(&c.IOWorkers, "io-workers", c.IOWorkers, "number of files the syncs, imports and exports read at once, 0 for the default")
+	fs.Var((*durationValue)(&c.Maintenance.DeleteRetention), "delete-retention", "only purge what was deleted longer ago than this in the gc, until then it can be restored")
+	fs.Var((*durationValue)(&c.Maintenance.AuditRetention), "audit-retention", "prune the audit log entries older than this in the gc, 0 to keep them forever")
+	fs.Float64Var(&c.Maintenance.MinRate, "min-rate", c.Maintenance.MinRate, "gc and fsck never run slower than n operations per second")
+	fs.Float64Var(&c.Maintenance.MaxRate, "max-rate", c.Maintenance.MaxRate, "gc and fsck never run faster than n operations per second")
+	fs.Var((*durationValue)(&c.Maintenance.TargetP95), "target-p95", "gc and fsck back off when the p95 query or storage latency goes above this")
+}
+
+// env overrides the options set in the environment
+//
+// Secrets (passwords, keys and tokens) can only be set here or in the file
+func (c *Config) env() error {
+	strs := map[string]*string{
+		"FATE_STORAGE_DIR":     &c.StorageDir,
+		"FATE_DB":              (*string)(&c.Database.Mode),
+		"FATE_DB_PATH":         &c.Database.SqlitePath,
+		"FATE_DB_HOST":         &c.Database.Host,
+		"FATE_DB_USER":         &c.Database.User,
+		"FATE_DB_PASSWORD":     &c.Database.Password,
+		"FATE_DB_NAME":         &c.Database.Name,
+		"FATE_DB_READ_DSN":     &c.Database.ReadDSN,
+		"FATE_SIGNING_KEY":     &c.SigningKey,
+		"FATE_MIGRATION_TOKEN": &c.MigrationToken,
+		"FATE_ADMIN_TOKEN":     &c.AdminToken,
+		"FATE_BACKUP_DIR":      &c.BackupDir,
+		"FATE_MANIFEST":        &c.Manifest,
+		"FATE_TENANT_HEADER":   &c.TenantHeader,
+		"FATE_IDS":             &c.IDs,
+		"FATE_SMTP_PASSWORD":   &c.SMTP.Password,
+		"FATE_OIDC_SECRET":     &c.OIDC.ClientSecret,
+		"FATE_CACHE_URL":       &c.Cache.URL,
+	}
+	for key, dst := range strs {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	if v, ok := os.LookupEnv("FATE_DB_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return errs.New(errs.ErrInvalidOption, "FATE_DB_PORT must be a number")
+		}
+		c.Database.Port = port
+	}
+	if v, ok := os.LookupEnv("FATE_ID_NODE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errs.New(errs.ErrInvalidOption, "FATE_ID_NODE must be a number")
+		}
+		c.IDNode = n
+	}
+	if v, ok := os.LookupEnv("FATE_MAX_UPLOAD"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errs.New(errs.ErrInvalidOption, "FATE_MAX_UPLOAD must be a number of bytes")
+		}
+		c.MaxUploadSize = n
+	}
+	return nil
+}
+
+// load reads the config file over the options
+func (c *Config) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return errs.New(errs.ErrInvalidOption, "Config file "+path+": "+err.Error())
+	}
+	return nil
+}
+
+// Parse parses the command's arguments into a config
+//
+// The flags of every option and -config are added to fs, register the
+// command's own flags before calling it. The config file is -config,
+// then FATE_CONFIG, then fate.json if it exists.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+	c.flags(fs)
+	file := os.Getenv("FATE_CONFIG")
+	explicit := file != ""
+	if file == "" {
+		file = DefaultFile
+	}
+	fs.StringVar(&file, "config", file, "config file")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// flags win, remember them before the file and env overwrite the options
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	err = c.load(file)
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return nil, err
+	}
+	err = c.env()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range set {
+		err = fs.Set(name, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Storage opens the storage and its database
+func (c *Config) Storage() (*f8.StorageConfig, error) {
+	var connect *retry.Policy
+	if c.Database.ConnectAttempts > 0 {
+		p := retry.Connect
+		p.Attempts = c.Database.ConnectAttempts
+		connect = &p
+	}
+	opts := []f8.Option{
+		f8.SetDBConfig(&f8.DBConfig{
+			DatabaseMode: c.Database.Mode,
+			LitePath:     c.Database.SqlitePath,
+			PGhostname:   c.Database.Host,
+			PGport:       c.Database.Port,
+			PGusername:   c.Database.User,
+			PGpassword:   c.Database.Password,
+			PGdbname:     c.Database.Name,
+
+			MaxOpenConns:    c.Database.MaxOpenConns,
+			MaxIdleConns:    c.Database.MaxIdleConns,
+			ConnMaxLifetime: time.Duration(c.Database.ConnMaxLifetime),
+			ConnMaxIdleTime: time.Duration(c.Database.ConnMaxIdleTime),
+			ConnectRetry:    connect,
+			ReadDSN:         c.Database.ReadDSN,
+		}),
+	}
+	if c.StorageDir != "" {
+		opts = append(opts, f8.StorageDir(c.StorageDir))
+	}
+	if c.SigningKey != "" {
+		opts = append(opts, f8.SigningKey([]byte(c.SigningKey)))
+	}
+	return f8.New(opts...)
+}
+
+// IDGenerator the generator of the ids of the new entities
+//
+// The snowflakes are refused without an IDNode, the processes would
+// all be the same node and generate the same ids
+func (c *Config) IDGenerator() (clock.IDGenerator, error) {
+	if c.IDNode >= 0 {
+		err := clock.SetNode(c.IDNode)
+		if err != nil {
+			return nil, err
+		}
+	} else if strings.EqualFold(c.IDs, clock.Snowflake) {
+		return nil, errs.New(errs.ErrInvalidOption, "Snowflake ids need an id_node (-id-node, FATE_ID_NODE) unique to the process")
+	}
+	return clock.Generator(c.IDs)
+}
+
+// Pacer the pacer for the gc and fsck
+func (c *Config) Pacer(db *pace.Monitor) *pace.Pacer {
+	return pace.New(pace.Options{
+		MinRate:   c.Maintenance.MinRate,
+		MaxRate:   c.Maintenance.MaxRate,
+		TargetP95: time.Duration(c.Maintenance.TargetP95),
+		DB:        db,
+	})
+}
@@ -0,0 +1,307 @@
+// Package dav serves the files of a bucket over WebDAV so it can be mounted as a network drive
+//
+// FileSystem adapts a bucket to golang.org/x/net/webdav, the reads and
+// writes go through the bucket like the rest of the api, quotas, locks
+// and events included.
+//
+//	h := &webdav.Handler{
+//		Prefix:     "/dav/users/phano/default",
+//		FileSystem: dav.New(b),
+//		LockSystem: webdav.NewMemLS(),
+//	}
+package dav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"golang.org/x/net/webdav"
+)
+
+// FileSystem a webdav.FileSystem over the files of a bucket
+type FileSystem struct {
+	b *buckets.Bucket
+}
+
+// New returns the webdav.FileSystem of the bucket, it must have its db and storage attached
+func New(b *buckets.Bucket) *FileSystem {
+	return &FileSystem{b: b}
+}
+
+// isRoot whether the webdav name is the root of the bucket
+func isRoot(name string) bool {
+	return strings.Trim(name, "/") == ""
+}
+
+// osError converts the bucket errors to the os errors webdav.Handler maps to statuses
+func osError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errs.ErrFileNotFound):
+		err = os.ErrNotExist
+	case errors.Is(err, errs.ErrFileExists):
+		err = os.ErrExist
+	case errors.Is(err, errs.ErrForbidden):
+		err = os.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentExists returns an error unless the parent directory of name exists
+func (fs *FileSystem) parentExists(op, name string) error {
+	dir := path.Dir("/" + strings.Trim(name, "/"))
+	if isRoot(dir) {
+		return nil
+	}
+	fdir, err := fs.b.Stat(dir)
+	if err != nil {
+		return osError(op, name, err)
+	}
+	if !fdir.IsDir {
+		return osError(op, name, errs.New(errs.ErrInvalidPath, dir+" is not a directory"))
+	}
+	return nil
+}
+
+// Mkdir creates the directory, its parent must exist
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isRoot(name) {
+		return osError("mkdir", name, os.ErrExist)
+	}
+	_, err := fs.b.Stat(name)
+	if err == nil {
+		return osError("mkdir", name, os.ErrExist)
+	}
+	if !errors.Is(err, errs.ErrFileNotFound) {
+		return osError("mkdir", name, err)
+	}
+	err = fs.parentExists("mkdir", name)
+	if err != nil {
+		return err
+	}
+	_, err = fs.b.Mkdir(name)
+	return osError("mkdir", name, err)
+}
+
+// OpenFile opens the file or directory for reading, or the file for writing
+//
+// Opening for writing always truncates, the contents are written to a temp
+// object and replace the file on Close
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fs.create(name)
+	}
+	info, err := fs.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dir{fs: fs, name: name, info: info}, nil
+	}
+	f, err := fs.b.Open(name)
+	if err != nil {
+		return nil, osError("open", name, err)
+	}
+	return &file{File: f, info: info}, nil
+}
+
+// create opens the file at name for writing
+func (fs *FileSystem) create(name string) (webdav.File, error) {
+	if isRoot(name) {
+		return nil, osError("open", name, errs.ErrIsDir)
+	}
+	fdir, err := fs.b.Stat(name)
+	if err == nil && fdir.IsDir {
+		return nil, osError("open", name, errs.ErrIsDir)
+	}
+	if err != nil && !errors.Is(err, errs.ErrFileNotFound) {
+		return nil, osError("open", name, err)
+	}
+	err = fs.parentExists("open", name)
+	if err != nil {
+		return nil, err
+	}
+	u, err := fs.b.NewUpload(name)
+	if err != nil {
+		return nil, osError("open", name, err)
+	}
+	return &upload{u: u, name: name, modTime: clock.Now()}, nil
+}
+
+// RemoveAll removes the file or directory along with everything under it
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if isRoot(name) {
+		return osError("remove", name, os.ErrPermission)
+	}
+	err := fs.b.Remove(name)
+	if errors.Is(err, errs.ErrFileNotFound) {
+		// like os.RemoveAll
+		return nil
+	}
+	return osError("remove", name, err)
+}
+
+// Rename moves the file or directory, see buckets.Bucket.Move
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if isRoot(oldName) || isRoot(newName) {
+		return osError("rename", oldName, os.ErrPermission)
+	}
+	_, err := fs.b.Move(oldName, newName)
+	return osError("rename", oldName, err)
+}
+
+// Stat returns the FileInfo of the file or directory
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.stat(name)
+}
+
+func (fs *FileSystem) stat(name string) (*fileInfo, error) {
+	if isRoot(name) {
+		return &fileInfo{FileDir: &buckets.FileDir{
+			Name:    "/",
+			Mode:    os.ModeDir | 0766,
+			ModTime: fs.b.UpdatedAt,
+			IsDir:   true,
+		}}, nil
+	}
+	fdir, err := fs.b.Stat(name)
+	if err != nil {
+		return nil, osError("stat", name, err)
+	}
+	return &fileInfo{FileDir: fdir}, nil
+}
+
+// fileInfo the os.FileInfo of a FileDir row
+type fileInfo struct {
+	*buckets.FileDir
+}
+
+func (fi *fileInfo) Name() string       { return fi.FileDir.Name }
+func (fi *fileInfo) Size() int64        { return fi.FileDir.Size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.FileDir.Mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.FileDir.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.FileDir.IsDir }
+func (fi *fileInfo) Sys() interface{}   { return fi.FileDir }
+
+// ContentType the sniffed content type of the file, webdav.Handler
+// opens the file to sniff it again otherwise
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.FileDir.ContentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.FileDir.ContentType, nil
+}
+
+// file a file of the bucket opened for reading
+type file struct {
+	*os.File
+	info *fileInfo
+}
+
+func (f *file) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, osError("readdir", f.info.Path, errs.New(errs.ErrInvalidPath, "Not a directory"))
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	return 0, osError("write", f.info.Path, os.ErrPermission)
+}
+
+// dir a directory of the bucket, its entries are read on the first Readdir
+type dir struct {
+	fs      *FileSystem
+	name    string
+	info    *fileInfo
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *dir) Close() error                                 { return nil }
+func (d *dir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+func (d *dir) Read(p []byte) (int, error)                   { return 0, osError("read", d.name, errs.ErrIsDir) }
+func (d *dir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *dir) Write(p []byte) (int, error)                  { return 0, osError("write", d.name, errs.ErrIsDir) }
+
+// Readdir reads the next count entries of the directory, all of them if count <= 0
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		fdirs, err := d.fs.b.ReadDir(d.name)
+		if err != nil {
+			return nil, osError("readdir", d.name, err)
+		}
+		d.entries = make([]os.FileInfo, len(fdirs))
+		for i := range fdirs {
+			d.entries[i] = &fileInfo{FileDir: &fdirs[i]}
+		}
+		d.read = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// upload a file being written, committed to its path on Close
+type upload struct {
+	u       *buckets.Upload
+	name    string
+	modTime time.Time
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	return u.u.Write(p)
+}
+
+// ReadFrom copies the request body, webdav.Handler's io.Copy goes through
+// it so a client going away aborts the upload instead of committing a part
+func (u *upload) ReadFrom(r io.Reader) (int64, error) {
+	return u.u.ReadFrom(r)
+}
+
+// Close replaces the file with what was written unless the upload was aborted
+func (u *upload) Close() error {
+	_, err := u.u.Commit()
+	return osError("close", u.name, err)
+}
+
+func (u *upload) Stat() (os.FileInfo, error) {
+	return &fileInfo{FileDir: &buckets.FileDir{
+		Name:    path.Base(u.name),
+		Path:    strings.Trim(u.name, "/"),
+		Size:    u.u.Size(),
+		Mode:    0766,
+		ModTime: u.modTime,
+	}}, nil
+}
+
+func (u *upload) Read(p []byte) (int, error) {
+	return 0, osError("read", u.name, os.ErrPermission)
+}
+
+func (u *upload) Seek(offset int64, whence int) (int64, error) {
+	return 0, osError("seek", u.name, os.ErrPermission)
+}
+
+func (u *upload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, osError("readdir", u.name, errs.New(errs.ErrInvalidPath, "Not a directory"))
+}
@@ -0,0 +1,108 @@
+package entity
+
+import (
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/validate"
+	"gorm.io/gorm"
+)
+
+// loadChunk the most entity ids LoadBuckets puts in one query
+const loadChunk = 500
+
+// Attach attaches a BaseEntity loaded from the database, eg. by a repository,
+// to the db and the storage of the options
+//
+// Unlike Entity it doesn't fetch nor create any bucket and leaves
+// EntityBucketMap alone, see LoadBuckets. The ID option is ignored.
+func Attach(e *BaseEntity, opts ...Option) error {
+	o := options{
+		defaultBucketName: "default",
+		tenant:            e.Tenant,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.db == nil {
+		return errs.New(errs.ErrInvalidOption, "Must pass the gorm database instance")
+	}
+	if o.storage == nil {
+		return errs.New(errs.ErrInvalidOption, "Must pass a storage instance")
+	}
+	if o.tableName == "" {
+		return errs.New(errs.ErrInvalidOption, "Must specify the table name")
+	}
+	if err := validate.EntityType(o.tableName); err != nil {
+		return err
+	}
+	if err := o.scope(); err != nil {
+		return err
+	}
+	if o.defaultBucketName == "" {
+		o.defaultBucketName = "default"
+	}
+	if o.bucketLayout == "" {
+		o.bucketLayout = buckets.EntityLayoutName
+	}
+	if _, ok := buckets.LookupLayout(o.bucketLayout); !ok {
+		return errs.New(errs.ErrInvalidOption, "Unknown bucket layout "+o.bucketLayout)
+	}
+
+	e.Tenant = o.tenant
+	e.entityType = o.tableName
+	e.db = o.db
+	e.storage = o.storage
+	e.bucketLayout = o.bucketLayout
+	e.defaultBucketName = o.defaultBucketName
+	e.templates = nil
+	if o.numBuckets == 0 && len(o.bucketNames) == 0 && o.defaultBucketName == "default" {
+		e.templates = BucketTemplates(o.tableName)
+		if len(e.templates) > 0 {
+			e.defaultBucketName = e.templates[0].Name
+		}
+	}
+	for _, b := range e.Buckets {
+		e.attach(b)
+	}
+	return nil
+}
+
+// LoadBuckets loads the buckets of the attached entities of a type, in one query per 500 entities
+//
+// The hidden buckets (eg. thumbnails) are left out, like GetBuckets
+func LoadBuckets(db *gorm.DB, ents []*BaseEntity) error {
+	if len(ents) == 0 {
+		return nil
+	}
+	byID := make(map[string]*BaseEntity, len(ents))
+	ids := make([]string, 0, len(ents))
+	for _, e := range ents {
+		e.Buckets = []*buckets.Bucket{}
+		byID[e.ID] = e
+		ids = append(ids, e.ID)
+	}
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > loadChunk {
+			chunk = chunk[:loadChunk]
+		}
+		ids = ids[len(chunk):]
+		var bucks []*buckets.Bucket
+		tx := db.Where(
+			"entity_type = ? AND entity_id IN ? AND id NOT LIKE ?",
+			ents[0].entityType, chunk, ".%",
+		).Find(&bucks)
+		if tx.Error != nil {
+			return errs.Wrap(errs.ErrDatabase, tx.Error)
+		}
+		for _, b := range bucks {
+			e, ok := byID[b.EntityID]
+			if !ok {
+				continue
+			}
+			e.attach(b)
+			e.Buckets = append(e.Buckets, b)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package entity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// maxChecks the most checks a CheckCache remembers
+const maxChecks = 10000
+
+// CheckCache remembers the passwords which matched for a while, so the
+// requests sending a password every time (eg. basic auth) don't all pay
+// for an argon2id hash, see CacheChecks
+//
+// The checks are keyed by an HMAC of the entity, the password and its
+// stored hash under a random key, a changed password is checked again
+type CheckCache struct {
+	key []byte
+	ttl time.Duration
+
+	mu      sync.Mutex
+	matched map[string]time.Time
+}
+
+// NewCheckCache returns a cache remembering the passwords which matched for ttl
+func NewCheckCache(ttl time.Duration) *CheckCache {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic("entity: reading random bytes failed " + err.Error())
+	}
+	return &CheckCache{key: key, ttl: ttl, matched: map[string]time.Time{}}
+}
+
+// CacheChecks option skips hashing the passwords which matched recently, see CheckCache
+func CacheChecks(c *CheckCache) PasswordOption {
+	return func(o *passwordOptions) {
+		o.checks = c
+	}
+}
+
+// sum the key of the check of the password against the credential
+func (cc *CheckCache) sum(c *Credential, password string) string {
+	mac := hmac.New(sha256.New, cc.key)
+	for _, part := range [][]byte{[]byte(c.EntityType), []byte(c.EntityID), c.Hash, []byte(password)} {
+		mac.Write(part)
+		mac.Write([]byte{0})
+	}
+	return string(mac.Sum(nil))
+}
+
+// hit whether the password matched the credential less than ttl ago
+func (cc *CheckCache) hit(c *Credential, password string) bool {
+	if cc == nil {
+		return false
+	}
+	sum := cc.sum(c, password)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	expires, ok := cc.matched[sum]
+	if ok && time.Now().After(expires) {
+		delete(cc.matched, sum)
+		return false
+	}
+	return ok
+}
+
+// add remembers that the password matched the credential
+func (cc *CheckCache) add(c *Credential, password string) {
+	if cc == nil {
+		return
+	}
+	sum := cc.sum(c, password)
+	now := time.Now()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if len(cc.matched) >= maxChecks {
+		for k, expires := range cc.matched {
+			if now.After(expires) {
+				delete(cc.matched, k)
+			}
+		}
+		if len(cc.matched) >= maxChecks {
+			cc.matched = map[string]time.Time{}
+		}
+	}
+	cc.matched[sum] = now.Add(cc.ttl)
+}
@@ -0,0 +1,280 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+)
+
+// DefaultTokenTTL how long an email verification token can be used
+const DefaultTokenTTL = 48 * time.Hour
+
+// Email an email address of an entity
+//
+// Any entity type can have emails, the model embedding the BaseEntity
+// declares them with the polymorphic association of the entity
+//
+//	Emails []entity.Email `json:"emails" gorm:"polymorphic:Entity;"`
+type Email struct {
+	gorm.Model
+	// Email the lower cased address, an entity has it only once
+	Email      string `gorm:"uniqueIndex:entity_email_idx;not null" json:"email"`
+	EntityID   string `gorm:"uniqueIndex:entity_email_idx" json:"-"`
+	EntityType string `gorm:"uniqueIndex:entity_email_idx" json:"-"`
+	// Primary the address the entity is reached at, at most one per entity
+	Primary bool `gorm:"column:is_primary" json:"primary"`
+	// VerifiedAt when the entity proved it owns the address, nil until then
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// TokenHash the sha256 of the pending verification token, see Contacts.NewToken
+	TokenHash      string     `gorm:"index" json:"-"`
+	TokenExpiresAt *time.Time `json:"-"`
+}
+
+// Verified whether the entity proved it owns the address
+func (e *Email) Verified() bool {
+	return e.VerifiedAt != nil
+}
+
+// BeforeSave lower cases the address
+func (e *Email) BeforeSave(tx *gorm.DB) error {
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+	return nil
+}
+
+// Contacts the email addresses of an entity
+type Contacts struct {
+	db         *gorm.DB
+	entityType string
+	entityID   string
+}
+
+// NewContacts returns the contacts of the entity
+func NewContacts(db *gorm.DB, entityType, entityID string) *Contacts {
+	return &Contacts{db: db, entityType: entityType, entityID: entityID}
+}
+
+// Contacts returns the contacts of the entity
+func (e *BaseEntity) Contacts() *Contacts {
+	return NewContacts(e.db, e.entityType, e.ID)
+}
+
+// scope returns a query matching the emails of the entity
+func (c *Contacts) scope() *gorm.DB {
+	return c.db.Model(&Email{}).Where("entity_type = ? AND entity_id = ?", c.entityType, c.entityID)
+}
+
+// normalize returns the lower cased address or an errs.ErrInvalidOption error
+func normalize(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errs.New(errs.ErrInvalidOption, "Invalid email "+email)
+	}
+	return email, nil
+}
+
+// hashToken the hash of a verification token kept in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Emails returns the emails of the entity, the primary one first
+func (c *Contacts) Emails() (emails []Email, err error) {
+	err = c.scope().Order("is_primary DESC, id").Find(&emails).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return emails, nil
+}
+
+// Find returns the email of the entity
+func (c *Contacts) Find(email string) (*Email, error) {
+	email, err := normalize(email)
+	if err != nil {
+		return nil, err
+	}
+	e := &Email{}
+	tx := c.scope().Where("email = ?", email).First(e)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrEntityNotFound)
+	}
+	return e, nil
+}
+
+// Add adds the unverified email, the first email of the entity is its primary one
+//
+// Adding an email the entity already has returns errs.ErrEntityExists
+func (c *Contacts) Add(email string) (*Email, error) {
+	email, err := normalize(email)
+	if err != nil {
+		return nil, err
+	}
+	e := &Email{Email: email, EntityType: c.entityType, EntityID: c.entityID}
+	err = c.db.Transaction(func(tx *gorm.DB) error {
+		c := NewContacts(tx, c.entityType, c.entityID)
+		var n, primaries int64
+		err := c.scope().Where("email = ?", email).Count(&n).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if n > 0 {
+			return errs.New(errs.ErrEntityExists, "Email "+email+" is already added")
+		}
+		err = c.scope().Where("is_primary = ?", true).Count(&primaries).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		e.Primary = primaries == 0
+		return errs.Wrap(errs.ErrDatabase, tx.Create(e).Error)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Remove removes the email, the oldest verified one left becomes the primary one
+func (c *Contacts) Remove(email string) error {
+	e, err := c.Find(email)
+	if err != nil {
+		return err
+	}
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Delete(e).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if !e.Primary {
+			return nil
+		}
+		var next []Email
+		err = NewContacts(tx, c.entityType, c.entityID).scope().
+			Order("verified_at IS NULL, id").Limit(1).Find(&next).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(next) == 0 {
+			// it was the last one
+			return nil
+		}
+		return errs.Wrap(errs.ErrDatabase, tx.Model(&next[0]).Update("is_primary", true).Error)
+	})
+}
+
+// Primary returns the primary email of the entity, the oldest one if none is set
+func (c *Contacts) Primary() (*Email, error) {
+	e := &Email{}
+	tx := c.scope().Order("is_primary DESC, id").First(e)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrEntityNotFound)
+	}
+	return e, nil
+}
+
+// SetPrimary makes the email the primary one of the entity, it must be verified
+func (c *Contacts) SetPrimary(email string) error {
+	e, err := c.Find(email)
+	if err != nil {
+		return err
+	}
+	if !e.Verified() {
+		return errs.New(errs.ErrInvalidOption, "Email "+e.Email+" is not verified")
+	}
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		err := NewContacts(tx, c.entityType, c.entityID).scope().
+			Where("id <> ?", e.ID).Update("is_primary", false).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		return errs.Wrap(errs.ErrDatabase, tx.Model(e).Update("is_primary", true).Error)
+	})
+}
+
+// NewToken returns a new verification token of the email valid for ttl, DefaultTokenTTL if 0
+//
+// Only its hash is kept, the token is sent to the address and given back
+// to Verify. A new token replaces the previous one.
+func (c *Contacts) NewToken(email string, ttl time.Duration) (string, error) {
+	e, err := c.Find(email)
+	if err != nil {
+		return "", err
+	}
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	expires := clock.Now().Add(ttl)
+	err = c.db.Model(e).Updates(map[string]interface{}{
+		"token_hash":       hashToken(token),
+		"token_expires_at": expires,
+	}).Error
+	if err != nil {
+		return "", errs.Wrap(errs.ErrDatabase, err)
+	}
+	return token, nil
+}
+
+// Verify marks the email of the token verified
+//
+// Unknown, used and expired tokens return errs.ErrInvalidOption
+func (c *Contacts) Verify(token string) (*Email, error) {
+	invalid := errs.New(errs.ErrInvalidOption, "Invalid or expired verification token")
+	if token == "" {
+		return nil, invalid
+	}
+	e := &Email{}
+	tx := c.scope().Where("token_hash = ?", hashToken(token)).First(e)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return nil, invalid
+	}
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	now := clock.Now()
+	if e.TokenExpiresAt == nil || now.After(*e.TokenExpiresAt) {
+		return nil, invalid
+	}
+	err := c.db.Model(e).Updates(map[string]interface{}{
+		"verified_at":      now,
+		"token_hash":       "",
+		"token_expires_at": nil,
+	}).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	e.VerifiedAt, e.TokenHash, e.TokenExpiresAt = &now, "", nil
+	return e, nil
+}
+
+// migrateEmails migrates the emails, moving those of the users which
+// were only associated with them over to the entities
+func migrateEmails(db *gorm.DB) error {
+	m := db.Migrator()
+	legacy := m.HasTable(&Email{}) && m.HasColumn(&Email{}, "user_id")
+	if legacy && m.HasIndex(&Email{}, "user_email_idx") {
+		err := m.DropIndex(&Email{}, "user_email_idx")
+		if err != nil {
+			return err
+		}
+	}
+	err := db.AutoMigrate(&Email{})
+	if err != nil || !legacy {
+		return err
+	}
+	return db.Exec("UPDATE emails SET entity_id = user_id, entity_type = user_type" +
+		" WHERE entity_id IS NULL OR entity_id = ''").Error
+}
@@ -0,0 +1,199 @@
+package entity
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+)
+
+// ErrEntityExists an entity with the same id and type already exists
+var ErrEntityExists = errs.ErrEntityExists
+
+// Stage the step of Create that failed
+type Stage string
+
+const (
+	// StageEntity inserting the entity row
+	StageEntity Stage = "entity"
+	// StageBuckets inserting the bucket rows
+	StageBuckets Stage = "buckets"
+	// StageStorage creating the bucket directories
+	StageStorage Stage = "storage"
+)
+
+// CreateError the reason Create failed
+//
+// Everything Create wrote to the database and storage was rolled back
+type CreateError struct {
+	Stage      Stage
+	EntityType string
+	EntityID   string
+	// BucketID the bucket being created when the error happened if any
+	BucketID string
+	Err      error
+}
+
+func (e *CreateError) Error() string {
+	msg := "Failed to create " + e.EntityType + " " + e.EntityID + " at " + string(e.Stage)
+	if e.BucketID != "" {
+		msg += " of bucket " + e.BucketID
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *CreateError) Unwrap() error {
+	return e.Err
+}
+
+// Create inserts the entity row along with its buckets and provisions
+// the bucket directories, all or nothing
+//
+// model is the application struct embedding the BaseEntity eg. a User,
+// it's inserted into the entity's table whatever its TableName.
+// Its other associations are created in the same transaction.
+// Returns ErrEntityExists or a *CreateError.
+func (e *BaseEntity) Create(model interface{}) error {
+	if e.db == nil {
+		return errs.New(errs.ErrInvalidOption, "DB was nil for some reason")
+	}
+	fail := func(stage Stage, bID string, err error) error {
+		return &CreateError{Stage: stage, EntityType: e.entityType, EntityID: e.ID, BucketID: bID, Err: err}
+	}
+	var made []string
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Table(e.entityType).Where("id = ?", e.ID).Count(&count).Error
+		if err != nil {
+			return fail(StageEntity, "", err)
+		}
+		if count > 0 {
+			return ErrEntityExists
+		}
+		err = tx.Table(e.entityType).Omit("Buckets").Create(model).Error
+		if err != nil {
+			return fail(StageEntity, "", err)
+		}
+		// no hooks, the bucket upsert hook would hide conflicts
+		// and the events must wait for the commit
+		btx := tx.Session(&gorm.Session{SkipHooks: true})
+		for _, b := range e.Buckets {
+			err = btx.Create(b).Error
+			if err != nil {
+				return fail(StageBuckets, b.ID, err)
+			}
+		}
+		if e.storage == nil {
+			return nil
+		}
+		for _, b := range e.Buckets {
+			if b.Layout != "" && b.Layout != buckets.EntityLayoutName {
+				// the other layouts create their objects on write
+				continue
+			}
+			created, err := mkdirAll(b.Dir())
+			made = append(made, created...)
+			if err != nil {
+				return fail(StageStorage, b.ID, err)
+			}
+		}
+		for _, b := range e.Buckets {
+			created, err := e.templateDirs(tx, b)
+			made = append(made, created...)
+			if err != nil {
+				return fail(StageStorage, b.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// deepest first, only the directories Create made and only if still empty
+		for i := len(made) - 1; i >= 0; i-- {
+			if rerr := os.Remove(made[i]); rerr != nil {
+				log.Println("[f8][WARNING]: Failed to roll back directory", made[i], rerr)
+			}
+		}
+		return err
+	}
+	cache.Forget(buckets.OwnerCacheKey(e.entityType, e.ID))
+	events.Publish(&events.Event{
+		Type:       events.EntityCreated,
+		EntityType: e.entityType,
+		EntityID:   e.ID,
+		Data:       map[string]interface{}{"buckets": len(e.Buckets)},
+	})
+	for _, b := range e.Buckets {
+		events.Publish(&events.Event{
+			Type:       events.BucketCreated,
+			EntityType: b.EntityType,
+			EntityID:   b.EntityID,
+			BucketID:   b.ID,
+			Data:       map[string]interface{}{"layout": b.Layout, "quota": b.Quota},
+		})
+	}
+	return nil
+}
+
+// templateDirs records the directories of the bucket's template in the transaction
+//
+// Returns the directories it created on disk
+func (e *BaseEntity) templateDirs(tx *gorm.DB, b *buckets.Bucket) ([]string, error) {
+	t := e.template(b.ID)
+	if t == nil || len(t.Dirs) == 0 {
+		return nil, nil
+	}
+	b.AttatchDB(tx)
+	defer b.AttatchDB(e.db)
+	made := []string{}
+	for _, dir := range t.Dirs {
+		if b.Layout == "" || b.Layout == buckets.EntityLayoutName {
+			// ahead of Mkdir so the rollback knows what to remove
+			created, err := mkdirAll(filepath.Join(b.Dir(), filepath.FromSlash(path.Clean("/"+dir))))
+			made = append(made, created...)
+			if err != nil {
+				return made, err
+			}
+		}
+		_, err := b.Mkdir(dir)
+		if err != nil {
+			return made, err
+		}
+	}
+	return made, nil
+}
+
+// mkdirAll creates dir and its missing parents
+//
+// Returns the directories it created, outermost first
+func mkdirAll(dir string) ([]string, error) {
+	missing := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err := os.Stat(d)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append([]string{d}, missing...)
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+	made := []string{}
+	for _, d := range missing {
+		err := os.Mkdir(d, 0766)
+		if err != nil {
+			return made, err
+		}
+		made = append(made, d)
+	}
+	return made, nil
+}
@@ -1,14 +1,26 @@
 package entity
 
 import (
-	"errors"
 	"log"
 	"sort"
 	"strconv"
+	"sync"
 
-	"github.com/google/uuid"
 	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/audit"
 	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/oidc"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/sftp"
+	"github.com/phanirithvij/fate/f8/stats"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"github.com/phanirithvij/fate/f8/usage"
+	"github.com/phanirithvij/fate/f8/validate"
 	"gorm.io/gorm"
 )
 
@@ -20,12 +32,19 @@ type BaseEntity struct {
 	// would be great if this was a map but unfortunately sql no maps
 	// Buckets []*buckets.Bucket `gorm:"foreignKey:EntityID"`
 	Buckets []*buckets.Bucket `gorm:"polymorphic:Entity"`
+	// Metadata application defined details of the entity
+	Metadata metadata.Metadata
+	// Tenant the application the entity belongs to, empty for none
+	Tenant string
 	// Buckets []*buckets.Bucket `gorm:"polymorphic:Entity;<-:false"`
 	// f8.BaseEntity `gorm:"-"`
 	db                *gorm.DB `gorm:"-"`
 	entityType        string   `gorm:"-"`
 	defaultBucketName string   `gorm:"-"`
+	bucketLayout      string   `gorm:"-"`
 	storage           *f8.StorageConfig
+	// templates the bucket templates the entity's buckets were made from if any
+	templates []*BucketTemplate
 }
 
 var (
@@ -34,9 +53,45 @@ var (
 	//	map[entity_type][entity_id][bucket_id]
 	//	eg:
 	//	map["users"][userid"]["default"]
+	//
+	// The entities are made concurrently (eg. by the oidc logins), only read
+	// or change it under bucketMapMu, see KnownBucket and Forget
 	EntityBucketMap map[string]map[string]map[string]*buckets.Bucket = make(map[string]map[string]map[string]*buckets.Bucket)
+	bucketMapMu     sync.RWMutex
 )
 
+// entityBuckets returns the buckets of the entity in EntityBucketMap, making the maps if needed
+//
+// bucketMapMu must be held
+func entityBuckets(entityType, id string) map[string]*buckets.Bucket {
+	m, ok := EntityBucketMap[entityType]
+	if !ok {
+		m = make(map[string]map[string]*buckets.Bucket)
+		EntityBucketMap[entityType] = m
+	}
+	bm, ok := m[id]
+	if !ok {
+		bm = make(map[string]*buckets.Bucket)
+		m[id] = bm
+	}
+	return bm
+}
+
+// KnownBucket returns the bucket of the entity in EntityBucketMap, saved or not
+func KnownBucket(entityType, id, bID string) (*buckets.Bucket, bool) {
+	bucketMapMu.RLock()
+	defer bucketMapMu.RUnlock()
+	b, ok := EntityBucketMap[entityType][id][bID]
+	return b, ok
+}
+
+// Forget drops the buckets of the entity from EntityBucketMap
+func Forget(entityType, id string) {
+	bucketMapMu.Lock()
+	delete(EntityBucketMap[entityType], id)
+	bucketMapMu.Unlock()
+}
+
 // From this vararg approach
 // https://github.com/faiface/gui/commit/ee3366ded862f02a1a5ee4ea856a06e46bb889ee#diff-f9c3d4c5cce2eabfcf19a1c38214e739a6619bdd22b15373e34be2e3e4589247R89
 
@@ -48,6 +103,10 @@ type options struct {
 	defaultBucketName string
 	bucketNames       []string
 	tableName         string
+	bucketLayout      string
+	tenant            string
+	ids               clock.IDGenerator
+	idGenerator       string
 	db                *gorm.DB
 	storage           *f8.StorageConfig
 }
@@ -63,6 +122,24 @@ func ID(id string) Option {
 	}
 }
 
+// IDs option sets the generator of the auto ids, default clock.NewID
+//
+// eg. clock.NewPrefixed("usr", clock.NewULIDs()) for sortable ids like usr_01ARZ3NDEKTSV4RRFFQ69G5FAV
+func IDs(ids clock.IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// IDGenerator option sets the generator of the auto ids by name, uuid, ulid, ksuid or snowflake
+//
+// See clock.Generator, IDs takes any generator
+func IDGenerator(name string) Option {
+	return func(o *options) {
+		o.idGenerator = name
+	}
+}
+
 // BucketCount option sets the num of buckets initially
 func BucketCount(numBuckets int) Option {
 	return func(o *options) {
@@ -113,7 +190,46 @@ func BucketNames(bucketNames []string) Option {
 	}
 }
 
+// BucketLayout option sets the storage layout of the buckets created for the entity
+//
+// Must be the name of a layout registered with buckets.RegisterLayout
+// default is buckets.EntityLayoutName
+func BucketLayout(name string) Option {
+	return func(o *options) {
+		o.bucketLayout = name
+	}
+}
+
+// Tenant option sets the tenant the entity and its buckets belong to
+//
+// The entity's queries are scoped to the tenant, see tenant.Scope.
+// Defaults to the tenant of the db if it's scoped.
+func Tenant(name string) Option {
+	return func(o *options) {
+		o.tenant = name
+	}
+}
+
+// scope scopes the db to the tenant, or takes the tenant of an already scoped db
+func (o *options) scope() error {
+	if scoped, ok := tenant.Of(o.db); ok {
+		if o.tenant != "" && o.tenant != scoped {
+			return errs.New(errs.ErrInvalidOption, "The db is scoped to tenant "+scoped+" not "+o.tenant)
+		}
+		o.tenant = scoped
+	} else if o.tenant != "" {
+		o.db = tenant.Scope(o.db, o.tenant)
+	}
+	if o.tenant != "" {
+		return validate.Tenant(o.tenant)
+	}
+	return nil
+}
+
 // Entity a new base entity
+//
+// Without BucketCount, BucketName or BucketNames its buckets are the ones
+// registered for the table with RegisterBucketTemplates, if any
 func Entity(opts ...Option) (*BaseEntity, error) {
 	o := options{
 		defaultBucketName: "default",
@@ -123,40 +239,78 @@ func Entity(opts ...Option) (*BaseEntity, error) {
 	}
 
 	if o.db == nil {
-		return nil, errors.New("Must pass the gorm database instance")
+		return nil, errs.New(errs.ErrInvalidOption, "Must pass the gorm database instance")
 	}
 	if o.storage == nil {
-		return nil, errors.New("Must pass a storage instance")
+		return nil, errs.New(errs.ErrInvalidOption, "Must pass a storage instance")
+	}
+	if o.idGenerator != "" && o.ids == nil {
+		ids, err := clock.Generator(o.idGenerator)
+		if err != nil {
+			return nil, err
+		}
+		o.ids = ids
 	}
-	if o.id == "" {
-		o.id = uuid.New().String()
+	if o.id == "" && o.ids != nil {
+		o.id = o.ids.NewID()
+	} else if o.id == "" {
+		o.id = clock.NewID()
 	}
 	if o.tableName == "" {
-		return nil, errors.New("Must specify the table name")
+		return nil, errs.New(errs.ErrInvalidOption, "Must specify the table name")
+	}
+	if err := validate.EntityType(o.tableName); err != nil {
+		return nil, err
+	}
+	if err := validate.EntityID(o.id); err != nil {
+		return nil, err
+	}
+
+	if err := o.scope(); err != nil {
+		return nil, err
 	}
 
 	if o.defaultBucketName == "" {
 		o.defaultBucketName = "default"
 	}
+	if o.bucketLayout == "" {
+		o.bucketLayout = buckets.EntityLayoutName
+	}
+	if _, ok := buckets.LookupLayout(o.bucketLayout); !ok {
+		return nil, errs.New(errs.ErrInvalidOption, "Unknown bucket layout "+o.bucketLayout)
+	}
+
+	var tmpls []*BucketTemplate
+	if o.numBuckets == 0 && len(o.bucketNames) == 0 && o.defaultBucketName == "default" {
+		tmpls = BucketTemplates(o.tableName)
+		for _, t := range tmpls {
+			o.bucketNames = append(o.bucketNames, t.Name)
+		}
+		o.numBuckets = len(tmpls)
+	}
 
 	// whether we should use bucketNames[]
 	usebNames := false
 	if len(o.bucketNames) > 0 {
 		if o.defaultBucketName != "default" {
 			// both bucketNames and a name was specifed for an incremental bucket name
-			return nil, errors.New("Use only one of BucketNames, BucketName")
+			return nil, errs.New(errs.ErrInvalidOption, "Use only one of BucketNames, BucketName")
 		}
 		if len(o.bucketNames) != o.numBuckets {
-			return nil, errors.New("Number of bucket names must match the numBuckets")
+			return nil, errs.New(errs.ErrInvalidOption, "Number of bucket names must match the numBuckets")
 		}
 		usebNames = true
 	}
 
 	ent := &BaseEntity{
-		ID:         o.id,
-		Buckets:    []*buckets.Bucket{},
-		entityType: o.tableName,
-		db:         o.db,
+		ID:           o.id,
+		Tenant:       o.tenant,
+		Buckets:      []*buckets.Bucket{},
+		entityType:   o.tableName,
+		db:           o.db,
+		storage:      o.storage,
+		bucketLayout: o.bucketLayout,
+		templates:    tmpls,
 	}
 	if o.numBuckets == 0 {
 		// number of buckets was not specified
@@ -165,17 +319,13 @@ func Entity(opts ...Option) (*BaseEntity, error) {
 	}
 
 	ent.defaultBucketName = o.defaultBucketName
+	if len(tmpls) > 0 {
+		// the first template is the default bucket
+		ent.defaultBucketName = tmpls[0].Name
+	}
 
-	// make for this entity type
-	EntityBucketMap[ent.entityType] = make(map[string]map[string]*buckets.Bucket)
-
-	// populate the buckets from the db
-	_ = ent.FetchBuckets()
-	// if len(existing) > 0 {
-	// 	// some buckets already exist
-	// }
-	// create initial buckets
-	for i := 0; i < o.numBuckets; i++ {
+	bIDs := make([]string, o.numBuckets)
+	for i := range bIDs {
 		bID := o.defaultBucketName
 		if usebNames {
 			bID = o.bucketNames[i]
@@ -185,6 +335,19 @@ func Entity(opts ...Option) (*BaseEntity, error) {
 				bID = o.defaultBucketName + "-" + strconv.Itoa(i)
 			}
 		}
+		if err := validate.BucketName(bID); err != nil {
+			return nil, err
+		}
+		bIDs[i] = bID
+	}
+
+	// populate the buckets from the db
+	_ = ent.FetchBuckets()
+	// if len(existing) > 0 {
+	// 	// some buckets already exist
+	// }
+	// create initial buckets
+	for _, bID := range bIDs {
 		// this will create a bucket but will no-op if already exists
 		// so no need for error handling
 		_, err := ent.CreateBucket(bID)
@@ -203,14 +366,14 @@ func (e *BaseEntity) FetchBuckets() (bucks []*buckets.Bucket) {
 	e.Buckets = append(e.Buckets, bucks...)
 
 	// populate map
-	if _, ok := EntityBucketMap[e.entityType][e.ID]; !ok {
-		EntityBucketMap[e.entityType][e.ID] = make(map[string]*buckets.Bucket)
-	}
+	bucketMapMu.Lock()
+	defer bucketMapMu.Unlock()
+	known := entityBuckets(e.entityType, e.ID)
 	for _, b := range bucks {
-		b.AttatchDB(e.db)
-		if val, ok := EntityBucketMap[e.entityType][e.ID][b.ID]; !ok {
+		e.attach(b)
+		if val, ok := known[b.ID]; !ok {
 			log.Println("Added fetched", b.ID, "to map")
-			EntityBucketMap[e.entityType][e.ID][b.ID] = b
+			known[b.ID] = b
 		} else {
 			// already exists which is unlikely
 			log.Println("Duplicate bucket exists", val, e.ID, b.ID)
@@ -221,10 +384,12 @@ func (e *BaseEntity) FetchBuckets() (bucks []*buckets.Bucket) {
 }
 
 // GetBuckets fetches existing buckets and adds them to the map and list
+//
+// The hidden buckets (eg. thumbnails) are left out
 func (e *BaseEntity) GetBuckets() (bucks []*buckets.Bucket) {
 	tx := e.db.Where(
-		"entity_id = ? AND entity_type = ?",
-		e.ID, e.entityType,
+		"entity_id = ? AND entity_type = ? AND id NOT LIKE ?",
+		e.ID, e.entityType, ".%",
 	).Find(&bucks)
 	if tx.Error != nil {
 		log.Println("Failed to fetch buckets", tx.Error)
@@ -233,15 +398,73 @@ func (e *BaseEntity) GetBuckets() (bucks []*buckets.Bucket) {
 	return bucks
 }
 
+// SetMetadata sets a metadata key of the entity and saves it
+func (e *BaseEntity) SetMetadata(key string, value interface{}) error {
+	e.Metadata.Set(key, value)
+	tx := e.db.Table(e.entityType).Where("id = ?", e.ID).Update("metadata", e.Metadata)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if tx.RowsAffected == 0 {
+		return errs.New(errs.ErrEntityNotFound, e.entityType+" "+e.ID)
+	}
+	return nil
+}
+
+// WhereMetadata a scope filtering the entities by a metadata key and value
+//
+//	db.Scopes(entity.WhereMetadata("plan", "pro")).Find(&users)
+func WhereMetadata(key string, value interface{}) func(*gorm.DB) *gorm.DB {
+	return metadata.Where("metadata", key, value)
+}
+
+// Actor returns the entity as an actor for bucket access checks
+func (e *BaseEntity) Actor() *buckets.Actor {
+	return &buckets.Actor{ID: e.ID, Type: e.entityType, Tenant: e.Tenant}
+}
+
+// Role returns the role of the entity, see the roles package
+func (e *BaseEntity) Role() (roles.Role, error) {
+	return roles.Get(e.db, e.entityType, e.ID)
+}
+
+// SetRole gives the entity the role
+func (e *BaseEntity) SetRole(role roles.Role) error {
+	return roles.Set(e.db, e.entityType, e.ID, role)
+}
+
+// SharedBuckets returns the buckets of other entities shared with this entity
+func (e *BaseEntity) SharedBuckets() ([]*buckets.Bucket, error) {
+	bucks, err := buckets.SharedWith(e.db, e.Actor())
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bucks {
+		e.attach(b)
+	}
+	return bucks, nil
+}
+
+// attach attaches the entity's db and storage directory to the bucket
+func (e *BaseEntity) attach(b *buckets.Bucket) {
+	b.AttatchDB(e.db)
+	if e.storage != nil {
+		b.AttachStorage(e.storage.StorageDir)
+	}
+}
+
 // OverwriteBuckets overwrites the local buckets from the database
 func (e *BaseEntity) OverwriteBuckets() {
 	e.Buckets = e.GetBuckets()
 	// reset and populate map
-	EntityBucketMap[e.entityType][e.ID] = make(map[string]*buckets.Bucket)
+	bucketMapMu.Lock()
+	defer bucketMapMu.Unlock()
+	delete(EntityBucketMap[e.entityType], e.ID)
+	known := entityBuckets(e.entityType, e.ID)
 	for _, b := range e.Buckets {
-		b.AttatchDB(e.db)
-		if _, ok := EntityBucketMap[e.entityType][e.ID][b.ID]; !ok {
-			EntityBucketMap[e.entityType][e.ID][b.ID] = b
+		e.attach(b)
+		if _, ok := known[b.ID]; !ok {
+			known[b.ID] = b
 		}
 	}
 }
@@ -249,17 +472,35 @@ func (e *BaseEntity) OverwriteBuckets() {
 // CreateBucket creates a new bucket for the entity
 // and appends it to the entity owned bucket list
 func (e *BaseEntity) CreateBucket(bID string) (buck *buckets.Bucket, err error) {
-	if _, ok := EntityBucketMap[e.entityType][e.ID]; !ok {
-		EntityBucketMap[e.entityType][e.ID] = make(map[string]*buckets.Bucket)
+	err = validate.BucketName(bID)
+	if err != nil {
+		return nil, err
+	}
+	// the entities of a repository only have their loaded buckets
+	for _, b := range e.Buckets {
+		if b.ID == bID {
+			return nil, errs.New(errs.ErrBucketExists, bID)
+		}
 	}
-	if _, ok := EntityBucketMap[e.entityType][e.ID][bID]; !ok {
+	bucketMapMu.Lock()
+	defer bucketMapMu.Unlock()
+	known := entityBuckets(e.entityType, e.ID)
+	if _, ok := known[bID]; !ok {
 		buck = buckets.NewBucket(bID, e.db)
-		EntityBucketMap[e.entityType][e.ID][bID] = buck
+		buck.EntityID = e.ID
+		buck.EntityType = e.entityType
+		buck.Layout = e.bucketLayout
+		buck.Tenant = e.Tenant
+		if t := e.template(bID); t != nil {
+			t.apply(buck)
+		}
+		e.attach(buck)
+		known[bID] = buck
 		e.Buckets = append(e.Buckets, buck)
 		log.Println("Added", buck.ID, "to map")
 		return buck, nil
 	}
-	return nil, errors.New("Bucket already exists " + bID)
+	return nil, errs.New(errs.ErrBucketExists, bID)
 }
 
 // GetBucket returns a bucket with given name reading from DB
@@ -267,7 +508,7 @@ func (e *BaseEntity) CreateBucket(bID string) (buck *buckets.Bucket, err error)
 // pass an empty string to get the default bucket
 func (e *BaseEntity) GetBucket(bID string) (buck *buckets.Bucket, err error) {
 	if e.db == nil {
-		return nil, errors.New("DB was nil for some reason")
+		return nil, errs.New(errs.ErrInvalidOption, "DB was nil for some reason")
 	}
 	if bID == "" {
 		bID = e.defaultBucketName
@@ -277,32 +518,28 @@ func (e *BaseEntity) GetBucket(bID string) (buck *buckets.Bucket, err error) {
 		EntityID:   e.ID,
 		EntityType: e.entityType,
 	}
-	buck.AttatchDB(e.db)
+	e.attach(buck)
 
 	tx := e.db.First(buck)
 	if tx.Error != nil {
-		return nil, tx.Error
-	}
-	if _, ok := EntityBucketMap[e.entityType][e.ID]; !ok {
-		EntityBucketMap[e.entityType][e.ID] = make(map[string]*buckets.Bucket)
+		return nil, errs.DB(tx.Error, errs.ErrBucketNotFound)
 	}
 	// Add to map
-	if _, ok := EntityBucketMap[e.entityType][e.ID][bID]; !ok {
-		EntityBucketMap[e.entityType][e.ID][bID] = buck
+	bucketMapMu.Lock()
+	known := entityBuckets(e.entityType, e.ID)
+	if _, ok := known[bID]; !ok {
+		known[bID] = buck
 	}
+	bucketMapMu.Unlock()
 	// TODO add to list if it doesn't exist
 	return buck, nil
 }
 
 // DeleteBucket deletes a bucket from the entity
 func (e *BaseEntity) DeleteBucket(bID string) bool {
-	if _, ok := EntityBucketMap[e.entityType][e.ID]; !ok {
-		EntityBucketMap[e.entityType][e.ID] = make(map[string]*buckets.Bucket)
-	}
-
 	var buck *buckets.Bucket
 	// get bucket from map
-	if val, ok := EntityBucketMap[e.entityType][e.ID][bID]; ok && val != nil {
+	if val, ok := KnownBucket(e.entityType, e.ID, bID); ok && val != nil {
 		buck = val
 	} else {
 		var err error
@@ -324,7 +561,9 @@ func (e *BaseEntity) DeleteBucket(bID string) bool {
 		// delete from list
 		e.Buckets = remove(e.Buckets, idx)
 		// delete from map
+		bucketMapMu.Lock()
 		delete(EntityBucketMap[e.entityType][e.ID], bID)
+		bucketMapMu.Unlock()
 	}
 
 	return ok
@@ -344,5 +583,45 @@ func remove(s []*buckets.Bucket, i int) []*buckets.Bucket {
 //
 // Note: EntityBase will not auto migrate because it's the parent's responsibility
 func AutoMigrate(db *gorm.DB) error {
-	return buckets.AutoMigrate(db)
+	err := buckets.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = flags.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = audit.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = jobs.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = sftp.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = oidc.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = roles.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = migrateEmails(db)
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&Credential{})
+	if err != nil {
+		return err
+	}
+	err = usage.AutoMigrate(db)
+	if err != nil {
+		return err
+	}
+	return stats.AutoMigrate(db)
 }
@@ -0,0 +1,50 @@
+package entity_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+func TestValidation(t *testing.T) {
+	env := fatetest.New(t)
+	base := func(opts ...entity.Option) error {
+		_, err := entity.Entity(append([]entity.Option{
+			entity.DB(env.DB), entity.StorageConfig(env.Storage), entity.TableName("users"), entity.ID("alice"),
+		}, opts...)...)
+		return err
+	}
+	if err := base(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]entity.Option{
+		"entity type":          {entity.TableName("Users")},
+		"reserved entity type": {entity.TableName("public")},
+		"entity id":            {entity.ID("../bob")},
+		"long entity id":       {entity.ID(strings.Repeat("a", 129))},
+		"reserved entity id":   {entity.ID("NUL")},
+		"default bucket":       {entity.BucketName("a/b")},
+		"bucket names":         {entity.BucketCount(2), entity.BucketNames([]string{"default", ".."})},
+		// default-1 is longer than a bucket name can be
+		"numbered bucket": {entity.BucketCount(2), entity.BucketName(strings.Repeat("a", 62))},
+	}
+	for name, opts := range tests {
+		if err := base(opts...); !errors.Is(err, errs.ErrInvalidName) {
+			t.Errorf("%s: got %v want %v", name, err, errs.ErrInvalidName)
+		}
+	}
+
+	e := env.Entity(t, "users", "alice")
+	for _, bad := range []string{"", "..", "../bob", "a/b", "con", strings.Repeat("a", 64)} {
+		if _, err := e.CreateBucket(bad); !errors.Is(err, errs.ErrInvalidName) {
+			t.Errorf("bucket %q: got %v want %v", bad, err, errs.ErrInvalidName)
+		}
+	}
+	if _, err := e.CreateBucket("photos"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,323 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The algorithms of the password hashes, stored with every hash
+const (
+	// AlgArgon2id argon2id, the algorithm of the new hashes
+	AlgArgon2id = "argon2id"
+	// AlgBcrypt bcrypt, only for the hashes imported with ImportBcrypt
+	AlgBcrypt = "bcrypt"
+)
+
+const (
+	// MinPasswordLength the shortest password SetPassword accepts
+	MinPasswordLength = 8
+	// DefaultMaxFailures the failed checks in a row locking the entity out
+	DefaultMaxFailures = 5
+	// DefaultLockout how long the entity stays locked out
+	DefaultLockout = 15 * time.Minute
+	// MaxHashing the most passwords hashed at once by the process, each
+	// argon2id hash takes its Memory, 64 MiB with the DefaultHashParams
+	MaxHashing = 4
+)
+
+// hashing the slots of the passwords being hashed
+var hashing = make(chan struct{}, MaxHashing)
+
+// argon2id returns the argon2id key of the password, waiting for a free slot
+func argon2id(password string, salt []byte, p HashParams) []byte {
+	hashing <- struct{}{}
+	defer func() { <-hashing }()
+	return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+}
+
+// HashParams the argon2id parameters of the password hashes
+type HashParams struct {
+	// Time the number of passes over the memory
+	Time uint32
+	// Memory the memory used in KiB
+	Memory uint32
+	// Threads the parallelism
+	Threads uint8
+	// KeyLen and SaltLen the lengths in bytes of the hash and its salt
+	KeyLen  uint32
+	SaltLen int
+}
+
+// DefaultHashParams the parameters recommended by RFC 9106 for low memory machines
+var DefaultHashParams = HashParams{Time: 3, Memory: 64 << 10, Threads: 4, KeyLen: 32, SaltLen: 16}
+
+// String the parameters as stored with the hashes, eg. m=65536,t=3,p=4,l=32
+func (p HashParams) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d,l=%d", p.Memory, p.Time, p.Threads, p.KeyLen)
+}
+
+// parseHashParams parses the parameters stored with a hash
+func parseHashParams(s string) (p HashParams, err error) {
+	_, err = fmt.Sscanf(s, "m=%d,t=%d,p=%d,l=%d", &p.Memory, &p.Time, &p.Threads, &p.KeyLen)
+	return p, err
+}
+
+// Credential the password hash of an entity
+type Credential struct {
+	EntityType string `gorm:"primaryKey"`
+	EntityID   string `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	// Algorithm and Params how the hash was made, a hash made differently
+	// than the current parameters is replaced on the next successful check
+	Algorithm string `gorm:"not null"`
+	Params    string
+	Salt      []byte
+	Hash      []byte `gorm:"not null"`
+	// Failures the failed checks in a row since the last successful one
+	Failures int
+	// LockedUntil the checks fail until then, nil when not locked
+	LockedUntil *time.Time
+}
+
+// Passwords the password of an entity
+type Passwords struct {
+	db          *gorm.DB
+	entityType  string
+	entityID    string
+	params      HashParams
+	maxFailures int
+	lockout     time.Duration
+	checks      *CheckCache
+}
+
+// PasswordOption is a functional option to the passwords constructor NewPasswords.
+type PasswordOption func(*passwordOptions)
+type passwordOptions struct {
+	params      HashParams
+	maxFailures int
+	lockout     time.Duration
+	checks      *CheckCache
+}
+
+// HashWith option sets the parameters of the new hashes, default DefaultHashParams
+//
+// The hashes made with other parameters are rehashed when the entity logs in
+func HashWith(p HashParams) PasswordOption {
+	return func(o *passwordOptions) {
+		o.params = p
+	}
+}
+
+// Lockout option locks the entity out for d after maxFailures failed checks in a row,
+// default DefaultMaxFailures and DefaultLockout, 0 failures never locks it
+func Lockout(maxFailures int, d time.Duration) PasswordOption {
+	return func(o *passwordOptions) {
+		o.maxFailures = maxFailures
+		o.lockout = d
+	}
+}
+
+// NewPasswords returns the password of the entity
+func NewPasswords(db *gorm.DB, entityType, entityID string, opts ...PasswordOption) *Passwords {
+	o := passwordOptions{params: DefaultHashParams, maxFailures: DefaultMaxFailures, lockout: DefaultLockout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Passwords{
+		db: db, entityType: entityType, entityID: entityID,
+		params: o.params, maxFailures: o.maxFailures, lockout: o.lockout,
+		checks: o.checks,
+	}
+}
+
+// Passwords returns the password of the entity
+func (e *BaseEntity) Passwords(opts ...PasswordOption) *Passwords {
+	return NewPasswords(e.db, e.entityType, e.ID, opts...)
+}
+
+// SetPassword sets the password of the entity
+func (e *BaseEntity) SetPassword(password string) error {
+	return e.Passwords().SetPassword(password)
+}
+
+// CheckPassword checks the password of the entity, see Passwords.CheckPassword
+func (e *BaseEntity) CheckPassword(password string) error {
+	return e.Passwords().CheckPassword(password)
+}
+
+// scope returns a query matching the credential of the entity
+func (p *Passwords) scope() *gorm.DB {
+	return p.db.Model(&Credential{}).Where("entity_type = ? AND entity_id = ?", p.entityType, p.entityID)
+}
+
+// hash returns a new argon2id credential of the password
+func (p *Passwords) hash(password string) (*Credential, error) {
+	salt := make([]byte, p.params.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{
+		EntityType: p.entityType,
+		EntityID:   p.entityID,
+		Algorithm:  AlgArgon2id,
+		Params:     p.params.String(),
+		Salt:       salt,
+		Hash:       argon2id(password, salt, p.params),
+	}, nil
+}
+
+// save replaces the credential of the entity, unlocking it
+func (p *Passwords) save(c *Credential) error {
+	tx := p.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "entity_type"}, {Name: "entity_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"algorithm", "params", "salt", "hash", "failures", "locked_until", "updated_at",
+		}),
+	}).Create(c)
+	return errs.Wrap(errs.ErrDatabase, tx.Error)
+}
+
+// SetPassword sets the password of the entity, unlocking it
+func (p *Passwords) SetPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return errs.New(errs.ErrInvalidOption, fmt.Sprintf("Passwords need at least %d characters", MinPasswordLength))
+	}
+	c, err := p.hash(password)
+	if err != nil {
+		return err
+	}
+	return p.save(c)
+}
+
+// ImportBcrypt sets the bcrypt hash as the password of the entity, eg. a
+// filebrowser user's. It's rehashed with argon2id when the entity logs in
+func (p *Passwords) ImportBcrypt(hash string) error {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return errs.New(errs.ErrInvalidOption, "Invalid bcrypt hash")
+	}
+	return p.save(&Credential{
+		EntityType: p.entityType,
+		EntityID:   p.entityID,
+		Algorithm:  AlgBcrypt,
+		Params:     fmt.Sprintf("cost=%d", cost),
+		Hash:       []byte(hash),
+	})
+}
+
+// Has whether the entity has a password
+func (p *Passwords) Has() (bool, error) {
+	var n int64
+	err := p.scope().Count(&n).Error
+	if err != nil {
+		return false, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return n > 0, nil
+}
+
+// Remove removes the password of the entity, it can't log in with one anymore
+func (p *Passwords) Remove() error {
+	return errs.Wrap(errs.ErrDatabase, p.scope().Delete(&Credential{}).Error)
+}
+
+// Unlock lifts the lockout of the entity and forgets its failed checks
+func (p *Passwords) Unlock() error {
+	return errs.Wrap(errs.ErrDatabase, p.scope().Updates(map[string]interface{}{
+		"failures":     0,
+		"locked_until": nil,
+	}).Error)
+}
+
+// matches whether the password matches the credential
+func (c *Credential) matches(password string) bool {
+	switch c.Algorithm {
+	case AlgArgon2id:
+		params, err := parseHashParams(c.Params)
+		if err != nil {
+			return false
+		}
+		hash := argon2id(password, c.Salt, params)
+		return subtle.ConstantTimeCompare(hash, c.Hash) == 1
+	case AlgBcrypt:
+		return bcrypt.CompareHashAndPassword(c.Hash, []byte(password)) == nil
+	}
+	return false
+}
+
+// CheckPassword returns nil if the password is the entity's
+//
+// A wrong password, or an entity without one, returns errs.ErrUnauthenticated
+// and a locked out entity errs.ErrLocked without checking the password.
+// A hash made with other parameters than the current ones is replaced.
+// With CacheChecks a password which matched recently isn't hashed again.
+func (p *Passwords) CheckPassword(password string) error {
+	c := &Credential{}
+	tx := p.scope().First(c)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		// take as long as a wrong password so the entities can't be told apart
+		p.hash(password)
+		return errs.ErrUnauthenticated
+	}
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	now := clock.Now()
+	if c.LockedUntil != nil && now.Before(*c.LockedUntil) {
+		return errs.New(errs.ErrLocked, "Locked out until "+c.LockedUntil.Format(time.RFC3339))
+	}
+	if !p.checks.hit(c, password) {
+		if !c.matches(password) {
+			return p.fail(now)
+		}
+		p.checks.add(c, password)
+	}
+	if c.Failures > 0 || c.LockedUntil != nil {
+		err := p.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Algorithm != AlgArgon2id || c.Params != p.params.String() || len(c.Salt) != p.params.SaltLen {
+		n, err := p.hash(password)
+		if err != nil {
+			return err
+		}
+		return p.save(n)
+	}
+	return nil
+}
+
+// fail counts a failed check, locking the entity out after too many in a row
+func (p *Passwords) fail(now time.Time) error {
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		p := *p
+		p.db = tx
+		err := p.scope().UpdateColumn("failures", gorm.Expr("failures + 1")).Error
+		if err != nil {
+			return err
+		}
+		if p.maxFailures <= 0 {
+			return nil
+		}
+		return p.scope().Where("failures >= ?", p.maxFailures).UpdateColumns(map[string]interface{}{
+			"failures":     0,
+			"locked_until": now.Add(p.lockout),
+		}).Error
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return errs.ErrUnauthenticated
+}
@@ -0,0 +1,256 @@
+package entity_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fast the argon2id parameters keeping the hashing of the tests quick
+var fast = entity.HashParams{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+// credential returns the stored credential of alice
+func credential(t *testing.T, env *fatetest.Env) *entity.Credential {
+	t.Helper()
+	c := &entity.Credential{}
+	err := env.DB.First(c, "entity_type = ? AND entity_id = ?", "users", "alice").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPasswords(t *testing.T) {
+	env := fatetest.New(t)
+	p := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast))
+
+	if err := p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("without a password: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+	if err := p.SetPassword("short"); !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("a short password: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	err := p.SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := credential(t, env)
+	if c.Algorithm != entity.AlgArgon2id || c.Params != fast.String() || len(c.Salt) != fast.SaltLen {
+		t.Errorf("stored %s %s with a %d bytes salt", c.Algorithm, c.Params, len(c.Salt))
+	}
+	if string(c.Hash) == "correct horse" {
+		t.Error("the password is stored as is")
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Errorf("the password: %v", err)
+	}
+	if err = p.CheckPassword("wrong horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("a wrong password: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+	// bob's password is his own
+	bob := entity.NewPasswords(env.DB, "users", "bob", entity.HashWith(fast))
+	if err = bob.CheckPassword("correct horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("the password of alice for bob: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+
+	// the same password gets another salt
+	before := credential(t, env)
+	if err = p.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if after := credential(t, env); string(after.Salt) == string(before.Salt) || string(after.Hash) == string(before.Hash) {
+		t.Error("the hash was made with the same salt")
+	}
+
+	ok, err := p.Has()
+	if err != nil || !ok {
+		t.Errorf("Has: got %v %v want true", ok, err)
+	}
+	if err = p.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ = p.Has(); ok {
+		t.Error("the removed password is still there")
+	}
+	if err = p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("a removed password: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	c := clock.NewFake(time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC))
+	env := fatetest.New(t, fatetest.Clock(c))
+	p := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast), entity.Lockout(3, time.Minute))
+	err := p.SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a success resets the failures in a row
+	p.CheckPassword("wrong")
+	p.CheckPassword("wrong")
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if n := credential(t, env).Failures; n != 0 {
+		t.Errorf("got %d failures after a success want 0", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = p.CheckPassword("wrong"); !errors.Is(err, errs.ErrUnauthenticated) {
+			t.Fatalf("failure %d: got %v want %v", i, err, errs.ErrUnauthenticated)
+		}
+	}
+	if err = p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrLocked) {
+		t.Errorf("locked out: got %v want %v", err, errs.ErrLocked)
+	}
+	c.Advance(59 * time.Second)
+	if err = p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrLocked) {
+		t.Errorf("before the end of the lockout: got %v want %v", err, errs.ErrLocked)
+	}
+	c.Advance(time.Second)
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Errorf("after the lockout: %v", err)
+	}
+	if cred := credential(t, env); cred.Failures != 0 || cred.LockedUntil != nil {
+		t.Errorf("still locked: %d failures until %v", cred.Failures, cred.LockedUntil)
+	}
+
+	for i := 0; i < 3; i++ {
+		p.CheckPassword("wrong")
+	}
+	if err = p.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Errorf("after Unlock: %v", err)
+	}
+	// setting the password unlocks it too
+	for i := 0; i < 3; i++ {
+		p.CheckPassword("wrong")
+	}
+	if err = p.SetPassword("battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.CheckPassword("battery staple"); err != nil {
+		t.Errorf("after SetPassword: %v", err)
+	}
+
+	never := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast), entity.Lockout(0, time.Minute))
+	for i := 0; i < 10; i++ {
+		never.CheckPassword("wrong")
+	}
+	if err = never.CheckPassword("battery staple"); err != nil {
+		t.Errorf("without a lockout: %v", err)
+	}
+}
+
+func TestRehash(t *testing.T) {
+	env := fatetest.New(t)
+	old := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast))
+	err := old.SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := fast
+	stronger.Time = 2
+	p := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(stronger))
+
+	if err = p.CheckPassword("wrong horse"); err == nil {
+		t.Fatal("a wrong password matched")
+	}
+	if c := credential(t, env); c.Params != fast.String() {
+		t.Errorf("a failed check rehashed the password with %s", c.Params)
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if c := credential(t, env); c.Params != stronger.String() {
+		t.Errorf("got the params %s want %s", c.Params, stronger)
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Errorf("after the rehash: %v", err)
+	}
+}
+
+func TestImportBcrypt(t *testing.T) {
+	env := fatetest.New(t)
+	p := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast))
+	if err := p.ImportBcrypt("not a hash"); !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("an invalid hash: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.ImportBcrypt(string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := credential(t, env); c.Algorithm != entity.AlgBcrypt {
+		t.Errorf("imported as %s", c.Algorithm)
+	}
+	if err = p.CheckPassword("wrong horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("a wrong password: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if c := credential(t, env); c.Algorithm != entity.AlgArgon2id || c.Params != fast.String() {
+		t.Errorf("not rehashed with argon2id: %s %s", c.Algorithm, c.Params)
+	}
+	if err = p.CheckPassword("correct horse"); err != nil {
+		t.Errorf("after the rehash: %v", err)
+	}
+}
+
+func TestCacheChecks(t *testing.T) {
+	env := fatetest.New(t)
+	cache := entity.CacheChecks(entity.NewCheckCache(time.Minute))
+	p := entity.NewPasswords(env.DB, "users", "alice", entity.HashWith(fast), entity.Lockout(3, time.Minute), cache)
+	err := p.SetPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = p.CheckPassword("correct horse"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the wrong passwords are never cached and still lock the entity out
+	for i := 0; i < 3; i++ {
+		if err = p.CheckPassword("wrong horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+			t.Fatalf("a wrong password: got %v want %v", err, errs.ErrUnauthenticated)
+		}
+	}
+	if err = p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrLocked) {
+		t.Errorf("a cached password while locked out: got %v want %v", err, errs.ErrLocked)
+	}
+	if err = p.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	// a changed password is checked again
+	if err = p.SetPassword("battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.CheckPassword("correct horse"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("the old cached password: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+	if err = p.CheckPassword("battery staple"); err != nil {
+		t.Error(err)
+	}
+	// the cache is per entity
+	bob := entity.NewPasswords(env.DB, "users", "bob", entity.HashWith(fast), cache)
+	if err = bob.SetPassword("other password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.CheckPassword("battery staple"); !errors.Is(err, errs.ErrUnauthenticated) {
+		t.Errorf("the cached password of alice for bob: got %v want %v", err, errs.ErrUnauthenticated)
+	}
+}
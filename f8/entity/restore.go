@@ -0,0 +1,148 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+)
+
+// Delete soft deletes the entity and its buckets
+//
+// The files stay on disk until the gc purges the buckets, until then
+// Restore brings them all back
+func Delete(db *gorm.DB, entityType, id string) error {
+	var bucks []*buckets.Bucket
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Table(entityType).Where("id = ? AND deleted_at IS NULL", id).Update("deleted_at", clock.Now())
+		if res.Error != nil {
+			return errs.Wrap(errs.ErrDatabase, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return errs.New(errs.ErrEntityNotFound, entityType+" "+id)
+		}
+		err := tx.Where("entity_type = ? AND entity_id = ?", entityType, id).Find(&bucks).Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		for _, b := range bucks {
+			b.AttatchDB(tx)
+			if !b.Delete() {
+				return errs.New(errs.ErrDatabase, "Failed to delete bucket "+b.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// forgotten again now that it's committed, a lookup meanwhile may have cached them
+	buckets.Forget(bucks...)
+	Forget(entityType, id)
+	events.Publish(&events.Event{
+		Type:       events.EntityDeleted,
+		EntityType: entityType,
+		EntityID:   id,
+		Data:       map[string]interface{}{"buckets": len(bucks)},
+	})
+	return nil
+}
+
+// RestoreOptions the options of Restore
+type RestoreOptions struct {
+	// Type the type of the entity, the table it's stored in
+	Type string
+	// Retention entities deleted longer ago aren't restored, 0 for no limit
+	//
+	// Use the age the gc purges the deleted buckets at, they're gone after it
+	Retention time.Duration
+}
+
+// RestoreReport what a Restore brought back
+type RestoreReport struct {
+	// Buckets the number of buckets restored
+	Buckets int
+	// Files the number of files in them
+	Files int64
+}
+
+// deletedRow the timestamps of an entity row
+type deletedRow struct {
+	CreatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// Restore undeletes the soft deleted entity with the buckets deleted along with it
+//
+// Buckets deleted before the entity stay deleted. Fails with errs.ErrEntityExists
+// if the id was reused by another entity since and errs.ErrEntityNotFound once the
+// entity is past the retention.
+func Restore(db *gorm.DB, id string, opts RestoreOptions) (*RestoreReport, error) {
+	if opts.Type == "" {
+		return nil, errs.New(errs.ErrInvalidOption, "Restore needs the type of the entity")
+	}
+	var rows []deletedRow
+	err := db.Unscoped().Table(opts.Type).Select("created_at, deleted_at").Where("id = ?", id).Limit(1).Find(&rows).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	if len(rows) == 0 {
+		return nil, errs.New(errs.ErrEntityNotFound, opts.Type+" "+id)
+	}
+	row := rows[0]
+	var bucks []*buckets.Bucket
+	err = db.Unscoped().Where(
+		"entity_type = ? AND entity_id = ? AND deleted_at IS NOT NULL", opts.Type, id,
+	).Find(&bucks).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	if row.DeletedAt == nil {
+		for _, b := range bucks {
+			// the bucket was there before the entity
+			if b.CreatedAt.Before(row.CreatedAt) {
+				return nil, errs.New(errs.ErrEntityExists, "The id of "+opts.Type+" "+id+" was reused by another entity since it was deleted")
+			}
+		}
+		return nil, errs.New(errs.ErrInvalidOption, opts.Type+" "+id+" isn't deleted")
+	}
+	if opts.Retention > 0 && clock.Now().Sub(*row.DeletedAt) > opts.Retention {
+		return nil, errs.New(errs.ErrEntityNotFound, opts.Type+" "+id+" was deleted more than "+opts.Retention.String()+" ago")
+	}
+
+	report := &RestoreReport{}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Table(opts.Type).Where("id = ?", id).Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		for _, b := range bucks {
+			if b.DeletedAt.Time.Before(*row.DeletedAt) {
+				continue
+			}
+			err = tx.Unscoped().Model(&buckets.Bucket{}).Where(
+				"id = ? AND entity_id = ? AND entity_type = ?", b.ID, b.EntityID, b.EntityType,
+			).Update("deleted_at", nil).Error
+			if err != nil {
+				return err
+			}
+			var files int64
+			err = tx.Model(&buckets.FileDir{}).Where(
+				"bucket_id = ? AND entity_id = ? AND entity_type = ? AND is_dir = ?", b.ID, b.EntityID, b.EntityType, false,
+			).Count(&files).Error
+			if err != nil {
+				return err
+			}
+			report.Buckets++
+			report.Files += files
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return report, nil
+}
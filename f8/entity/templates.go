@@ -0,0 +1,104 @@
+package entity
+
+import (
+	"sync"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/validate"
+)
+
+// BucketTemplate a bucket the new entities of a type start with
+type BucketTemplate struct {
+	// Name the id of the bucket
+	Name string
+	// Layout the storage layout, the one of BucketLayout if empty
+	Layout string
+	// Quota and MaxUploadSize the default limits, 0 for unlimited
+	Quota         int64
+	MaxUploadSize int64
+	// Visibility private if empty
+	Visibility buckets.Visibility
+	// Dirs the directories the bucket starts with, eg. avatar or uploads/images
+	Dirs []string
+}
+
+var (
+	templatesMu sync.RWMutex
+	// templates the bucket templates by table name
+	templates = map[string][]*BucketTemplate{}
+)
+
+// RegisterBucketTemplates sets the buckets the new entities of the table start with
+//
+// Entity creates them unless the buckets are given with BucketCount,
+// BucketName or BucketNames, Create provisions their directories.
+// Registering the templates of a table again replaces them.
+//
+//	entity.RegisterBucketTemplates("users",
+//		&entity.BucketTemplate{Name: "default", Quota: 1 << 30, Dirs: []string{"avatar", "uploads", "trash"}},
+//	)
+//	entity.RegisterBucketTemplates("organizations",
+//		&entity.BucketTemplate{Name: "shared", Quota: 10 << 30},
+//		&entity.BucketTemplate{Name: "exports", Layout: buckets.DateLayoutName},
+//	)
+func RegisterBucketTemplates(table string, tmpls ...*BucketTemplate) error {
+	if err := validate.EntityType(table); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, t := range tmpls {
+		if err := validate.BucketName(t.Name); err != nil {
+			return err
+		}
+		if seen[t.Name] {
+			return errs.New(errs.ErrInvalidOption, "Bucket template "+t.Name+" of "+table+" declared twice")
+		}
+		seen[t.Name] = true
+		if t.Layout != "" {
+			if _, ok := buckets.LookupLayout(t.Layout); !ok {
+				return errs.New(errs.ErrInvalidOption, "Unknown bucket layout "+t.Layout)
+			}
+		}
+		if t.Quota < 0 || t.MaxUploadSize < 0 {
+			return errs.New(errs.ErrInvalidOption, "Bucket template "+t.Name+" has a negative limit")
+		}
+	}
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if len(tmpls) == 0 {
+		delete(templates, table)
+		return nil
+	}
+	templates[table] = tmpls
+	return nil
+}
+
+// BucketTemplates returns the bucket templates registered for the table
+func BucketTemplates(table string) []*BucketTemplate {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	return templates[table]
+}
+
+// template returns the template of the bucket if the entity was created from templates
+func (e *BaseEntity) template(bID string) *BucketTemplate {
+	for _, t := range e.templates {
+		if t.Name == bID {
+			return t
+		}
+	}
+	return nil
+}
+
+// apply sets the defaults of the template on a new bucket
+func (t *BucketTemplate) apply(b *buckets.Bucket) {
+	if t.Layout != "" {
+		b.Layout = t.Layout
+	}
+	b.Quota = t.Quota
+	b.MaxUploadSize = t.MaxUploadSize
+	if t.Visibility != "" {
+		b.Visibility = t.Visibility
+	}
+}
@@ -0,0 +1,98 @@
+package entity
+
+import (
+	"log"
+	"time"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"gorm.io/gorm"
+)
+
+// WarmOptions the options for the boot time WarmUp
+type WarmOptions struct {
+	// TopN the number of heaviest entities whose buckets are cached
+	// and whose quota counters are verified, default 100
+	TopN int
+}
+
+// WarmReport what was done during a WarmUp
+type WarmReport struct {
+	// Entities the number of entities whose buckets were cached
+	Entities int
+	// Buckets the number of buckets cached
+	Buckets int
+	// Fixed the number of buckets whose usage counters had drifted
+	Fixed int
+	// Took how long the warm up took
+	Took time.Duration
+}
+
+type entityUsage struct {
+	EntityID   string
+	EntityType string
+	Used       int64
+}
+
+// WarmUp preloads the caches so the first requests after boot aren't slow
+//
+// It primes the database connection used by the file queries, loads the
+// buckets of the TopN entities by usage into EntityBucketMap and verifies
+// their quota counters fixing any drift
+func WarmUp(db *gorm.DB, storage *f8.StorageConfig, opts WarmOptions) (*WarmReport, error) {
+	start := time.Now()
+	if opts.TopN <= 0 {
+		opts.TopN = 100
+	}
+	report := &WarmReport{}
+
+	// prime the connection pool and the file_dirs query plan
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	err = sqlDB.Ping()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	tx := db.Model(&buckets.FileDir{}).Limit(1).Pluck("path", &paths)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var heavy []entityUsage
+	tx = db.Model(&buckets.Bucket{}).
+		Select("entity_id, entity_type, SUM(used) AS used").
+		Group("entity_id, entity_type").
+		Order("used DESC").
+		Limit(opts.TopN).
+		Scan(&heavy)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	for _, h := range heavy {
+		ent := &BaseEntity{
+			ID:         h.EntityID,
+			entityType: h.EntityType,
+			db:         db,
+			storage:    storage,
+		}
+		ent.OverwriteBuckets()
+		for _, b := range ent.Buckets {
+			fixed, err := b.Recount()
+			if err != nil {
+				return nil, err
+			}
+			if fixed {
+				log.Println("[f8][WARNING]: Fixed usage counter of bucket", b.ID, "of", b.EntityType, b.EntityID)
+				report.Fixed++
+			}
+		}
+		report.Entities++
+		report.Buckets += len(ent.Buckets)
+	}
+	report.Took = time.Since(start)
+	return report, nil
+}
@@ -0,0 +1,76 @@
+package errs
+
+import "errors"
+
+// CodeInternal the code of errors which aren't of any kind
+const CodeInternal = "internal"
+
+// kind the machine readable code and the remediation hint of a sentinel
+type kind struct {
+	err  error
+	code string
+	hint string
+}
+
+var kinds = []kind{
+	{ErrEntityNotFound, "entity_not_found", "Check the entity type and id, the entity may have been deleted"},
+	{ErrEntityExists, "entity_exists", "Use another id or update the existing entity"},
+	{ErrBucketNotFound, "bucket_not_found", "Check the bucket name, list the entity's buckets to see the existing ones"},
+	{ErrBucketExists, "bucket_exists", "Use another bucket name or the existing bucket"},
+	{ErrFileNotFound, "file_not_found", "Check the path, list the bucket to see the existing files"},
+	{ErrFileExists, "file_exists", "Remove the destination first or use another path"},
+	{ErrJobNotFound, "job_not_found", "Check the job id, finished jobs are pruned after a while"},
+	{ErrIsDir, "is_dir", "The path is a directory, list it instead"},
+	{ErrInvalidPath, "invalid_path", "Use a path relative to the bucket without `..` elements or control characters"},
+	{ErrInvalidName, "invalid_name", "Use letters, digits, '.', '_' and '-' starting with a letter or a digit"},
+	{ErrQuotaExceeded, "quota_exceeded", "Delete files from the bucket or raise its quota"},
+	{ErrTooLarge, "too_large", "Upload a smaller file, the limit is in the detail"},
+	{ErrTooSlow, "too_slow", "Retry from a faster connection, the minimum rate is in the detail"},
+	{ErrReadOnly, "read_only", "The service is under maintenance, retry after the Retry-After delay"},
+	{ErrRateLimited, "rate_limited", "Slow down, retry after the Retry-After delay"},
+	{ErrInvalidOption, "invalid_option", "Fix the value named in the detail"},
+	{ErrUnauthenticated, "unauthenticated", "Send valid credentials with the request"},
+	{ErrLocked, "locked", "Too many failed logins, retry after the lockout or ask an admin to unlock the account"},
+	{ErrDisabled, "disabled", "Ask an admin to enable the account"},
+	{ErrForbidden, "forbidden", "Ask the owner of the bucket for a grant"},
+	{ErrNotAttached, "not_attached", ""},
+	{ErrDatabase, "database", "Retry later, the database is unavailable"},
+	{ErrStorage, "storage", "Retry later, the storage is unavailable"},
+}
+
+// lookup returns the kind of err, the outermost one if it wraps several
+func lookup(err error) *kind {
+	var e *Error
+	if errors.As(err, &e) {
+		for i := range kinds {
+			if kinds[i].err == e.Kind {
+				return &kinds[i]
+			}
+		}
+	}
+	for i := range kinds {
+		if errors.Is(err, kinds[i].err) {
+			return &kinds[i]
+		}
+	}
+	return nil
+}
+
+// Code returns the machine readable code of the error's kind
+//
+// Codes are stable and meant for clients to branch on,
+// CodeInternal is returned for errors which aren't of any kind
+func Code(err error) string {
+	if k := lookup(err); k != nil {
+		return k.code
+	}
+	return CodeInternal
+}
+
+// Hint returns a remediation hint for the error's kind, empty if there is none
+func Hint(err error) string {
+	if k := lookup(err); k != nil {
+		return k.hint
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+// Package errs the error values shared by the f8 packages
+//
+// Errors returned by f8 wrap one of the sentinels below together with
+// the underlying gorm or filesystem error so both can be checked
+//
+//	if errors.Is(err, errs.ErrBucketNotFound) { ... }
+//	if errors.Is(err, gorm.ErrRecordNotFound) { ... }
+//	var pathErr *os.PathError
+//	if errors.As(err, &pathErr) { ... }
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrEntityNotFound the entity doesn't exist
+	ErrEntityNotFound = errors.New("Entity not found")
+	// ErrEntityExists an entity with the same id and type already exists
+	ErrEntityExists = errors.New("Entity already exists")
+	// ErrBucketNotFound the bucket doesn't exist
+	ErrBucketNotFound = errors.New("Bucket not found")
+	// ErrBucketExists a bucket with the same id already exists for the entity
+	ErrBucketExists = errors.New("Bucket already exists")
+	// ErrFileNotFound the file or directory doesn't exist in the bucket
+	ErrFileNotFound = errors.New("File not found")
+	// ErrFileExists the destination of a move or copy already exists
+	ErrFileExists = errors.New("File already exists")
+	// ErrJobNotFound the background job doesn't exist, it may have been pruned
+	ErrJobNotFound = errors.New("Job not found")
+	// ErrIsDir a file operation on a directory
+	ErrIsDir = errors.New("Is a directory")
+	// ErrInvalidPath the path is empty or otherwise unusable
+	ErrInvalidPath = errors.New("Invalid path")
+	// ErrInvalidName an entity id, entity type or bucket name that can't be used
+	ErrInvalidName = errors.New("Invalid name")
+	// ErrQuotaExceeded the write would take the bucket over its quota
+	ErrQuotaExceeded = errors.New("Bucket quota exceeded")
+	// ErrTooLarge the upload is larger than the allowed size
+	ErrTooLarge = errors.New("Upload too large")
+	// ErrTooSlow the client sent or read the request slower than the allowed rate
+	ErrTooSlow = errors.New("Client too slow")
+	// ErrReadOnly the service is in read-only maintenance mode
+	ErrReadOnly = errors.New("Service is read-only")
+	// ErrRateLimited the client made too many requests
+	ErrRateLimited = errors.New("Too many requests")
+	// ErrInvalidOption an option or argument has an invalid value
+	ErrInvalidOption = errors.New("Invalid option")
+	// ErrUnauthenticated the request carried no or invalid credentials
+	ErrUnauthenticated = errors.New("Authentication required")
+	// ErrLocked the entity is locked out after too many failed logins
+	ErrLocked = errors.New("Account locked")
+	// ErrDisabled the entity's account was disabled by an admin
+	ErrDisabled = errors.New("Account disabled")
+	// ErrForbidden the actor has no access to the bucket
+	ErrForbidden = errors.New("Access to the bucket is forbidden")
+	// ErrNotAttached the db or storage was not attached to the bucket
+	ErrNotAttached = errors.New("Bucket DB is nil AttachDB call missed somewhere")
+	// ErrDatabase the database failed
+	ErrDatabase = errors.New("Database error")
+	// ErrStorage the storage directory failed
+	ErrStorage = errors.New("Storage error")
+)
+
+// Error an error of a Kind with the underlying cause
+type Error struct {
+	// Kind one of the sentinels of this package
+	Kind error
+	// Err the cause
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Is reports whether the target is the kind of the error
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap returns err as an error of the kind, nil if err is nil
+func Wrap(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// New returns an error of the kind with the message as the cause
+func New(kind error, msg string) error {
+	return &Error{Kind: kind, Err: errors.New(msg)}
+}
+
+// DB wraps a gorm error, record not found becomes notFound
+// and everything else ErrDatabase
+func DB(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Wrap(notFound, err)
+	}
+	return Wrap(ErrDatabase, err)
+}
+
+// FS wraps a filesystem error, missing files become ErrFileNotFound
+// and everything else ErrStorage
+//
+// Errors which already are of a kind (eg. from a reader) are returned as is
+func FS(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	if os.IsNotExist(err) {
+		return Wrap(ErrFileNotFound, err)
+	}
+	return Wrap(ErrStorage, err)
+}
+
+// TooLarge returns an ErrTooLarge error telling the limit
+func TooLarge(limit int64) error {
+	return New(ErrTooLarge, fmt.Sprintf("Limit is %d bytes", limit))
+}
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// Encoding how the events are serialized for the brokers
+type Encoding string
+
+const (
+	// JSON the Event as json, the same payload the webhooks get
+	JSON Encoding = "json"
+	// CloudEvents the Event as the data of a CloudEvents 1.0 json envelope
+	CloudEvents Encoding = "cloudevents"
+)
+
+// cloudEvent a CloudEvents 1.0 structured mode envelope
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            *Event    `json:"data"`
+}
+
+// ContentType the media type of the encoded events
+func (enc Encoding) ContentType() string {
+	if enc == CloudEvents {
+		return "application/cloudevents+json"
+	}
+	return "application/json"
+}
+
+// Encode serializes the event, an empty encoding is JSON
+func (enc Encoding) Encode(e *Event) ([]byte, error) {
+	switch enc {
+	case "", JSON:
+		return json.Marshal(e)
+	case CloudEvents:
+		return json.Marshal(&cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              e.ID,
+			Source:          "fate",
+			Type:            "fate." + string(e.Type),
+			Subject:         EntityKey(e),
+			Time:            e.Time,
+			DataContentType: "application/json",
+			Data:            e,
+		})
+	}
+	return nil, errs.New(errs.ErrInvalidOption, "Unknown event encoding "+string(enc))
+}
+
+// EntityKey the key the events are partitioned by, entity_type/entity_id
+//
+// Events of an entity always land in the same partition so their order is kept
+func EntityKey(e *Event) string {
+	return e.EntityType + "/" + e.EntityID
+}
+
+// Partition the partition of the key out of n
+func Partition(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// wants whether the event types include t, empty for all
+func wants(types []Type, t Type) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, want := range types {
+		if want == t {
+			return true
+		}
+	}
+	return false
+}
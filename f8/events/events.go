@@ -0,0 +1,153 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+)
+
+const (
+	// SchemaVersion the version of the event payload schema
+	//
+	// Bump it whenever a field changes meaning or is removed,
+	// adding new fields is backwards compatible
+	SchemaVersion = 1
+	// queueSize the number of events buffered per sink
+	queueSize = 1024
+)
+
+// Type of an event
+type Type string
+
+const (
+	// EntityCreated an entity was created along with its buckets
+	EntityCreated Type = "entity.created"
+	// EntityDeleted an entity was soft deleted along with its buckets
+	EntityDeleted Type = "entity.deleted"
+	// Login an entity logged in through the filebrowser proxy, oidc or sftp, the username is in the data
+	//
+	// The entity is empty when only the username is known (filebrowser)
+	Login Type = "entity.login"
+	// LoginFailed a login was refused, the username is in the data
+	LoginFailed Type = "entity.login_failed"
+	// BucketCreated a bucket was provisioned for an entity
+	BucketCreated Type = "bucket.created"
+	// BucketDeleted a bucket was deleted
+	BucketDeleted Type = "bucket.deleted"
+	// FileWritten a file was created or overwritten
+	FileWritten Type = "file.written"
+	// FileDeleted a file or directory was deleted
+	FileDeleted Type = "file.deleted"
+	// FileProcessed a written file reached the webhook step of its bucket's pipeline
+	//
+	// It's only sent to the endpoint of the step, never published
+	FileProcessed Type = "file.processed"
+	// QuotaExceeded a write was refused as it'd take the bucket over its quota
+	QuotaExceeded Type = "bucket.quota_exceeded"
+	// BucketShared a bucket was shared with another entity, the grantee and role are in the data
+	BucketShared Type = "bucket.shared"
+)
+
+// Event something that happened to an entity or its buckets
+type Event struct {
+	ID      string    `json:"id"`
+	Type    Type      `json:"type"`
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// EntityType and EntityID the entity the event is about
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	BucketID   string `json:"bucket_id,omitempty"`
+	Path       string `json:"path,omitempty"`
+	// ActorType and ActorID the entity which did it, empty if unknown
+	ActorType string `json:"actor_type,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	// IP the client ip of the request which did it, empty if unknown
+	IP string `json:"ip,omitempty"`
+	// Data extra details specific to the event type
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Sink receives the published events
+type Sink interface {
+	Send(e *Event) error
+}
+
+// SinkFunc a function implementing Sink
+type SinkFunc func(e *Event) error
+
+// Send calls the function
+func (f SinkFunc) Send(e *Event) error {
+	return f(e)
+}
+
+type subscription struct {
+	sink  Sink
+	queue chan *Event
+}
+
+// Bus fans out the published events to the subscribed sinks
+//
+// Every sink gets its own queue so a slow sink doesn't hold up the others
+type Bus struct {
+	mu   sync.RWMutex
+	subs []*subscription
+}
+
+var (
+	// Default the bus the buckets and entities publish to
+	Default = &Bus{}
+)
+
+// Subscribe adds a sink to the bus
+func (b *Bus) Subscribe(sink Sink) {
+	sub := &subscription{sink: sink, queue: make(chan *Event, queueSize)}
+	go func() {
+		for e := range sub.queue {
+			err := sub.sink.Send(e)
+			if err != nil {
+				log.Println("[f8][events]: Failed to send", e.Type, e.ID, err)
+			}
+		}
+	}()
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Publish sends the event to all the sinks without blocking
+//
+// The ID, Version and Time are filled in if missing.
+// If a sink's queue is full the event is dropped for that sink.
+func (b *Bus) Publish(e *Event) {
+	if e.ID == "" {
+		e.ID = clock.NewID()
+	}
+	if e.Version == 0 {
+		e.Version = SchemaVersion
+	}
+	if e.Time.IsZero() {
+		e.Time = clock.Now().UTC()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		select {
+		case sub.queue <- e:
+		default:
+			log.Println("[f8][events]: Queue full dropping", e.Type, e.ID)
+		}
+	}
+}
+
+// Subscribe adds a sink to the Default bus
+func Subscribe(sink Sink) {
+	Default.Subscribe(sink)
+}
+
+// Publish publishes to the Default bus
+func Publish(e *Event) {
+	Default.Publish(e)
+}
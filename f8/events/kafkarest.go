@@ -0,0 +1,102 @@
+package events
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// KafkaREST a sink producing the events to a Kafka topic through a Kafka REST proxy
+//
+// It doesn't talk to the Kafka brokers, it needs a Confluent REST Proxy
+// (or another proxy serving its v2 api) in front of the cluster and POSTs
+// the records to /topics/{topic}. Records are keyed by EntityKey.
+// They aren't signed as the v2 api has no record headers, secure the
+// proxy and the topic instead.
+type KafkaREST struct {
+	// URL of the REST proxy, eg. http://localhost:8082, not of a broker
+	URL   string
+	Topic string
+	// Encoding of the record values, default JSON
+	Encoding Encoding
+	// Partitions when set the records go to Partition(EntityKey, Partitions)
+	// instead of the partition Kafka picks by hashing the key
+	Partitions int
+	// Types the event types to send, empty for all
+	Types []Type
+	// Client the http client to use, default has a 10s timeout
+	Client *http.Client
+}
+
+type kafkaRecord struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Partition *int   `json:"partition,omitempty"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Send produces the event to the topic
+func (k *KafkaREST) Send(e *Event) error {
+	if !wants(k.Types, e.Type) {
+		return nil
+	}
+	value, err := k.Encoding.Encode(e)
+	if err != nil {
+		return err
+	}
+	key := EntityKey(e)
+	rec := kafkaRecord{
+		Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+		Value: base64.StdEncoding.EncodeToString(value),
+	}
+	if k.Partitions > 0 {
+		p := Partition(key, k.Partitions)
+		rec.Partition = &p
+	}
+	body, err := json.Marshal(map[string][]kafkaRecord{"records": {rec}})
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(k.URL, "/") + "/topics/" + k.Topic
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	client := k.Client
+	if client == nil {
+		client = defaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError(fmt.Errorf("Kafka proxy %s responded with %s", k.URL, res.Status), res.StatusCode)
+	}
+	var out kafkaResponse
+	err = json.NewDecoder(res.Body).Decode(&out)
+	if err != nil {
+		return err
+	}
+	for _, o := range out.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("Kafka topic %s rejected the event: %s", k.Topic, o.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package events_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/events"
+)
+
+func TestKafkaREST(t *testing.T) {
+	var got struct {
+		Records []struct {
+			Key       string `json:"key"`
+			Value     string `json:"value"`
+			Partition *int   `json:"partition"`
+		} `json:"records"`
+	}
+	reject := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/fate" || r.Header.Get("Content-Type") != "application/vnd.kafka.binary.v2+json" {
+			t.Errorf("got %s %s of %s want the v2 api", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+		if reject {
+			w.Write([]byte(`{"offsets":[{"partition":0,"offset":-1,"error_code":40403,"error":"no such topic"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":1,"offset":7}]}`))
+	}))
+	defer proxy.Close()
+
+	k := &events.KafkaREST{URL: proxy.URL + "/", Topic: "fate", Partitions: 4}
+	e := &events.Event{Type: events.EntityCreated, EntityType: "users", EntityID: "alice"}
+	err := k.Send(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 1 {
+		t.Fatalf("got %d records want 1", len(got.Records))
+	}
+	rec := got.Records[0]
+	key, _ := base64.StdEncoding.DecodeString(rec.Key)
+	if string(key) != events.EntityKey(e) {
+		t.Errorf("got the key %q want %q", key, events.EntityKey(e))
+	}
+	if rec.Partition == nil || *rec.Partition != events.Partition(events.EntityKey(e), 4) {
+		t.Errorf("got the partition %v want %d", rec.Partition, events.Partition(events.EntityKey(e), 4))
+	}
+	value, _ := base64.StdEncoding.DecodeString(rec.Value)
+	sent := &events.Event{}
+	if err := json.Unmarshal(value, sent); err != nil || sent.EntityID != "alice" {
+		t.Errorf("got the value %s want the json event", value)
+	}
+
+	reject = true
+	if err := k.Send(e); err == nil {
+		t.Error("a record the proxy refused was reported as sent")
+	}
+	k.Types = []events.Type{events.FileDeleted}
+	if err := k.Send(e); err != nil {
+		t.Errorf("an event of another type: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package events
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultAttempts the number of times a Retry sends an event by default
+	DefaultAttempts = 5
+	// DefaultBackoff the wait of a Retry before its first retry by default
+	DefaultBackoff = time.Second
+	// maxBackoff the longest wait between two attempts
+	maxBackoff = time.Minute
+)
+
+// Retry a sink sending the events to another, retrying the failed sends with a backoff
+//
+// The retries hold up the queue of the sink, not the publishers, events
+// published meanwhile are dropped once the queue is full
+type Retry struct {
+	Sink Sink
+	// Attempts the number of times an event is sent, default DefaultAttempts, 1 never retries
+	Attempts int
+	// Backoff the wait before the first retry doubled on every retry, default DefaultBackoff
+	Backoff time.Duration
+}
+
+// permanentError an error retrying won't fix, eg. the endpoint refusing the payload
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent whether err was marked as not worth retrying
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Send sends the event until it succeeds, fails permanently or runs out of attempts
+func (r *Retry) Send(e *Event) error {
+	attempts := r.Attempts
+	if attempts == 0 {
+		attempts = DefaultAttempts
+	}
+	wait := r.Backoff
+	if wait == 0 {
+		wait = DefaultBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := r.Sink.Send(e)
+		if err == nil || attempt >= attempts || IsPermanent(err) {
+			return err
+		}
+		log.Println("[f8][events]: Retrying", e.Type, e.ID, "in", wait, err)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// statusError the error of an http sink's response, permanent for the
+// client errors besides timeouts and rate limits
+func statusError(err error, status int) error {
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers sent along with every webhook request
+const (
+	// HeaderEvent the type of the event
+	HeaderEvent = "X-Fate-Event"
+	// HeaderEventID the id of the event, use it to drop duplicates
+	HeaderEventID = "X-Fate-Event-Id"
+	// HeaderSchemaVersion the SchemaVersion of the payload
+	HeaderSchemaVersion = "X-Fate-Schema-Version"
+	// HeaderTimestamp the unix time the request was signed at
+	HeaderTimestamp = "X-Fate-Timestamp"
+	// HeaderSignature the signature of the request, see Sign
+	HeaderSignature = "X-Fate-Signature"
+)
+
+// Webhook a sink POSTing the events as signed json to an endpoint
+type Webhook struct {
+	// URL the endpoint
+	URL string
+	// Secret the endpoint specific key used for signing the payloads
+	Secret []byte
+	// Types the event types to send, empty for all
+	Types []Type
+	// Client the http client to use, default has a 10s timeout
+	Client *http.Client
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Sign returns the signature of a webhook payload
+//
+//	v1=hex(hmac_sha256(secret, timestamp + "." + body))
+//
+// The timestamp is signed too so receivers can reject replays
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send POSTs the event to the endpoint
+func (w *Webhook) Send(e *Event) error {
+	if !wants(w.Types, e.Type) {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(e.Type))
+	req.Header.Set(HeaderEventID, e.ID)
+	req.Header.Set(HeaderSchemaVersion, strconv.Itoa(e.Version))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(w.Secret, ts, body))
+
+	client := w.Client
+	if client == nil {
+		client = defaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError(fmt.Errorf("Webhook %s responded with %s", w.URL, res.Status), res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package f8_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8"
+)
+
+func TestKey(t *testing.T) {
+	s := &f8.StorageConfig{SigningKey: []byte("secret")}
+	share, session := s.Key(f8.KeyShare), s.Key(f8.KeyOIDCSession)
+	if bytes.Equal(share, session) {
+		t.Error("the share and the session keys are the same")
+	}
+	for _, k := range [][]byte{share, session} {
+		if bytes.Equal(k, s.SigningKey) {
+			t.Error("a derived key is the signing key")
+		}
+	}
+	if !bytes.Equal(share, s.Key(f8.KeyShare)) {
+		t.Error("the share key changed between calls")
+	}
+	other := &f8.StorageConfig{SigningKey: []byte("other secret")}
+	if bytes.Equal(share, other.Key(f8.KeyShare)) {
+		t.Error("two signing keys derived the same share key")
+	}
+}
@@ -0,0 +1,98 @@
+package fatetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+// API calls the http api of the env in-process
+type API struct {
+	Server *api.Server
+	actor  *buckets.Actor
+	header http.Header
+}
+
+type actorKey struct{}
+
+// API returns the http api of the env
+//
+// The requests are authenticated as the actor set with As,
+// pass api.Auth to authenticate them like the app does instead
+func (env *Env) API(opts ...api.Option) *API {
+	opts = append([]api.Option{
+		api.Auth(func(r *http.Request) (*buckets.Actor, error) {
+			actor, _ := r.Context().Value(actorKey{}).(*buckets.Actor)
+			return actor, nil
+		}),
+	}, opts...)
+	return &API{Server: api.New(env.Storage, opts...), header: http.Header{}}
+}
+
+// As returns a copy of the api making the requests as the actor, nil for anonymous ones
+func (a *API) As(actor *buckets.Actor) *API {
+	c := *a
+	c.actor = actor
+	return &c
+}
+
+// Header returns a copy of the api sending the header with every request
+func (a *API) Header(key, value string) *API {
+	c := *a
+	c.header = a.header.Clone()
+	c.header.Set(key, value)
+	return &c
+}
+
+// Do makes the request and returns the recorded response
+//
+// The path is relative to api.Prefix unless it starts with it
+func (a *API) Do(t testing.TB, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	if !strings.HasPrefix(path, api.Prefix) {
+		path = api.Prefix + path
+	}
+	r := httptest.NewRequest(method, path, body)
+	for k, v := range a.header {
+		r.Header[k] = v
+	}
+	if a.actor != nil {
+		r = r.WithContext(context.WithValue(r.Context(), actorKey{}, a.actor))
+	}
+	w := httptest.NewRecorder()
+	a.Server.ServeHTTP(w, r)
+	return w
+}
+
+// JSON sends in as the json body of the request and decodes the response into out
+//
+// Either can be nil. Fails the test if the status isn't the wanted one.
+func (a *API) JSON(t testing.TB, method, path string, in, out interface{}, status int) {
+	t.Helper()
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	w := a.Do(t, method, path, body)
+	if w.Code != status {
+		t.Fatalf("%s %s: got status %d want %d: %s", method, path, w.Code, status, w.Body.String())
+	}
+	if out != nil {
+		err := json.Unmarshal(w.Body.Bytes(), out)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+}
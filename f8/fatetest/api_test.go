@@ -0,0 +1,68 @@
+package fatetest_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+func TestAPIAs(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := createUser(t, env, "alice")
+	env.WriteFile(t, env.Bucket(t, alice, ""), "a.txt", "hello")
+	a := env.API()
+
+	w := a.As(alice.Actor()).Do(t, http.MethodGet, "/users/alice/buckets/default/files/a.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("got status %d and %q want 200 and hello", w.Code, w.Body.String())
+	}
+	w = a.Do(t, http.MethodGet, "/users/alice/buckets/default/files/a.txt", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: got status %d want 401", w.Code)
+	}
+	w = a.As(alice.Actor()).Do(t, http.MethodGet, api.Prefix+"/users/alice/buckets/default/files/a.txt", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("with the prefix: got status %d want 200", w.Code)
+	}
+}
+
+func TestAPIJSON(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := createUser(t, env, "alice")
+	env.WriteFile(t, env.Bucket(t, alice, ""), "a.txt", "hello")
+	a := env.API().As(alice.Actor())
+
+	page := &buckets.ListPage{}
+	a.JSON(t, http.MethodGet, "/users/alice/buckets/default/files", nil, page, http.StatusOK)
+	if len(page.Files) != 1 || page.Files[0].Path != "a.txt" {
+		t.Errorf("got %+v want a.txt", page.Files)
+	}
+	out := map[string]buckets.Visibility{}
+	in := map[string]buckets.Visibility{"visibility": buckets.PublicRead}
+	a.JSON(t, http.MethodPut, "/users/alice/buckets/default/visibility", in, &out, http.StatusOK)
+	if out["visibility"] != buckets.PublicRead {
+		t.Errorf("got the visibility %q want %q", out["visibility"], buckets.PublicRead)
+	}
+	w := env.API().Do(t, http.MethodGet, "/users/alice/buckets/default/files/a.txt", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("anonymous read of a public bucket: got status %d want 200", w.Code)
+	}
+}
+
+func TestAPIHeader(t *testing.T) {
+	env := fatetest.New(t)
+	a := env.API()
+	withID := a.Header(api.RequestIDHeader, "fatetest-request")
+
+	w := withID.Do(t, http.MethodGet, "/openapi.json", nil)
+	if got := w.Header().Get(api.RequestIDHeader); got != "fatetest-request" {
+		t.Errorf("got the request id %q want fatetest-request", got)
+	}
+	w = a.Do(t, http.MethodGet, "/openapi.json", nil)
+	if got := w.Header().Get(api.RequestIDHeader); got == "fatetest-request" {
+		t.Error("Header changed the api it was called on")
+	}
+}
@@ -0,0 +1,330 @@
+// Package fatetest helpers for the integration tests of apps embedding the BaseEntity
+//
+// Every Env has its own in-memory sqlite database and a temporary storage
+// directory, both removed when the test ends
+//
+// Set FATETEST_POSTGRES to a postgres dsn (or use the Postgres option) to run
+// against postgres instead, eg. one started by testcontainers in TestMain.
+// Every Env then gets its own schema which is dropped when the test ends.
+//
+//	func TestUpload(t *testing.T) {
+//		env := fatetest.New(t, fatetest.Models(&User{}))
+//		user := &User{Name: "Alice"}
+//		user.BaseEntity = env.Entity(t, "users", "alice", entity.BucketCount(2))
+//		env.Create(t, user.BaseEntity, user)
+//		env.WriteFile(t, env.Bucket(t, user.BaseEntity, ""), "notes/a.txt", "hello")
+//
+//		w := env.API().As(user.Actor()).Do(t, "GET", "/users/alice/buckets/default/files/notes/a.txt", nil)
+//	}
+package fatetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Env a database and a storage directory for a test
+type Env struct {
+	DB      *gorm.DB
+	Storage *f8.StorageConfig
+	// Dir the storage directory
+	Dir string
+
+	// entities created through the env, forgotten on cleanup
+	entities []*entity.BaseEntity
+}
+
+// Option is a functional option to the env constructor New.
+type Option func(*options)
+type options struct {
+	models     []interface{}
+	logger     logger.Interface
+	signingKey []byte
+	postgres   string
+	clock      clock.Clock
+	ids        clock.IDGenerator
+}
+
+// Clock option sets the clock of the timestamps and expiries during the test, eg. a clock.Fake
+//
+// It replaces the process wide default so the test can't run in parallel
+func Clock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// IDs option sets the generator of the ids during the test, eg. a clock.Sequence
+//
+// It replaces the process wide default so the test can't run in parallel
+func IDs(ids clock.IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// PostgresEnv the environment variable with the dsn of the postgres to test against
+const PostgresEnv = "FATETEST_POSTGRES"
+
+// Postgres option runs the env against the postgres of the dsn instead of sqlite
+//
+//	host=localhost user=postgres password=secret dbname=fate port=5432
+//
+// Overrides FATETEST_POSTGRES, the user must be able to create schemas
+func Postgres(dsn string) Option {
+	return func(o *options) {
+		o.postgres = dsn
+	}
+}
+
+// Models option migrates the app's models along with the f8 tables
+func Models(models ...interface{}) Option {
+	return func(o *options) {
+		o.models = append(o.models, models...)
+	}
+}
+
+// Logger option sets the gorm logger, by default the queries aren't logged
+func Logger(l logger.Interface) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// SigningKey option sets the key signing the shared urls
+//
+// By default a fixed key is used so the signed urls are the same across runs
+func SigningKey(key []byte) Option {
+	return func(o *options) {
+		o.signingKey = key
+	}
+}
+
+// dbs numbers the in-memory databases so the envs don't share one
+var dbs int64
+
+// New returns a migrated env, failing the test if it can't be set up
+func New(t testing.TB, opts ...Option) *Env {
+	t.Helper()
+	o := options{
+		logger:     logger.Discard,
+		signingKey: []byte("fatetest-signing-key"),
+		postgres:   os.Getenv(PostgresEnv),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.clock != nil || o.ids != nil {
+		t.Cleanup(clock.Use(o.clock, o.ids))
+	}
+
+	n := atomic.AddInt64(&dbs, 1)
+	var db *gorm.DB
+	var drop func()
+	if o.postgres != "" {
+		db, drop = openPostgres(t, o, n)
+	} else {
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+		dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", name, n)
+		var err error
+		db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: o.logger, NowFunc: clock.Now})
+		if err != nil {
+			t.Fatal("Failed to open the database ", err)
+		}
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	storage, err := f8.New(f8.StorageDir(dir), f8.DB(db), f8.SigningKey(o.signingKey))
+	if err != nil {
+		sqlDB.Close()
+		t.Fatal("Failed to create the storage ", err)
+	}
+
+	env := &Env{DB: db, Storage: storage, Dir: dir}
+	// registered after TempDir's so it runs first, the directory is removed last
+	t.Cleanup(func() {
+		env.forget()
+		sqlDB.Close()
+		if drop != nil {
+			drop()
+		}
+	})
+
+	err = tenant.Register(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.AutoMigrate(db)
+	if err != nil {
+		t.Fatal("AutoMigrate failed ", err)
+	}
+	if len(o.models) > 0 {
+		err = db.AutoMigrate(o.models...)
+		if err != nil {
+			t.Fatal("AutoMigrate failed ", err)
+		}
+	}
+	return env
+}
+
+// openPostgres returns a db using a new schema of the postgres, dropped by drop
+func openPostgres(t testing.TB, o options, n int64) (db *gorm.DB, drop func()) {
+	t.Helper()
+	admin, err := gorm.Open(postgres.Open(o.postgres), &gorm.Config{Logger: o.logger})
+	if err != nil {
+		t.Fatal("Failed to connect to postgres ", err)
+	}
+	adminDB, err := admin.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("fatetest_%d_%d", os.Getpid(), n)
+	err = admin.Exec("CREATE SCHEMA " + schema).Error
+	if err != nil {
+		adminDB.Close()
+		t.Fatal("Failed to create the schema ", err)
+	}
+	drop = func() {
+		err := admin.Exec("DROP SCHEMA " + schema + " CASCADE").Error
+		if err != nil {
+			t.Log("Failed to drop the schema ", schema, " ", err)
+		}
+		adminDB.Close()
+	}
+	db, err = gorm.Open(postgres.Open(withSearchPath(o.postgres, schema)), &gorm.Config{Logger: o.logger, NowFunc: clock.Now})
+	if err != nil {
+		drop()
+		t.Fatal("Failed to connect to postgres ", err)
+	}
+	return db, drop
+}
+
+// withSearchPath sets the search_path of the key=value or url dsn
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "search_path=" + schema
+}
+
+// forget drops the env's entities from the bucket map shared by the whole process
+func (env *Env) forget() {
+	for _, e := range env.entities {
+		entity.Forget(e.Actor().Type, e.ID)
+	}
+}
+
+// Entity returns a base entity of the type using the env's database and storage
+//
+// Nothing is saved, see Create
+func (env *Env) Entity(t testing.TB, entityType, id string, opts ...entity.Option) *entity.BaseEntity {
+	t.Helper()
+	opts = append([]entity.Option{
+		entity.ID(id),
+		entity.TableName(entityType),
+		entity.DB(env.DB),
+		entity.StorageConfig(env.Storage),
+	}, opts...)
+	e, err := entity.Entity(opts...)
+	if err != nil {
+		t.Fatal("Failed to make the entity ", err)
+	}
+	env.entities = append(env.entities, e)
+	return e
+}
+
+// Create saves the model embedding the entity, along with its buckets
+func (env *Env) Create(t testing.TB, e *entity.BaseEntity, model interface{}) {
+	t.Helper()
+	err := e.Create(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Bucket returns a saved bucket of the entity, creating it if it doesn't exist
+//
+// An empty id is the entity's default bucket, which must have been saved by Create
+func (env *Env) Bucket(t testing.TB, e *entity.BaseEntity, id string) *buckets.Bucket {
+	t.Helper()
+	b, err := e.GetBucket(id)
+	if err == nil {
+		return b
+	}
+	if id == "" {
+		t.Fatal("The default bucket isn't saved, Create the entity first")
+	}
+	// the buckets made by entity.Entity are known but not saved until Create
+	if known, ok := entity.KnownBucket(e.Actor().Type, e.ID, id); ok {
+		b = known
+	} else {
+		b, err = e.CreateBucket(id)
+		if err != nil {
+			t.Fatal("Failed to create the bucket ", err)
+		}
+	}
+	tx := env.DB.Create(b)
+	if tx.Error != nil {
+		t.Fatal("Failed to save the bucket ", tx.Error)
+	}
+	if tx.RowsAffected > 0 {
+		b.PublishCreated()
+	}
+	return b
+}
+
+// WriteFile writes the contents to the path in the bucket
+func (env *Env) WriteFile(t testing.TB, b *buckets.Bucket, p, contents string) *buckets.FileDir {
+	t.Helper()
+	fdir, err := b.WriteFile(p, strings.NewReader(contents))
+	if err != nil {
+		t.Fatal("Failed to write ", p, " ", err)
+	}
+	return fdir
+}
+
+// Files writes the files to the bucket, the keys are the paths and the values the contents
+func (env *Env) Files(t testing.TB, b *buckets.Bucket, files map[string]string) {
+	t.Helper()
+	for p, contents := range files {
+		env.WriteFile(t, b, p, contents)
+	}
+}
+
+// ReadFile returns the contents of the path in the bucket
+func (env *Env) ReadFile(t testing.TB, b *buckets.Bucket, p string) string {
+	t.Helper()
+	f, err := b.Open(p)
+	if err != nil {
+		t.Fatal("Failed to open ", p, " ", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal("Failed to read ", p, " ", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,82 @@
+package fatetest_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+)
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+	Name               string
+}
+
+// createUser saves a user with its default bucket
+func createUser(t *testing.T, env *fatetest.Env, id string) *entity.BaseEntity {
+	t.Helper()
+	e := env.Entity(t, "users", id)
+	env.Create(t, e, &user{BaseEntity: e, Name: id})
+	return e
+}
+
+func TestBuckets(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	e := createUser(t, env, "alice")
+
+	b := env.Bucket(t, e, "")
+	if b.ID != "default" {
+		t.Errorf("got the bucket %q want the default one", b.ID)
+	}
+	other := env.Bucket(t, e, "photos")
+	if other.ID != "photos" {
+		t.Errorf("got the bucket %q want photos", other.ID)
+	}
+	if again := env.Bucket(t, e, "photos"); again.ID != "photos" {
+		t.Errorf("got the bucket %q want the saved photos", again.ID)
+	}
+	if !strings.HasPrefix(b.Dir(), env.Dir) {
+		t.Errorf("the bucket directory %s isn't in the storage directory %s", b.Dir(), env.Dir)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	b := env.Bucket(t, createUser(t, env, "alice"), "")
+
+	fdir := env.WriteFile(t, b, "notes/a.txt", "hello")
+	if fdir.Path != "notes/a.txt" || fdir.Size != 5 {
+		t.Errorf("got %s of %d bytes want notes/a.txt of 5", fdir.Path, fdir.Size)
+	}
+	env.Files(t, b, map[string]string{"b.txt": "b", "notes/c.txt": "c"})
+	for p, want := range map[string]string{"notes/a.txt": "hello", "b.txt": "b", "notes/c.txt": "c"} {
+		if got := env.ReadFile(t, b, p); got != want {
+			t.Errorf("%s: got %q want %q", p, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir(), "notes", "c.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvsAreIsolated(t *testing.T) {
+	a := fatetest.New(t, fatetest.Models(&user{}))
+	b := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, a, "alice")
+
+	var n int64
+	err := b.DB.Table("users").Count(&n).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("the other env has %d users want 0", n)
+	}
+	if a.Dir == b.Dir {
+		t.Error("the envs share their storage directory")
+	}
+}
@@ -0,0 +1,18 @@
+package fatetest
+
+import "testing"
+
+func TestWithSearchPath(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"host=localhost dbname=fate", "host=localhost dbname=fate search_path=s"},
+		{"postgres://u@localhost/fate", "postgres://u@localhost/fate?search_path=s"},
+		{"postgres://u@localhost/fate?sslmode=disable", "postgres://u@localhost/fate?sslmode=disable&search_path=s"},
+	}
+	for _, tt := range tests {
+		if got := withSearchPath(tt.dsn, "s"); got != tt.want {
+			t.Errorf("withSearchPath(%q): got %q want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package flags feature flags evaluated per entity
+//
+// A flag is on or off by default, can be rolled out to a percentage of the
+// entities and overridden for an entity type or a single entity.
+// The most specific setting wins
+//
+//	entity override > entity type override > rollout percentage > default
+//
+// Flags are stored in the database and cached by the Store
+package flags
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// PublicSharing entities can make buckets public and share signed urls
+	PublicSharing = "public_sharing"
+
+	// DefaultTTL how long the flags are cached
+	DefaultTTL = 30 * time.Second
+)
+
+// Flag a feature that can be switched on per entity
+type Flag struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Name      string `gorm:"primaryKey" json:"name"`
+	// Enabled whether the flag is on for the entities without an override
+	Enabled bool `json:"enabled"`
+	// Percentage rolls the flag out to this percentage of the entities, 0 to 100
+	//
+	// Entities are picked by hashing the flag name with the entity
+	// so raising the percentage keeps the already enabled ones
+	Percentage  int    `json:"percentage"`
+	Description string `json:"description"`
+}
+
+// Override a flag forced on or off for an entity type or an entity
+type Override struct {
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	FlagName   string `gorm:"primaryKey" json:"flag"`
+	EntityType string `gorm:"primaryKey" json:"entity_type"`
+	// EntityID the entity, empty for all the entities of the type
+	EntityID string `gorm:"primaryKey" json:"entity_id"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// TableName of the overrides
+func (Override) TableName() string {
+	return "flag_overrides"
+}
+
+// AutoMigrate creates the tables of the flags
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Flag{}, &Override{})
+}
+
+var (
+	nameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+	registryMu sync.RWMutex
+	registry   = map[string]Flag{}
+)
+
+// Register declares a flag with its default, eg. for a capability being rolled out
+//
+// Registered flags are used until they're saved in the database,
+// evaluating a flag that is neither registered nor saved gives false
+func Register(name string, enabled bool, description string) {
+	registryMu.Lock()
+	registry[name] = Flag{Name: name, Enabled: enabled, Description: description}
+	registryMu.Unlock()
+}
+
+func init() {
+	Register(PublicSharing, true, "Public buckets and signed share urls")
+}
+
+// snapshot the flags and overrides loaded from the database
+type snapshot struct {
+	flags     map[string]Flag
+	overrides map[string]bool
+	loaded    time.Time
+}
+
+func overrideKey(name, entityType, entityID string) string {
+	return name + "\xff" + entityType + "\xff" + entityID
+}
+
+// Store evaluates and changes the flags
+type Store struct {
+	db  *gorm.DB
+	ttl time.Duration
+
+	mu   sync.Mutex
+	snap *snapshot
+}
+
+// Option is a functional option to the store constructor New.
+type Option func(*options)
+type options struct {
+	ttl time.Duration
+}
+
+// TTL option sets how long the flags are cached, changes made through
+// other stores (eg. other instances) are seen after at most this long
+func TTL(d time.Duration) Option {
+	return func(o *options) {
+		o.ttl = d
+	}
+}
+
+// New returns a store of the flags in db
+func New(db *gorm.DB, opts ...Option) *Store {
+	o := options{ttl: DefaultTTL}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Store{db: db, ttl: o.ttl}
+}
+
+// load returns the cached snapshot, reloading it once it expired
+func (s *Store) load() (*snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snap != nil && time.Since(s.snap.loaded) < s.ttl {
+		return s.snap, nil
+	}
+	var fs []Flag
+	err := s.db.Find(&fs).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	var ovs []Override
+	err = s.db.Find(&ovs).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	snap := &snapshot{flags: map[string]Flag{}, overrides: map[string]bool{}, loaded: time.Now()}
+	registryMu.RLock()
+	for name, f := range registry {
+		snap.flags[name] = f
+	}
+	registryMu.RUnlock()
+	for _, f := range fs {
+		snap.flags[f.Name] = f
+	}
+	for _, o := range ovs {
+		snap.overrides[overrideKey(o.FlagName, o.EntityType, o.EntityID)] = o.Enabled
+	}
+	s.snap = snap
+	return snap, nil
+}
+
+// invalidate drops the cache after a change
+func (s *Store) invalidate() {
+	s.mu.Lock()
+	s.snap = nil
+	s.mu.Unlock()
+}
+
+// inRollout whether the entity is in the first percentage of the flag's entities
+func inRollout(name, entityType, entityID string, percentage int) bool {
+	if percentage <= 0 {
+		return false
+	}
+	if percentage >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "\xff" + entityType + "\xff" + entityID))
+	return int(h.Sum32()%100) < percentage
+}
+
+func (snap *snapshot) enabled(name, entityType, entityID string) bool {
+	if v, ok := snap.overrides[overrideKey(name, entityType, entityID)]; ok {
+		return v
+	}
+	if v, ok := snap.overrides[overrideKey(name, entityType, "")]; ok {
+		return v
+	}
+	f, ok := snap.flags[name]
+	if !ok {
+		return false
+	}
+	return f.Enabled || inRollout(name, entityType, entityID, f.Percentage)
+}
+
+// Enabled whether the flag is on for the entity
+func (s *Store) Enabled(name, entityType, entityID string) (bool, error) {
+	snap, err := s.load()
+	if err != nil {
+		return false, err
+	}
+	return snap.enabled(name, entityType, entityID), nil
+}
+
+// Evaluate every flag for the entity
+func (s *Store) Evaluate(entityType, entityID string) (map[string]bool, error) {
+	snap, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool, len(snap.flags))
+	for name := range snap.flags {
+		m[name] = snap.enabled(name, entityType, entityID)
+	}
+	return m, nil
+}
+
+// List the registered and saved flags
+func (s *Store) List() ([]Flag, error) {
+	snap, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]Flag, 0, len(snap.flags))
+	for _, f := range snap.flags {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].Name < fs[j].Name })
+	return fs, nil
+}
+
+// Save creates or updates a flag
+func (s *Store) Save(f *Flag) error {
+	if !nameRe.MatchString(f.Name) {
+		return errs.New(errs.ErrInvalidName, "Flag names may only contain lowercase letters, digits and '_'")
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return errs.New(errs.ErrInvalidOption, "Percentage must be between 0 and 100")
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "enabled", "percentage", "description"}),
+	}).Create(f).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	s.invalidate()
+	return nil
+}
+
+// Override forces the flag on or off for an entity, an empty entityID for the whole type
+func (s *Store) Override(name, entityType, entityID string, enabled bool) (*Override, error) {
+	o := &Override{FlagName: name, EntityType: entityType, EntityID: entityID, Enabled: enabled}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "flag_name"}, {Name: "entity_type"}, {Name: "entity_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "enabled"}),
+	}).Create(o).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	s.invalidate()
+	return o, nil
+}
+
+// ClearOverride removes an override so the flag falls back to the broader settings
+func (s *Store) ClearOverride(name, entityType, entityID string) error {
+	err := s.db.Where(
+		"flag_name = ? AND entity_type = ? AND entity_id = ?", name, entityType, entityID,
+	).Delete(&Override{}).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	s.invalidate()
+	return nil
+}
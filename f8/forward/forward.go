@@ -0,0 +1,253 @@
+// Package forward a TCP forwarder, eg. to expose a service only listening on localhost
+//
+// Every accepted connection is piped to a new connection to the target
+// until either side closes it or it stays idle too long.
+//
+//	f := forward.New(":5000", "127.0.0.1:8080", forward.Options{MaxConns: 100})
+//	go f.ListenAndServe()
+//	defer f.Close()
+package forward
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/metrics"
+)
+
+const (
+	// DefaultIdleTimeout the default time a connection may stay idle
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultDialTimeout the default time to connect to the target
+	DefaultDialTimeout = 10 * time.Second
+)
+
+// ErrClosed returned by Serve and ListenAndServe once the forwarder is closed
+var ErrClosed = errors.New("Forwarder closed")
+
+var (
+	openConns = metrics.Default.NewGauge("fate_forward_connections",
+		"Open connections of the TCP forwarders", "listen")
+	accepted = metrics.Default.NewCounter("fate_forward_connections_total",
+		"Connections accepted by the TCP forwarders, by result: forwarded, rejected (too many) or failed (the target is down)",
+		"listen", "result")
+	forwarded = metrics.Default.NewCounter("fate_forward_bytes_total",
+		"Bytes piped by the TCP forwarders, in from the clients and out from the target",
+		"listen", "direction")
+)
+
+// Options the limits of a forwarder, zero values use the defaults
+type Options struct {
+	// MaxConns the most connections forwarded at once, the extra ones are closed, 0 for no limit
+	MaxConns int
+	// IdleTimeout closes the connections nothing was sent on for this long, negative to disable
+	IdleTimeout time.Duration
+	// DialTimeout the time to connect to the target
+	DialTimeout time.Duration
+}
+
+// Forwarder forwards the connections it accepts to the target
+type Forwarder struct {
+	// Listen the address to listen on, eg. :5000
+	Listen string
+	// Target the address the connections are forwarded to, eg. 127.0.0.1:8080
+	Target string
+	opts   Options
+
+	mu sync.Mutex
+	ln net.Listener
+	// conns the client and target connections, to close them
+	conns   map[net.Conn]struct{}
+	clients int
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// New returns a forwarder from listen to target
+func New(listen, target string, opts Options) *Forwarder {
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	return &Forwarder{Listen: listen, Target: target, opts: opts, conns: map[net.Conn]struct{}{}}
+}
+
+// ListenAndServe listens on Listen and forwards the connections until Close
+func (f *Forwarder) ListenAndServe() error {
+	ln, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	return f.Serve(ln)
+}
+
+// Serve forwards the connections of ln until Close, ln is closed on return
+func (f *Forwarder) Serve(ln net.Listener) error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		ln.Close()
+		return ErrClosed
+	}
+	f.ln = ln
+	f.mu.Unlock()
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		if !f.track(c, true) {
+			accepted.Inc(f.Listen, "rejected")
+			c.Close()
+			continue
+		}
+		f.wg.Add(1)
+		go f.forward(c)
+	}
+}
+
+// Addr the address listened on, nil until Serve is called
+func (f *Forwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ln == nil {
+		return nil
+	}
+	return f.ln.Addr()
+}
+
+// Conns the number of connections being forwarded
+func (f *Forwarder) Conns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clients
+}
+
+// Close stops listening, closes the connections being forwarded and waits for them
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	var err error
+	if f.ln != nil {
+		err = f.ln.Close()
+	}
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// track adds a connection for Close to close, false if the forwarder is
+// closed or, for a client, full
+func (f *Forwarder) track(c net.Conn, client bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || client && f.opts.MaxConns > 0 && f.clients >= f.opts.MaxConns {
+		return false
+	}
+	f.conns[c] = struct{}{}
+	if client {
+		f.clients++
+		openConns.Inc(f.Listen)
+	}
+	return true
+}
+
+func (f *Forwarder) untrack(c net.Conn, client bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, c)
+	if client {
+		f.clients--
+		openConns.Dec(f.Listen)
+	}
+}
+
+// forward pipes the client connection to a new connection to the target
+func (f *Forwarder) forward(client net.Conn) {
+	defer f.wg.Done()
+	defer f.untrack(client, true)
+	defer client.Close()
+	target, err := net.DialTimeout("tcp", f.Target, f.opts.DialTimeout)
+	if err != nil {
+		accepted.Inc(f.Listen, "failed")
+		log.Println("[f8][forward]: Failed to connect to", f.Target, err)
+		return
+	}
+	if !f.track(target, false) {
+		target.Close()
+		return
+	}
+	defer f.untrack(target, false)
+	defer target.Close()
+	accepted.Inc(f.Listen, "forwarded")
+
+	idle := &idleTimer{timeout: f.opts.IdleTimeout, conns: []net.Conn{client, target}}
+	idle.touch()
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn, direction string) {
+		n, _ := io.Copy(dst, &idleReader{src, idle})
+		forwarded.Add(float64(n), f.Listen, direction)
+		// the other side sees the end of the stream, a half close if possible
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(target, client, "in")
+	go pipe(client, target, "out")
+	<-done
+	<-done
+}
+
+// idleTimer pushes the deadlines of the connections back whenever one of them reads
+type idleTimer struct {
+	timeout time.Duration
+	conns   []net.Conn
+}
+
+func (t *idleTimer) touch() {
+	if t.timeout < 0 {
+		return
+	}
+	deadline := time.Now().Add(t.timeout)
+	for _, c := range t.conns {
+		c.SetDeadline(deadline)
+	}
+}
+
+// idleReader a connection touching its idle timer on every read
+type idleReader struct {
+	net.Conn
+	idle *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.idle.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,229 @@
+// Package httpserver an http.Server hardened against slow clients
+//
+// Besides the usual timeouts and header limits, clients must keep sending
+// request bodies and reading responses at a minimum rate, so slowloris
+// style clients trickling bytes can't hold connections forever
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+const (
+	// DefaultReadHeaderTimeout the default time to send the request headers
+	DefaultReadHeaderTimeout = 10 * time.Second
+	// DefaultIdleTimeout the default time a keep-alive connection is kept idle
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultMaxHeaderBytes the default limit of the request headers
+	DefaultMaxHeaderBytes = 64 << 10
+	// DefaultMinRate the default minimum transfer rate in bytes per second
+	DefaultMinRate = 1 << 10
+	// DefaultGrace the default time a client may stay below the minimum rate
+	DefaultGrace = 10 * time.Second
+)
+
+// Options the limits of the server, zero values use the defaults
+//
+// ReadTimeout and WriteTimeout bound whole requests and responses so they
+// also cap the size of uploads and downloads, they are off by default and
+// the minimum rates are enforced instead
+type Options struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// MinReadRate the minimum rate request bodies are read at, negative to disable
+	MinReadRate int64
+	// MinWriteRate the minimum rate responses are written at, negative to disable
+	MinWriteRate int64
+	// Grace how far behind the minimum rates a client may fall
+	Grace time.Duration
+}
+
+func (o *Options) defaults() {
+	if o.ReadHeaderTimeout == 0 {
+		o.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = DefaultIdleTimeout
+	}
+	if o.MaxHeaderBytes == 0 {
+		o.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if o.MinReadRate == 0 {
+		o.MinReadRate = DefaultMinRate
+	}
+	if o.MinWriteRate == 0 {
+		o.MinWriteRate = DefaultMinRate
+	}
+	if o.Grace == 0 {
+		o.Grace = DefaultGrace
+	}
+}
+
+type connKey struct{}
+
+// New returns a server for the handler with the limits applied
+func New(addr string, handler http.Handler, opts Options) *http.Server {
+	opts.defaults()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           enforce(handler, opts),
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+}
+
+// ListenAndServe serves the handler on addr with the limits applied
+func ListenAndServe(addr string, handler http.Handler, opts Options) error {
+	return New(addr, handler, opts).ListenAndServe()
+}
+
+// deadline the latest time a transfer of n bytes started at start may end
+func deadline(start time.Time, grace time.Duration, rate, n int64) time.Time {
+	return start.Add(grace + time.Duration(float64(n)/float64(rate)*float64(time.Second)))
+}
+
+// before the earlier of two deadlines where zero is none
+func before(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// enforce sets the connection deadlines as the body and response go
+//
+// The deadline of every read or write is when the transfer would drop below
+// the minimum rate, so a client trickling bytes times out even while it's blocking
+func enforce(next http.Handler, o Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connKey{}).(net.Conn)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		// the deadlines of the whole request set by the server
+		var readBy, writeBy time.Time
+		if o.ReadTimeout > 0 {
+			readBy = start.Add(o.ReadTimeout)
+		}
+		if o.WriteTimeout > 0 {
+			writeBy = start.Add(o.WriteTimeout)
+		}
+		sw := &slowWriter{ResponseWriter: w, conn: conn, start: start, rate: o.MinWriteRate, grace: o.Grace, by: writeBy}
+		var sr *slowReader
+		if o.MinReadRate > 0 && r.Body != nil && r.Body != http.NoBody {
+			sr = &slowReader{ReadCloser: r.Body, conn: conn, start: start, rate: o.MinReadRate, grace: o.Grace, by: readBy}
+			r.Body = sr
+		}
+		defer func() {
+			if sw.hijacked {
+				return
+			}
+			// keep-alive connections must not inherit the deadlines,
+			// the rest of an unread body is still discarded at the minimum rate
+			if sr != nil && !sr.done {
+				conn.SetReadDeadline(sr.deadline())
+			} else {
+				conn.SetReadDeadline(readBy)
+			}
+			conn.SetWriteDeadline(writeBy)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// slowReader fails the body once the client sends it slower than rate
+type slowReader struct {
+	io.ReadCloser
+	conn  net.Conn
+	start time.Time
+	rate  int64
+	grace time.Duration
+	by    time.Time
+	n     int64
+	done  bool
+}
+
+// deadline when the next byte must have arrived
+func (s *slowReader) deadline() time.Time {
+	return before(s.by, deadline(s.start, s.grace, s.rate, s.n+1))
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.done {
+		return s.ReadCloser.Read(p)
+	}
+	s.conn.SetReadDeadline(s.deadline())
+	n, err := s.ReadCloser.Read(p)
+	s.n += int64(n)
+	if err == io.EOF {
+		s.done = true
+		s.conn.SetReadDeadline(s.by)
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return n, errs.New(errs.ErrTooSlow, fmt.Sprintf("The body must be sent at %d bytes per second at least", s.rate))
+	}
+	return n, err
+}
+
+// slowWriter fails the response once the client reads it slower than rate
+type slowWriter struct {
+	http.ResponseWriter
+	conn     net.Conn
+	start    time.Time
+	rate     int64
+	grace    time.Duration
+	by       time.Time
+	n        int64
+	hijacked bool
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	if s.rate > 0 {
+		s.conn.SetWriteDeadline(before(s.by, deadline(s.start, s.grace, s.rate, s.n+int64(len(p)))))
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *slowWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection without any deadline, eg. for websockets
+func (s *slowWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response writer can't be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.hijacked = true
+	conn.SetDeadline(time.Time{})
+	return conn, rw, nil
+}
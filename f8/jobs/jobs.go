@@ -0,0 +1,502 @@
+// Package jobs the database backed queue of the slow storage operations
+//
+// Thumbnailing, archive exports, recursive deletes and sync scans are
+// enqueued by the request handlers and run by the workers of the server,
+// failed jobs are retried with a backoff until they run out of attempts
+//
+//	q := jobs.New(db, jobs.Workers(4))
+//	jobs.RegisterStorage(q, storage.StorageDir)
+//	q.Start()
+//	defer q.Stop()
+//	job, err := q.Sync(b)
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+)
+
+// Status the state of a job
+type Status string
+
+const (
+	// Queued waiting for a worker, or for its retry
+	Queued Status = "queued"
+	// Running picked up by a worker
+	Running Status = "running"
+	// Succeeded done, its result is set
+	Succeeded Status = "succeeded"
+	// Failed gave up after its last attempt, its error is set
+	Failed Status = "failed"
+)
+
+const (
+	// DefaultWorkers the number of jobs run at once
+	DefaultWorkers = 2
+	// DefaultMaxAttempts the number of times a job is tried
+	DefaultMaxAttempts = 5
+	// DefaultBackoff the wait before the first retry, doubled on every retry
+	DefaultBackoff = 10 * time.Second
+	// DefaultTimeout how long a job can run
+	DefaultTimeout = 30 * time.Minute
+	// maxBackoff the longest wait between two attempts
+	maxBackoff = time.Hour
+	// pollEvery how often idle workers look for jobs
+	pollEvery = 5 * time.Second
+	// pruneBatch the number of jobs deleted per query
+	pruneBatch = 500
+)
+
+// Job a slow operation done in the background
+type Job struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Kind picks the handler running the job
+	Kind   string `gorm:"not null" json:"kind"`
+	Status Status `gorm:"index:job_status_idx;not null" json:"status"`
+	// EntityType EntityID and BucketID what the job works on
+	EntityType string `gorm:"index:job_entity_idx" json:"entity_type,omitempty"`
+	EntityID   string `gorm:"index:job_entity_idx" json:"entity_id,omitempty"`
+	BucketID   string `json:"bucket_id,omitempty"`
+	// ActorType ActorID and IP who enqueued it, for the events of the job
+	ActorType string `json:"actor_type,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	IP        string `json:"-"`
+	// Payload the arguments of the handler
+	Payload metadata.Metadata `json:"payload,omitempty"`
+	// Result what the handler returned on success
+	Result      metadata.Metadata `json:"result,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Attempts    int               `json:"attempts"`
+	MaxAttempts int               `json:"max_attempts"`
+	// RunAt when it's next run while queued
+	RunAt      time.Time  `gorm:"index:job_status_idx" json:"run_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Done whether the job succeeded or failed for good
+func (j *Job) Done() bool {
+	return j.Status == Succeeded || j.Status == Failed
+}
+
+// AutoMigrate creates the table of the jobs
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Job{})
+}
+
+// Handler runs a job, the returned metadata is its result
+//
+// Errors are retried unless they're Permanent. The context is
+// cancelled when the job times out or the queue is stopped.
+type Handler func(ctx context.Context, job *Job) (metadata.Metadata, error)
+
+// permanent an error retrying won't fix
+type permanent struct {
+	err error
+}
+
+func (p *permanent) Error() string { return p.err.Error() }
+func (p *permanent) Unwrap() error { return p.err }
+
+// Permanent marks err as not worth retrying, the job fails right away
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanent{err: err}
+}
+
+// Queue the jobs of the database and the workers running them
+type Queue struct {
+	db          *gorm.DB
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	timeout     time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option is a functional option to the queue constructor New.
+type Option func(*options)
+type options struct {
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	timeout     time.Duration
+}
+
+// Workers option sets the number of jobs run at once, DefaultWorkers by default
+func Workers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// MaxAttempts option sets the number of times a job is tried, DefaultMaxAttempts by default
+func MaxAttempts(n int) Option {
+	return func(o *options) {
+		o.maxAttempts = n
+	}
+}
+
+// Backoff option sets the wait before the first retry, DefaultBackoff by default
+func Backoff(d time.Duration) Option {
+	return func(o *options) {
+		o.backoff = d
+	}
+}
+
+// Timeout option sets how long a job can run, DefaultTimeout by default
+//
+// Jobs running for twice as long are assumed to be lost with their
+// worker, eg. in a crash, and are queued again
+func Timeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// New returns the queue of the jobs in the database
+func New(db *gorm.DB, opts ...Option) *Queue {
+	o := options{
+		workers:     DefaultWorkers,
+		maxAttempts: DefaultMaxAttempts,
+		backoff:     DefaultBackoff,
+		timeout:     DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers < 1 {
+		o.workers = 1
+	}
+	if o.maxAttempts < 1 {
+		o.maxAttempts = 1
+	}
+	return &Queue{
+		db:          db,
+		workers:     o.workers,
+		maxAttempts: o.maxAttempts,
+		backoff:     o.backoff,
+		timeout:     o.timeout,
+		handlers:    map[string]Handler{},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Handle sets the handler of the jobs of the kind
+func (q *Queue) Handle(kind string, h Handler) {
+	q.mu.Lock()
+	q.handlers[kind] = h
+	q.mu.Unlock()
+}
+
+func (q *Queue) handler(kind string) Handler {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.handlers[kind]
+}
+
+func (q *Queue) kinds() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	kinds := make([]string, 0, len(q.handlers))
+	for kind := range q.handlers {
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// Enqueue saves the job to be run as soon as a worker is free
+//
+// Only the kind, the entity, the actor, the payload and the max attempts
+// are kept, a RunAt in the future delays it
+func (q *Queue) Enqueue(job *Job) (*Job, error) {
+	if job.Kind == "" {
+		return nil, errs.New(errs.ErrInvalidOption, "Job has no kind")
+	}
+	now := clock.Now().UTC()
+	j := &Job{
+		ID:          clock.NewID(),
+		Kind:        job.Kind,
+		Status:      Queued,
+		EntityType:  job.EntityType,
+		EntityID:    job.EntityID,
+		BucketID:    job.BucketID,
+		ActorType:   job.ActorType,
+		ActorID:     job.ActorID,
+		IP:          job.IP,
+		Payload:     job.Payload,
+		MaxAttempts: job.MaxAttempts,
+		RunAt:       job.RunAt,
+	}
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = q.maxAttempts
+	}
+	if j.RunAt.Before(now) {
+		j.RunAt = now
+	}
+	err := q.db.Create(j).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	q.wakeIn(j.RunAt.Sub(now))
+	return j, nil
+}
+
+// wakeIn wakes an idle worker after d, they poll anyway so later ones are left to it
+func (q *Queue) wakeIn(d time.Duration) {
+	wake := func() {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	switch {
+	case d <= 0:
+		wake()
+	case d < pollEvery:
+		time.AfterFunc(d, wake)
+	}
+}
+
+// Get returns the job with the id
+func (q *Queue) Get(id string) (*Job, error) {
+	job := &Job{}
+	err := q.db.Where("id = ?", id).First(job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errs.ErrJobNotFound
+	}
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return job, nil
+}
+
+// Start starts the workers, call Stop to wait for them
+//
+// Jobs of kinds without a handler are left in the queue
+// for the servers which have one
+func (q *Queue) Start() {
+	if q.cancel != nil {
+		return
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop stops the workers and waits for their running jobs
+//
+// The jobs see their context cancelled, they're retried on the next start
+func (q *Queue) Stop() {
+	if q.cancel == nil {
+		return
+	}
+	q.cancel()
+	q.wg.Wait()
+	q.cancel = nil
+}
+
+// work runs the jobs until the queue is stopped
+func (q *Queue) work() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(pollEvery)
+	defer ticker.Stop()
+	for {
+		job, err := q.claim()
+		if err != nil {
+			log.Println("[f8][WARNING]: Failed to claim a job", err)
+		}
+		if job != nil {
+			q.run(job)
+			continue
+		}
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the next due job as running, nil if there's none
+//
+// Workers of several servers can race for the same job,
+// only the one whose update goes through runs it
+func (q *Queue) claim() (*Job, error) {
+	if q.ctx.Err() != nil {
+		return nil, nil
+	}
+	kinds := q.kinds()
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+	now := clock.Now().UTC()
+	err := q.requeueLost(now)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		job := &Job{}
+		err := q.db.Where("status = ? AND run_at <= ? AND kind IN ?", Queued, now, kinds).
+			Order("run_at").First(job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, err)
+		}
+		tx := q.db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, Queued).Updates(map[string]interface{}{
+			"status":     Running,
+			"attempts":   gorm.Expr("attempts + 1"),
+			"started_at": now,
+		})
+		if tx.Error != nil {
+			return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+		}
+		if tx.RowsAffected == 1 {
+			job.Status = Running
+			job.Attempts++
+			job.StartedAt = &now
+			return job, nil
+		}
+	}
+}
+
+// requeueLost queues the jobs again whose worker went away without finishing them
+func (q *Queue) requeueLost(now time.Time) error {
+	err := q.db.Model(&Job{}).
+		Where("status = ? AND started_at < ?", Running, now.Add(-2*q.timeout)).
+		Updates(map[string]interface{}{"status": Queued, "run_at": now, "error": "Worker lost"}).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	return nil
+}
+
+// run runs the claimed job and saves its outcome
+func (q *Queue) run(job *Job) {
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	result, err := q.call(ctx, job)
+	cancel()
+
+	now := clock.Now().UTC()
+	updates := map[string]interface{}{}
+	switch {
+	case err == nil:
+		job.Status = Succeeded
+		job.Result = result
+		job.Error = ""
+		job.FinishedAt = &now
+		updates["result"] = result
+	case q.ctx.Err() != nil:
+		// stopped, the attempt doesn't count
+		job.Status = Queued
+		job.Attempts--
+		job.RunAt = now
+		job.Error = err.Error()
+	case job.Attempts >= job.MaxAttempts || errors.As(err, new(*permanent)):
+		job.Status = Failed
+		job.Error = err.Error()
+		job.FinishedAt = &now
+		log.Println("[f8][WARNING]: Job", job.ID, job.Kind, "failed", err)
+	default:
+		job.Status = Queued
+		job.RunAt = now.Add(q.retryIn(job.Attempts))
+		job.Error = err.Error()
+		defer q.wakeIn(job.RunAt.Sub(now))
+	}
+	updates["status"] = job.Status
+	updates["attempts"] = job.Attempts
+	updates["error"] = job.Error
+	updates["run_at"] = job.RunAt
+	updates["finished_at"] = job.FinishedAt
+	err = q.db.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to save job", job.ID, err)
+	}
+}
+
+// call runs the handler of the job, a panic is a failed attempt
+func (q *Queue) call(ctx context.Context, job *Job) (result metadata.Metadata, err error) {
+	h := q.handler(job.Kind)
+	if h == nil {
+		return nil, Permanent(errs.New(errs.ErrInvalidOption, "No handler for jobs of kind "+job.Kind))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// retryIn the wait before the next attempt after the nth one
+func (q *Queue) retryIn(attempts int) time.Duration {
+	d := q.backoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Prune deletes the jobs done for longer than the retention, 0 keeps them forever
+//
+// Returns the number of jobs deleted. Pass a pacer to keep it from
+// competing with production traffic, nil runs it flat out.
+func (q *Queue) Prune(retention time.Duration, p *pace.Pacer) (int64, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := clock.Now().UTC().Add(-retention)
+	var total int64
+	for {
+		var ids []string
+		err := p.Do(func() error {
+			return q.db.Model(&Job{}).Where("status IN ? AND finished_at < ?", []Status{Succeeded, Failed}, cutoff).
+				Order("finished_at").Limit(pruneBatch).Pluck("id", &ids).Error
+		})
+		if err != nil {
+			return total, errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		var n int64
+		err = p.Do(func() error {
+			tx := q.db.Where("id IN ?", ids).Delete(&Job{})
+			n = tx.RowsAffected
+			return tx.Error
+		})
+		if err != nil {
+			return total, errs.Wrap(errs.ErrDatabase, err)
+		}
+		total += n
+	}
+}
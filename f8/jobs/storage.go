@@ -0,0 +1,180 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/workers"
+)
+
+const (
+	// Thumbnail generates the thumbnails of an image, payload {"path"}
+	Thumbnail = "thumbnail"
+	// ExportArchive exports a bucket into the buckets.ExportBucket, payload {"format"}
+	//
+	// The result is {"bucket", "path", "size"} of the archive
+	ExportArchive = "archive.export"
+	// Remove deletes a file or a directory with everything under it, payload {"path"}
+	Remove = "files.remove"
+	// Sync reconciles a bucket with its directory on disk
+	//
+	// The result is {"added", "updated", "removed"}
+	Sync = "bucket.sync"
+	// Pipeline runs the pipeline of the bucket on a written file, payload {"path"}
+	Pipeline = "files.process"
+	// GC purges what was deleted and prunes the old records, the server
+	// running the gc handles it
+	GC = "storage.gc"
+)
+
+// RegisterStorage handles the storage jobs of the buckets in storageDir
+//
+// The thumbnails of the written images and the pipelines of the written files
+// are run by the queue from then on
+func RegisterStorage(q *Queue, storageDir string) {
+	q.Handle(Thumbnail, q.bucketJob(storageDir, func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error) {
+		err := b.GenerateThumbnails(job.path())
+		if err != nil && !errors.Is(err, errs.ErrDatabase) {
+			// the image doesn't decode
+			return nil, Permanent(err)
+		}
+		return nil, err
+	}))
+	q.Handle(ExportArchive, q.bucketJob(storageDir, func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error) {
+		format, _ := job.Payload["format"].(string)
+		_, fdir, err := b.ExportArchiveFile(ctx, buckets.ArchiveFormat(format))
+		if err != nil {
+			return nil, err
+		}
+		return metadata.Metadata{"bucket": buckets.ExportBucket, "path": fdir.Path, "size": fdir.Size}, nil
+	}))
+	q.Handle(Remove, q.bucketJob(storageDir, func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error) {
+		err := b.Remove(job.path())
+		if errors.Is(err, errs.ErrFileNotFound) {
+			// removed by a previous attempt or someone else
+			return nil, nil
+		}
+		return nil, err
+	}))
+	q.Handle(Sync, q.bucketJob(storageDir, func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error) {
+		report, err := b.SyncContext(ctx, workers.Options{})
+		if err != nil {
+			return nil, err
+		}
+		return metadata.Metadata{"added": report.Added, "updated": report.Updated, "removed": report.Removed}, nil
+	}))
+	q.Handle(Pipeline, q.bucketJob(storageDir, func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error) {
+		return nil, b.RunPipeline(job.path())
+	}))
+	buckets.QueueThumbnails(func(b *buckets.Bucket, p string) error {
+		_, err := q.Thumbnails(b, p)
+		return err
+	})
+	buckets.QueuePipeline(func(b *buckets.Bucket, p string) error {
+		_, err := q.Pipeline(b, p)
+		return err
+	})
+}
+
+// bucketJob wraps a handler of the jobs working on a bucket
+//
+// The bucket is found with its storage and the origin of the job attached.
+// Errors retrying won't fix, eg. a missing bucket, fail the job right away.
+func (q *Queue) bucketJob(storageDir string, h func(ctx context.Context, b *buckets.Bucket, job *Job) (metadata.Metadata, error)) Handler {
+	return func(ctx context.Context, job *Job) (metadata.Metadata, error) {
+		b, err := buckets.Find(q.db, job.EntityType, job.EntityID, job.BucketID)
+		if err != nil {
+			return nil, permanentIf(err)
+		}
+		b.AttachStorage(storageDir)
+		if job.ActorID != "" {
+			b.AttachOrigin(&buckets.Actor{Type: job.ActorType, ID: job.ActorID}, job.IP)
+		}
+		result, err := h(ctx, b, job)
+		return result, permanentIf(err)
+	}
+}
+
+// permanentIf marks the errors of invalid jobs as Permanent
+func permanentIf(err error) error {
+	for _, kind := range []error{
+		errs.ErrBucketNotFound,
+		errs.ErrInvalidOption,
+		errs.ErrInvalidPath,
+		errs.ErrIsDir,
+		errs.ErrQuotaExceeded,
+	} {
+		if errors.Is(err, kind) {
+			return Permanent(err)
+		}
+	}
+	return err
+}
+
+// path the path of the payload
+func (j *Job) path() string {
+	p, _ := j.Payload["path"].(string)
+	return p
+}
+
+// bucketJob the job of the kind working on the bucket, done as its origin
+func bucketJob(b *buckets.Bucket, kind string, payload metadata.Metadata) *Job {
+	job := &Job{
+		Kind:       kind,
+		EntityType: b.EntityType,
+		EntityID:   b.EntityID,
+		BucketID:   b.ID,
+		Payload:    payload,
+	}
+	if actor, ip := b.Origin(); actor != nil {
+		job.ActorType, job.ActorID, job.IP = actor.Type, actor.ID, ip
+	}
+	return job
+}
+
+// Thumbnails queues the generation of the thumbnails of the image at p
+func (q *Queue) Thumbnails(b *buckets.Bucket, p string) (*Job, error) {
+	return q.Enqueue(bucketJob(b, Thumbnail, metadata.Metadata{"path": p}))
+}
+
+// Pipeline queues running the pipeline of the bucket on the file at p
+func (q *Queue) Pipeline(b *buckets.Bucket, p string) (*Job, error) {
+	return q.Enqueue(bucketJob(b, Pipeline, metadata.Metadata{"path": p}))
+}
+
+// ExportArchive queues the export of the bucket in the format
+func (q *Queue) ExportArchive(b *buckets.Bucket, format buckets.ArchiveFormat) (*Job, error) {
+	switch format {
+	case buckets.Zip, buckets.Tar, buckets.TarGz:
+	default:
+		return nil, errs.New(errs.ErrInvalidOption, "Unknown archive format "+string(format))
+	}
+	return q.Enqueue(bucketJob(b, ExportArchive, metadata.Metadata{"format": string(format)}))
+}
+
+// Remove queues the removal of the file or directory at p with everything under it
+func (q *Queue) Remove(b *buckets.Bucket, p string) (*Job, error) {
+	if _, err := b.Stat(p); err != nil {
+		return nil, err
+	}
+	return q.Enqueue(bucketJob(b, Remove, metadata.Metadata{"path": p}))
+}
+
+// Sync queues the reconciliation of the bucket with its directory on disk
+func (q *Queue) Sync(b *buckets.Bucket) (*Job, error) {
+	return q.Enqueue(bucketJob(b, Sync, nil))
+}
+
+// GC queues a gc run on behalf of the actor, nil for the server itself
+//
+// A single attempt, the next one is on schedule anyway
+func (q *Queue) GC(actor *buckets.Actor, ip string) (*Job, error) {
+	job := &Job{Kind: GC, MaxAttempts: 1, IP: ip}
+	if actor != nil {
+		job.ActorType, job.ActorID = actor.Type, actor.ID
+	}
+	return q.Enqueue(job)
+}
@@ -0,0 +1,170 @@
+package metadata
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Metadata arbitrary key/value details attached to a row
+//
+// Stored as JSONB on postgres and as serialized JSON text on sqlite
+type Metadata map[string]interface{}
+
+// Value serializes the metadata for the database
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(map[string]interface{}(m))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan deserializes the metadata from the database
+func (m *Metadata) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.New("Unsupported metadata value")
+	}
+	out := Metadata{}
+	if len(b) > 0 {
+		err := json.Unmarshal(b, &out)
+		if err != nil {
+			return err
+		}
+	}
+	*m = out
+	return nil
+}
+
+// GormDataType the general data type of the metadata
+func (Metadata) GormDataType() string {
+	return "json"
+}
+
+// GormDBDataType the column type of the metadata for the database
+func (Metadata) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "JSONB"
+	default:
+		return "TEXT"
+	}
+}
+
+// Set sets the value of a key, the value must be json serializable
+func (m *Metadata) Set(key string, value interface{}) {
+	if *m == nil {
+		*m = Metadata{}
+	}
+	(*m)[key] = value
+}
+
+// Delete removes a key
+func (m Metadata) Delete(key string) {
+	delete(m, key)
+}
+
+// Get returns the value of a key
+func (m Metadata) Get(key string) (interface{}, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+// GetString returns the value of a key if it's a string
+func (m Metadata) GetString(key string) (string, bool) {
+	v, ok := m[key].(string)
+	return v, ok
+}
+
+// GetBool returns the value of a key if it's a bool
+func (m Metadata) GetBool(key string) (bool, bool) {
+	v, ok := m[key].(bool)
+	return v, ok
+}
+
+// GetFloat returns the value of a key if it's a number
+func (m Metadata) GetFloat(key string) (float64, bool) {
+	switch v := m[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// GetInt returns the value of a key if it's a whole number
+//
+// JSON numbers are decoded as float64 so this converts them back
+func (m Metadata) GetInt(key string) (int64, bool) {
+	f, ok := m.GetFloat(key)
+	if !ok || f != float64(int64(f)) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// GetTime returns the value of a key if it's an RFC3339 time
+func (m Metadata) GetTime(key string) (time.Time, bool) {
+	s, ok := m.GetString(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Where a scope filtering the rows whose metadata column has the key set to value
+//
+//	db.Scopes(metadata.Where("metadata", "plan", "pro")).Find(&users)
+//
+// Uses JSONB containment on postgres. Elsewhere the serialized JSON is searched
+// which can also match a nested object with the same key and value.
+func Where(column, key string, value interface{}) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if db.Dialector.Name() == "postgres" {
+			b, err := json.Marshal(map[string]interface{}{key: value})
+			if err != nil {
+				db.AddError(err)
+				return db
+			}
+			return db.Where(column+" @> ?", string(b))
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			db.AddError(err)
+			return db
+		}
+		v, err := json.Marshal(value)
+		if err != nil {
+			db.AddError(err)
+			return db
+		}
+		needle := string(k) + ":" + string(v)
+		return db.Where(
+			"(INSTR("+column+", ?) > 0 OR INSTR("+column+", ?) > 0)",
+			needle+",", needle+"}",
+		)
+	}
+}
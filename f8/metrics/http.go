@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	httpDuration = Default.NewHistogram("fate_http_request_duration_seconds",
+		"Latency of the requests served by the proxy in front of filebrowser and the api",
+		nil, "route", "method", "code")
+	httpRequests = Default.NewCounter("fate_http_requests_total",
+		"Requests served by the proxy in front of filebrowser and the api",
+		"route", "method", "code")
+	websockets = Default.NewGauge("fate_websocket_connections",
+		"Open websocket connections", "route")
+	dbDuration = Default.NewHistogram("fate_db_query_duration_seconds",
+		"Latency of the database queries", nil, "operation")
+)
+
+// Middleware records the latency and status code of every request
+//
+// route names the route of the request for the labels, keep the number
+// of distinct routes small. Websocket upgrades are counted while open.
+func Middleware(next http.Handler, route func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		name := route(r)
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			websockets.Inc(name)
+			defer websockets.Dec(name)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		code := sw.status
+		switch {
+		case sw.hijacked:
+			code = http.StatusSwitchingProtocols
+		case code == 0:
+			code = http.StatusOK
+		}
+		labels := []string{name, r.Method, strconv.Itoa(code)}
+		httpDuration.Observe(time.Since(start).Seconds(), labels...)
+		httpRequests.Inc(labels...)
+	})
+}
+
+// statusWriter remembers the status code, it can still be hijacked for websockets
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response writer can't be hijacked")
+	}
+	w.hijacked = true
+	return h.Hijack()
+}
+
+// InstrumentDB records the latency of every query run through db
+func InstrumentDB(db *gorm.DB) error {
+	const startKey = "metrics:start"
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(startKey, time.Now())
+	}
+	after := func(op string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if v, ok := tx.InstanceGet(startKey); ok {
+				dbDuration.Observe(time.Since(v.(time.Time)).Seconds(), op)
+			}
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("*").Register("metrics:before_create", before),
+		cb.Create().After("*").Register("metrics:after_create", after("create")),
+		cb.Query().Before("*").Register("metrics:before_query", before),
+		cb.Query().After("*").Register("metrics:after_query", after("query")),
+		cb.Update().Before("*").Register("metrics:before_update", before),
+		cb.Update().After("*").Register("metrics:after_update", after("update")),
+		cb.Delete().Before("*").Register("metrics:before_delete", before),
+		cb.Delete().After("*").Register("metrics:after_delete", after("delete")),
+		cb.Row().Before("*").Register("metrics:before_row", before),
+		cb.Row().After("*").Register("metrics:after_row", after("row")),
+		cb.Raw().Before("*").Register("metrics:before_raw", before),
+		cb.Raw().After("*").Register("metrics:after_raw", after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Package metrics a small Prometheus compatible metrics registry
+//
+// Metrics are served in the Prometheus text exposition format
+//
+//	browser.Handle("^/metrics$", metrics.Default)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets the default histogram buckets in seconds, same as the Prometheus client
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default the registry the f8 packages register their metrics in
+var Default = NewRegistry()
+
+// collector writes the HELP, TYPE and sample lines of a metric
+type collector interface {
+	name() string
+	collect(w io.Writer)
+}
+
+// Registry a set of metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register adds the metric, panics if the name is taken
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[c.name()] {
+		panic("metrics: " + c.name() + " is already registered")
+	}
+	r.names[c.name()] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every metric in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.collect(cw)
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc the name, help and label names of a metric
+type desc struct {
+	metric string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) name() string { return d.metric }
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metric, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(d.help), d.metric, d.kind)
+}
+
+// key joins the label values, panics if their number doesn't match
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.metric, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// sample writes a sample line, extra is an additional label pair like le="0.5"
+func (d *desc) sample(w io.Writer, suffix, key string, extra string, v float64) {
+	var b strings.Builder
+	b.WriteString(d.metric + suffix)
+	values := []string{}
+	if len(d.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	if len(values) > 0 || extra != "" {
+		b.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l + `="` + escape(values[i]) + `"`)
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(extra)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+func escape(v string) string {
+	return strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys the keys of the series in a stable order
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter a value that only goes up, eg. bytes uploaded
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+// Add adds v to the series of the label values, v must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.metric + " can't go down")
+	}
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, k := range sortedKeys(c.values) {
+		c.sample(w, "", k, "", c.values[k])
+	}
+}
+
+// Gauge a value that goes up and down, eg. open connections
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge registers a gauge with the label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, "gauge", labels}, values: map[string]float64{}}
+	r.register(g)
+	return g
+}
+
+// Set sets the series of the label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+// Add adds v to the series of the label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] += v
+	g.mu.Unlock()
+}
+
+// Inc adds one to the series of the label values
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+
+// Dec subtracts one from the series of the label values
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *Gauge) collect(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w)
+	for _, k := range sortedKeys(g.values) {
+		g.sample(w, "", k, "", g.values[k])
+	}
+}
+
+// Sample a value of a GaugeFunc for the label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc a gauge computed on every scrape, eg. from the database
+type GaugeFunc struct {
+	desc
+	fn func() ([]Sample, error)
+}
+
+// NewGaugeFunc registers a gauge whose samples fn returns when scraped
+//
+// Samples aren't written if fn fails
+func (r *Registry) NewGaugeFunc(name, help string, fn func() ([]Sample, error), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, "gauge", labels}, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) collect(w io.Writer) {
+	samples, err := g.fn()
+	g.header(w)
+	if err != nil {
+		return
+	}
+	for _, s := range samples {
+		g.sample(w, "", g.key(s.LabelValues), "", s.Value)
+	}
+}
+
+// Histogram counts values into buckets, eg. request latencies
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the upper bounds, nil for DefBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{desc: desc{name, help, "histogram", labels}, buckets: buckets, series: map[string]*histogramSeries{}}
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the series of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, le := range h.buckets {
+			h.sample(w, "_bucket", k, `le="`+formatFloat(le)+`"`, float64(s.counts[i]))
+		}
+		h.sample(w, "_bucket", k, `le="+Inf"`, float64(s.count))
+		h.sample(w, "_sum", k, "", s.sum)
+		h.sample(w, "_count", k, "", float64(s.count))
+	}
+}
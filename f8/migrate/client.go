@@ -0,0 +1,376 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/client"
+	"github.com/phanirithvij/fate/f8/validate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// apiPath where the source serves the migration endpoints, see api.Prefix
+	apiPath = "/api/v1/migrate"
+)
+
+// ErrChecksum a downloaded file didn't match the manifest checksum twice in a row
+var ErrChecksum = errors.New("Downloaded file doesn't match its checksum")
+
+// Client pulls entities with all of their buckets and files from another
+// fate deployment
+type Client struct {
+	// BaseURL of the source deployment eg. https://eu.example.com
+	BaseURL string
+	// Token the migration token the source api was started with
+	Token string
+	// BytesPerSecond caps the download bandwidth, 0 for no cap
+	BytesPerSecond int64
+	// StateFile keeps the progress so an interrupted Pull resumes where it stopped
+	//
+	// Partial downloads are kept next to it. Without it nothing survives the process.
+	StateFile string
+	// HTTP the client used for the requests, default http.DefaultClient
+	HTTP *http.Client
+}
+
+// Report what a Pull transferred
+type Report struct {
+	Files int `json:"files"`
+	// Skipped the files already migrated by an earlier Pull
+	Skipped int   `json:"skipped"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// state the files migrated so far per entity
+type state map[string]map[string]string
+
+func (c *Client) loadState() (state, error) {
+	st := state{}
+	if c.StateFile == "" {
+		return st, nil
+	}
+	b, err := ioutil.ReadFile(c.StateFile)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, json.Unmarshal(b, &st)
+}
+
+func (c *Client) saveState(st state) error {
+	if c.StateFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := c.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.StateFile)
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// endpoint returns the url of the migration endpoint made of the escaped segments
+func (c *Client) endpoint(segments ...string) string {
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + apiPath + "/" + strings.Join(segments, "/")
+}
+
+func (c *Client) get(u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	return c.http().Do(req)
+}
+
+// Manifest fetches the manifest of an entity from the source
+func (c *Client) Manifest(entityType, entityID string) (*Manifest, error) {
+	res, err := c.get(c.endpoint(entityType, entityID, "manifest"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching the manifest of %s %s failed: %w", entityType, entityID, client.ReadProblem(res))
+	}
+	m := &Manifest{}
+	dec := json.NewDecoder(res.Body)
+	dec.UseNumber()
+	return m, dec.Decode(m)
+}
+
+// Pull copies the entity row, its buckets and files from the source
+// into the database and storage directory
+//
+// Every file is verified against the manifest checksum.
+// Files migrated by an earlier Pull with the same StateFile are skipped.
+// Only the entity's own row is copied, not the application's other tables.
+func (c *Client) Pull(db *gorm.DB, storageDir, entityType, entityID string) (*Report, error) {
+	err := validate.EntityType(entityType)
+	if err != nil {
+		return nil, err
+	}
+	err = validate.EntityID(entityID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.Manifest(entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	// the names come from another deployment and become paths here
+	for _, b := range m.Buckets {
+		err = validate.BucketName(b.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	st, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+	key := entityType + "/" + entityID
+	if st[key] == nil {
+		st[key] = map[string]string{}
+	}
+	done := st[key]
+
+	tx := db.Table(entityType).Clauses(clause.OnConflict{DoNothing: true}).Create(m.Entity)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	bucks := map[string]*buckets.Bucket{}
+	for _, b := range m.Buckets {
+		// the usage is counted again as the files are written
+		b.Used = 0
+		tx = db.Session(&gorm.Session{SkipHooks: true}).Clauses(clause.OnConflict{DoNothing: true}).Create(b)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		dst, err := buckets.Find(db, entityType, entityID, b.ID)
+		if err != nil {
+			return nil, err
+		}
+		dst.AttachStorage(storageDir)
+		bucks[b.ID] = dst
+	}
+
+	parts, err := c.partsDir()
+	if err != nil {
+		return nil, err
+	}
+	if c.StateFile == "" {
+		defer os.RemoveAll(parts)
+	}
+	report := &Report{}
+	limit := newThrottle(c.BytesPerSecond)
+	for _, f := range m.Files {
+		b, ok := bucks[f.Bucket]
+		if !ok {
+			return nil, errors.New("Manifest file in an unknown bucket " + f.Bucket)
+		}
+		id := f.Bucket + "/" + f.Path
+		if sum, ok := done[id]; ok && sum == f.SHA256 {
+			report.Skipped++
+			continue
+		}
+		if f.IsDir {
+			_, err = b.Mkdir(f.Path)
+		} else {
+			err = c.pullFile(b, f, filepath.Join(parts, f.SHA256), limit)
+			report.Bytes += f.Size
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range f.Metadata {
+			_, err = b.SetFileMetadata(f.Path, k, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = b.Tag(f.Path, f.Tags...)
+		if err != nil {
+			return nil, err
+		}
+		done[id] = f.SHA256
+		err = c.saveState(st)
+		if err != nil {
+			return nil, err
+		}
+		report.Files++
+	}
+	return report, nil
+}
+
+// partsDir the directory of the partial downloads
+func (c *Client) partsDir() (string, error) {
+	if c.StateFile == "" {
+		return ioutil.TempDir("", "fate-migrate-")
+	}
+	dir := c.StateFile + ".parts"
+	return dir, os.MkdirAll(dir, 0766)
+}
+
+// pullFile downloads a file into part, resuming it if it's already there,
+// verifies it and writes it to the bucket
+func (c *Client) pullFile(b *buckets.Bucket, f File, part string, limit *throttle) error {
+	for attempt := 0; ; attempt++ {
+		err := c.download(b, f, part, limit)
+		if err != nil {
+			return err
+		}
+		sum, err := hashLocal(part)
+		if err != nil {
+			return err
+		}
+		if sum == f.SHA256 {
+			break
+		}
+		// corrupt or changed on the source, start over once
+		os.Remove(part)
+		if attempt > 0 {
+			return fmt.Errorf("%w %s/%s", ErrChecksum, f.Bucket, f.Path)
+		}
+	}
+	in, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteFileInfo(f.Path, in, f.Mode, f.ModTime)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(part)
+}
+
+// download fetches the missing bytes of the file with a range request
+func (c *Client) download(b *buckets.Bucket, f File, part string, limit *throttle) error {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	if offset > f.Size {
+		offset = 0
+	}
+	if offset == f.Size && offset > 0 {
+		return nil
+	}
+	segments := append([]string{b.EntityType, b.EntityID, "buckets", b.ID, "files"}, strings.Split(f.Path, "/")...)
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := c.get(c.endpoint(segments...), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// the source ignored the range
+		flags |= os.O_TRUNC
+	default:
+		return fmt.Errorf("Downloading %s/%s failed: %w", f.Bucket, f.Path, client.ReadProblem(res))
+	}
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, limit.reader(res.Body))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// hashLocal returns the hex sha256 of a file on disk
+func hashLocal(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// throttle caps the rate of the readers it wraps, shared by all the downloads
+type throttle struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{rate: bytesPerSecond, start: time.Now()}
+}
+
+func (t *throttle) reader(r io.Reader) io.Reader {
+	if t.rate <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	t := tr.t
+	// small reads keep the rate smooth
+	if max := t.rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	t.n += int64(n)
+	due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
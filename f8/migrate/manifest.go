@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"gorm.io/gorm"
+)
+
+// File a file or directory of a migrated bucket
+type File struct {
+	Bucket   string            `json:"bucket"`
+	Path     string            `json:"path"`
+	IsDir    bool              `json:"is_dir"`
+	Size     int64             `json:"size"`
+	Mode     os.FileMode       `json:"mode"`
+	ModTime  time.Time         `json:"mod_time"`
+	SHA256   string            `json:"sha256,omitempty"`
+	Metadata metadata.Metadata `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+}
+
+// Manifest everything needed to recreate an entity on another deployment
+type Manifest struct {
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	// Entity the row of the entity table
+	Entity  map[string]interface{} `json:"entity"`
+	Buckets []*buckets.Bucket      `json:"buckets"`
+	Files   []File                 `json:"files"`
+}
+
+// BuildManifest describes the entity, its buckets and all of their files
+//
+// The hidden buckets are left out, the destination derives them again
+func BuildManifest(db *gorm.DB, storageDir, entityType, entityID string) (*Manifest, error) {
+	m := &Manifest{EntityType: entityType, EntityID: entityID, Files: []File{}}
+	row := map[string]interface{}{}
+	tx := db.Table(entityType).Where("id = ?", entityID).Take(&row)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrEntityNotFound)
+	}
+	for k, v := range row {
+		if b, ok := v.([]byte); ok {
+			row[k] = string(b)
+		}
+	}
+	m.Entity = row
+	tx = db.Where(
+		"entity_id = ? AND entity_type = ? AND id NOT LIKE ?",
+		entityID, entityType, ".%",
+	).Order("id").Find(&m.Buckets)
+	if tx.Error != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	for _, b := range m.Buckets {
+		b.AttatchDB(db)
+		b.AttachStorage(storageDir)
+		fdirs, err := b.Files()
+		if err != nil {
+			return nil, err
+		}
+		for _, fdir := range fdirs {
+			f := File{
+				Bucket:   b.ID,
+				Path:     fdir.Path,
+				IsDir:    fdir.IsDir,
+				Size:     fdir.Size,
+				Mode:     fdir.Mode,
+				ModTime:  fdir.ModTime,
+				Metadata: fdir.Metadata,
+			}
+			f.Tags, err = b.Tags(fdir.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !fdir.IsDir {
+				f.SHA256, err = hashFile(b, fdir.Path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			m.Files = append(m.Files, f)
+		}
+	}
+	return m, nil
+}
+
+// hashFile returns the hex sha256 of a bucket file
+func hashFile(b *buckets.Bucket, p string) (string, error) {
+	f, err := b.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
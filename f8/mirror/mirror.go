@@ -0,0 +1,369 @@
+// Package mirror one-way copies of buckets in real directories for the tools which only understand paths
+//
+// A mirror is filled by a full Sync and kept up to date with the file events
+// of its bucket, writes to the directory itself are overwritten or removed
+// by the next sync
+//
+//	m := mirror.New(db, storage.StorageDir)
+//	_, err := m.Add(mirror.Target{EntityType: "users", EntityID: "phano", Bucket: "default", Dir: "/srv/legacy/phano"})
+//	events.Subscribe(m)
+package mirror
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+)
+
+// tempPrefix the prefix of the files being copied into a mirror
+const tempPrefix = ".fate-mirror-"
+
+// Target a bucket and the directory it's mirrored to
+type Target struct {
+	EntityType string
+	EntityID   string
+	Bucket     string
+	// Dir the directory the files are materialized in, it's created if missing
+	Dir string
+}
+
+func (t Target) key() [3]string {
+	return [3]string{t.EntityType, t.EntityID, t.Bucket}
+}
+
+// Report what a Sync changed in the directory
+type Report struct {
+	// Copied files missing from the directory or which didn't match the bucket
+	Copied int
+	// Removed files and directories not in the bucket
+	Removed int
+	Bytes   int64
+}
+
+// Mirror keeps the directories of its targets in sync with their buckets
+//
+// It's an events.Sink, subscribe it to get the changes as they happen
+type Mirror struct {
+	db         *gorm.DB
+	storageDir string
+
+	mu      sync.Mutex
+	targets map[[3]string]Target
+}
+
+// New returns a mirror of the buckets in storageDir without targets
+func New(db *gorm.DB, storageDir string) *Mirror {
+	return &Mirror{db: db, storageDir: storageDir, targets: map[[3]string]Target{}}
+}
+
+// Add syncs the target directory and keeps it updated from then on
+//
+// Returns the report of the first sync. The directory can't be inside the
+// storage directory, the watcher would take the copies for filebrowser writes
+func (m *Mirror) Add(t Target) (*Report, error) {
+	dir, err := filepath.Abs(t.Dir)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	storage, err := filepath.Abs(m.storageDir)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	if dir == storage || strings.HasPrefix(dir, storage+string(filepath.Separator)) {
+		return nil, errs.New(errs.ErrInvalidPath, "Mirror can't be inside the storage directory "+dir)
+	}
+	t.Dir = dir
+	report, err := m.Sync(t)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.targets[t.key()] = t
+	m.mu.Unlock()
+	return report, nil
+}
+
+// Targets returns the mirrored targets
+func (m *Mirror) Targets() []Target {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets := make([]Target, 0, len(m.targets))
+	for _, t := range m.targets {
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// bucket returns the bucket of the target with the storage attached
+func (m *Mirror) bucket(t Target) (*buckets.Bucket, error) {
+	b, err := buckets.Find(m.db, t.EntityType, t.EntityID, t.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	b.AttachStorage(m.storageDir)
+	return b, nil
+}
+
+// local the path in the directory of the bucket path
+func local(t Target, p string) string {
+	return filepath.Join(t.Dir, filepath.FromSlash(p))
+}
+
+// Sync makes the target directory match its bucket
+//
+// Files whose size or modification time differ are copied again,
+// what isn't in the bucket is removed
+func (m *Mirror) Sync(t Target) (*Report, error) {
+	b, err := m.bucket(t)
+	if err != nil {
+		return nil, err
+	}
+	fdirs, err := b.Files()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(t.Dir, 0766)
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	report := &Report{}
+	keep := map[string]bool{}
+	for i := range fdirs {
+		fdir, err := resolve(b, &fdirs[i])
+		if err != nil {
+			return nil, err
+		}
+		if fdir == nil {
+			continue
+		}
+		name := local(t, fdir.Path)
+		keep[name] = true
+		info, err := os.Lstat(name)
+		if err == nil && info.IsDir() != fdir.IsDir {
+			// a file replaced by a directory or the other way around
+			err = os.RemoveAll(name)
+			if err != nil {
+				return nil, errs.FS(err)
+			}
+			info = nil
+		}
+		if fdir.IsDir {
+			err = os.MkdirAll(name, 0766)
+			if err != nil {
+				return nil, errs.FS(err)
+			}
+			continue
+		}
+		if fdir.IsSymlink() {
+			changed, err := linkFile(fdir, name)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				report.Copied++
+			}
+			continue
+		}
+		// the file systems and databases keep different precisions
+		if info != nil && info.Size() == fdir.Size && info.ModTime().Unix() == fdir.ModTime.Unix() {
+			continue
+		}
+		err = copyFile(b, fdir, name)
+		if err != nil {
+			return nil, err
+		}
+		report.Copied++
+		report.Bytes += fdir.Size
+	}
+	var extra []string
+	err = filepath.Walk(t.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == t.Dir || keep[name] {
+			return nil
+		}
+		extra = append(extra, name)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errs.FS(err)
+	}
+	for _, name := range extra {
+		err = os.RemoveAll(name)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		report.Removed++
+	}
+	return report, nil
+}
+
+// SyncAll syncs every target, eg. to catch up on the events dropped under load
+//
+// A failing target is logged and doesn't stop the others
+func (m *Mirror) SyncAll() *Report {
+	total := &Report{}
+	for _, t := range m.Targets() {
+		report, err := m.Sync(t)
+		if err != nil {
+			log.Println("[f8][WARNING]: Failed to sync the mirror", t.Dir, err)
+			continue
+		}
+		total.Copied += report.Copied
+		total.Removed += report.Removed
+		total.Bytes += report.Bytes
+	}
+	return total
+}
+
+// Send applies the file event to the mirror of its bucket
+func (m *Mirror) Send(e *events.Event) error {
+	m.mu.Lock()
+	t, ok := m.targets[[3]string{e.EntityType, e.EntityID, e.BucketID}]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	switch e.Type {
+	case events.FileWritten:
+		b, err := m.bucket(t)
+		if err != nil {
+			return err
+		}
+		fdir, err := b.Stat(e.Path)
+		if errors.Is(err, errs.ErrFileNotFound) {
+			// deleted since, its own event follows
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fdir, err = resolve(b, fdir)
+		if err != nil || fdir == nil {
+			return err
+		}
+		if fdir.IsDir {
+			return errs.FS(os.MkdirAll(local(t, fdir.Path), 0766))
+		}
+		if fdir.IsSymlink() {
+			_, err = linkFile(fdir, local(t, fdir.Path))
+			return err
+		}
+		return copyFile(b, fdir, local(t, fdir.Path))
+	case events.FileDeleted:
+		if e.Path == "" {
+			return nil
+		}
+		return errs.FS(os.RemoveAll(local(t, e.Path)))
+	case events.BucketDeleted:
+		m.mu.Lock()
+		delete(m.targets, t.key())
+		m.mu.Unlock()
+		log.Println("[f8][WARNING]: Mirrored bucket deleted, stopped mirroring to", t.Dir)
+	}
+	return nil
+}
+
+// resolve returns the row mirrored in place of the file following the
+// bucket's LinkPolicy, nil to leave it out
+//
+// The preserved symlinks are mirrored as symlinks, the followed ones as the
+// files they point to and the rejected ones, the dangling ones and the ones
+// to directories are left out
+func resolve(b *buckets.Bucket, fdir *buckets.FileDir) (*buckets.FileDir, error) {
+	if !fdir.IsSymlink() || b.LinkPolicy() == buckets.LinksPreserve {
+		return fdir, nil
+	}
+	if b.LinkPolicy() == buckets.LinksReject {
+		return nil, nil
+	}
+	target, err := b.Resolve(fdir.Path)
+	if errors.Is(err, errs.ErrFileNotFound) || errors.Is(err, errs.ErrInvalidPath) {
+		return nil, nil
+	}
+	if err != nil || target.IsDir {
+		return nil, err
+	}
+	// under the name of the link, copyFile reads through it
+	followed := *target
+	followed.Path = fdir.Path
+	return &followed, nil
+}
+
+// linkFile makes name a symlink like the bucket's one, false if it already was
+func linkFile(fdir *buckets.FileDir, name string) (bool, error) {
+	target := filepath.FromSlash(fdir.RelTarget())
+	if cur, err := os.Readlink(name); err == nil && cur == target {
+		return false, nil
+	}
+	err := os.RemoveAll(name)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(name), 0766)
+	}
+	if err == nil {
+		err = os.Symlink(target, name)
+	}
+	if err != nil {
+		return false, errs.FS(err)
+	}
+	return true, nil
+}
+
+// copyFile copies the bucket file to name through a temp file
+//
+// The directory never has a partially written file
+func copyFile(b *buckets.Bucket, fdir *buckets.FileDir, name string) error {
+	src, err := b.Open(fdir.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if info, err := os.Lstat(name); err == nil && info.IsDir() {
+		err = os.RemoveAll(name)
+		if err != nil {
+			return errs.FS(err)
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0766)
+	if err != nil {
+		return errs.FS(err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), tempPrefix)
+	if err != nil {
+		return errs.FS(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errs.FS(err)
+	}
+	mode := fdir.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), fdir.ModTime, fdir.ModTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	return errs.FS(err)
+}
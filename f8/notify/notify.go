@@ -0,0 +1,85 @@
+// Package notify emails the entities, the verification links of their
+// addresses and the events they should know about
+//
+// The messages go through a Notifier, SMTP is included and apps plug in
+// their own transport (a mail api, a queue) by implementing Notify.
+//
+//	n := &notify.SMTP{Addr: "smtp.example.com:587", From: "fate@example.com", Username: "fate", Password: pass}
+//	events.Subscribe(notify.NewSink(db, n))
+//	err := notify.SendVerification(n, user.Contacts(), "a@b.c", "https://example.com/verify")
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// Message an email to the entity
+type Message struct {
+	To      []string
+	Subject string
+	// Text the plain text body
+	Text string
+}
+
+// Notifier sends the messages
+type Notifier interface {
+	Notify(m *Message) error
+}
+
+// NotifierFunc a function implementing Notifier
+type NotifierFunc func(m *Message) error
+
+// Notify calls the function
+func (f NotifierFunc) Notify(m *Message) error {
+	return f(m)
+}
+
+// SMTP sends the messages through an smtp server
+type SMTP struct {
+	// Addr the host:port of the server, eg. smtp.example.com:587
+	Addr string
+	// From the sender of the messages
+	From string
+	// Username and Password authenticate with PLAIN when the username is set
+	Username string
+	Password string
+}
+
+// Notify sends the message, upgrading to TLS if the server supports it
+func (s *SMTP) Notify(m *Message) error {
+	if len(m.To) == 0 {
+		return errs.New(errs.ErrInvalidOption, "The message has no recipients")
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return errs.New(errs.ErrInvalidOption, "Invalid smtp address "+s.Addr)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, m.To, s.encode(m))
+}
+
+// encode the message with its headers
+func (s *SMTP) encode(m *Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", clock.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Text, "\r\n", "\n"), "\n", "\r\n"))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultQuietPeriod how long the same notification isn't sent again, eg. for every refused write
+	DefaultQuietPeriod = time.Hour
+	// maxSent the notifications remembered before the past quiet periods are forgotten
+	maxSent = 10000
+)
+
+// Template the message about the event and the entity it goes to, nil to send nothing
+type Template func(e *events.Event) (to *buckets.Actor, m *Message)
+
+// DefaultTemplates the messages of the events the entities are notified of
+var DefaultTemplates = map[events.Type]Template{
+	events.QuotaExceeded: func(e *events.Event) (*buckets.Actor, *Message) {
+		return &buckets.Actor{Type: e.EntityType, ID: e.EntityID}, &Message{
+			Subject: "Your bucket " + e.BucketID + " is full",
+			Text: fmt.Sprintf("Writing %s to your bucket %s was refused, it uses %v of its %v bytes.\n\n"+
+				"Delete files from the bucket or ask for a larger quota.", e.Path, e.BucketID, e.Data["used"], e.Data["quota"]),
+		}
+	},
+	events.BucketShared: func(e *events.Event) (*buckets.Actor, *Message) {
+		granteeType, _ := e.Data["grantee_type"].(string)
+		granteeID, _ := e.Data["grantee_id"].(string)
+		if granteeID == "" {
+			return nil, nil
+		}
+		return &buckets.Actor{Type: granteeType, ID: granteeID}, &Message{
+			Subject: e.EntityID + " shared " + e.BucketID + " with you",
+			Text:    fmt.Sprintf("%s %s gave you %v access to their bucket %s.", e.EntityType, e.EntityID, e.Data["role"], e.BucketID),
+		}
+	},
+}
+
+// Sink emails the entities about the events, to their primary email once it's verified
+type Sink struct {
+	db        *gorm.DB
+	n         Notifier
+	templates map[events.Type]Template
+	quiet     time.Duration
+
+	mu sync.Mutex
+	// sent when the notifications were last sent, by their event type, entity and bucket
+	sent map[string]time.Time
+}
+
+// SinkOption is a functional option to the sink constructor NewSink.
+type SinkOption func(*sinkOptions)
+type sinkOptions struct {
+	templates map[events.Type]Template
+	quiet     time.Duration
+}
+
+// WithTemplate option replaces the template of the event type, nil stops notifying it
+func WithTemplate(t events.Type, tmpl Template) SinkOption {
+	return func(o *sinkOptions) {
+		o.templates[t] = tmpl
+	}
+}
+
+// QuietPeriod option sets how long the same notification isn't sent again, default DefaultQuietPeriod
+func QuietPeriod(d time.Duration) SinkOption {
+	return func(o *sinkOptions) {
+		o.quiet = d
+	}
+}
+
+// NewSink returns the sink notifying the entities through n
+func NewSink(db *gorm.DB, n Notifier, opts ...SinkOption) *Sink {
+	o := sinkOptions{templates: map[events.Type]Template{}, quiet: DefaultQuietPeriod}
+	for t, tmpl := range DefaultTemplates {
+		o.templates[t] = tmpl
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Sink{db: db, n: n, templates: o.templates, quiet: o.quiet, sent: map[string]time.Time{}}
+}
+
+// Send notifies the entity the template of the event picks
+func (s *Sink) Send(e *events.Event) error {
+	tmpl := s.templates[e.Type]
+	if tmpl == nil {
+		return nil
+	}
+	to, m := tmpl(e)
+	if to == nil || m == nil {
+		return nil
+	}
+	email, err := entity.NewContacts(s.db, to.Type, to.ID).Primary()
+	if err != nil || !email.Verified() {
+		// nowhere to send it
+		return nil
+	}
+	key := string(e.Type) + "/" + to.Type + "/" + to.ID + "/" + e.EntityType + "/" + e.EntityID + "/" + e.BucketID
+	now := clock.Now()
+	s.mu.Lock()
+	last, ok := s.sent[key]
+	if ok && now.Sub(last) < s.quiet {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sent[key] = now
+	if len(s.sent) > maxSent {
+		for k, t := range s.sent {
+			if now.Sub(t) >= s.quiet {
+				delete(s.sent, k)
+			}
+		}
+	}
+	s.mu.Unlock()
+	m.To = []string{email.Email}
+	return s.n.Notify(m)
+}
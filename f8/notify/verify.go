@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"net/url"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// SendVerification sends the email of the contacts a link verifying it
+//
+// The new token is added to the link as its token query parameter, the
+// page behind it passes it to Contacts.Verify. The previous links stop working.
+func SendVerification(n Notifier, c *entity.Contacts, email, link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return errs.New(errs.ErrInvalidOption, "Invalid verification link "+link)
+	}
+	e, err := c.Find(email)
+	if err != nil {
+		return err
+	}
+	if e.Verified() {
+		return errs.New(errs.ErrInvalidOption, "Email "+e.Email+" is already verified")
+	}
+	token, err := c.NewToken(e.Email, 0)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return n.Notify(&Message{
+		To:      []string{e.Email},
+		Subject: "Verify your email",
+		Text: "Open the link below to verify " + e.Email + ".\n\n" + u.String() +
+			"\n\nThe link works for " + entity.DefaultTokenTTL.String() + ", ignore this email if you didn't add the address.",
+	})
+}
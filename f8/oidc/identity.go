@@ -0,0 +1,94 @@
+package oidc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+)
+
+// Identity links the subject of a provider to the entity it logs in as
+type Identity struct {
+	Issuer     string    `gorm:"primaryKey" json:"issuer"`
+	Subject    string    `gorm:"primaryKey" json:"subject"`
+	EntityType string    `gorm:"index:identity_entity_idx;not null" json:"entity_type"`
+	EntityID   string    `gorm:"index:identity_entity_idx;not null" json:"entity_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	// LastLoginAt when the entity last logged in with it
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// TableName of the identities
+func (Identity) TableName() string {
+	return "identities"
+}
+
+// AutoMigrate creates the table of the identities
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Identity{})
+}
+
+// Link links the subject of the issuer to the entity, eg. an existing user
+// logging in with the provider for the first time
+func Link(db *gorm.DB, issuer, subject, entityType, entityID string) (*Identity, error) {
+	if issuer == "" || subject == "" {
+		return nil, errs.New(errs.ErrInvalidOption, "The issuer and the subject are required")
+	}
+	i := &Identity{Issuer: issuer, Subject: subject, EntityType: entityType, EntityID: entityID}
+	var n int64
+	err := db.Model(&Identity{}).Where("issuer = ? AND subject = ?", issuer, subject).Count(&n).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	if n > 0 {
+		return nil, errs.New(errs.ErrEntityExists, "The subject "+subject+" is already linked")
+	}
+	err = db.Create(i).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return i, nil
+}
+
+// Identities returns the identities linked to the entity
+func Identities(db *gorm.DB, entityType, entityID string) (ids []Identity, err error) {
+	err = db.Where("entity_type = ? AND entity_id = ?", entityType, entityID).Order("created_at").Find(&ids).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return ids, nil
+}
+
+// Unlink removes the identity, the subject can't log in as the entity anymore
+func Unlink(db *gorm.DB, issuer, subject string) error {
+	tx := db.Where("issuer = ? AND subject = ?", issuer, subject).Delete(&Identity{})
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if tx.RowsAffected == 0 {
+		return errs.New(errs.ErrEntityNotFound, "The subject "+subject+" isn't linked")
+	}
+	return nil
+}
+
+// findIdentity returns the identity of the subject, nil if it isn't linked
+func findIdentity(db *gorm.DB, issuer, subject string) (*Identity, error) {
+	i := &Identity{}
+	err := db.Where("issuer = ? AND subject = ?", issuer, subject).First(i).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return i, nil
+}
+
+// touch records the login of the identity
+func touch(db *gorm.DB, i *Identity) error {
+	now := clock.Now()
+	i.LastLoginAt = &now
+	return errs.Wrap(errs.ErrDatabase, db.Model(i).Update("last_login_at", now).Error)
+}
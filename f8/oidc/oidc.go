@@ -0,0 +1,469 @@
+// Package oidc logs the entities into the filebrowser proxy through an
+// external OpenID Connect or OAuth2 provider, eg. Google, GitHub or Keycloak
+//
+// The subject of the provider is linked to an entity, see Identity, the
+// unknown ones are provisioned on their first login when a ProvisionFunc is
+// set. The logged in requests carry the entity id in the header filebrowser's
+// proxy auth reads, see browser.ProxyAuth, the header sent by the clients is dropped.
+//
+//	o, err := oidc.New(db, oidc.Config{Issuer: "https://accounts.google.com", ClientID: id, ClientSecret: secret},
+//		signingKey, oidc.Provision(provision))
+//	storage.StartBrowser(browser.Middleware(o.Middleware), browser.ProxyAuth(oidc.DefaultHeader))
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultHeader the header the entity id is passed to filebrowser in
+	DefaultHeader = "X-Fate-User"
+	// DefaultEntityType the type of the entities logging in
+	DefaultEntityType = "users"
+	// DefaultBaseURL the path of the proxy, the endpoints are under its /oidc/
+	DefaultBaseURL = "/admin"
+	// DefaultSessionTTL how long a login lasts
+	DefaultSessionTTL = 12 * time.Hour
+
+	sessionCookie = "fate_session"
+	stateCookie   = "fate_oidc"
+	// stateTTL how long the user has to log in at the provider
+	stateTTL = 10 * time.Minute
+)
+
+// ProvisionFunc creates the entity of a subject logging in for the first time, returning its id
+type ProvisionFunc func(c Claims) (entityID string, err error)
+
+// PasswordFunc checks the password of the entity
+type PasswordFunc func(entityType, entityID, password string) (bool, error)
+
+// OIDC the login middleware of the proxy
+type OIDC struct {
+	db         *gorm.DB
+	provider   *provider
+	key        []byte
+	header     string
+	entityType string
+	baseURL    string
+	ttl        time.Duration
+	provision  ProvisionFunc
+	passwords  PasswordFunc
+	audit      *audit.Log
+}
+
+// Option is a functional option to the middleware constructor New.
+type Option func(*options)
+type options struct {
+	header     string
+	entityType string
+	baseURL    string
+	ttl        time.Duration
+	provision  ProvisionFunc
+	passwords  PasswordFunc
+	audit      *audit.Log
+	client     *http.Client
+}
+
+// Header option sets the header the entity id is passed in, default DefaultHeader
+func Header(name string) Option {
+	return func(o *options) {
+		o.header = name
+	}
+}
+
+// EntityType option sets the type of the entities logging in, default DefaultEntityType
+func EntityType(entityType string) Option {
+	return func(o *options) {
+		o.entityType = entityType
+	}
+}
+
+// BaseURL option sets the path of the proxy, default DefaultBaseURL
+func BaseURL(base string) Option {
+	return func(o *options) {
+		o.baseURL = strings.TrimSuffix(base, "/")
+	}
+}
+
+// SessionTTL option sets how long a login lasts, default DefaultSessionTTL
+func SessionTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.ttl = d
+	}
+}
+
+// Provision option creates the entities of the unknown subjects on their first login
+//
+// By default only the subjects linked with Link can log in
+func Provision(provision ProvisionFunc) Option {
+	return func(o *options) {
+		o.provision = provision
+	}
+}
+
+// Passwords option also lets the requests log in with the basic auth
+// credentials of the entities, checked by check
+func Passwords(check PasswordFunc) Option {
+	return func(o *options) {
+		o.passwords = check
+	}
+}
+
+// Audit option records the logins in the audit log
+func Audit(l *audit.Log) Option {
+	return func(o *options) {
+		o.audit = l
+	}
+}
+
+// HTTPClient option sets the client the provider is called with
+func HTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// New returns the middleware logging in through the provider, the sessions are signed with key
+func New(db *gorm.DB, cfg Config, key []byte, opts ...Option) (*OIDC, error) {
+	o := options{
+		header:     DefaultHeader,
+		entityType: DefaultEntityType,
+		baseURL:    DefaultBaseURL,
+		ttl:        DefaultSessionTTL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errs.New(errs.ErrInvalidOption, "The oidc issuer and client id are required")
+	}
+	if len(key) == 0 {
+		return nil, errs.New(errs.ErrInvalidOption, "The oidc sessions need a signing key")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.SubjectClaim == "" {
+		cfg.SubjectClaim = "sub"
+	}
+	return &OIDC{
+		db:         db,
+		provider:   &provider{cfg: cfg, client: o.client},
+		key:        key,
+		header:     o.header,
+		entityType: o.entityType,
+		baseURL:    o.baseURL,
+		ttl:        o.ttl,
+		provision:  o.provision,
+		passwords:  o.passwords,
+		audit:      o.audit,
+	}, nil
+}
+
+// Middleware serves the login endpoints and passes the entity of the logged
+// in requests on in the header
+//
+//	GET /admin/oidc/login?next=/admin/files/  redirects to the provider
+//	GET /admin/oidc/callback                  the provider redirects back here
+//	GET /admin/oidc/logout                    ends the session
+//
+// Navigations without a session are redirected to the login.
+func (o *OIDC) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(o.header)
+		switch r.URL.Path {
+		case o.baseURL + "/oidc/login":
+			o.login(w, r)
+			return
+		case o.baseURL + "/oidc/callback":
+			o.callback(w, r)
+			return
+		case o.baseURL + "/oidc/logout":
+			http.SetCookie(w, o.cookie(r, sessionCookie, "", -1))
+			http.Redirect(w, r, o.baseURL+"/", http.StatusFound)
+			return
+		}
+		id := o.session(r)
+		if id == "" {
+			id = o.basic(r)
+		}
+		if id != "" {
+			r.Header.Set(o.header, id)
+		} else if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") &&
+			(r.URL.Path == o.baseURL || strings.HasPrefix(r.URL.Path, o.baseURL+"/")) {
+			http.Redirect(w, r, o.baseURL+"/oidc/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// login redirects to the provider with a new state, nonce and PKCE verifier
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request) {
+	e, err := o.provider.discover()
+	if err != nil {
+		log.Println("[f8][WARNING]: Discovering the oidc provider failed", err)
+		http.Error(w, "The login provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	state, nonce, verifier := random(), random(), random()
+	nextURL := r.URL.Query().Get("next")
+	if !strings.HasPrefix(nextURL, o.baseURL+"/") || strings.HasPrefix(nextURL, "//") {
+		nextURL = o.baseURL + "/"
+	}
+	http.SetCookie(w, o.cookie(r, stateCookie, o.sign(stateCookie, state, nonce, verifier, nextURL), stateTTL))
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.provider.cfg.ClientID},
+		"redirect_uri":          {o.redirectURL(r)},
+		"scope":                 {strings.Join(o.provider.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(e.Auth, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, e.Auth+sep+q.Encode(), http.StatusFound)
+}
+
+// callback completes the login, linking or provisioning the entity of the subject
+func (o *OIDC) callback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(stateCookie)
+	var fields []string
+	if err == nil {
+		fields = o.verify(stateCookie, c.Value)
+	}
+	http.SetCookie(w, o.cookie(r, stateCookie, "", -1))
+	q := r.URL.Query()
+	if len(fields) != 4 || !hmac.Equal([]byte(fields[0]), []byte(q.Get("state"))) {
+		http.Error(w, "The login expired, log in again", http.StatusBadRequest)
+		return
+	}
+	nonce, verifier, nextURL := fields[1], fields[2], fields[3]
+	if q.Get("error") != "" {
+		http.Error(w, "The login was refused: "+q.Get("error")+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	claims, err := o.provider.exchange(q.Get("code"), verifier, o.redirectURL(r), nonce)
+	if err != nil {
+		log.Println("[f8][WARNING]: The oidc login failed", err)
+		o.record(r, audit.LoginFailed, "", nil)
+		http.Error(w, "The login failed", http.StatusUnauthorized)
+		return
+	}
+	subject := claims.String(o.provider.cfg.SubjectClaim)
+	if subject == "" {
+		log.Println("[f8][WARNING]: The oidc login has no", o.provider.cfg.SubjectClaim, "claim")
+		http.Error(w, "The login failed", http.StatusUnauthorized)
+		return
+	}
+	i, err := o.identity(subject, claims)
+	if err != nil {
+		if !errors.Is(err, errs.ErrForbidden) {
+			log.Println("[f8][WARNING]: Linking the oidc subject", subject, "failed", err)
+		}
+		o.record(r, audit.LoginFailed, subject, nil)
+		httpError(w, err)
+		return
+	}
+	http.SetCookie(w, o.cookie(r, sessionCookie,
+		o.sign(sessionCookie, i.EntityID, strconv.FormatInt(clock.Now().Add(o.ttl).Unix(), 10)), o.ttl))
+	o.record(r, audit.Login, subject, i)
+	http.Redirect(w, r, nextURL, http.StatusFound)
+}
+
+// identity returns the identity of the subject, provisioning its entity on the first login
+func (o *OIDC) identity(subject string, claims Claims) (*Identity, error) {
+	issuer := o.provider.cfg.Issuer
+	i, err := findIdentity(o.db, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		if o.provision == nil {
+			return nil, errs.New(errs.ErrForbidden, "No entity is linked to this login")
+		}
+		err = readonly.Check()
+		if err != nil {
+			return nil, err
+		}
+		id, err := o.provision(claims)
+		if err != nil {
+			return nil, err
+		}
+		i, err = Link(o.db, issuer, subject, o.entityType, id)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("[f8][oidc]: Provisioned", o.entityType, id, "for", subject)
+	}
+	if readonly.Check() == nil {
+		err = touch(o.db, i)
+		if err != nil {
+			log.Println("[f8][WARNING]: Recording the login of", i.EntityID, "failed", err)
+		}
+	}
+	return i, nil
+}
+
+// httpError writes the error of the login
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errs.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errs.ErrReadOnly):
+		readonly.SetRetryAfter(w)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "The login failed", http.StatusInternalServerError)
+	}
+}
+
+// session returns the entity of the session cookie, empty without a valid one
+func (o *OIDC) session(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	fields := o.verify(sessionCookie, c.Value)
+	if len(fields) != 2 {
+		return ""
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || clock.Now().Unix() >= expires {
+		return ""
+	}
+	return fields[0]
+}
+
+// basic returns the entity of the basic auth credentials, empty without valid ones
+func (o *OIDC) basic(r *http.Request) string {
+	if o.passwords == nil {
+		return ""
+	}
+	id, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	ok, err := o.passwords(o.entityType, id, password)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to check the password of", id, err)
+	}
+	if !ok || err != nil {
+		return ""
+	}
+	return id
+}
+
+// record records the login in the audit log if there is one
+func (o *OIDC) record(r *http.Request, action, subject string, i *Identity) {
+	if o.audit == nil {
+		return
+	}
+	e := &audit.Entry{
+		Action:   action,
+		Username: subject,
+		IP:       audit.RemoteIP(r),
+		Data:     map[string]interface{}{"via": "oidc", "issuer": o.provider.cfg.Issuer},
+	}
+	if i != nil {
+		e.ActorType, e.ActorID = i.EntityType, i.EntityID
+	}
+	err := o.audit.Record(e)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to record the", action, "of", subject, err)
+	}
+}
+
+// redirectURL the callback the provider redirects back to
+func (o *OIDC) redirectURL(r *http.Request) string {
+	if o.provider.cfg.RedirectURL != "" {
+		return o.provider.cfg.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + o.baseURL + "/oidc/callback"
+}
+
+// cookie returns the cookie of the proxy, a negative ttl deletes it
+func (o *OIDC) cookie(r *http.Request, name, value string, ttl time.Duration) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     o.baseURL,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl / time.Second),
+	}
+	if ttl < 0 {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+// sign returns the fields signed for the purpose
+func (o *OIDC) sign(purpose string, fields ...string) string {
+	for i, f := range fields {
+		fields[i] = base64.RawURLEncoding.EncodeToString([]byte(f))
+	}
+	payload := strings.Join(fields, ".")
+	return payload + "." + o.mac(purpose, payload)
+}
+
+// verify returns the fields of the value signed for the purpose, nil if it wasn't
+func (o *OIDC) verify(purpose, value string) []string {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(o.mac(purpose, value[:i]))) {
+		return nil
+	}
+	fields := strings.Split(value[:i], ".")
+	for i, f := range fields {
+		b, err := base64.RawURLEncoding.DecodeString(f)
+		if err != nil {
+			return nil
+		}
+		fields[i] = string(b)
+	}
+	return fields
+}
+
+// mac the signature of the payload for the purpose
+func (o *OIDC) mac(purpose, payload string) string {
+	m := hmac.New(sha256.New, o.key)
+	m.Write([]byte(purpose + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// random returns 32 random bytes in base64
+func random() string {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
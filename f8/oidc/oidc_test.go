@@ -0,0 +1,381 @@
+package oidc_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/oidc"
+)
+
+// provider a fake OIDC provider
+type provider struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+	// signer the key the id tokens are signed with, the published key by default
+	signer *rsa.PrivateKey
+	// claims returns the claims of the id token of the login, nil answers without one
+	claims func(nonce string) jwt.MapClaims
+	// userinfo the claims of the userinfo endpoint
+	userinfo map[string]interface{}
+	// challenges the PKCE challenges of the codes
+	challenges map[string]string
+	nonces     map[string]string
+}
+
+// newProvider starts a provider whose id tokens name the subject
+func newProvider(t *testing.T, subject string) *provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &provider{t: t, key: key, signer: key, challenges: map[string]string{}, nonces: map[string]string{}}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	p.claims = func(nonce string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": p.URL, "aud": "fate", "sub": subject, "nonce": nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "email": subject + "@example.com",
+		}
+	}
+	return p
+}
+
+func (p *provider) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/auth",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	case "/jwks":
+		e := big.NewInt(int64(p.key.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1", "kty": "RSA", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(e),
+		}}})
+	case "/token":
+		code := r.FormValue("code")
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		challenge, ok := p.challenges[code]
+		if !ok || r.FormValue("client_secret") != "secret" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		res := map[string]string{"access_token": "access-" + code}
+		if claims := p.claims(p.nonces[code]); claims != nil {
+			res["id_token"] = p.sign(claims)
+		}
+		json.NewEncoder(w).Encode(res)
+	case "/userinfo":
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer access-") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(p.userinfo)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sign returns the id token signed by the signer
+func (p *provider) sign(claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = "k1"
+	s, err := tok.SignedString(p.signer)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return s
+}
+
+// proxy the middleware in front of a handler answering with the entity it was passed
+func proxy(t *testing.T, env *fatetest.Env, p *provider, opts ...oidc.Option) http.Handler {
+	t.Helper()
+	o, err := oidc.New(env.DB, oidc.Config{Issuer: p.URL, ClientID: "fate", ClientSecret: "secret"}, []byte("key"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(oidc.DefaultHeader)))
+	}))
+}
+
+// serve makes the request with the cookies
+func serve(h http.Handler, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// login logs in at the provider, returning the response of the callback
+func login(t *testing.T, p *provider, h http.Handler, next string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(h, "/admin/oidc/login?next="+url.QueryEscape(next), nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d: %s", w.Code, w.Body)
+	}
+	auth, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := auth.Query()
+	if auth.Path != "/auth" || q.Get("client_id") != "fate" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("redirect_uri") != "http://example.com/admin/oidc/callback" {
+		t.Errorf("redirected to %s", auth)
+	}
+	p.challenges["code"], p.nonces["code"] = q.Get("code_challenge"), q.Get("nonce")
+	return serve(h, "/admin/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")), w.Result().Cookies())
+}
+
+// session returns the session cookie set by the response
+func session(w *httptest.ResponseRecorder) []*http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "fate_session" && c.MaxAge > 0 {
+			return []*http.Cookie{c}
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	env := fatetest.New(t, fatetest.Clock(c))
+	p := newProvider(t, "subject-1")
+	var provisioned []string
+	h := proxy(t, env, p, oidc.Provision(func(claims oidc.Claims) (string, error) {
+		provisioned = append(provisioned, claims.String("email"))
+		return "alice", nil
+	}))
+
+	w := serve(h, "/admin/files/", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Errorf("without a session: got %d %q", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/admin/files/", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || loc != "/admin/oidc/login?next=%2Fadmin%2Ffiles%2F" {
+		t.Errorf("a navigation without a session: got %d to %s", w.Code, loc)
+	}
+
+	w = login(t, p, h, "/admin/files/")
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || loc != "/admin/files/" {
+		t.Fatalf("callback: got %d to %s: %s", w.Code, loc, w.Body)
+	}
+	cookies := session(w)
+	if cookies == nil {
+		t.Fatal("no session cookie")
+	}
+	if len(provisioned) != 1 || provisioned[0] != "subject-1@example.com" {
+		t.Errorf("provisioned %v", provisioned)
+	}
+	if w = serve(h, "/admin/files/", cookies); w.Body.String() != "alice" {
+		t.Errorf("logged in as %q", w.Body)
+	}
+
+	// the second login finds the identity
+	if w = login(t, p, h, "/admin/"); session(w) == nil || len(provisioned) != 1 {
+		t.Errorf("the second login: got %d, provisioned %v", w.Code, provisioned)
+	}
+
+	c.Advance(oidc.DefaultSessionTTL)
+	if w = serve(h, "/admin/files/", cookies); w.Body.String() != "" {
+		t.Errorf("an expired session logged in as %q", w.Body)
+	}
+	if w = serve(h, "/admin/oidc/logout", nil); session(w) != nil || w.Result().Cookies()[0].MaxAge != -1 {
+		t.Errorf("logout kept the session: %v", w.Result().Cookies())
+	}
+}
+
+func TestSpoofing(t *testing.T) {
+	h := proxy(t, fatetest.New(t), newProvider(t, "subject-1"))
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/files/", nil)
+	r.Header.Set(oidc.DefaultHeader, "admin")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "" {
+		t.Errorf("the header of the client was passed on: %q", w.Body)
+	}
+
+	forged := []*http.Cookie{{Name: "fate_session", Value: "YWRtaW4.OTk5OTk5OTk5OQ.forged"}}
+	if w = serve(h, "/admin/files/", forged); w.Body.String() != "" {
+		t.Errorf("a forged session logged in as %q", w.Body)
+	}
+	// the state cookie isn't a session
+	w = serve(h, "/admin/oidc/login?next=/admin/", nil)
+	state := w.Result().Cookies()[0]
+	state.Name = "fate_session"
+	if w = serve(h, "/admin/files/", []*http.Cookie{state}); w.Body.String() != "" {
+		t.Errorf("the state cookie logged in as %q", w.Body)
+	}
+}
+
+func TestLoginRefused(t *testing.T) {
+	p := newProvider(t, "subject-1")
+	env := fatetest.New(t)
+	h := proxy(t, env, p)
+
+	// only the linked subjects log in without a ProvisionFunc
+	if w := login(t, p, h, "/admin/"); w.Code != http.StatusForbidden || session(w) != nil {
+		t.Errorf("an unknown subject: got %d", w.Code)
+	}
+	_, err := oidc.Link(env.DB, p.URL, "subject-1", "users", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = oidc.Link(env.DB, p.URL, "subject-1", "users", "bob"); !errors.Is(err, errs.ErrEntityExists) {
+		t.Errorf("linked twice: got %v want %v", err, errs.ErrEntityExists)
+	}
+	if w := login(t, p, h, "/admin/"); w.Code != http.StatusFound || session(w) == nil {
+		t.Fatalf("a linked subject: got %d: %s", w.Code, w.Body)
+	}
+	ids, err := oidc.Identities(env.DB, "users", "alice")
+	if err != nil || len(ids) != 1 || ids[0].LastLoginAt == nil {
+		t.Errorf("got the identities %+v: %v", ids, err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := p.claims
+	tests := map[string]func(nonce string) jwt.MapClaims{
+		"other issuer":   func(nonce string) jwt.MapClaims { c := valid(nonce); c["iss"] = "https://evil.example.com"; return c },
+		"other audience": func(nonce string) jwt.MapClaims { c := valid(nonce); c["aud"] = "other"; return c },
+		"other nonce":    func(nonce string) jwt.MapClaims { return valid("other") },
+		"expired": func(nonce string) jwt.MapClaims {
+			c := valid(nonce)
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return c
+		},
+		"never expires": func(nonce string) jwt.MapClaims { c := valid(nonce); delete(c, "exp"); return c },
+		"no subject":    func(nonce string) jwt.MapClaims { c := valid(nonce); delete(c, "sub"); return c },
+	}
+	for name, claims := range tests {
+		p.claims = claims
+		if w := login(t, p, h, "/admin/"); w.Code != http.StatusUnauthorized || session(w) != nil {
+			t.Errorf("%s: got %d", name, w.Code)
+		}
+	}
+	p.claims, p.signer = valid, other
+	if w := login(t, p, h, "/admin/"); w.Code != http.StatusUnauthorized || session(w) != nil {
+		t.Errorf("signed with another key: got %d", w.Code)
+	}
+	p.signer = p.key
+
+	// the state must be the one of the login
+	w := serve(h, "/admin/oidc/login?next=/admin/", nil)
+	if w = serve(h, "/admin/oidc/callback?code=code&state=other", w.Result().Cookies()); w.Code != http.StatusBadRequest {
+		t.Errorf("another state: got %d", w.Code)
+	}
+	if w = serve(h, "/admin/oidc/callback?code=code&state=other", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("no state cookie: got %d", w.Code)
+	}
+	// the code is useless without the verifier of the login
+	delete(p.challenges, "code")
+	w = serve(h, "/admin/oidc/login?next=/admin/", nil)
+	auth, _ := url.Parse(w.Header().Get("Location"))
+	p.challenges["code"] = "not the challenge"
+	w = serve(h, "/admin/oidc/callback?code=code&state="+url.QueryEscape(auth.Query().Get("state")), w.Result().Cookies())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("another verifier: got %d", w.Code)
+	}
+}
+
+func TestNext(t *testing.T) {
+	p := newProvider(t, "subject-1")
+	h := proxy(t, fatetest.New(t), p, oidc.Provision(func(oidc.Claims) (string, error) { return "alice", nil }))
+	for next, want := range map[string]string{
+		"/admin/files/a.txt":    "/admin/files/a.txt",
+		"//evil.example.com/":   "/admin/",
+		"https://evil.example/": "/admin/",
+		"/other/":               "/admin/",
+		"/admin":                "/admin/",
+	} {
+		if w := login(t, p, h, next); w.Header().Get("Location") != want {
+			t.Errorf("%s: redirected to %s want %s", next, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	p := newProvider(t, "")
+	p.claims = func(string) jwt.MapClaims { return nil }
+	p.userinfo = map[string]interface{}{"id": 123456789012, "login": "octocat"}
+	env := fatetest.New(t)
+	o, err := oidc.New(env.DB, oidc.Config{
+		Issuer: "https://github.com", ClientID: "fate", ClientSecret: "secret",
+		AuthURL: p.URL + "/auth", TokenURL: p.URL + "/token", UserInfoURL: p.URL + "/userinfo", SubjectClaim: "id",
+	}, []byte("key"), oidc.Provision(func(c oidc.Claims) (string, error) { return c.String("login"), nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := o.Middleware(http.NotFoundHandler())
+	if w := login(t, p, h, "/admin/"); session(w) == nil {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	ids, err := oidc.Identities(env.DB, "users", "octocat")
+	if err != nil || len(ids) != 1 || ids[0].Issuer != "https://github.com" || ids[0].Subject != "123456789012" {
+		t.Errorf("got the identities %+v: %v", ids, err)
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	h := proxy(t, fatetest.New(t), newProvider(t, "subject-1"), oidc.Passwords(func(entityType, id, password string) (bool, error) {
+		return entityType == "users" && id == "alice" && password == "correct horse", nil
+	}))
+	for _, tt := range []struct{ id, password, want string }{
+		{"alice", "correct horse", "alice"},
+		{"alice", "wrong horse", ""},
+		{"bob", "correct horse", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/api/resources/", nil)
+		r.SetBasicAuth(tt.id, tt.password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Body.String() != tt.want {
+			t.Errorf("%s %s: logged in as %q want %q", tt.id, tt.password, w.Body, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	env := fatetest.New(t)
+	for name, cfg := range map[string]oidc.Config{
+		"no issuer":    {ClientID: "fate"},
+		"no client id": {Issuer: "https://accounts.example.com"},
+	} {
+		if _, err := oidc.New(env.DB, cfg, []byte("key")); !errors.Is(err, errs.ErrInvalidOption) {
+			t.Errorf("%s: got %v want %v", name, err, errs.ErrInvalidOption)
+		}
+	}
+	if _, err := oidc.New(env.DB, oidc.Config{Issuer: "https://accounts.example.com", ClientID: "fate"}, nil); !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("no key: got %v want %v", err, errs.ErrInvalidOption)
+	}
+}
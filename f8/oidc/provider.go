@@ -0,0 +1,336 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/phanirithvij/fate/f8/clock"
+)
+
+const (
+	// maxResponse the largest provider response read
+	maxResponse = 1 << 20
+	// keysRefresh how often the keys are fetched again at most, for the tokens signed with a new one
+	keysRefresh = time.Minute
+)
+
+// Config the client registered at the provider
+//
+// Only the issuer, client id and secret are needed for the OIDC providers,
+// the endpoints are discovered. The OAuth2 only ones, eg. GitHub, set the
+// endpoints and the claim naming the user in the userinfo
+//
+//	Config{Issuer: "https://github.com", ClientID: id, ClientSecret: secret,
+//		AuthURL: "https://github.com/login/oauth/authorize",
+//		TokenURL: "https://github.com/login/oauth/access_token",
+//		UserInfoURL: "https://api.github.com/user", SubjectClaim: "id", Scopes: []string{"read:user"}}
+type Config struct {
+	// Issuer the provider, eg. https://accounts.google.com or a Keycloak realm
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL the callback registered with the client, eg.
+	// https://fate.example.com/admin/oidc/callback, the request's if empty
+	RedirectURL string
+	// Scopes requested, default openid, profile and email
+	Scopes []string
+	// AuthURL, TokenURL and UserInfoURL override the discovered endpoints
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	// SubjectClaim the claim identifying the user, default sub
+	SubjectClaim string
+}
+
+// Claims the claims of the id token, or the userinfo without one
+type Claims map[string]interface{}
+
+// String the claim as a string, numbers are formatted without an exponent
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// Bool the claim as a bool, eg. email_verified
+func (c Claims) Bool(name string) bool {
+	switch v := c[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// endpoints of the provider
+type endpoints struct {
+	Issuer   string `json:"issuer"`
+	Auth     string `json:"authorization_endpoint"`
+	Token    string `json:"token_endpoint"`
+	UserInfo string `json:"userinfo_endpoint"`
+	JWKS     string `json:"jwks_uri"`
+}
+
+// provider talks to the provider, caching its endpoints and keys
+type provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *endpoints
+	keys      map[string]interface{}
+	fetched   time.Time
+}
+
+// getJSON decodes the json response of the request into v, numbers as json.Number
+func (p *provider) getJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body := io.LimitReader(res.Body, maxResponse)
+	if res.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(body)
+		return fmt.Errorf("%s %s responded with %s %s", req.Method, req.URL.Redacted(), res.Status, strings.TrimSpace(string(data)))
+	}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// discover returns the endpoints, the configured ones over the discovered ones
+func (p *provider) discover() (*endpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	e := &endpoints{Issuer: p.cfg.Issuer}
+	if p.cfg.AuthURL == "" || p.cfg.TokenURL == "" {
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+		if err != nil {
+			return nil, err
+		}
+		err = p.getJSON(req, e)
+		if err != nil {
+			return nil, err
+		}
+		if e.Issuer != p.cfg.Issuer {
+			return nil, fmt.Errorf("The provider's issuer is %s, not %s", e.Issuer, p.cfg.Issuer)
+		}
+	}
+	for dst, v := range map[*string]string{&e.Auth: p.cfg.AuthURL, &e.Token: p.cfg.TokenURL, &e.UserInfo: p.cfg.UserInfoURL} {
+		if v != "" {
+			*dst = v
+		}
+	}
+	p.endpoints = e
+	return e, nil
+}
+
+// tokens the response of the token endpoint
+type tokens struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// exchange exchanges the code of the callback for the claims of the user
+func (p *provider) exchange(code, verifier, redirectURL, nonce string) (Claims, error) {
+	e, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	t := &tokens{}
+	err = p.getJSON(req, t)
+	if err != nil {
+		return nil, err
+	}
+	if t.Error != "" {
+		// GitHub answers errors with 200
+		return nil, fmt.Errorf("The provider refused the code: %s %s", t.Error, t.Description)
+	}
+	if t.IDToken != "" {
+		return p.verify(e, t.IDToken, nonce)
+	}
+	if e.UserInfo == "" || t.AccessToken == "" {
+		return nil, fmt.Errorf("The provider returned no id token and has no userinfo endpoint")
+	}
+	req, err = http.NewRequest(http.MethodGet, e.UserInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	claims := Claims{}
+	err = p.getJSON(req, &claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verify verifies the signature, issuer, audience, expiry and nonce of the id token
+func (p *provider) verify(e *endpoints, token, nonce string) (Claims, error) {
+	parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}, UseJSONNumber: true}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(e, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid id token: %v", err)
+	}
+	c := Claims(claims)
+	if c.String("iss") != e.Issuer {
+		return nil, fmt.Errorf("The id token was issued by %s, not %s", c.String("iss"), e.Issuer)
+	}
+	if !audience(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("The id token isn't meant for %s", p.cfg.ClientID)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("The id token never expires")
+	}
+	if c.String("nonce") != nonce {
+		return nil, fmt.Errorf("The id token was issued for another login")
+	}
+	return c, nil
+}
+
+// audience whether the aud claim, a string or a list of them, has the client id
+func audience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the public key of the provider with the id, fetching them again for new ones
+func (p *provider) key(e *endpoints, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if e.JWKS == "" {
+		return nil, fmt.Errorf("The provider publishes no keys")
+	}
+	if p.keys != nil && clock.Now().Sub(p.fetched) < keysRefresh {
+		return nil, fmt.Errorf("Unknown key %q", kid)
+	}
+	req, err := http.NewRequest(http.MethodGet, e.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = p.getJSON(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.fetched = map[string]interface{}{}, clock.Now()
+	for _, k := range set.Keys {
+		pub, err := k.public()
+		if err == nil && (k.Use == "" || k.Use == "sig") {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Unknown key %q", kid)
+}
+
+// jwk a public key of the provider
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// public the rsa or ecdsa public key
+func (k *jwk) public() (interface{}, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("Invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
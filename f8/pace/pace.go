@@ -0,0 +1,122 @@
+// Package pace throttles the background maintenance like GC and Fsck
+//
+// A Pacer lets maintenance run fast while the database and the storage
+// backend are quiet and backs off when their p95 latency rises,
+// so it never competes with production traffic at peak.
+package pace
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultMinRate the default floor of operations per second
+	DefaultMinRate = 1
+	// DefaultMaxRate the default ceiling of operations per second
+	DefaultMaxRate = 200
+	// DefaultTargetP95 the default p95 latency above which the pacer backs off
+	DefaultTargetP95 = 50 * time.Millisecond
+	// DefaultWindow the default number of latency samples kept
+	DefaultWindow = 256
+
+	// adjustEvery how often the rate is reconsidered
+	adjustEvery = time.Second
+	startKey    = "pace:start"
+)
+
+// Monitor keeps a sliding window of observed latencies
+//
+// It is safe for concurrent use
+type Monitor struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewMonitor returns a monitor keeping the last size samples
+func NewMonitor(size int) *Monitor {
+	if size <= 0 {
+		size = DefaultWindow
+	}
+	return &Monitor{samples: make([]time.Duration, size)}
+}
+
+// Observe records a latency
+func (m *Monitor) Observe(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[m.next] = d
+	m.next++
+	if m.next == len(m.samples) {
+		m.next = 0
+		m.full = true
+	}
+}
+
+// Percentile returns the q (0 to 1) percentile of the window, 0 if it's empty
+func (m *Monitor) Percentile(q float64) time.Duration {
+	m.mu.Lock()
+	n := m.next
+	if m.full {
+		n = len(m.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, m.samples[:n])
+	m.mu.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(q*float64(n)+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return sorted[i]
+}
+
+// P95 returns the 95th percentile of the window
+func (m *Monitor) P95() time.Duration {
+	return m.Percentile(0.95)
+}
+
+// Instrument times every query run through db into m
+//
+// Call it once on the production database so pacers can see its latency
+func Instrument(db *gorm.DB, m *Monitor) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(startKey, time.Now())
+	}
+	after := func(tx *gorm.DB) {
+		if v, ok := tx.InstanceGet(startKey); ok {
+			m.Observe(time.Since(v.(time.Time)))
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("*").Register("pace:before_create", before),
+		cb.Create().After("*").Register("pace:after_create", after),
+		cb.Query().Before("*").Register("pace:before_query", before),
+		cb.Query().After("*").Register("pace:after_query", after),
+		cb.Update().Before("*").Register("pace:before_update", before),
+		cb.Update().After("*").Register("pace:after_update", after),
+		cb.Delete().Before("*").Register("pace:before_delete", before),
+		cb.Delete().After("*").Register("pace:after_delete", after),
+		cb.Row().Before("*").Register("pace:before_row", before),
+		cb.Row().After("*").Register("pace:after_row", after),
+		cb.Raw().Before("*").Register("pace:before_raw", before),
+		cb.Raw().After("*").Register("pace:after_raw", after),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package pace
+
+import (
+	"sync"
+	"time"
+)
+
+// Options the knobs of a Pacer
+type Options struct {
+	// MinRate the operations per second the pacer never goes below
+	//
+	// Maintenance always makes progress even under sustained load
+	MinRate float64
+	// MaxRate the operations per second the pacer never goes above
+	MaxRate float64
+	// TargetP95 the p95 latency of the database or the backend
+	// above which the pacer backs off
+	TargetP95 time.Duration
+	// DB the production database latency, see Instrument
+	//
+	// If nil only the latency of the maintenance itself is used
+	DB *Monitor
+	// Window the number of backend latency samples kept
+	Window int
+}
+
+// Pacer limits the rate of the maintenance operations
+//
+// The rate starts at MinRate, grows additively while the observed p95
+// latencies are under TargetP95 and is halved when either goes above it.
+// A nil Pacer doesn't limit anything.
+type Pacer struct {
+	opts    Options
+	backend *Monitor
+
+	mu       sync.Mutex
+	rate     float64
+	last     time.Time
+	adjusted time.Time
+}
+
+// New returns a pacer, zero options take their defaults
+func New(opts Options) *Pacer {
+	if opts.MinRate <= 0 {
+		opts.MinRate = DefaultMinRate
+	}
+	if opts.MaxRate <= 0 {
+		opts.MaxRate = DefaultMaxRate
+	}
+	if opts.MaxRate < opts.MinRate {
+		opts.MaxRate = opts.MinRate
+	}
+	if opts.TargetP95 <= 0 {
+		opts.TargetP95 = DefaultTargetP95
+	}
+	return &Pacer{
+		opts:    opts,
+		backend: NewMonitor(opts.Window),
+		rate:    opts.MinRate,
+	}
+}
+
+// Rate the current operations per second
+func (p *Pacer) Rate() float64 {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// Observe records the backend latency of a maintenance operation
+func (p *Pacer) Observe(d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.backend.Observe(d)
+}
+
+// Wait blocks until the next operation may run
+func (p *Pacer) Wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if now.Sub(p.adjusted) >= adjustEvery {
+		p.adjust()
+		p.adjusted = now
+	}
+	next := p.last.Add(time.Duration(float64(time.Second) / p.rate))
+	if next.Before(now) {
+		next = now
+	}
+	p.last = next
+	p.mu.Unlock()
+	time.Sleep(time.Until(next))
+}
+
+// Do waits for its turn then runs fn recording how long it took
+func (p *Pacer) Do(fn func() error) error {
+	p.Wait()
+	start := time.Now()
+	err := fn()
+	p.Observe(time.Since(start))
+	return err
+}
+
+// adjust moves the rate towards what the latencies allow
+func (p *Pacer) adjust() {
+	p95 := p.backend.P95()
+	if p.opts.DB != nil {
+		if d := p.opts.DB.P95(); d > p95 {
+			p95 = d
+		}
+	}
+	if p95 > p.opts.TargetP95 {
+		p.rate /= 2
+	} else {
+		p.rate += (p.opts.MaxRate - p.opts.MinRate) / 10
+	}
+	if p.rate < p.opts.MinRate {
+		p.rate = p.opts.MinRate
+	}
+	if p.rate > p.opts.MaxRate {
+		p.rate = p.opts.MaxRate
+	}
+}
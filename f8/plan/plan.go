@@ -0,0 +1,171 @@
+// Package plan dry runs, what a migration, gc, delete or import would change
+// printed instead of applied
+//
+// The statements run in a transaction which is always rolled back so the
+// later ones see the effects of the earlier ones, the writes to the storage
+// directory are only recorded by the code checking Of.
+//
+//	p, err := plan.Run(db, func(tx *gorm.DB) error {
+//		_, err := buckets.GC(tx, storageDir, nil)
+//		return err
+//	})
+//	p.Print(os.Stdout)
+//
+// A dry run holds the locks of its writes until it's done, on sqlite
+// the whole database can't be written meanwhile.
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// settingKey the gorm setting holding the plan of a dry run
+const settingKey = "f8:plan"
+
+// The operations of the steps
+const (
+	// SQL a statement changing the database
+	SQL = "sql"
+	// Write writes a file, Target its path
+	Write = "write"
+	// Link hard links a file, Target its path and the source
+	Link = "link"
+	// Rename moves a file, Target its path and the new one
+	Rename = "rename"
+	// Mkdir creates a directory and its parents
+	Mkdir = "mkdir"
+	// Remove removes a file or an empty directory
+	Remove = "remove"
+	// RemoveAll removes a directory with everything under it
+	RemoveAll = "remove-all"
+)
+
+// Step a change of a dry run
+type Step struct {
+	Op     string `json:"op"`
+	Target string `json:"target"`
+}
+
+// Plan the steps a dry run would have taken, in order
+type Plan struct {
+	mu    sync.Mutex
+	steps []Step
+}
+
+// errRollback ends the transaction of the dry run
+var errRollback = errors.New("plan: dry run")
+
+// Run runs f in a dry run, returning the steps it would have taken
+//
+// tx is a transaction of db rolled back once f returns, its error
+// is returned along with the steps taken until then.
+// Only the statements changing the database are recorded, not the queries.
+func Run(db *gorm.DB, f func(tx *gorm.DB) error) (*Plan, error) {
+	p := &Plan{}
+	dry := db.Session(&gorm.Session{Logger: &recorder{Interface: db.Logger, plan: p}}).
+		Set(settingKey, p).Session(&gorm.Session{})
+	err := dry.Transaction(func(tx *gorm.DB) error {
+		err := f(tx)
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		err = nil
+	}
+	return p, err
+}
+
+// Of returns the plan of the dry run db belongs to, nil if it's not one
+func Of(db *gorm.DB) *Plan {
+	if db == nil {
+		return nil
+	}
+	v, ok := db.Get(settingKey)
+	if !ok {
+		return nil
+	}
+	p, _ := v.(*Plan)
+	return p
+}
+
+// Record adds a step to the plan
+func (p *Plan) Record(op, target string) {
+	p.mu.Lock()
+	p.steps = append(p.steps, Step{Op: op, Target: target})
+	p.mu.Unlock()
+}
+
+// Steps returns the steps so far
+func (p *Plan) Steps() []Step {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Step(nil), p.steps...)
+}
+
+// Count the number of steps of the operation
+func (p *Plan) Count(op string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.steps {
+		if s.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes the steps one per line, eg. to show them before a rollout
+func (p *Plan) Print(w io.Writer) {
+	steps := p.Steps()
+	if len(steps) == 0 {
+		fmt.Fprintln(w, "Nothing to do")
+		return
+	}
+	for _, s := range steps {
+		fmt.Fprintf(w, "%-10s %s\n", s.Op, s.Target)
+	}
+}
+
+// recorder a logger recording the statements changing the database
+type recorder struct {
+	logger.Interface
+	plan *Plan
+}
+
+func (r *recorder) LogMode(level logger.LogLevel) logger.Interface {
+	return &recorder{Interface: r.Interface.LogMode(level), plan: r.plan}
+}
+
+func (r *recorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, rows := fc()
+	if err == nil && changes(sql) {
+		r.plan.Record(SQL, sql)
+	}
+	r.Interface.Trace(ctx, begin, func() (string, int64) { return sql, rows }, err)
+}
+
+// changes whether the statement changes the database
+func changes(sql string) bool {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "PRAGMA", "SHOW", "EXPLAIN", "WITH",
+		"BEGIN", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE":
+		return false
+	}
+	return true
+}
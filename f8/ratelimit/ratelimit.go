@@ -0,0 +1,262 @@
+// Package ratelimit the per client ip and per user request limits of the proxy and the api
+//
+// Clients going over a limit are refused with ErrRateLimited, served as a 429
+// with Retry-After, and bodies larger than the limit with a 413
+//
+//	limits := ratelimit.New(ratelimit.Options{IPRate: 20, IPBurst: 40, MaxBodySize: 1 << 30})
+//	handler = limits.Middleware(handler)
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// sweepEvery how often the idle clients are forgotten
+const sweepEvery = time.Minute
+
+// Limiter a token bucket per key
+//
+// Every key can make burst requests at once and rate requests per second after that
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu    sync.Mutex
+	keys  map[string]*tokens
+	swept time.Time
+}
+
+type tokens struct {
+	n    float64
+	last time.Time
+}
+
+// NewLimiter returns a limiter of rate requests per second per key
+//
+// A burst under 1 is the rate rounded up
+func NewLimiter(rate float64, burst int) *Limiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Limiter{rate: rate, burst: b, keys: map[string]*tokens{}, swept: time.Now()}
+}
+
+// Allow takes a token of the key
+//
+// Returns false and how long until the next token if there's none left
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	t, ok := l.keys[key]
+	if !ok {
+		t = &tokens{n: l.burst, last: now}
+		l.keys[key] = t
+	}
+	t.n = math.Min(l.burst, t.n+now.Sub(t.last).Seconds()*l.rate)
+	t.last = now
+	if t.n >= 1 {
+		t.n--
+		return true, 0
+	}
+	return false, time.Duration((1 - t.n) / l.rate * float64(time.Second))
+}
+
+// sweep forgets the keys whose bucket has filled up again, they're the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepEvery {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, t := range l.keys {
+		if now.Sub(t.last) >= full {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// Options the limits, zero values are unlimited
+type Options struct {
+	// IPRate and IPBurst the requests per second and the burst of every client ip
+	IPRate  float64
+	IPBurst int
+	// UserRate and UserBurst the requests per second and the burst of every user
+	UserRate  float64
+	UserBurst int
+	// User returns the user making the request for Middleware, empty for anonymous requests
+	//
+	// Anonymous requests only get the ip limit
+	User func(r *http.Request) string
+	// TrustForwarded use the first X-Forwarded-For address as the client ip
+	//
+	// Only behind a proxy which sets it, the clients could otherwise pick any ip
+	TrustForwarded bool
+	// MaxBodySize the largest request body in bytes
+	MaxBodySize int64
+}
+
+// Limits the limits of a handler
+type Limits struct {
+	opts Options
+	ip   *Limiter
+	user *Limiter
+}
+
+// New returns the limits of the options
+func New(opts Options) *Limits {
+	l := &Limits{opts: opts}
+	if opts.IPRate > 0 {
+		l.ip = NewLimiter(opts.IPRate, opts.IPBurst)
+	}
+	if opts.UserRate > 0 {
+		l.user = NewLimiter(opts.UserRate, opts.UserBurst)
+	}
+	return l
+}
+
+// Error a request refused because the client went over a limit
+type Error struct {
+	// RetryAfter how long until the client can make a request again
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s, retry after %ds", errs.ErrRateLimited.Error(), retryAfter(e.RetryAfter))
+}
+
+// Unwrap returns errs.ErrRateLimited
+func (e *Error) Unwrap() error {
+	return errs.ErrRateLimited
+}
+
+// retryAfter the delay in whole seconds, at least one
+func retryAfter(d time.Duration) int {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// SetRetryAfter sets the Retry-After header if err is a rate limit *Error
+func SetRetryAfter(w http.ResponseWriter, err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(e.RetryAfter)))
+	}
+}
+
+// ClientIP the ip the request came from
+func (l *Limits) ClientIP(r *http.Request) string {
+	if l.opts.TrustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.SplitN(fwd, ",", 2)[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Allow takes a request from the budgets of the client ip and of the user
+//
+// Returns an *Error if either is used up, an empty user only has the ip one
+func (l *Limits) Allow(r *http.Request, user string) error {
+	err := l.AllowIP(r)
+	if err != nil {
+		return err
+	}
+	return l.AllowUser(user)
+}
+
+// AllowIP takes a request from the budget of the client ip
+func (l *Limits) AllowIP(r *http.Request) error {
+	if l.ip != nil {
+		if ok, wait := l.ip.Allow(l.ClientIP(r)); !ok {
+			return &Error{RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// AllowUser takes a request from the budget of the user, an empty one has none
+func (l *Limits) AllowUser(user string) error {
+	if l.user != nil && user != "" {
+		if ok, wait := l.user.Allow(user); !ok {
+			return &Error{RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// LimitBody refuses a request body over MaxBodySize
+//
+// A Content-Length over the limit fails right away with errs.ErrTooLarge,
+// other bodies fail to read with it once they go over it
+func (l *Limits) LimitBody(r *http.Request) error {
+	if l.opts.MaxBodySize <= 0 {
+		return nil
+	}
+	if r.ContentLength > l.opts.MaxBodySize {
+		return errs.TooLarge(l.opts.MaxBodySize)
+	}
+	r.Body = &body{ReadCloser: r.Body, limit: l.opts.MaxBodySize}
+	return nil
+}
+
+// body a request body failing once more than limit bytes were read
+type body struct {
+	io.ReadCloser
+	n     int64
+	limit int64
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.n > b.limit {
+		return 0, errs.TooLarge(b.limit)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.n > b.limit {
+		return n, errs.TooLarge(b.limit)
+	}
+	return n, err
+}
+
+// Middleware enforces the limits on the requests of next
+//
+// The user of the requests is found with the User option
+func (l *Limits) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := ""
+		if l.opts.User != nil {
+			user = l.opts.User(r)
+		}
+		if err := l.Allow(r, user); err != nil {
+			SetRetryAfter(w, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err := l.LimitBody(r); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,126 @@
+// Package readonly the read-only maintenance switch of the service
+//
+// While enabled reads and downloads keep working and every mutation
+// is refused with ErrReadOnly, which the api serves as a 503 with Retry-After
+//
+//	readonly.Enable("Moving to the new database", 10*time.Minute)
+//	defer readonly.Disable()
+package readonly
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+// DefaultRetryAfter how long clients are told to wait when no estimate is given
+const DefaultRetryAfter = time.Minute
+
+// State whether the service is read-only and why
+type State struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// RetryAfter the estimated time until writes work again in seconds
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Since when the service is read-only
+	Since *time.Time `json:"since,omitempty"`
+}
+
+var (
+	mu    sync.RWMutex
+	state State
+)
+
+// Enable puts the service in read-only mode
+//
+// retryAfter is what clients are told to wait, 0 for DefaultRetryAfter
+func Enable(reason string, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	since := state.Since
+	if !state.Enabled {
+		now := time.Now().UTC()
+		since = &now
+	}
+	state = State{
+		Enabled:    true,
+		Reason:     reason,
+		RetryAfter: int((retryAfter + time.Second - 1) / time.Second),
+		Since:      since,
+	}
+}
+
+// Disable makes the service writable again
+func Disable() {
+	mu.Lock()
+	state = State{}
+	mu.Unlock()
+}
+
+// Current the current state
+func Current() State {
+	mu.RLock()
+	defer mu.RUnlock()
+	return state
+}
+
+// Check returns ErrReadOnly while the service is read-only
+func Check() error {
+	s := Current()
+	if !s.Enabled {
+		return nil
+	}
+	if s.Reason == "" {
+		return &errs.Error{Kind: errs.ErrReadOnly}
+	}
+	return errs.New(errs.ErrReadOnly, s.Reason)
+}
+
+// SetRetryAfter sets the Retry-After header while the service is read-only
+func SetRetryAfter(w http.ResponseWriter) {
+	if s := Current(); s.Enabled {
+		w.Header().Set("Retry-After", strconv.Itoa(s.RetryAfter))
+	}
+}
+
+// Mutating whether requests of the method change anything
+func Mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		// PROPFIND lists the files over WebDAV
+		return false
+	}
+	return true
+}
+
+// Middleware refuses the mutating requests while the service is read-only
+//
+// Requests under the exempt path prefixes still go through, eg. logins
+func Middleware(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Mutating(r.Method) && !exempted(r.URL.Path, exempt) {
+			if err := Check(); err != nil {
+				SetRetryAfter(w)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func exempted(p string, exempt []string) bool {
+	for _, prefix := range exempt {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+// Package repository typed access to the application models embedding the BaseEntity
+//
+//	users, err := repository.New[*User](db, storage, repository.Preload("Emails"))
+//	user, err := users.Get("phano")
+//	user.Name = "Phano"
+//	err = users.Update(user)
+//
+// The returned models have their BaseEntity attached to the database and
+// the storage so their buckets can be used right away, the buckets of a
+// page are loaded in a single query. The queries failing for a transient
+// reason, eg. a dropped connection or a serialization failure, are retried,
+// see the Retry option.
+//
+// With a read replica (f8.StorageConfig.ReadDB or the Replica option) Get
+// and List read from it and the writes go to the primary, pass FromPrimary
+// to read what was just written
+//
+//	user, err := users.Get("phano", repository.FromPrimary())
+package repository
+
+import (
+	"reflect"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/retry"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Entity an application model embedding the BaseEntity, eg. a *User
+type Entity interface {
+	// GetBase returns the embedded BaseEntity
+	GetBase() *entity.BaseEntity
+	TableName() string
+}
+
+// Repository the models of type T, a pointer to a struct
+type Repository[T Entity] struct {
+	db *gorm.DB
+	// read the replica Get and List read from, nil to read from db
+	read    *gorm.DB
+	storage *f8.StorageConfig
+	table   string
+	model   reflect.Type
+	o       options
+}
+
+// Option is a functional option to the repository constructor New.
+type Option func(*options)
+type options struct {
+	preload []string
+	entity  []entity.Option
+	retry   *retry.Policy
+	replica *gorm.DB
+	primary bool
+}
+
+// Preload option loads the associations of the models, eg. "Emails"
+func Preload(associations ...string) Option {
+	return func(o *options) {
+		o.preload = append(o.preload, associations...)
+	}
+}
+
+// EntityOptions option sets the options of the BaseEntities attached to loaded models
+//
+// eg. entity.BucketLayout for the buckets created later
+func EntityOptions(opts ...entity.Option) Option {
+	return func(o *options) {
+		o.entity = append(o.entity, opts...)
+	}
+}
+
+// Retry option sets how the queries failing for a transient reason are retried,
+// default retry.Default, retry.Never to not retry them
+func Retry(p retry.Policy) Option {
+	return func(o *options) {
+		o.retry = &p
+	}
+}
+
+// Replica option reads from the replica, default the storage's ReadDB
+func Replica(db *gorm.DB) Option {
+	return func(o *options) {
+		o.replica = db
+	}
+}
+
+// PrimaryOnly option reads from the primary even if there's a replica
+func PrimaryOnly() Option {
+	return func(o *options) {
+		o.primary = true
+	}
+}
+
+// ReadOption picks the database a single Get or List reads from
+type ReadOption func(*readOptions)
+type readOptions struct {
+	primary bool
+}
+
+// FromPrimary reads from the primary, eg. right after a write the replica may not have yet
+func FromPrimary() ReadOption {
+	return func(o *readOptions) {
+		o.primary = true
+	}
+}
+
+// FromReplica reads from the replica, if there's one, even with the PrimaryOnly option
+func FromReplica() ReadOption {
+	return func(o *readOptions) {
+		o.primary = false
+	}
+}
+
+// New returns the repository of the models of type T
+func New[T Entity](db *gorm.DB, storage *f8.StorageConfig, opts ...Option) (*Repository[T], error) {
+	if db == nil {
+		return nil, errs.New(errs.ErrInvalidOption, "Must pass the gorm database instance")
+	}
+	if storage == nil {
+		return nil, errs.New(errs.ErrInvalidOption, "Must pass a storage instance")
+	}
+	model := reflect.TypeOf((*T)(nil)).Elem()
+	if model.Kind() != reflect.Ptr || model.Elem().Kind() != reflect.Struct {
+		return nil, errs.New(errs.ErrInvalidOption, "The model must be a pointer to a struct, got "+model.String())
+	}
+	r := &Repository[T]{db: db, storage: storage, model: model.Elem()}
+	for _, opt := range opts {
+		opt(&r.o)
+	}
+	if r.o.retry == nil {
+		r.o.retry = &retry.Default
+	}
+	r.read = r.o.replica
+	if r.read == nil {
+		r.read = storage.ReadDB
+	}
+	if r.read != nil {
+		// the replica sees the tenant the db is scoped to
+		if name, ok := tenant.Of(db); ok {
+			r.read = tenant.Scope(r.read, name)
+		}
+	}
+	r.table = r.alloc().TableName()
+	return r, nil
+}
+
+// alloc returns a new zero model
+func (r *Repository[T]) alloc() T {
+	return reflect.New(r.model).Interface().(T)
+}
+
+// reader returns the database the read picks
+func (r *Repository[T]) reader(opts []ReadOption) *gorm.DB {
+	o := readOptions{primary: r.o.primary}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.primary || r.read == nil {
+		return r.db
+	}
+	return r.read
+}
+
+// query returns a query of db over the models with the associations preloaded
+func (r *Repository[T]) query(db *gorm.DB) *gorm.DB {
+	tx := db.Model(r.alloc())
+	for _, assoc := range r.o.preload {
+		tx = tx.Preload(assoc)
+	}
+	return tx
+}
+
+// attach attaches the BaseEntities the models were loaded with and loads
+// their buckets from db, the one the models were read from, in one query
+//
+// The entities and the buckets write to the primary
+func (r *Repository[T]) attach(db *gorm.DB, ms ...T) error {
+	bases := make([]*entity.BaseEntity, len(ms))
+	for i, m := range ms {
+		base := m.GetBase()
+		if base == nil {
+			return errs.New(errs.ErrInvalidOption, "The BaseEntity of "+r.model.String()+" was not loaded")
+		}
+		opts := append([]entity.Option{
+			entity.TableName(r.table),
+			entity.DB(r.db),
+			entity.StorageConfig(r.storage),
+		}, r.o.entity...)
+		err := entity.Attach(base, opts...)
+		if err != nil {
+			return err
+		}
+		bases[i] = base
+	}
+	return retry.Do(*r.o.retry, func() error {
+		return entity.LoadBuckets(db, bases)
+	})
+}
+
+// Create saves a new model along with its buckets, see BaseEntity.Create
+//
+// Returns entity.ErrEntityExists if the id is taken
+func (r *Repository[T]) Create(m T) error {
+	base := m.GetBase()
+	if base == nil {
+		return errs.New(errs.ErrInvalidOption, "The model has no BaseEntity")
+	}
+	return retry.Do(*r.o.retry, func() error {
+		return base.Create(m)
+	})
+}
+
+// Get returns the model with the id
+func (r *Repository[T]) Get(id string, opts ...ReadOption) (T, error) {
+	m := r.alloc()
+	db := r.reader(opts)
+	err := retry.Do(*r.o.retry, func() error {
+		return r.query(db).Where("id = ?", id).First(m).Error
+	})
+	if err != nil {
+		var zero T
+		return zero, errs.DB(err, errs.ErrEntityNotFound)
+	}
+	err = r.attach(db, m)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return m, nil
+}
+
+// ListOptions the page of models to list
+type ListOptions struct {
+	// Limit the number of models, 0 for all
+	Limit  int
+	Offset int
+	// Order the order of the models, default "id"
+	Order string
+	// Scopes filter the models, eg. entity.WhereMetadata
+	Scopes []func(*gorm.DB) *gorm.DB
+}
+
+// List returns the models
+func (r *Repository[T]) List(opts ListOptions, read ...ReadOption) ([]T, error) {
+	if opts.Order == "" {
+		opts.Order = "id"
+	}
+	db := r.reader(read)
+	rows := reflect.New(reflect.SliceOf(reflect.PtrTo(r.model)))
+	err := retry.Do(*r.o.retry, func() error {
+		tx := r.query(db).Scopes(opts.Scopes...).Order(opts.Order).Offset(opts.Offset)
+		if opts.Limit > 0 {
+			tx = tx.Limit(opts.Limit)
+		}
+		return tx.Find(rows.Interface()).Error
+	})
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	rows = rows.Elem()
+	ms := make([]T, rows.Len())
+	for i := range ms {
+		ms[i] = rows.Index(i).Interface().(T)
+	}
+	err = r.attach(db, ms...)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Update saves all the fields of an existing model, except its associations
+//
+// Returns errs.ErrEntityNotFound if there's no such model
+func (r *Repository[T]) Update(m T) error {
+	base := m.GetBase()
+	if base == nil {
+		return errs.New(errs.ErrInvalidOption, "The model has no BaseEntity")
+	}
+	var tx *gorm.DB
+	err := retry.Do(*r.o.retry, func() error {
+		tx = r.db.Model(m).Omit(clause.Associations, "created_at").Select("*").Updates(m)
+		return tx.Error
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	if tx.RowsAffected == 0 {
+		return errs.New(errs.ErrEntityNotFound, r.table+" "+base.ID)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package repository_test
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/repository"
+	"gorm.io/gorm"
+)
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+	Name               string
+}
+
+func (user) TableName() string { return "users" }
+
+func (u *user) GetBase() *entity.BaseEntity { return u.BaseEntity }
+
+// createUser saves a user with its default bucket and the extra buckets
+func createUser(t *testing.T, env *fatetest.Env, id string, extra ...string) {
+	t.Helper()
+	e := env.Entity(t, "users", id)
+	env.Create(t, e, &user{BaseEntity: e, Name: id})
+	for _, b := range extra {
+		env.Bucket(t, e, b)
+	}
+	// loaded from the database from now on
+	entity.Forget("users", id)
+}
+
+// countBuckets counts the queries of the buckets table run on db
+func countBuckets(t *testing.T, db *gorm.DB) *int64 {
+	t.Helper()
+	n := new(int64)
+	err := db.Callback().Query().After("gorm:query").Register("test:count_buckets", func(tx *gorm.DB) {
+		if tx.Statement.Table == "buckets" {
+			atomic.AddInt64(n, 1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestList(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, env, "alice", "photos")
+	createUser(t, env, "bob")
+	createUser(t, env, "carol", "photos", "videos")
+	users, err := repository.New[*user](env.DB, env.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := countBuckets(t, env.DB)
+
+	ms, err := users.List(repository.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *queries != 1 {
+		t.Errorf("listed the buckets in %d queries want 1", *queries)
+	}
+	want := map[string]string{"alice": "default photos", "bob": "default", "carol": "default photos videos"}
+	if len(ms) != len(want) {
+		t.Fatalf("got %d users want %d", len(ms), len(want))
+	}
+	for _, m := range ms {
+		var ids []string
+		for _, b := range m.Buckets {
+			ids = append(ids, b.ID)
+			if !strings.HasPrefix(b.Dir(), env.Dir) {
+				t.Errorf("%s/%s: the bucket isn't attached to the storage", m.ID, b.ID)
+			}
+		}
+		sort.Strings(ids)
+		if got := strings.Join(ids, " "); got != want[m.ID] {
+			t.Errorf("%s: got the buckets %q want %q", m.ID, got, want[m.ID])
+		}
+		if _, ok := entity.KnownBucket("users", m.ID, "default"); ok {
+			t.Errorf("%s: List added the buckets to the bucket map", m.ID)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, env, "alice", "photos")
+	users, err := repository.New[*user](env.DB, env.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := users.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "alice" || len(m.Buckets) != 2 {
+		t.Errorf("got %s with %d buckets want alice with 2", m.Name, len(m.Buckets))
+	}
+	b, err := m.GetBucket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != "default" {
+		t.Errorf("got the default bucket %q want default", b.ID)
+	}
+	_, err = m.CreateBucket("photos")
+	if !errors.Is(err, errs.ErrBucketExists) {
+		t.Errorf("creating a loaded bucket: got %v want %v", err, errs.ErrBucketExists)
+	}
+	_, err = users.Get("nobody")
+	if !errors.Is(err, errs.ErrEntityNotFound) {
+		t.Errorf("a missing user: got %v want %v", err, errs.ErrEntityNotFound)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	replica := fatetest.New(t, fatetest.Models(&user{}))
+	createUser(t, env, "alice")
+	createUser(t, replica, "alice", "photos")
+	users, err := repository.New[*user](env.DB, env.Storage, repository.Replica(replica.DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryQueries, replicaQueries := countBuckets(t, env.DB), countBuckets(t, replica.DB)
+
+	m, err := users.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Buckets) != 2 {
+		t.Errorf("got %d buckets want the 2 of the replica", len(m.Buckets))
+	}
+	_, err = users.List(repository.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *primaryQueries != 0 || *replicaQueries != 2 {
+		t.Errorf("got %d bucket queries of the primary and %d of the replica want 0 and 2", *primaryQueries, *replicaQueries)
+	}
+
+	m, err = users.Get("alice", repository.FromPrimary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Buckets) != 1 || *primaryQueries != 1 {
+		t.Errorf("from the primary: got %d buckets in %d queries want 1 in 1", len(m.Buckets), *primaryQueries)
+	}
+}
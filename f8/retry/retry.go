@@ -0,0 +1,111 @@
+// Package retry retries the database operations failing for transient reasons
+//
+// A dropped connection, a postgres serialization failure or deadlock and a
+// busy sqlite database are worth another try, anything else isn't
+//
+//	err := retry.Do(retry.Default, func() error {
+//		return db.Transaction(...)
+//	})
+package retry
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Policy how often and how long apart an operation is tried
+type Policy struct {
+	// Attempts the number of times the operation is tried, 1 or less never retries
+	Attempts int
+	// Backoff the wait before the first retry, doubled on every retry
+	Backoff time.Duration
+	// MaxBackoff the longest wait between two attempts
+	MaxBackoff time.Duration
+}
+
+var (
+	// Default the policy of the queries, a few quick retries
+	Default = Policy{Attempts: 4, Backoff: 50 * time.Millisecond, MaxBackoff: time.Second}
+	// Connect the policy of opening the database at startup, waiting about
+	// a minute for it to come up
+	Connect = Policy{Attempts: 10, Backoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second}
+	// Never tries the operation once
+	Never = Policy{Attempts: 1}
+)
+
+// Do runs fn until it succeeds, fails for a reason which isn't transient
+// or runs out of attempts, returning its last error
+func Do(p Policy, fn func() error) error {
+	wait := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !Transient(err) {
+			return err
+		}
+		log.Println("[f8][WARNING]: Retrying after a transient database error", err)
+		// jitter so the clients failing together don't retry together
+		time.Sleep(wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1)))
+		wait *= 2
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
+
+// Transient whether the error is worth retrying
+func Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return transientCode(pgErr.Code)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return transientCode(string(pqErr.Code))
+	}
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// pgconn reports the connections it couldn't make as plain errors
+	return strings.Contains(err.Error(), "failed to connect to")
+}
+
+// transientCode whether the postgres error code is worth retrying
+//
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+func transientCode(code string) bool {
+	switch code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03", // lock_not_available
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03", // cannot_connect_now
+		"53300": // too_many_connections
+		return true
+	}
+	// connection_exception
+	return strings.HasPrefix(code, "08")
+}
@@ -0,0 +1,123 @@
+// Package roles what the entities may do besides using their own buckets
+//
+// Every entity is a User unless it was given another role
+//
+//	Admin     can access every bucket, list the entities and change the quotas
+//	User      can only access its own buckets and the ones shared with it
+//	ReadOnly  a User which can't change anything, not even its own buckets
+//	Disabled  can't log in nor access anything, its files are kept
+//
+// The roles are enforced by the api, the filebrowser proxy and the sftp
+// server through the Role of the buckets.Actor
+package roles
+
+import (
+	"errors"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Role the role of an entity
+type Role string
+
+const (
+	// Admin can access and change everything
+	Admin Role = "admin"
+	// User can access its own buckets and the ones shared with it
+	User Role = "user"
+	// ReadOnly can only read the buckets a user could
+	ReadOnly Role = "readonly"
+	// Disabled can't log in, eg. a suspended account
+	Disabled Role = "disabled"
+)
+
+// Valid whether the role is one of the known ones
+func (r Role) Valid() bool {
+	return r == Admin || r == User || r == ReadOnly || r == Disabled
+}
+
+// CanWrite whether the role may change the buckets it can access
+func (r Role) CanWrite() bool {
+	return r != ReadOnly && r != Disabled
+}
+
+// CanLogIn whether the entities of the role may log in
+func (r Role) CanLogIn() bool {
+	return r != Disabled
+}
+
+// Assignment the role of an entity, entities without one are users
+type Assignment struct {
+	EntityType string    `gorm:"primaryKey" json:"entity_type"`
+	EntityID   string    `gorm:"primaryKey" json:"entity_id"`
+	Role       Role      `gorm:"index;not null" json:"role"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName of the assignments
+func (Assignment) TableName() string {
+	return "roles"
+}
+
+// AutoMigrate creates the table of the roles
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Assignment{})
+}
+
+// Get returns the role of the entity, User if it has none
+//
+// The role comes from the cache when one is in use
+func Get(db *gorm.DB, entityType, entityID string) (Role, error) {
+	key := cacheKey(entityType, entityID)
+	var role Role
+	if cache.Load(key, &role) {
+		return role, nil
+	}
+	a := &Assignment{Role: User}
+	err := db.Where("entity_type = ? AND entity_id = ?", entityType, entityID).First(a).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errs.Wrap(errs.ErrDatabase, err)
+	}
+	cache.Store(key, a.Role)
+	return a.Role, nil
+}
+
+// cacheKey the key of the entity's role in the cache
+func cacheKey(entityType, entityID string) string {
+	return cache.Key("role", entityType, entityID)
+}
+
+// Set gives the entity the role, User removes the one it had
+func Set(db *gorm.DB, entityType, entityID string, role Role) error {
+	if !role.Valid() {
+		return errs.New(errs.ErrInvalidOption, "Unknown role "+string(role))
+	}
+	var err error
+	if role == User {
+		err = db.Where("entity_type = ? AND entity_id = ?", entityType, entityID).Delete(&Assignment{}).Error
+	} else {
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "entity_type"}, {Name: "entity_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role", "updated_at"}),
+		}).Create(&Assignment{EntityType: entityType, EntityID: entityID, Role: role}).Error
+	}
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	cache.Forget(cacheKey(entityType, entityID))
+	return nil
+}
+
+// List returns the entities given the role, eg. the admins
+func List(db *gorm.DB, role Role) (as []Assignment, err error) {
+	err = db.Where("role = ?", role).Order("entity_type, entity_id").Find(&as).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return as, nil
+}
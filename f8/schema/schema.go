@@ -0,0 +1,501 @@
+// Package schema entity types declared in a manifest instead of Go structs
+//
+// A manifest lists the entity types with their buckets, quotas, the
+// directories the buckets start with and the lifecycle rules expiring old files
+//
+//	entities:
+//	  - name: orgs
+//	    quota: 1073741824
+//	    buckets:
+//	      - name: shared
+//	        dirs: [docs, exports]
+//	      - name: public
+//	        visibility: public-read
+//	    lifecycle:
+//	      - bucket: shared
+//	        prefix: exports/
+//	        expire_days: 30
+//
+// Apply validates the manifest, creates the tables of the types and records
+// them in the registry, the types can then be created with EntityType.Create
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"github.com/phanirithvij/fate/f8/validate"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Manifest the declared entity types
+type Manifest struct {
+	Entities []*EntityType `json:"entities"`
+}
+
+// EntityType an entity type and the buckets its entities start with
+type EntityType struct {
+	// Name the table of the entities
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Layout, Quota and MaxUploadSize the defaults of the buckets
+	Layout        string `json:"layout,omitempty"`
+	Quota         int64  `json:"quota,omitempty"`
+	MaxUploadSize int64  `json:"max_upload_size,omitempty"`
+	// Buckets the buckets of new entities, a default bucket if empty
+	Buckets   []*BucketSpec `json:"buckets,omitempty"`
+	Lifecycle []*Rule       `json:"lifecycle,omitempty"`
+}
+
+// BucketSpec a bucket of the entities of a type
+type BucketSpec struct {
+	Name          string             `json:"name"`
+	Layout        string             `json:"layout,omitempty"`
+	Quota         int64              `json:"quota,omitempty"`
+	MaxUploadSize int64              `json:"max_upload_size,omitempty"`
+	Visibility    buckets.Visibility `json:"visibility,omitempty"`
+	// Dirs the directories the bucket starts with
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+// Rule a lifecycle rule removing the files not modified for ExpireDays
+type Rule struct {
+	// Bucket the bucket the rule applies to, every bucket if empty
+	Bucket string `json:"bucket,omitempty"`
+	// Prefix only the paths starting with it, eg. "tmp/"
+	Prefix     string `json:"prefix,omitempty"`
+	ExpireDays int    `json:"expire_days"`
+}
+
+// Load reads a manifest from a .json, .yaml or .yml file
+func Load(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// Parse decodes a manifest, format is json, yaml or yml
+//
+// Unknown fields are rejected so typos don't silently do nothing
+func Parse(data []byte, format string) (*Manifest, error) {
+	switch format {
+	case "json":
+	case "yaml", "yml":
+		var err error
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, errs.Wrap(errs.ErrInvalidOption, err)
+		}
+	default:
+		return nil, errs.New(errs.ErrInvalidOption, "Unknown manifest format "+format)
+	}
+	m := &Manifest{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(m)
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrInvalidOption, err)
+	}
+	return m, nil
+}
+
+// yamlToJSON converts the YAML document to JSON, decoded like the json ones
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// invalid returns an errs.ErrInvalidOption error about the type
+func invalid(t *EntityType, msg string) error {
+	return errs.New(errs.ErrInvalidOption, "Entity type "+t.Name+": "+msg)
+}
+
+// Validate checks the names, layouts and rules of every type
+func (m *Manifest) Validate() error {
+	seen := map[string]bool{}
+	for _, t := range m.Entities {
+		if t == nil {
+			return errs.New(errs.ErrInvalidOption, "Empty entity type")
+		}
+		err := validate.EntityType(t.Name)
+		if err != nil {
+			return err
+		}
+		if seen[t.Name] {
+			return invalid(t, "declared twice")
+		}
+		seen[t.Name] = true
+		err = t.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validLayout(name string) bool {
+	_, ok := buckets.LookupLayout(name)
+	return name == "" || ok
+}
+
+func (t *EntityType) validate() error {
+	if !validLayout(t.Layout) {
+		return invalid(t, "unknown layout "+t.Layout)
+	}
+	if t.Quota < 0 || t.MaxUploadSize < 0 {
+		return invalid(t, "quotas can't be negative")
+	}
+	names := map[string]bool{}
+	for _, b := range t.Buckets {
+		if b == nil {
+			return invalid(t, "empty bucket")
+		}
+		err := validate.BucketName(b.Name)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(b.Name, ".") {
+			return invalid(t, "bucket "+b.Name+" is hidden")
+		}
+		if names[b.Name] {
+			return invalid(t, "bucket "+b.Name+" declared twice")
+		}
+		names[b.Name] = true
+		if !validLayout(b.Layout) {
+			return invalid(t, "bucket "+b.Name+" has an unknown layout "+b.Layout)
+		}
+		if b.Quota < 0 || b.MaxUploadSize < 0 {
+			return invalid(t, "bucket "+b.Name+" quotas can't be negative")
+		}
+		switch b.Visibility {
+		case "", buckets.Private, buckets.Shared, buckets.PublicRead:
+		default:
+			return invalid(t, "bucket "+b.Name+" has an unknown visibility "+string(b.Visibility))
+		}
+		for _, dir := range b.Dirs {
+			err = validate.Path(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range t.Lifecycle {
+		if r == nil {
+			return invalid(t, "empty lifecycle rule")
+		}
+		if r.ExpireDays <= 0 {
+			return invalid(t, "lifecycle rules need expire_days")
+		}
+		if r.Bucket != "" && len(t.Buckets) > 0 && !names[r.Bucket] {
+			return invalid(t, "lifecycle rule of the undeclared bucket "+r.Bucket)
+		}
+	}
+	return nil
+}
+
+// Record an entity of a declared type
+//
+// The same struct is used for every type, it's stored in the type's table
+type Record struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt indexed by Apply, gorm would name the index after Record
+	// which collides across the tables
+	DeletedAt          gorm.DeletedAt
+	*entity.BaseEntity `gorm:"embedded"`
+}
+
+// row the registry entry of a type
+type row struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Name      string `gorm:"primaryKey"`
+	// Spec the type as json
+	Spec string
+}
+
+// TableName of the registry
+func (row) TableName() string {
+	return "entity_types"
+}
+
+// AutoMigrate creates the registry table
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&row{})
+}
+
+var (
+	mu    sync.RWMutex
+	types = map[string]*EntityType{}
+)
+
+// Apply validates the manifest, creates or updates the tables of its types
+// and records them in the registry
+//
+// Types missing from the manifest are left alone
+func Apply(db *gorm.DB, m *Manifest) error {
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+	err = AutoMigrate(db)
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	for _, t := range m.Entities {
+		err = db.Table(t.Name).AutoMigrate(&Record{})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		err = db.Exec("CREATE INDEX IF NOT EXISTS " + "idx_" + t.Name + "_deleted_at ON " + t.Name + " (deleted_at)").Error
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, t := range m.Entities {
+			spec, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			err = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "name"}},
+				DoUpdates: clause.AssignmentColumns([]string{"updated_at", "spec"}),
+			}).Create(&row{Name: t.Name, Spec: string(spec)}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	mu.Lock()
+	for _, t := range m.Entities {
+		types[t.Name] = t
+	}
+	mu.Unlock()
+	return nil
+}
+
+// LoadRegistered reads the applied types into the registry, eg. when a server starts
+func LoadRegistered(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&row{}) {
+		// no manifest was ever applied
+		return nil
+	}
+	var rows []row
+	err := db.Find(&rows).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	loaded := map[string]*EntityType{}
+	for _, r := range rows {
+		t := &EntityType{}
+		err = json.Unmarshal([]byte(r.Spec), t)
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		loaded[t.Name] = t
+	}
+	mu.Lock()
+	for name, t := range loaded {
+		types[name] = t
+	}
+	mu.Unlock()
+	return nil
+}
+
+// Lookup returns the registered type
+func Lookup(name string) (*EntityType, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := types[name]
+	return t, ok
+}
+
+// Types returns the registered types ordered by name
+func Types() []*EntityType {
+	mu.RLock()
+	defer mu.RUnlock()
+	ts := make([]*EntityType, 0, len(types))
+	for _, t := range types {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	return ts
+}
+
+// spec returns the declared bucket or the defaults of the type
+func (t *EntityType) spec(name string) *BucketSpec {
+	for _, b := range t.Buckets {
+		if b.Name == name {
+			return b
+		}
+	}
+	return &BucketSpec{Name: name}
+}
+
+// Create creates an entity of the type with its buckets and their directories
+//
+// An empty id generates one
+func (t *EntityType) Create(db *gorm.DB, storage *f8.StorageConfig, id string) (*Record, error) {
+	opts := []entity.Option{
+		entity.ID(id),
+		entity.TableName(t.Name),
+		entity.DB(db),
+		entity.StorageConfig(storage),
+	}
+	if len(t.Buckets) > 0 {
+		names := make([]string, len(t.Buckets))
+		for i, b := range t.Buckets {
+			names[i] = b.Name
+		}
+		opts = append(opts, entity.BucketCount(len(names)), entity.BucketNames(names))
+	}
+	base, err := entity.Entity(opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range base.Buckets {
+		spec := t.spec(b.ID)
+		b.Layout = first(spec.Layout, t.Layout, b.Layout)
+		b.Quota = firstSize(spec.Quota, t.Quota)
+		b.MaxUploadSize = firstSize(spec.MaxUploadSize, t.MaxUploadSize)
+		if spec.Visibility != "" {
+			b.Visibility = spec.Visibility
+		}
+	}
+	rec := &Record{BaseEntity: base}
+	err = base.Create(rec)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range base.Buckets {
+		for _, dir := range t.spec(b.ID).Dirs {
+			_, err = b.Mkdir(dir)
+			if err != nil {
+				return rec, err
+			}
+		}
+	}
+	return rec, nil
+}
+
+func first(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstSize(n ...int64) int64 {
+	for _, v := range n {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// ExpireReport what the lifecycle rules removed
+type ExpireReport struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// expireBatch the number of files removed per query
+const expireBatch = 100
+
+// Expire removes the files matching the lifecycle rules of the registered types
+//
+// The removed files are soft deleted, GC purges them
+func Expire(db *gorm.DB, storageDir string, p *pace.Pacer) (*ExpireReport, error) {
+	report := &ExpireReport{}
+	now := clock.Now()
+	for _, t := range Types() {
+		for _, r := range t.Lifecycle {
+			err := expire(db, storageDir, t, r, now, report, p)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+func expire(db *gorm.DB, storageDir string, t *EntityType, r *Rule, now time.Time, report *ExpireReport, p *pace.Pacer) error {
+	cutoff := now.Add(-time.Duration(r.ExpireDays) * 24 * time.Hour)
+	owners := map[[2]string]*buckets.Bucket{}
+	// failed removals are skipped so they don't come up in every batch
+	skip := 0
+	for {
+		q := db.Model(&buckets.FileDir{}).Where(
+			"entity_type = ? AND is_dir = ? AND mod_time < ?", t.Name, false, cutoff,
+		)
+		if r.Bucket != "" {
+			q = q.Where("bucket_id = ?", r.Bucket)
+		}
+		if r.Prefix != "" {
+			q = q.Where("SUBSTR(path, 1, ?) = ?", len(r.Prefix), r.Prefix)
+		}
+		var fdirs []buckets.FileDir
+		err := p.Do(func() error {
+			return q.Order("entity_id, bucket_id, path").Offset(skip).Limit(expireBatch).Find(&fdirs).Error
+		})
+		if err != nil {
+			return errs.Wrap(errs.ErrDatabase, err)
+		}
+		if len(fdirs) == 0 {
+			return nil
+		}
+		for _, f := range fdirs {
+			key := [2]string{f.EntityID, f.BucketID}
+			b, ok := owners[key]
+			if !ok {
+				b, err = buckets.Find(db, t.Name, f.EntityID, f.BucketID)
+				if err != nil {
+					log.Println("[f8][WARNING]: Lifecycle skipped", t.Name, f.EntityID, f.BucketID, f.Path, err)
+					skip++
+					continue
+				}
+				b.AttachStorage(storageDir)
+				owners[key] = b
+			}
+			err = p.Do(func() error {
+				return b.Remove(f.Path)
+			})
+			if err != nil {
+				log.Println("[f8][WARNING]: Lifecycle failed to remove", t.Name, f.EntityID, f.BucketID, f.Path, err)
+				skip++
+				continue
+			}
+			report.Files++
+			report.Bytes += f.Size
+		}
+	}
+}
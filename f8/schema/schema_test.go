@@ -0,0 +1,141 @@
+package schema_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/schema"
+)
+
+const manifestYAML = `
+entities:
+  - name: orgs
+    quota: 1073741824
+    buckets:
+      - name: shared
+        dirs: [docs, exports]
+      - name: public
+        visibility: public-read
+    lifecycle:
+      - bucket: shared
+        prefix: exports/
+        expire_days: 30
+`
+
+const manifestJSON = `{
+	"entities": [{
+		"name": "orgs",
+		"quota": 1073741824,
+		"buckets": [
+			{"name": "shared", "dirs": ["docs", "exports"]},
+			{"name": "public", "visibility": "public-read"}
+		],
+		"lifecycle": [{"bucket": "shared", "prefix": "exports/", "expire_days": 30}]
+	}]
+}`
+
+func TestParse(t *testing.T) {
+	fromYAML, err := schema.Parse([]byte(manifestYAML), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := schema.Parse([]byte(manifestJSON), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("the yaml and json manifests differ")
+	}
+	if err := fromYAML.Validate(); err != nil {
+		t.Errorf("the manifest of the docs is invalid: %v", err)
+	}
+	orgs := fromYAML.Entities[0]
+	if orgs.Name != "orgs" || orgs.Quota != 1<<30 || len(orgs.Buckets) != 2 || orgs.Lifecycle[0].ExpireDays != 30 {
+		t.Errorf("got %+v", orgs)
+	}
+	if got := orgs.Buckets[0].Dirs; !reflect.DeepEqual(got, []string{"docs", "exports"}) {
+		t.Errorf("got the dirs %q", got)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	// anchors, block scalars and comments, which a subset would miss
+	m, err := schema.Parse([]byte(`
+entities:
+  - name: teams # the teams
+    description: |
+      Shared by
+      the members
+    buckets:
+      - &files
+        name: files
+        quota: 2048
+      - <<: *files
+        name: archive
+`), "yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	teams := m.Entities[0]
+	if teams.Description != "Shared by\nthe members\n" {
+		t.Errorf("got the description %q", teams.Description)
+	}
+	if len(teams.Buckets) != 2 || teams.Buckets[1].Name != "archive" || teams.Buckets[1].Quota != 2048 {
+		t.Errorf("the alias wasn't merged: %+v", teams.Buckets[1])
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		format string
+	}{
+		{"unknown json field", `{"entities": [{"name": "orgs", "qouta": 1}]}`, "json"},
+		{"unknown yaml field", "entities:\n  - name: orgs\n    qouta: 1\n", "yaml"},
+		{"malformed json", `{"entities": [`, "json"},
+		{"malformed yaml", "entities:\n  - name: [orgs\n", "yaml"},
+		{"bad indentation", "entities:\n  - name: orgs\n   quota: 1\n", "yaml"},
+		{"wrong type", "entities:\n  - name: orgs\n    quota: lots\n", "yaml"},
+		{"non string key", "entities:\n  - name: orgs\n    1: one\n", "yaml"},
+		{"unknown format", `entities = []`, "toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := schema.Parse([]byte(tt.data), tt.format)
+			if !errors.Is(err, errs.ErrInvalidOption) {
+				t.Errorf("got %v want %v", err, errs.ErrInvalidOption)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"fate.yaml", "fate.yml", "fate.json"} {
+		data := manifestYAML
+		if filepath.Ext(name) == ".json" {
+			data = manifestJSON
+		}
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := schema.Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(m.Entities) != 1 || m.Entities[0].Name != "orgs" {
+			t.Errorf("%s: got %+v", name, m.Entities)
+		}
+	}
+	_, err := schema.Load(filepath.Join(dir, "missing.yaml"))
+	if err == nil {
+		t.Error("loaded a missing manifest")
+	}
+}
@@ -0,0 +1,156 @@
+// Package seed fills buckets with fake file trees for development
+//
+// Trees are generated from a seeded math/rand so the same seed gives the same tree
+//
+//	rng := rand.New(rand.NewSource(1))
+//	report, err := seed.Fill(b, rng, seed.Options{Files: 50})
+package seed
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+)
+
+// Options the shape of the generated trees, zero values use the defaults
+type Options struct {
+	// Files the number of files in a bucket, default 20
+	Files int
+	// MaxDepth the deepest a file is nested, default 3
+	MaxDepth int
+	// MaxSize the largest file in bytes, default 64KiB
+	MaxSize int64
+	// Age the modification times are spread over this long before now, default 1 year
+	Age time.Duration
+}
+
+func (o *Options) defaults() {
+	if o.Files <= 0 {
+		o.Files = 20
+	}
+	if o.MaxDepth <= 0 {
+		o.MaxDepth = 3
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = 64 << 10
+	}
+	if o.Age <= 0 {
+		o.Age = 365 * 24 * time.Hour
+	}
+}
+
+// Report what was generated
+type Report struct {
+	Files int
+	Bytes int64
+}
+
+var (
+	dirs = []string{
+		"documents", "photos", "music", "projects", "notes", "archive",
+		"reports", "drafts", "shared", "backups", "receipts", "travel",
+	}
+	words = []string{
+		"alpha", "budget", "cat", "draft", "final", "holiday", "invoice", "lecture",
+		"meeting", "notes", "plan", "recipe", "resume", "scan", "summary", "todo",
+	}
+	exts = []string{".txt", ".md", ".json", ".csv", ".log", ".png", ".jpg", ".pdf", ".bin"}
+
+	firstNames = []string{
+		"Ada", "Alan", "Barbara", "Dennis", "Edsger", "Frances", "Grace", "Joan",
+		"Ken", "Linus", "Margaret", "Niklaus", "Radia", "Rob", "Sophie", "Tim",
+	}
+	lastNames = []string{
+		"Allen", "Berners", "Dijkstra", "Hamilton", "Hopper", "Kernighan", "Liskov", "Lovelace",
+		"Perlman", "Pike", "Ritchie", "Thompson", "Torvalds", "Turing", "Wilson", "Wirth",
+	}
+)
+
+func pick(rng *rand.Rand, s []string) string {
+	return s[rng.Intn(len(s))]
+}
+
+// Name a fake full name
+func Name(rng *rand.Rand) string {
+	return pick(rng, firstNames) + " " + pick(rng, lastNames)
+}
+
+// Email a fake email for the name
+func Email(rng *rand.Rand, name string) string {
+	local := strings.ToLower(strings.Replace(name, " ", ".", -1))
+	return local + strconv.Itoa(rng.Intn(1000)) + "@example.com"
+}
+
+// Path a fake slash separated file path at most maxDepth directories deep
+func Path(rng *rand.Rand, maxDepth int) string {
+	elems := []string{}
+	for i := rng.Intn(maxDepth + 1); i > 0; i-- {
+		elems = append(elems, pick(rng, dirs))
+	}
+	name := pick(rng, words) + "-" + strconv.Itoa(rng.Intn(10000)) + pick(rng, exts)
+	return path.Join(append(elems, name)...)
+}
+
+// content the fake contents of a file, text for the text extensions
+type content struct {
+	rng  *rand.Rand
+	n    int64
+	text bool
+}
+
+func (c *content) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	if c.text {
+		for i := range p {
+			if c.rng.Intn(8) == 0 {
+				p[i] = ' '
+			} else {
+				p[i] = byte('a' + c.rng.Intn(26))
+			}
+		}
+	} else {
+		c.rng.Read(p)
+	}
+	c.n -= int64(len(p))
+	return len(p), nil
+}
+
+func isText(p string) bool {
+	switch path.Ext(p) {
+	case ".txt", ".md", ".csv", ".log":
+		return true
+	}
+	return false
+}
+
+// Fill writes a random file tree to the bucket
+//
+// Paths that are generated twice overwrite the earlier file
+func Fill(b *buckets.Bucket, rng *rand.Rand, opts Options) (*Report, error) {
+	opts.defaults()
+	report := &Report{}
+	now := time.Now()
+	for i := 0; i < opts.Files; i++ {
+		p := Path(rng, opts.MaxDepth)
+		size := rng.Int63n(opts.MaxSize + 1)
+		modTime := now.Add(-time.Duration(rng.Int63n(int64(opts.Age))))
+		fdir, err := b.WriteFileInfo(p, &content{rng: rng, n: size, text: isText(p)}, os.FileMode(0644), modTime)
+		if err != nil {
+			return report, err
+		}
+		report.Files++
+		report.Bytes += fdir.Size
+	}
+	return report, nil
+}
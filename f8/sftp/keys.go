@@ -0,0 +1,99 @@
+package sftp
+
+import (
+	"strings"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// Key a public key an entity logs in with
+type Key struct {
+	// Fingerprint the SHA256 fingerprint of the key, eg. SHA256:...
+	Fingerprint string    `gorm:"primaryKey" json:"fingerprint"`
+	EntityType  string    `gorm:"index:ssh_key_entity_idx;not null" json:"entity_type"`
+	EntityID    string    `gorm:"index:ssh_key_entity_idx;not null" json:"entity_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Key the key in the authorized_keys format, without the comment
+	Key string `gorm:"not null" json:"key"`
+	// Comment the comment of the authorized_keys line, eg. user@host
+	Comment string `json:"comment,omitempty"`
+}
+
+// TableName of the keys
+func (Key) TableName() string {
+	return "ssh_keys"
+}
+
+// AutoMigrate creates the table of the keys
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Key{})
+}
+
+// AddKey lets the entity log in with the public key of the authorized_keys line
+//
+// A key can only belong to one entity, adding it again returns errs.ErrEntityExists
+func AddKey(db *gorm.DB, entityType, entityID, line string) (*Key, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, errs.New(errs.ErrInvalidOption, "Invalid public key: "+err.Error())
+	}
+	k := &Key{
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		EntityType:  entityType,
+		EntityID:    entityID,
+		CreatedAt:   clock.Now(),
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		Comment:     comment,
+	}
+	var n int64
+	err = db.Model(&Key{}).Where("fingerprint = ?", k.Fingerprint).Count(&n).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	if n > 0 {
+		return nil, errs.New(errs.ErrEntityExists, "Key "+k.Fingerprint+" is already added")
+	}
+	err = db.Create(k).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return k, nil
+}
+
+// Keys returns the keys of the entity, oldest first
+func Keys(db *gorm.DB, entityType, entityID string) ([]Key, error) {
+	keys := []Key{}
+	err := db.Where("entity_type = ? AND entity_id = ?", entityType, entityID).
+		Order("created_at, fingerprint").Find(&keys).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return keys, nil
+}
+
+// RemoveKey removes the key of the entity with the fingerprint
+func RemoveKey(db *gorm.DB, entityType, entityID, fingerprint string) error {
+	tx := db.Where("entity_type = ? AND entity_id = ? AND fingerprint = ?", entityType, entityID, fingerprint).Delete(&Key{})
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if tx.RowsAffected == 0 {
+		return errs.New(errs.ErrEntityNotFound, "No key "+fingerprint)
+	}
+	return nil
+}
+
+// findKey returns the key with the fingerprint of pub if it belongs to the entity
+func findKey(db *gorm.DB, entityType, entityID string, pub ssh.PublicKey) (*Key, error) {
+	k := &Key{}
+	tx := db.Where("entity_type = ? AND entity_id = ? AND fingerprint = ?",
+		entityType, entityID, ssh.FingerprintSHA256(pub)).First(k)
+	if tx.Error != nil {
+		return nil, errs.DB(tx.Error, errs.ErrEntityNotFound)
+	}
+	return k, nil
+}
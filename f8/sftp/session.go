@@ -0,0 +1,592 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"github.com/pkg/sftp"
+)
+
+// tempPrefix the prefix of the temp objects of the uploads
+const tempPrefix = "sftp-"
+
+// errUnsupported a request the server doesn't implement, eg. hard links
+var errUnsupported = errors.New("Operation unsupported")
+
+// session the sftp.Handlers of the buckets of an actor
+//
+// Its root is virtual, the buckets of the actor are its directories.
+// The paths of the requests are already clean and absolute.
+type session struct {
+	s     *Server
+	actor *buckets.Actor
+	ip    string
+
+	mu sync.Mutex
+	// uploads the files open for writing by path, fstat sees their size so far
+	uploads map[string]*upload
+}
+
+func newSession(s *Server, actor *buckets.Actor, ip string) *session {
+	return &session{s: s, actor: actor, ip: ip, uploads: map[string]*upload{}}
+}
+
+// handlers the handlers of the request server
+func (s *session) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: s, FilePut: s, FileCmd: s, FileList: s}
+}
+
+// fileInfo the os.FileInfo of a FileDir row
+type fileInfo struct {
+	*buckets.FileDir
+}
+
+func (fi *fileInfo) Name() string       { return fi.FileDir.Name }
+func (fi *fileInfo) Size() int64        { return fi.FileDir.Size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.FileDir.Mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.FileDir.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.FileDir.IsDir }
+func (fi *fileInfo) Sys() interface{}   { return fi.FileDir }
+
+// dirInfo the fileInfo of the root or of a bucket
+func dirInfo(name string, modTime time.Time) *fileInfo {
+	return &fileInfo{FileDir: &buckets.FileDir{
+		Name:    name,
+		Mode:    os.ModeDir | 0766,
+		ModTime: modTime,
+		IsDir:   true,
+	}}
+}
+
+// listing the entries of a directory, or the single result of a stat
+type listing []os.FileInfo
+
+// ListAt implements sftp.ListerAt
+func (l listing) ListAt(ls []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[off:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fxError the error sent back to the client, with the status code of the errs error
+func fxError(err error) error {
+	switch {
+	case err == nil, err == io.EOF:
+		return err
+	case errors.Is(err, errs.ErrFileNotFound), errors.Is(err, errs.ErrBucketNotFound):
+		return sftp.ErrSSHFxNoSuchFile
+	case errors.Is(err, errs.ErrForbidden), errors.Is(err, errs.ErrReadOnly):
+		return sftp.ErrSSHFxPermissionDenied
+	case errors.Is(err, errUnsupported):
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return err
+}
+
+// resolve returns the bucket of the path and the path in it, the bucket is nil for the root
+func (s *session) resolve(name string) (*buckets.Bucket, string, error) {
+	abs := path.Clean("/" + name)
+	if abs == "/" {
+		return nil, "", nil
+	}
+	parts := strings.SplitN(abs[1:], "/", 2)
+	if strings.HasPrefix(parts[0], ".") {
+		return nil, "", errs.New(errs.ErrBucketNotFound, "No bucket "+parts[0])
+	}
+	b, err := buckets.Find(s.s.db, s.actor.Type, s.actor.ID, parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	b.AttachStorage(s.s.storageDir)
+	b.AttachOrigin(s.actor, s.ip)
+	if len(parts) == 1 {
+		return b, "", nil
+	}
+	return b, parts[1], nil
+}
+
+// lookup returns the bucket of the path and its fileInfo
+func (s *session) lookup(name string) (*buckets.Bucket, *fileInfo, error) {
+	b, rel, err := s.resolve(name)
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case b == nil:
+		return nil, dirInfo("/", clock.Now()), nil
+	case rel == "":
+		return b, dirInfo(b.ID, b.UpdatedAt), nil
+	}
+	fdir, err := b.Stat(rel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, &fileInfo{FileDir: fdir}, nil
+}
+
+// writable resolves the path of a change, neither the root nor the buckets can change
+func (s *session) writable(name string) (*buckets.Bucket, string, error) {
+	err := readonly.Check()
+	if err != nil {
+		return nil, "", err
+	}
+	b, rel, err := s.resolve(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if rel == "" {
+		return nil, "", errs.New(errs.ErrForbidden, "Buckets can't be changed over sftp")
+	}
+	err = b.Authorize(s.actor, buckets.Writer)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, rel, nil
+}
+
+// parentExists returns an error unless the parent directory of rel exists
+func parentExists(b *buckets.Bucket, rel string) error {
+	dir := path.Dir("/" + rel)
+	if dir == "/" {
+		return nil
+	}
+	fdir, err := b.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fdir.IsDir {
+		return errs.New(errs.ErrInvalidPath, fdir.Path+" is not a directory")
+	}
+	return nil
+}
+
+// download a file open for reading, the bytes read are counted on close
+type download struct {
+	s    *session
+	b    *buckets.Bucket
+	rel  string
+	f    *os.File
+	read int64
+}
+
+// ReadAt reads the file, the request server reads concurrently
+func (d *download) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.f.ReadAt(p, off)
+	atomic.AddInt64(&d.read, int64(n))
+	if err != nil && err != io.EOF {
+		err = errs.FS(err)
+	}
+	return n, err
+}
+
+// Close closes the file and records the download
+func (d *download) Close() error {
+	d.f.Close()
+	read := atomic.LoadInt64(&d.read)
+	if read == 0 {
+		return nil
+	}
+	d.b.CountDownload(read)
+	d.s.s.record(&audit.Entry{
+		Action:     audit.Download,
+		ActorType:  d.s.actor.Type,
+		ActorID:    d.s.actor.ID,
+		IP:         d.s.ip,
+		EntityType: d.b.EntityType,
+		EntityID:   d.b.EntityID,
+		BucketID:   d.b.ID,
+		Path:       d.rel,
+		Data:       map[string]interface{}{"size": read, "via": "sftp"},
+	})
+	return nil
+}
+
+// upload a file open for writing, the writes go to a temp object promoted to it on close
+type upload struct {
+	s    *session
+	name string
+	b    *buckets.Bucket
+	rel  string
+
+	mu     sync.Mutex
+	temp   *buckets.Temp
+	append bool
+	info   *fileInfo
+	// failed the error of a write or of the transfer, the upload is discarded on close
+	failed error
+}
+
+// WriteAt writes at the offset, at the end of the file when appending
+func (u *upload) WriteAt(p []byte, off int64) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed != nil {
+		return 0, fxError(u.failed)
+	}
+	if u.append {
+		off = u.info.FileDir.Size
+	}
+	n, err := u.temp.WriteAt(p, off)
+	if end := off + int64(n); end > u.info.FileDir.Size {
+		u.info.FileDir.Size = end
+	}
+	if err != nil {
+		u.failed = err
+	}
+	return n, fxError(err)
+}
+
+// TransferError implements sftp.TransferError, the upload is discarded
+func (u *upload) TransferError(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed == nil {
+		u.failed = err
+	}
+}
+
+// Close replaces the file with the temp object unless a write failed
+func (u *upload) Close() error {
+	u.s.mu.Lock()
+	if u.s.uploads[u.name] == u {
+		delete(u.s.uploads, u.name)
+	}
+	u.s.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed != nil {
+		u.temp.Discard()
+		return fxError(u.failed)
+	}
+	_, err := u.temp.Promote(u.rel)
+	if err != nil {
+		u.temp.Discard()
+		return fxError(err)
+	}
+	return nil
+}
+
+// uploading the fileInfo of the upload open at the path if there is one
+func (s *session) uploading(name string) (*fileInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[name]
+	if !ok {
+		return nil, false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fdir := *u.info.FileDir
+	return &fileInfo{FileDir: &fdir}, true
+}
+
+// Fileread opens a file for reading
+func (s *session) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	b, info, err := s.lookup(r.Filepath)
+	if err != nil {
+		return nil, fxError(err)
+	}
+	if info.IsDir() {
+		return nil, errs.ErrIsDir
+	}
+	f, err := b.Open(info.Path)
+	if err != nil {
+		return nil, fxError(err)
+	}
+	return &download{s: s, b: b, rel: info.Path, f: f}, nil
+}
+
+// Filewrite opens the file for writing, the writes go to a temp object
+//
+// Without the truncate flag the temp object starts with the contents of the file
+func (s *session) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	u, err := s.create(r.Filepath, r.Pflags())
+	if err != nil {
+		return nil, fxError(err)
+	}
+	s.mu.Lock()
+	s.uploads[u.name] = u
+	s.mu.Unlock()
+	return u, nil
+}
+
+func (s *session) create(name string, flags sftp.FileOpenFlags) (*upload, error) {
+	b, rel, err := s.writable(name)
+	if err != nil {
+		return nil, err
+	}
+	fdir, err := b.Stat(rel)
+	exists := err == nil
+	switch {
+	case err != nil && !errors.Is(err, errs.ErrFileNotFound):
+		return nil, err
+	case exists && fdir.IsDir:
+		return nil, errs.ErrIsDir
+	case exists && flags.Creat && flags.Excl:
+		return nil, errs.New(errs.ErrFileExists, fdir.Path+" already exists")
+	case !exists && !flags.Creat:
+		return nil, err
+	}
+	err = parentExists(b, rel)
+	if err != nil {
+		return nil, err
+	}
+	t, err := b.CreateTemp(tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{
+		s:      s,
+		name:   name,
+		b:      b,
+		rel:    rel,
+		temp:   t,
+		append: flags.Append,
+		info: &fileInfo{FileDir: &buckets.FileDir{
+			Name:    path.Base(rel),
+			Path:    strings.Trim(rel, "/"),
+			Mode:    0766,
+			ModTime: clock.Now(),
+		}},
+	}
+	if exists && !flags.Trunc {
+		f, err := b.Open(rel)
+		if err != nil {
+			t.Discard()
+			return nil, err
+		}
+		u.info.FileDir.Size, err = io.Copy(t, f)
+		f.Close()
+		if err != nil {
+			t.Discard()
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// Filecmd runs the changes, the times and permissions of setstat are not kept
+func (s *session) Filecmd(r *sftp.Request) error {
+	var err error
+	switch r.Method {
+	case "Setstat":
+		// only the file has to exist
+		if _, ok := s.uploading(r.Filepath); ok {
+			return nil
+		}
+		_, _, err = s.lookup(r.Filepath)
+	case "Rename", "PosixRename":
+		err = s.rename(r.Filepath, r.Target)
+	case "Rmdir":
+		err = s.rmdir(r.Filepath)
+	case "Mkdir":
+		err = s.mkdir(r.Filepath)
+	case "Remove":
+		err = s.remove(r.Filepath)
+	case "Symlink":
+		// the target is the path and the link the target of the request
+		err = s.symlink(r.Filepath, r.Target)
+	default:
+		err = errUnsupported
+	}
+	return fxError(err)
+}
+
+// remove removes the file, directories are removed with rmdir
+func (s *session) remove(name string) error {
+	b, rel, err := s.writable(name)
+	if err != nil {
+		return err
+	}
+	fdir, err := b.Stat(rel)
+	if err != nil {
+		return err
+	}
+	if fdir.IsDir {
+		return errs.ErrIsDir
+	}
+	return b.Remove(rel)
+}
+
+// mkdir creates the directory, its parent must exist
+func (s *session) mkdir(name string) error {
+	b, rel, err := s.writable(name)
+	if err != nil {
+		return err
+	}
+	_, err = b.Stat(rel)
+	if err == nil {
+		return errs.New(errs.ErrFileExists, rel+" already exists")
+	}
+	if !errors.Is(err, errs.ErrFileNotFound) {
+		return err
+	}
+	err = parentExists(b, rel)
+	if err != nil {
+		return err
+	}
+	_, err = b.Mkdir(rel)
+	return err
+}
+
+// rmdir removes the directory if it's empty
+func (s *session) rmdir(name string) error {
+	b, rel, err := s.writable(name)
+	if err != nil {
+		return err
+	}
+	children, err := b.ReadDir(rel)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return errs.New(errs.ErrInvalidPath, "Directory "+rel+" is not empty")
+	}
+	return b.Remove(rel)
+}
+
+// symlink creates a symlink in a bucket to a path of the same bucket, see buckets.Bucket.Symlink
+func (s *session) symlink(target, name string) error {
+	b, rel, err := s.writable(name)
+	if err != nil {
+		return err
+	}
+	tb, trel, err := s.resolve(target)
+	if err != nil {
+		return err
+	}
+	if tb == nil || tb.ID != b.ID || trel == "" {
+		return errs.Wrap(errUnsupported, errors.New("Links can't point outside of their bucket"))
+	}
+	err = parentExists(b, rel)
+	if err != nil {
+		return err
+	}
+	_, err = b.Symlink("/"+trel, rel)
+	return err
+}
+
+// rename moves the file or directory within its bucket, see buckets.Bucket.Move
+func (s *session) rename(oldName, newName string) error {
+	from, oldRel, err := s.writable(oldName)
+	if err != nil {
+		return err
+	}
+	to, newRel, err := s.writable(newName)
+	if err != nil {
+		return err
+	}
+	if from.ID != to.ID {
+		return errs.Wrap(errUnsupported, errors.New("Files can't be moved between buckets"))
+	}
+	_, err = from.Move(oldRel, newRel)
+	return err
+}
+
+// Filelist lists the directories, stats the paths and reads the links
+func (s *session) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	var l listing
+	var err error
+	switch r.Method {
+	case "List":
+		l, err = s.list(r.Filepath)
+	case "Stat":
+		l, err = s.stat(r.Filepath, true)
+	case "Readlink":
+		l, err = s.readlink(r.Filepath)
+	default:
+		err = errUnsupported
+	}
+	return l, fxError(err)
+}
+
+// Lstat implements sftp.LstatFileLister, the symlinks are not followed
+func (s *session) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	l, err := s.stat(r.Filepath, false)
+	return l, fxError(err)
+}
+
+// stat returns the attributes of the path, of the file a symlink points
+// to if follow and the bucket follows its links
+//
+// The files being uploaded have the size written so far
+func (s *session) stat(name string, follow bool) (listing, error) {
+	if info, ok := s.uploading(name); ok {
+		return listing{info}, nil
+	}
+	b, info, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if follow && info.FileDir.IsSymlink() && b.LinkPolicy() == buckets.LinksFollow {
+		fdir, err := b.Resolve(info.FileDir.Path)
+		if err != nil {
+			return nil, err
+		}
+		info = &fileInfo{FileDir: fdir}
+	}
+	return listing{info}, nil
+}
+
+// list lists the directory, the root lists the buckets of the actor
+func (s *session) list(name string) (listing, error) {
+	b, info, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errs.New(errs.ErrInvalidPath, name+" is not a directory")
+	}
+	var l listing
+	if b == nil {
+		bucks, err := buckets.Owned(s.s.db, s.actor.Type, s.actor.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bucks {
+			if !b.Hidden() {
+				l = append(l, dirInfo(b.ID, b.UpdatedAt))
+			}
+		}
+		return l, nil
+	}
+	fdirs, err := b.ReadDir(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fdirs {
+		l = append(l, &fileInfo{FileDir: &fdirs[i]})
+	}
+	return l, nil
+}
+
+// readlink returns the target of the symlink as an absolute path of the session
+func (s *session) readlink(name string) (listing, error) {
+	b, rel, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil || rel == "" {
+		return nil, errs.New(errs.ErrInvalidPath, "Not a link")
+	}
+	target, err := b.Readlink(rel)
+	if err != nil {
+		return nil, err
+	}
+	return listing{&fileInfo{FileDir: &buckets.FileDir{Name: "/" + b.ID + "/" + target}}}, nil
+}
@@ -0,0 +1,284 @@
+// Package sftp serves the buckets of the entities over SFTP
+//
+// An entity logs in with its id as the username and one of its public
+// keys, see AddKey, or a password when the server checks them. Each
+// session only sees the buckets of the entity, as the directories of
+// its root, and the transfers go through the buckets so the files are
+// recorded, counted and audited like the uploads of the api.
+//
+//	key, err := sftp.LoadHostKey("fate_host_key")
+//	srv, err := sftp.New(db, storageDir, sftp.HostKey(key), sftp.Audit(auditLog))
+//	err = srv.ListenAndServe(":2022")
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// DefaultEntityType the type of the entities logging in
+const DefaultEntityType = "users"
+
+// PasswordFunc checks the password of the entity
+type PasswordFunc func(entityType, entityID, password string) (bool, error)
+
+// Server the sftp server of the buckets
+type Server struct {
+	db         *gorm.DB
+	storageDir string
+	hostKeys   []ssh.Signer
+	entityType string
+	passwords  PasswordFunc
+	audit      *audit.Log
+}
+
+// Option is a functional option to the server constructor New.
+type Option func(*options)
+type options struct {
+	hostKeys   []ssh.Signer
+	entityType string
+	passwords  PasswordFunc
+	audit      *audit.Log
+}
+
+// HostKey option adds a host key the server identifies with, at least one is needed
+func HostKey(key ssh.Signer) Option {
+	return func(o *options) {
+		o.hostKeys = append(o.hostKeys, key)
+	}
+}
+
+// EntityType option sets the type of the entities logging in, default DefaultEntityType
+func EntityType(entityType string) Option {
+	return func(o *options) {
+		o.entityType = entityType
+	}
+}
+
+// Passwords option lets the entities log in with a password checked by check
+//
+// By default only public keys are accepted
+func Passwords(check PasswordFunc) Option {
+	return func(o *options) {
+		o.passwords = check
+	}
+}
+
+// Audit option records the logins and the downloads in the audit log
+//
+// The uploads and removals are recorded from the file events like the api's
+func Audit(l *audit.Log) Option {
+	return func(o *options) {
+		o.audit = l
+	}
+}
+
+// New returns the sftp server of the buckets under the storage directory
+func New(db *gorm.DB, storageDir string, opts ...Option) (*Server, error) {
+	o := options{entityType: DefaultEntityType}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.hostKeys) == 0 {
+		return nil, errs.New(errs.ErrInvalidOption, "The sftp server needs a host key")
+	}
+	return &Server{
+		db:         db,
+		storageDir: storageDir,
+		hostKeys:   o.hostKeys,
+		entityType: o.entityType,
+		passwords:  o.passwords,
+		audit:      o.audit,
+	}, nil
+}
+
+// LoadHostKey reads the private host key at path, generating an ed25519 key there if it's missing
+func LoadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			return nil, errs.FS(err)
+		}
+		log.Println("[f8][sftp]: Generated the host key", path)
+	} else if err != nil {
+		return nil, errs.FS(err)
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// ListenAndServe listens on the tcp address and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections accepted by the listener until it fails
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+// exists whether the entity logging in is in its table
+func (s *Server) exists(entityID string) bool {
+	ok, err := buckets.OwnerExists(s.db, s.entityType, entityID)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to look up", s.entityType, entityID, err)
+		return false
+	}
+	return ok
+}
+
+// config the ssh config of a connection, the usernames tried are passed to attempt
+func (s *Server) config(attempt func(username string)) *ssh.ServerConfig {
+	c := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			attempt(conn.User())
+			if !s.exists(conn.User()) {
+				return nil, errs.ErrUnauthenticated
+			}
+			k, err := findKey(s.db, s.entityType, conn.User(), pub)
+			if err != nil {
+				return nil, errs.ErrUnauthenticated
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"method": "publickey", "key": k.Fingerprint}}, nil
+		},
+	}
+	if s.passwords != nil {
+		c.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			attempt(conn.User())
+			if !s.exists(conn.User()) {
+				return nil, errs.ErrUnauthenticated
+			}
+			ok, err := s.passwords(s.entityType, conn.User(), string(password))
+			if err != nil {
+				log.Println("[f8][WARNING]: Failed to check the password of", conn.User(), err)
+			}
+			if !ok || err != nil {
+				return nil, errs.ErrUnauthenticated
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"method": "password"}}, nil
+		}
+	}
+	for _, k := range s.hostKeys {
+		c.AddHostKey(k)
+	}
+	return c
+}
+
+// record records the entry in the audit log if there is one
+func (s *Server) record(e *audit.Entry) {
+	if s.audit == nil {
+		return
+	}
+	err := s.audit.Record(e)
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to record the", e.Action, "of", e.Username, err)
+	}
+}
+
+// serveConn authenticates the connection and serves the sftp subsystem of its sessions
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	ip, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	username := ""
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config(func(u string) { username = u }))
+	if err != nil {
+		if username != "" {
+			s.record(&audit.Entry{Action: audit.LoginFailed, Username: username, IP: ip, Data: map[string]interface{}{"via": "sftp"}})
+		}
+		return
+	}
+	defer conn.Close()
+	role, err := roles.Get(s.db, s.entityType, conn.User())
+	if err != nil {
+		log.Println("[f8][WARNING]: Failed to get the role of", conn.User(), err)
+		return
+	}
+	if !role.CanLogIn() {
+		s.record(&audit.Entry{Action: audit.LoginFailed, Username: conn.User(), IP: ip, Data: map[string]interface{}{"via": "sftp", "reason": "disabled"}})
+		return
+	}
+	actor := &buckets.Actor{Type: s.entityType, ID: conn.User(), Role: role}
+	s.record(&audit.Entry{
+		Action:     audit.Login,
+		ActorType:  actor.Type,
+		ActorID:    actor.ID,
+		Username:   conn.User(),
+		IP:         ip,
+		EntityType: actor.Type,
+		EntityID:   actor.ID,
+		Data:       map[string]interface{}{"via": "sftp", "method": conn.Permissions.Extensions["method"]},
+	})
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			log.Println("[f8][WARNING]: Failed to accept the sftp session of", actor.ID, err)
+			continue
+		}
+		go s.serveChannel(ch, requests, actor, ip)
+	}
+}
+
+// serveChannel starts the sftp subsystem when the session asks for it, there are no shells
+func (s *Server) serveChannel(ch ssh.Channel, requests <-chan *ssh.Request, actor *buckets.Actor, ip string) {
+	defer ch.Close()
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		srv := sftp.NewRequestServer(ch, newSession(s, actor, ip).handlers())
+		err := srv.Serve()
+		if err != nil && err != io.EOF {
+			log.Println("[f8][sftp]: Session of", actor.ID, "ended", err)
+		}
+		ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+		return
+	}
+}
@@ -0,0 +1,548 @@
+package sftp_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/sftp"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+	Name               string
+}
+
+// server an sftp server of the users of an env
+type server struct {
+	env  *fatetest.Env
+	addr string
+}
+
+// newServer serves the env over sftp on a local port until the test ends
+func newServer(t *testing.T, env *fatetest.Env) *server {
+	t.Helper()
+	err := sftp.AutoMigrate(env.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := sftp.New(env.DB, env.Dir, sftp.HostKey(newSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Serve(l)
+	return &server{env: env, addr: l.Addr().String()}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// createUser saves a user with its default bucket and the extra buckets, it logs in with the returned key
+func (s *server) createUser(t *testing.T, id string, extra ...string) (*entity.BaseEntity, ssh.Signer) {
+	t.Helper()
+	e := s.env.Entity(t, "users", id)
+	s.env.Create(t, e, &user{BaseEntity: e, Name: id})
+	for _, b := range extra {
+		s.env.Bucket(t, e, b)
+	}
+	key := newSigner(t)
+	_, err := sftp.AddKey(s.env.DB, "users", id, string(ssh.MarshalAuthorizedKey(key.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, key
+}
+
+func (s *server) dial(id string, key ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.addr, &ssh.ClientConfig{
+		User:            id,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// client logs in as the user and starts an sftp session
+func (s *server) client(t *testing.T, id string, key ssh.Signer) *pkgsftp.Client {
+	t.Helper()
+	conn, err := s.dial(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := pkgsftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func readFile(t *testing.T, c *pkgsftp.Client, p string) string {
+	t.Helper()
+	f, err := c.Open(p)
+	if err != nil {
+		t.Fatal(p, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(p, err)
+	}
+	return string(data)
+}
+
+func writeFile(c *pkgsftp.Client, p, contents string) error {
+	f, err := c.Create(p)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(contents))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// notExist whether the error is the status of a missing file
+func notExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func TestLogin(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	_, key := s.createUser(t, "alice")
+	s.createUser(t, "bob")
+
+	conn, err := s.dial("alice", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err = s.dial("bob", key); err == nil {
+		t.Error("logged in as bob with the key of alice")
+	}
+	if _, err = s.dial("carol", key); err == nil {
+		t.Error("logged in as a missing user")
+	}
+	if _, err = s.dial("alice", newSigner(t)); err == nil {
+		t.Error("logged in with an unknown key")
+	}
+	err = roles.Set(env.DB, "users", "alice", roles.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.dial("alice", key)
+	if err == nil {
+		_, err = pkgsftp.NewClient(c)
+		c.Close()
+	}
+	if err == nil {
+		t.Error("a disabled user started a session")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice")
+	b := env.Bucket(t, e, "")
+	env.WriteFile(t, b, "notes/a.txt", "hello")
+	c := s.client(t, "alice", key)
+
+	if got := readFile(t, c, "/default/notes/a.txt"); got != "hello" {
+		t.Errorf("read %q want hello", got)
+	}
+	// relative to the root
+	if got := readFile(t, c, "default/notes/a.txt"); got != "hello" {
+		t.Errorf("read %q want hello", got)
+	}
+	err := writeFile(c, "/default/notes/b.txt", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.ReadFile(t, b, "notes/b.txt"); got != "world" {
+		t.Errorf("uploaded %q want world", got)
+	}
+	err = writeFile(c, "/default/notes/a.txt", "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.ReadFile(t, b, "notes/a.txt"); got != "bye" {
+		t.Errorf("overwrote with %q want bye", got)
+	}
+
+	f, err := c.OpenFile("/default/notes/a.txt", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("!"))
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 4 {
+		t.Errorf("fstat of the upload: got %d bytes want 4", info.Size())
+	}
+	f.Close()
+	if got := env.ReadFile(t, b, "notes/a.txt"); got != "bye!" {
+		t.Errorf("appended %q want bye!", got)
+	}
+
+	_, err = c.OpenFile("/default/notes/a.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err == nil {
+		t.Error("created an existing file exclusively")
+	}
+	_, err = c.OpenFile("/default/notes/c.txt", os.O_WRONLY)
+	if !notExist(err) {
+		t.Errorf("opened a missing file without creating it: %v", err)
+	}
+	err = writeFile(c, "/default/missing/c.txt", "x")
+	if !notExist(err) {
+		t.Errorf("wrote in a missing directory: %v", err)
+	}
+	if err = writeFile(c, "/default", "x"); err == nil {
+		t.Error("wrote over a bucket")
+	}
+	if _, err = c.Open("/default/notes"); err == nil {
+		t.Error("opened a directory for reading")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice")
+	env.WriteFile(t, env.Bucket(t, e, ""), "a.txt", "hello")
+	err := roles.Set(env.DB, "users", "alice", roles.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.client(t, "alice", key)
+
+	if got := readFile(t, c, "/default/a.txt"); got != "hello" {
+		t.Errorf("read %q want hello", got)
+	}
+	changes := map[string]func() error{
+		"write":  func() error { return writeFile(c, "/default/b.txt", "x") },
+		"remove": func() error { return c.Remove("/default/a.txt") },
+		"rename": func() error { return c.Rename("/default/a.txt", "/default/b.txt") },
+		"mkdir":  func() error { return c.Mkdir("/default/dir") },
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("%s: got %v want permission denied", name, err)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice", "photos")
+	bob, _ := s.createUser(t, "bob", "secret")
+	env.Files(t, env.Bucket(t, e, ""), map[string]string{"a.txt": "a", "docs/b.txt": "bb", "docs/c.txt": "ccc"})
+	env.WriteFile(t, env.Bucket(t, bob, "secret"), "d.txt", "d")
+	c := s.client(t, "alice", key)
+
+	names := func(p string) string {
+		t.Helper()
+		infos, err := c.ReadDir(p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		var ns []string
+		for _, info := range infos {
+			n := info.Name()
+			if info.IsDir() {
+				n += "/"
+			}
+			ns = append(ns, n)
+		}
+		sort.Strings(ns)
+		return strings.Join(ns, " ")
+	}
+	if got := names("/"); got != "default/ photos/" {
+		t.Errorf("the root lists %q want the buckets of alice", got)
+	}
+	if got := names("/default"); got != "a.txt docs/" {
+		t.Errorf("/default lists %q", got)
+	}
+	if got := names("/default/docs"); got != "b.txt c.txt" {
+		t.Errorf("/default/docs lists %q", got)
+	}
+	if _, err := c.ReadDir("/default/a.txt"); err == nil {
+		t.Error("listed a file")
+	}
+	if _, err := c.ReadDir("/secret"); !notExist(err) {
+		t.Errorf("listed the bucket of bob: %v", err)
+	}
+
+	info, err := c.Stat("/default/docs/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3 || info.IsDir() {
+		t.Errorf("got the size %d want 3", info.Size())
+	}
+	info, err = c.Stat("/photos")
+	if err != nil || !info.IsDir() {
+		t.Errorf("a bucket isn't a directory: %v", err)
+	}
+	if _, err := c.Stat("/default/nothing"); !notExist(err) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+}
+
+func TestRenameRemove(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice", "photos")
+	b := env.Bucket(t, e, "")
+	env.Files(t, b, map[string]string{"a.txt": "a", "docs/b.txt": "b"})
+	c := s.client(t, "alice", key)
+
+	err := c.Rename("/default/a.txt", "/default/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.ReadFile(t, b, "docs/a.txt"); got != "a" {
+		t.Errorf("moved %q want a", got)
+	}
+	if _, err = b.Stat("a.txt"); err == nil {
+		t.Error("the renamed file is still there")
+	}
+	err = c.Rename("/default/docs/a.txt", "/photos/a.txt")
+	if err == nil {
+		t.Error("renamed into another bucket")
+	}
+	if err = c.Rename("/default", "/renamed"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("renamed a bucket: %v", err)
+	}
+
+	if err = c.Mkdir("/default/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Mkdir("/default/empty"); err == nil {
+		t.Error("made an existing directory")
+	}
+	if err = c.Mkdir("/default/missing/dir"); !notExist(err) {
+		t.Errorf("made a directory in a missing one: %v", err)
+	}
+	if err = c.Remove("/default/docs"); err == nil {
+		t.Error("removed a directory as a file")
+	}
+	if err = c.RemoveDirectory("/default/docs"); err == nil {
+		t.Error("removed a directory which isn't empty")
+	}
+	if err = c.RemoveDirectory("/default/empty"); err != nil {
+		t.Error(err)
+	}
+	if err = c.Remove("/default/docs/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Stat("docs/b.txt"); err == nil {
+		t.Error("the removed file is still there")
+	}
+	if err = c.Remove("/default/docs/b.txt"); !notExist(err) {
+		t.Errorf("removed a missing file: %v", err)
+	}
+	if err = c.Remove("/photos"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("removed a bucket: %v", err)
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice", "photos")
+	bob, _ := s.createUser(t, "bob")
+	b := env.Bucket(t, e, "")
+	env.WriteFile(t, b, "a.txt", "alice")
+	env.WriteFile(t, env.Bucket(t, e, "photos"), "p.txt", "photo")
+	env.WriteFile(t, env.Bucket(t, bob, ""), "a.txt", "bob")
+	c := s.client(t, "alice", key)
+
+	// the paths are cleaned at the root, they can't leave it
+	for _, p := range []string{
+		"/default/../../bob/default/a.txt",
+		"../users/bob/default/a.txt",
+		"/../../../etc/passwd",
+		"/default/../../../" + env.Dir + "/objects",
+		"/.thumbnails/a.txt",
+	} {
+		if _, err := c.Open(p); !notExist(err) {
+			t.Errorf("%s: got %v want no such file", p, err)
+		}
+		if err := writeFile(c, p, "x"); err == nil {
+			t.Errorf("%s: wrote outside of the buckets of alice", p)
+		}
+	}
+	if got := readFile(t, c, "/photos/../default/./a.txt"); got != "alice" {
+		t.Errorf("read %q want alice", got)
+	}
+	if got := env.ReadFile(t, env.Bucket(t, bob, ""), "a.txt"); got != "bob" {
+		t.Errorf("the file of bob changed to %q", got)
+	}
+
+	// the links stay in their bucket
+	for target, reason := range map[string]string{
+		"/photos/p.txt":                    "another bucket",
+		"/default/../../bob/default/a.txt": "the bucket of bob",
+		"../../../etc/passwd":              "outside of the root",
+		"/":                                "the root",
+		"/default":                         "the bucket itself",
+	} {
+		if err := c.Symlink(target, "/default/link"); err == nil {
+			t.Errorf("linked to %s", reason)
+		}
+	}
+	err := c.Symlink("/default/a.txt", "/default/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := c.ReadLink("/default/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "/default/a.txt" {
+		t.Errorf("got the target %q want /default/a.txt", target)
+	}
+	info, err := c.Lstat("/default/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat of a link: got the mode %s", info.Mode())
+	}
+	// preserved links can't be read
+	if _, err = c.Open("/default/link"); err == nil {
+		t.Error("read through a preserved link")
+	}
+	err = b.SetLinks(buckets.LinksFollow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, c, "/default/link"); got != "alice" {
+		t.Errorf("read %q through the link want alice", got)
+	}
+	if err = writeFile(c, "/default/link/x.txt", "x"); err == nil {
+		t.Error("wrote under a link")
+	}
+}
+
+// rawSession starts the sftp subsystem and returns its stdin and stdout
+func rawSession(t *testing.T, conn *ssh.Client) (io.WriteCloser, io.Reader) {
+	t.Helper()
+	sess, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	in, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.RequestSubsystem("sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// init with version 3, the version is answered
+	in.Write([]byte{0, 0, 0, 5, 1, 0, 0, 0, 3})
+	var size [4]byte
+	_, err = io.ReadFull(out, size[:])
+	if err != nil {
+		t.Fatal("no version ", err)
+	}
+	_, err = io.CopyN(ioutil.Discard, out, int64(binary.BigEndian.Uint32(size[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in, out
+}
+
+func TestMalformedPackets(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	s := newServer(t, env)
+	e, key := s.createUser(t, "alice")
+	env.WriteFile(t, env.Bucket(t, e, ""), "a.txt", "hello")
+	conn, err := s.dial("alice", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	packets := map[string][]byte{
+		// an open with a path longer than the packet
+		"truncated string": {0, 0, 0, 13, 3, 0, 0, 0, 1, 0, 0, 1, 0, '/', 'a', 0, 0},
+		// a read without its handle, offset and length
+		"truncated read": {0, 0, 0, 5, 5, 0, 0, 0, 1},
+		// longer than any packet the server reads
+		"too long": {0xff, 0xff, 0xff, 0xff, 3},
+		"empty":    {0, 0, 0, 0},
+		// the length promises more than is sent before the end
+		"cut short": {0, 0, 0, 100, 3, 0, 0},
+	}
+	for name, p := range packets {
+		in, out := rawSession(t, conn)
+		in.Write(p)
+		in.Close()
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(ioutil.Discard, out)
+			done <- err
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: the session didn't end", name)
+		}
+	}
+
+	// the connection and the server still work
+	c, err := pkgsftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := readFile(t, c, "/default/a.txt"); got != "hello" {
+		t.Errorf("read %q want hello", got)
+	}
+}
@@ -0,0 +1,136 @@
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+)
+
+var (
+	// ErrInvalidSignature the url was not signed by us or was tampered with
+	ErrInvalidSignature = errors.New("Invalid signature")
+	// ErrExpired the url was signed by us but is past its expiry
+	ErrExpired = errors.New("Signed url expired")
+	// ErrIPMismatch the url is bound to a different client ip
+	ErrIPMismatch = errors.New("Signed url is bound to another ip")
+)
+
+// Signer mints and validates pre-signed urls
+type Signer struct {
+	key   []byte
+	clock clock.Clock
+}
+
+// Option is a functional option to the signer constructor NewSigner.
+type Option func(*options)
+type options struct {
+	clock clock.Clock
+}
+
+// Clock option sets the clock the expiries are computed and checked with
+//
+// By default the clock package's Default one is used
+func Clock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// Link a validated signed url
+type Link struct {
+	// Path the url path that was signed
+	Path string
+	// Expires the time after which the link is rejected
+	Expires time.Time
+	// IP the client ip the link is bound to, empty if unbound
+	IP string
+}
+
+// NewSigner returns a signer using the HMAC key
+func NewSigner(key []byte, opts ...Option) *Signer {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Signer{key: key, clock: o.clock}
+}
+
+// now the time of the signer's clock
+func (s *Signer) now() time.Time {
+	if s.clock != nil {
+		return s.clock.Now()
+	}
+	return clock.Now()
+}
+
+// Sign returns the url path with the expiry and signature as query params
+//
+// If ip is not empty the url can only be used from that client ip
+func (s *Signer) Sign(path string, ttl time.Duration, ip string) string {
+	u, _ := s.SignLink(path, ttl, ip)
+	return u
+}
+
+// SignLink is Sign also returning the link the url is valid for, its
+// expiry is the one in the url, to the second
+func (s *Signer) SignLink(path string, ttl time.Duration, ip string) (string, *Link) {
+	unix := s.now().Add(ttl).Unix()
+	expires := strconv.FormatInt(unix, 10)
+	q := url.Values{}
+	q.Set("expires", expires)
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("signature", s.signature(path, expires, ip))
+	u := url.URL{Path: path, RawQuery: q.Encode()}
+	return u.String(), &Link{Path: path, Expires: time.Unix(unix, 0), IP: ip}
+}
+
+// Verify validates the signature of the request's url
+func (s *Signer) Verify(r *http.Request) (*Link, error) {
+	q := r.URL.Query()
+	expires, ip, sig := q.Get("expires"), q.Get("ip"), q.Get("signature")
+
+	expected := s.signature(r.URL.Path, expires, ip)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	link := &Link{Path: r.URL.Path, Expires: time.Unix(unix, 0), IP: ip}
+	if s.now().After(link.Expires) {
+		return nil, ErrExpired
+	}
+	if ip != "" && ip != ClientIP(r) {
+		return nil, ErrIPMismatch
+	}
+	return link, nil
+}
+
+func (s *Signer) signature(path, expires, ip string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path + "\n" + expires + "\n" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ClientIP returns the ip of the client that made the request
+//
+// Only the remote address is used, headers like X-Forwarded-For
+// can be spoofed by the client
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+package share_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/share"
+)
+
+var now = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// verify verifies the url requested from the client ip
+func verify(s *share.Signer, u, ip string) (*share.Link, error) {
+	r := httptest.NewRequest("GET", u, nil)
+	r.RemoteAddr = ip + ":1234"
+	return s.Verify(r)
+}
+
+func TestSignVerify(t *testing.T) {
+	c := clock.NewFake(now)
+	s := share.NewSigner([]byte("key"), share.Clock(c))
+
+	u, link := s.SignLink("/public/users/alice/default/a.txt", time.Hour, "")
+	if !link.Expires.Equal(now.Add(time.Hour)) || link.IP != "" {
+		t.Errorf("got the link %+v", link)
+	}
+	got, err := verify(s, u, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != "/public/users/alice/default/a.txt" || !got.Expires.Equal(link.Expires) {
+		t.Errorf("verified %+v want %+v", got, link)
+	}
+
+	c.Advance(time.Hour)
+	if _, err = verify(s, u, "10.0.0.1"); err != nil {
+		t.Errorf("rejected at its expiry: %v", err)
+	}
+	c.Advance(time.Second)
+	if _, err = verify(s, u, "10.0.0.1"); !errors.Is(err, share.ErrExpired) {
+		t.Errorf("after its expiry: got %v want %v", err, share.ErrExpired)
+	}
+}
+
+func TestSignExpiresToTheSecond(t *testing.T) {
+	c := clock.NewFake(now.Add(700 * time.Millisecond))
+	s := share.NewSigner([]byte("key"), share.Clock(c))
+
+	u, link := s.SignLink("/a", time.Minute, "")
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Query().Get("expires"); got != "1609502460" || !link.Expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("got the expiry %s in the url and %s in the link", got, link.Expires)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	c := clock.NewFake(now)
+	s := share.NewSigner([]byte("key"), share.Clock(c))
+	u := s.Sign("/public/users/alice/default/a.txt", time.Hour, "")
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(change func(u *url.URL, q url.Values)) string {
+		c := *parsed
+		q := c.Query()
+		change(&c, q)
+		c.RawQuery = q.Encode()
+		return c.String()
+	}
+	tests := map[string]string{
+		"other path": tamper(func(u *url.URL, q url.Values) { u.Path = "/public/users/bob/default/a.txt" }),
+		"later expiry": tamper(func(u *url.URL, q url.Values) {
+			q.Set("expires", "1609592400")
+		}),
+		"bad expiry":       tamper(func(u *url.URL, q url.Values) { q.Set("expires", "soon") }),
+		"added ip":         tamper(func(u *url.URL, q url.Values) { q.Set("ip", "10.0.0.1") }),
+		"no signature":     tamper(func(u *url.URL, q url.Values) { q.Del("signature") }),
+		"other signature":  tamper(func(u *url.URL, q url.Values) { q.Set("signature", "AAAA") }),
+		"unsigned":         "/public/users/alice/default/a.txt",
+		"signed elsewhere": share.NewSigner([]byte("other key"), share.Clock(c)).Sign("/public/users/alice/default/a.txt", time.Hour, ""),
+	}
+	for name, u := range tests {
+		if _, err := verify(s, u, "10.0.0.1"); !errors.Is(err, share.ErrInvalidSignature) {
+			t.Errorf("%s: got %v want %v", name, err, share.ErrInvalidSignature)
+		}
+	}
+}
+
+func TestBoundIP(t *testing.T) {
+	s := share.NewSigner([]byte("key"), share.Clock(clock.NewFake(now)))
+	u, link := s.SignLink("/a", time.Hour, "10.0.0.1")
+	if link.IP != "10.0.0.1" {
+		t.Errorf("got the ip %q", link.IP)
+	}
+	if _, err := verify(s, u, "10.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := verify(s, u, "10.0.0.2"); !errors.Is(err, share.ErrIPMismatch) {
+		t.Errorf("from another ip: got %v want %v", err, share.ErrIPMismatch)
+	}
+	r := httptest.NewRequest("GET", u, nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	if _, err := s.Verify(r); !errors.Is(err, share.ErrIPMismatch) {
+		t.Errorf("a spoofed forwarded ip: got %v want %v", err, share.ErrIPMismatch)
+	}
+}
@@ -0,0 +1,289 @@
+// Package stats the file counts and sizes of the entities and their buckets
+//
+// The current numbers are aggregated from the files, the growth over
+// time comes from the daily snapshots Snapshot takes, eg. on every gc.
+//
+//	n, err := stats.Snapshot(db)
+//	top, err := stats.Entities(db, stats.Filter{Limit: 10})
+//	details, err := stats.Entity(db, "users", "phano", stats.Options{Days: 90})
+package stats
+
+import (
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/pace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// DayFormat the format of the days of the snapshots, in UTC
+	DayFormat = "2006-01-02"
+	// DefaultLimit the number of entities Entities returns by default
+	DefaultLimit = 20
+	// MaxLimit the most entities Entities returns
+	MaxLimit = 1000
+	// DefaultLargest the number of largest files Entity returns by default
+	DefaultLargest = 10
+	// DefaultDays the days of history Entity returns by default
+	DefaultDays = 30
+	// batchSize the number of snapshots saved per query
+	batchSize = 500
+)
+
+// Bucket the stats of a bucket
+type Bucket struct {
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	BucketID   string `json:"bucket_id"`
+	Tenant     string `json:"tenant,omitempty"`
+	// Files the number of files, not counting the directories
+	Files int64 `json:"files"`
+	// Bytes the size of the files
+	Bytes int64 `json:"bytes"`
+	// Quota of the bucket, 0 for none
+	Quota int64 `json:"quota"`
+}
+
+// Stats the stats of an entity
+type Stats struct {
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	Tenant     string `json:"tenant,omitempty"`
+	Buckets    int64  `json:"buckets"`
+	Files      int64  `json:"files"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// Day the snapshot of a bucket's stats on a day
+type Day struct {
+	Day        string    `gorm:"primaryKey" json:"day"`
+	EntityType string    `gorm:"primaryKey" json:"entity_type"`
+	EntityID   string    `gorm:"primaryKey" json:"entity_id"`
+	BucketID   string    `gorm:"primaryKey" json:"bucket_id"`
+	Tenant     string    `gorm:"index" json:"tenant,omitempty"`
+	Files      int64     `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName of the snapshots
+func (Day) TableName() string {
+	return "stats_days"
+}
+
+// AutoMigrate creates the table of the snapshots
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Day{})
+}
+
+// Point the stats of an entity on a day
+type Point struct {
+	Day   string `json:"day"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Details the stats of an entity with the ones of its buckets
+type Details struct {
+	Stats   Stats    `json:"stats"`
+	Buckets []Bucket `json:"buckets"`
+	// Largest the largest files of the entity, largest first
+	Largest []buckets.FileDir `json:"largest"`
+	// History the snapshots of the days, oldest first
+	History []Point `json:"history"`
+}
+
+// Filter the entities Entities returns, zero values match everything
+type Filter struct {
+	Tenant     string
+	EntityType string
+	// Limit the number of entities, DefaultLimit if 0, at most MaxLimit
+	Limit int
+}
+
+// Options of Entity
+type Options struct {
+	// Largest the number of largest files, DefaultLargest if 0
+	Largest int
+	// Days the days of history, DefaultDays if 0
+	Days int
+}
+
+// files joins the live buckets with their files, the counts of a bucket are 0 when it's empty
+func files(db *gorm.DB) *gorm.DB {
+	return db.Model(&buckets.Bucket{}).Joins(
+		"LEFT JOIN file_dirs ON file_dirs.bucket_id = buckets.id"+
+			" AND file_dirs.entity_id = buckets.entity_id AND file_dirs.entity_type = buckets.entity_type"+
+			" AND file_dirs.is_dir = ? AND file_dirs.deleted_at IS NULL", false,
+	)
+}
+
+// Buckets returns the stats of the buckets matching the filter, ignoring its limit
+func Buckets(db *gorm.DB, f Filter) ([]Bucket, error) {
+	tx := files(db).Select(
+		"buckets.entity_type, buckets.entity_id, buckets.id AS bucket_id, buckets.tenant, buckets.quota," +
+			" COUNT(file_dirs.path) AS files, COALESCE(SUM(file_dirs.size), 0) AS bytes",
+	)
+	tx = filter(tx, f).Group("buckets.entity_type, buckets.entity_id, buckets.id, buckets.tenant, buckets.quota")
+	rows := []Bucket{}
+	err := tx.Order("buckets.entity_type, buckets.entity_id, buckets.id").Scan(&rows).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return rows, nil
+}
+
+// Entities returns the stats of the entities matching the filter, the heaviest first
+func Entities(db *gorm.DB, f Filter) ([]Stats, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	tx := files(db).Select(
+		"buckets.entity_type, buckets.entity_id, MAX(buckets.tenant) AS tenant," +
+			" COUNT(DISTINCT buckets.id) AS buckets," +
+			" COUNT(file_dirs.path) AS files, COALESCE(SUM(file_dirs.size), 0) AS bytes",
+	)
+	tx = filter(tx, f).Group("buckets.entity_type, buckets.entity_id")
+	rows := []Stats{}
+	err := tx.Order("bytes DESC, buckets.entity_type, buckets.entity_id").Limit(limit).Scan(&rows).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return rows, nil
+}
+
+// filter restricts the query to the buckets matching f
+func filter(tx *gorm.DB, f Filter) *gorm.DB {
+	if f.Tenant != "" {
+		tx = tx.Where("buckets.tenant = ?", f.Tenant)
+	}
+	if f.EntityType != "" {
+		tx = tx.Where("buckets.entity_type = ?", f.EntityType)
+	}
+	return tx
+}
+
+// Entity returns the stats of an entity, its buckets, largest files and history
+//
+// Returns errs.ErrEntityNotFound if it has no buckets
+func Entity(db *gorm.DB, entityType, entityID string, opts Options) (*Details, error) {
+	bucks, err := Buckets(db.Where("buckets.entity_id = ?", entityID), Filter{EntityType: entityType})
+	if err != nil {
+		return nil, err
+	}
+	if len(bucks) == 0 {
+		return nil, errs.New(errs.ErrEntityNotFound, entityType+" "+entityID)
+	}
+	d := &Details{
+		Stats:   Stats{EntityType: entityType, EntityID: entityID, Tenant: bucks[0].Tenant},
+		Buckets: bucks,
+	}
+	for _, b := range bucks {
+		d.Stats.Buckets++
+		d.Stats.Files += b.Files
+		d.Stats.Bytes += b.Bytes
+	}
+
+	largest := opts.Largest
+	if largest <= 0 {
+		largest = DefaultLargest
+	}
+	d.Largest = []buckets.FileDir{}
+	err = db.Where("entity_type = ? AND entity_id = ? AND is_dir = ?", entityType, entityID, false).
+		Order("size DESC, path").Limit(largest).Find(&d.Largest).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+
+	days := opts.Days
+	if days <= 0 {
+		days = DefaultDays
+	}
+	since := clock.Now().UTC().AddDate(0, 0, -days).Format(DayFormat)
+	d.History = []Point{}
+	err = db.Model(&Day{}).Select("day, SUM(files) AS files, SUM(bytes) AS bytes").
+		Where("entity_type = ? AND entity_id = ? AND day > ?", entityType, entityID, since).
+		Group("day").Order("day").Scan(&d.History).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return d, nil
+}
+
+// Snapshot saves the stats of every bucket as the ones of today, returning the number of buckets
+//
+// Taken several times a day the last one wins, the days without
+// a snapshot are missing from the history
+func Snapshot(db *gorm.DB) (int, error) {
+	bucks, err := Buckets(db, Filter{})
+	if err != nil {
+		return 0, err
+	}
+	now := clock.Now().UTC()
+	day := now.Format(DayFormat)
+	for start := 0; start < len(bucks); start += batchSize {
+		end := start + batchSize
+		if end > len(bucks) {
+			end = len(bucks)
+		}
+		rows := make([]Day, 0, end-start)
+		for _, b := range bucks[start:end] {
+			rows = append(rows, Day{
+				Day:        day,
+				EntityType: b.EntityType,
+				EntityID:   b.EntityID,
+				BucketID:   b.BucketID,
+				Tenant:     b.Tenant,
+				Files:      b.Files,
+				Bytes:      b.Bytes,
+				UpdatedAt:  now,
+			})
+		}
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "day"}, {Name: "entity_type"}, {Name: "entity_id"}, {Name: "bucket_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"tenant", "files", "bytes", "updated_at"}),
+		}).Create(&rows).Error
+		if err != nil {
+			return start, errs.Wrap(errs.ErrDatabase, err)
+		}
+	}
+	return len(bucks), nil
+}
+
+// Prune deletes the snapshots older than the retention, 0 keeps them forever
+func Prune(db *gorm.DB, retention time.Duration, p *pace.Pacer) (int64, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := clock.Now().UTC().Add(-retention).Format(DayFormat)
+	var total int64
+	for {
+		var n int64
+		err := p.Do(func() error {
+			// a day at a time, it holds a row per bucket
+			var days []string
+			err := db.Model(&Day{}).Distinct("day").Where("day < ?", cutoff).Order("day").Limit(1).Pluck("day", &days).Error
+			if err != nil || len(days) == 0 {
+				return err
+			}
+			tx := db.Where("day = ?", days[0]).Delete(&Day{})
+			n = tx.RowsAffected
+			return tx.Error
+		})
+		if err != nil {
+			return total, errs.Wrap(errs.ErrDatabase, err)
+		}
+		if n == 0 {
+			return total, nil
+		}
+		total += n
+	}
+}
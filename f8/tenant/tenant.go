@@ -0,0 +1,116 @@
+// Package tenant namespaces the entities and buckets of the applications sharing a deployment
+//
+//	err := tenant.Register(db)
+//	acme := tenant.Scope(db, "acme")
+//	b, err := buckets.Find(acme, "users", "phano", "default")
+//
+// The queries of a scoped db on models with a Tenant field only match the
+// rows of the tenant and the rows it creates are stamped with it.
+// An unscoped db sees every tenant, the maintenance jobs (gc, fsck, backups) use one.
+package tenant
+
+import (
+	"reflect"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	// Column the column holding the tenant of a row
+	Column = "tenant"
+	// field the name of the Tenant field of the models
+	field      = "Tenant"
+	settingKey = "f8:tenant"
+)
+
+// Scope returns a db whose queries are restricted to the tenant
+//
+// The callbacks must be registered on the db with Register
+func Scope(db *gorm.DB, name string) *gorm.DB {
+	return db.Set(settingKey, name).Session(&gorm.Session{})
+}
+
+// Of returns the tenant the db is scoped to, if any
+func Of(db *gorm.DB) (string, bool) {
+	v, ok := db.Get(settingKey)
+	if !ok {
+		return "", false
+	}
+	name, ok := v.(string)
+	return name, ok && name != ""
+}
+
+// Register registers the callbacks enforcing the scopes
+//
+// A db never passed to Scope is unaffected by them
+func Register(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("tenant:create", stamp),
+		cb.Query().Before("gorm:query").Register("tenant:query", where),
+		cb.Update().Before("gorm:update").Register("tenant:update", where),
+		cb.Delete().Before("gorm:delete").Register("tenant:delete", where),
+		cb.Row().Before("gorm:row").Register("tenant:row", where),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantField returns the tenant of the statement and the Tenant field of its model
+func tenantField(tx *gorm.DB) (string, *schema.Field, bool) {
+	if tx.Error != nil || tx.Statement.Schema == nil {
+		return "", nil, false
+	}
+	name, ok := Of(tx)
+	if !ok {
+		return "", nil, false
+	}
+	f := tx.Statement.Schema.LookUpField(field)
+	return name, f, f != nil
+}
+
+// where restricts the statement to the rows of the tenant
+func where(tx *gorm.DB) {
+	name, _, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: Column}, Value: name},
+	}})
+}
+
+// stamp sets the tenant of the rows being created
+//
+// Rows already belonging to another tenant are refused
+func stamp(tx *gorm.DB) {
+	name, f, ok := tenantField(tx)
+	if !ok {
+		return
+	}
+	set := func(rv reflect.Value) {
+		v, zero := f.ValueOf(rv)
+		if !zero && v != name {
+			tx.AddError(errs.New(errs.ErrInvalidOption, "Can't create a row of tenant "+v.(string)+" in tenant "+name))
+			return
+		}
+		if err := f.Set(rv, name); err != nil {
+			tx.AddError(err)
+		}
+	}
+	rv := tx.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			set(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		set(rv)
+	}
+}
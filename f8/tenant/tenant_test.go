@@ -0,0 +1,182 @@
+package tenant_test
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/tenant"
+	"gorm.io/gorm"
+)
+
+// doc a model with a Tenant field
+type doc struct {
+	ID     string `gorm:"primaryKey"`
+	Tenant string
+	Title  string
+}
+
+// note a model without one, its rows are shared by the tenants
+type note struct {
+	ID string `gorm:"primaryKey"`
+}
+
+// user a model embedding the entity, saved in the users table
+type user struct {
+	*entity.BaseEntity `gorm:"embedded"`
+}
+
+// ids returns the sorted ids of the docs the db sees
+func ids(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+	var docs []doc
+	if err := db.Find(&docs).Error; err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func TestOf(t *testing.T) {
+	env := fatetest.New(t)
+	acme := tenant.Scope(env.DB, "acme")
+	if name, ok := tenant.Of(acme); !ok || name != "acme" {
+		t.Errorf("got the tenant %q %v want acme", name, ok)
+	}
+	if _, ok := tenant.Of(env.DB); ok {
+		t.Error("the db passed to Scope got scoped too")
+	}
+	if _, ok := tenant.Of(tenant.Scope(env.DB, "")); ok {
+		t.Error("scoped to an empty tenant")
+	}
+}
+
+func TestScope(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&doc{}, &note{}))
+	acme, umbrella := tenant.Scope(env.DB, "acme"), tenant.Scope(env.DB, "umbrella")
+
+	for db, rows := range map[*gorm.DB]interface{}{
+		acme:     []*doc{{ID: "a1", Title: "one"}, {ID: "a2"}},
+		umbrella: &doc{ID: "u1"},
+		env.DB:   &doc{ID: "n1"},
+	} {
+		if err := db.Create(rows).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := acme.Create(&doc{ID: "u2", Tenant: "umbrella"}).Error
+	if !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("a row of umbrella created in acme: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	d := &doc{}
+	if err = env.DB.First(d, "id = ?", "a2").Error; err != nil || d.Tenant != "acme" {
+		t.Errorf("the created row has the tenant %q: %v", d.Tenant, err)
+	}
+
+	if got := ids(t, acme); got != "a1 a2" {
+		t.Errorf("acme sees %q", got)
+	}
+	if got := ids(t, umbrella); got != "u1" {
+		t.Errorf("umbrella sees %q", got)
+	}
+	if got := ids(t, env.DB); got != "a1 a2 n1 u1" {
+		t.Errorf("the unscoped db sees %q", got)
+	}
+	if err = umbrella.First(&doc{}, "id = ?", "a1").Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("umbrella found a doc of acme: %v", err)
+	}
+	var n int64
+	if err = umbrella.Model(&doc{}).Where("id LIKE ?", "a%").Count(&n).Error; err != nil || n != 0 {
+		t.Errorf("umbrella counted %d docs of acme: %v", n, err)
+	}
+	rows, err := umbrella.Model(&doc{}).Select("id").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil || id != "u1" {
+			t.Errorf("umbrella read the row %q: %v", id, err)
+		}
+	}
+	rows.Close()
+
+	// the updates and deletes only reach the rows of the tenant
+	if err = umbrella.Model(&doc{}).Where("1 = 1").Update("title", "taken").Error; err != nil {
+		t.Fatal(err)
+	}
+	d = &doc{}
+	if err = env.DB.First(d, "id = ?", "a1").Error; err != nil || d.Title != "one" {
+		t.Errorf("umbrella updated a doc of acme to %q: %v", d.Title, err)
+	}
+	if err = umbrella.Where("1 = 1").Delete(&doc{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(t, env.DB); got != "a1 a2 n1" {
+		t.Errorf("after umbrella deleted its docs: %q", got)
+	}
+
+	// the models without a tenant are shared
+	if err = acme.Create(&note{ID: "n"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err = umbrella.First(&note{}, "id = ?", "n").Error; err != nil {
+		t.Errorf("a note isn't shared: %v", err)
+	}
+}
+
+func TestEntities(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := env.Entity(t, "users", "alice", entity.Tenant("acme"))
+	env.Create(t, alice, &user{alice})
+	if alice.Actor().Tenant != "acme" {
+		t.Errorf("got the actor's tenant %q", alice.Actor().Tenant)
+	}
+	b := &buckets.Bucket{}
+	if err := env.DB.First(b, "entity_id = ?", "alice").Error; err != nil || b.Tenant != "acme" {
+		t.Errorf("the default bucket has the tenant %q: %v", b.Tenant, err)
+	}
+
+	_, err := entity.Entity(entity.ID("bob"), entity.TableName("users"),
+		entity.DB(tenant.Scope(env.DB, "umbrella")), entity.StorageConfig(env.Storage), entity.Tenant("acme"))
+	if !errors.Is(err, errs.ErrInvalidOption) {
+		t.Errorf("an entity of acme on a db of umbrella: got %v want %v", err, errs.ErrInvalidOption)
+	}
+	_, err = entity.Entity(entity.ID("bob"), entity.TableName("users"),
+		entity.DB(env.DB), entity.StorageConfig(env.Storage), entity.Tenant("not a tenant!"))
+	if !errors.Is(err, errs.ErrInvalidName) {
+		t.Errorf("an invalid tenant: got %v want %v", err, errs.ErrInvalidName)
+	}
+}
+
+func TestFind(t *testing.T) {
+	defer cache.Use(cache.NewLRU(100), time.Minute)()
+	env := fatetest.New(t, fatetest.Models(&user{}))
+	alice := env.Entity(t, "users", "alice", entity.Tenant("acme"))
+	env.Create(t, alice, &user{alice})
+
+	// the second lookups come from the cache
+	for i := 0; i < 2; i++ {
+		if _, err := buckets.Find(tenant.Scope(env.DB, "acme"), "users", "alice", "default"); err != nil {
+			t.Errorf("acme: %v", err)
+		}
+		_, err := buckets.Find(tenant.Scope(env.DB, "umbrella"), "users", "alice", "default")
+		if !errors.Is(err, errs.ErrBucketNotFound) {
+			t.Errorf("umbrella found a bucket of acme: %v", err)
+		}
+		if _, err = buckets.Find(env.DB, "users", "alice", "default"); err != nil {
+			t.Errorf("unscoped: %v", err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Package usage the monthly storage, bandwidth and operation counts of the entities, eg. for billing
+//
+// The written and deleted files are counted from the events, the downloads
+// from the servers of the files and the storage is sampled from the usage
+// counters of the buckets on every Flush.
+//
+//	meter := usage.New(db)
+//	events.Subscribe(meter)
+//	buckets.MeterDownloads(meter.Download)
+//	err := meter.Flush() // eg. every hour
+//	reports, err := meter.List(usage.Filter{Month: "2026-10"})
+package usage
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MonthFormat the format of the months of the reports, in UTC
+const MonthFormat = "2006-01"
+
+// Report the usage of an entity during a month
+type Report struct {
+	Month      string `gorm:"primaryKey" json:"month"`
+	EntityType string `gorm:"primaryKey" json:"entity_type"`
+	EntityID   string `gorm:"primaryKey" json:"entity_id"`
+	// Tenant the tenant of the entity's buckets, empty for none
+	Tenant string `gorm:"index" json:"tenant,omitempty"`
+	// ByteHours the bytes stored by the buckets of the entity over the hours of the month
+	//
+	// Sampled on every Flush, the storage is assumed constant in between
+	ByteHours int64 `json:"byte_hours"`
+	// BytesIn and BytesOut the bytes written to and downloaded from the buckets
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Writes, Deletes and Downloads the number of operations on the files
+	Writes    int64 `json:"writes"`
+	Deletes   int64 `json:"deletes"`
+	Downloads int64 `json:"downloads"`
+	// SampledAt when the storage was last added to ByteHours
+	SampledAt *time.Time `json:"-"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// TableName of the reports
+func (Report) TableName() string {
+	return "usage_reports"
+}
+
+// AutoMigrate creates the table of the reports
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Report{})
+}
+
+// Month the month of the time
+func Month(t time.Time) string {
+	return t.UTC().Format(MonthFormat)
+}
+
+// counters the operations counted since the last Flush
+type counters struct {
+	bytesIn, bytesOut, writes, deletes, downloads int64
+}
+
+// key the month and the entity of the counters
+type key struct {
+	month, entityType, entityID string
+}
+
+// Meter counts the usage of the entities and flushes it to their reports
+type Meter struct {
+	db *gorm.DB
+
+	mu      sync.Mutex
+	pending map[key]*counters
+}
+
+// New returns a meter writing the reports to the database
+func New(db *gorm.DB) *Meter {
+	return &Meter{db: db, pending: map[key]*counters{}}
+}
+
+// count updates the pending counters of the entity for the month of t
+func (m *Meter) count(t time.Time, entityType, entityID string, fn func(c *counters)) {
+	k := key{Month(t), entityType, entityID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.pending[k]
+	if !ok {
+		c = &counters{}
+		m.pending[k] = c
+	}
+	fn(c)
+}
+
+// Send counts the written and deleted files, the Meter is an events.Sink
+func (m *Meter) Send(e *events.Event) error {
+	if _, ok := e.Data["from"]; ok {
+		// moved within the bucket, nothing was uploaded
+		return nil
+	}
+	if _, ok := e.Data["to"]; ok {
+		return nil
+	}
+	switch e.Type {
+	case events.FileWritten:
+		var size int64
+		switch v := e.Data["size"].(type) {
+		case int64:
+			size = v
+		case float64:
+			size = int64(v)
+		}
+		m.count(e.Time, e.EntityType, e.EntityID, func(c *counters) {
+			c.writes++
+			c.bytesIn += size
+		})
+	case events.FileDeleted:
+		m.count(e.Time, e.EntityType, e.EntityID, func(c *counters) {
+			c.deletes++
+		})
+	}
+	return nil
+}
+
+// Download counts a download of n bytes from the bucket, see buckets.MeterDownloads
+func (m *Meter) Download(b *buckets.Bucket, n int64) {
+	m.count(clock.Now(), b.EntityType, b.EntityID, func(c *counters) {
+		c.downloads++
+		c.bytesOut += n
+	})
+}
+
+// Flush adds the counted operations and the storage since the last Flush to the reports
+//
+// Several instances can flush to the same database, the storage of an
+// entity is only sampled by one of them
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = map[key]*counters{}
+	m.mu.Unlock()
+
+	tenants := map[[2]string]string{}
+	var failed error
+	for k, c := range pending {
+		tenant, err := m.tenant(tenants, k.entityType, k.entityID)
+		if err == nil {
+			err = m.add(&Report{
+				Month:      k.month,
+				EntityType: k.entityType,
+				EntityID:   k.entityID,
+				Tenant:     tenant,
+				BytesIn:    c.bytesIn,
+				BytesOut:   c.bytesOut,
+				Writes:     c.writes,
+				Deletes:    c.deletes,
+				Downloads:  c.downloads,
+			})
+		}
+		if err != nil {
+			// counted again by the next flush
+			m.mu.Lock()
+			m.merge(k, c)
+			m.mu.Unlock()
+			failed = err
+		}
+	}
+	err := m.sample(clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// merge adds c to the pending counters of k, the lock must be held
+func (m *Meter) merge(k key, c *counters) {
+	cur, ok := m.pending[k]
+	if !ok {
+		m.pending[k] = c
+		return
+	}
+	cur.bytesIn += c.bytesIn
+	cur.bytesOut += c.bytesOut
+	cur.writes += c.writes
+	cur.deletes += c.deletes
+	cur.downloads += c.downloads
+}
+
+// tenant the tenant of the entity's buckets, cached in tenants
+func (m *Meter) tenant(tenants map[[2]string]string, entityType, entityID string) (string, error) {
+	k := [2]string{entityType, entityID}
+	if t, ok := tenants[k]; ok {
+		return t, nil
+	}
+	var found []string
+	err := m.db.Unscoped().Model(&buckets.Bucket{}).
+		Where("entity_type = ? AND entity_id = ?", entityType, entityID).
+		Limit(1).Pluck("tenant", &found).Error
+	if err != nil {
+		return "", errs.Wrap(errs.ErrDatabase, err)
+	}
+	tenants[k] = ""
+	if len(found) > 0 {
+		tenants[k] = found[0]
+	}
+	return tenants[k], nil
+}
+
+// add adds the counters of r to its report, creating it if needed
+func (m *Meter) add(r *Report) error {
+	r.UpdatedAt = clock.Now()
+	updates := map[string]interface{}{"updated_at": r.UpdatedAt}
+	for column, n := range map[string]int64{
+		"byte_hours": r.ByteHours,
+		"bytes_in":   r.BytesIn,
+		"bytes_out":  r.BytesOut,
+		"writes":     r.Writes,
+		"deletes":    r.Deletes,
+		"downloads":  r.Downloads,
+	} {
+		if n != 0 {
+			updates[column] = gorm.Expr("usage_reports."+column+" + ?", n)
+		}
+	}
+	if r.SampledAt != nil {
+		updates["sampled_at"] = r.SampledAt
+	}
+	err := m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "month"}, {Name: "entity_type"}, {Name: "entity_id"}},
+		DoUpdates: clause.Assignments(updates),
+	}).Create(r).Error
+	return errs.Wrap(errs.ErrDatabase, err)
+}
+
+// stored the bytes stored by the buckets of an entity
+type stored struct {
+	EntityType string
+	EntityID   string
+	Tenant     string
+	Used       int64
+}
+
+// sample adds the bytes stored by every entity since its last sample to the
+// byte hours of the months in between
+func (m *Meter) sample(now time.Time) error {
+	var rows []stored
+	err := m.db.Model(&buckets.Bucket{}).
+		Select("entity_type, entity_id, MAX(tenant) AS tenant, SUM(used) AS used").
+		Group("entity_type, entity_id").Scan(&rows).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	for _, row := range rows {
+		err := m.sampleEntity(row, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Meter) sampleEntity(row stored, now time.Time) error {
+	var last []Report
+	err := m.db.Where("entity_type = ? AND entity_id = ?", row.EntityType, row.EntityID).
+		Order("month DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		return errs.Wrap(errs.ErrDatabase, err)
+	}
+	if len(last) == 0 || last[0].SampledAt == nil {
+		// metered from now on
+		return m.add(&Report{Month: Month(now), EntityType: row.EntityType, EntityID: row.EntityID, Tenant: row.Tenant, SampledAt: &now})
+	}
+	from := last[0].SampledAt.UTC()
+	if !now.After(from) {
+		return nil
+	}
+	// claim the interval, another instance may be sampling it
+	tx := m.db.Model(&Report{}).Where(
+		"month = ? AND entity_type = ? AND entity_id = ? AND sampled_at = ?",
+		last[0].Month, row.EntityType, row.EntityID, last[0].SampledAt,
+	).Update("sampled_at", now)
+	if tx.Error != nil {
+		return errs.Wrap(errs.ErrDatabase, tx.Error)
+	}
+	if tx.RowsAffected == 0 {
+		return nil
+	}
+	for t := from; t.Before(now); {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end := start.AddDate(0, 1, 0)
+		if end.After(now) {
+			end = now
+		}
+		r := &Report{
+			Month:      Month(t),
+			EntityType: row.EntityType,
+			EntityID:   row.EntityID,
+			Tenant:     row.Tenant,
+			ByteHours:  int64(math.Round(float64(row.Used) * end.Sub(t).Hours())),
+		}
+		if end.Equal(now) {
+			r.SampledAt = &now
+		}
+		err := m.add(r)
+		if err != nil {
+			return err
+		}
+		t = end
+	}
+	return nil
+}
+
+// Filter the reports to list, zero values match everything
+type Filter struct {
+	Month      string
+	EntityType string
+	EntityID   string
+	Tenant     string
+}
+
+// List returns the reports matching the filter ordered by month and entity
+func (m *Meter) List(f Filter) ([]Report, error) {
+	tx := m.db.Model(&Report{})
+	for column, v := range map[string]string{
+		"month":       f.Month,
+		"entity_type": f.EntityType,
+		"entity_id":   f.EntityID,
+		"tenant":      f.Tenant,
+	} {
+		if v != "" {
+			tx = tx.Where(column+" = ?", v)
+		}
+	}
+	reports := []Report{}
+	err := tx.Order("month, entity_type, entity_id").Find(&reports).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ErrDatabase, err)
+	}
+	return reports, nil
+}
+
+// csvHeader the columns of WriteCSV
+var csvHeader = []string{
+	"month", "tenant", "entity_type", "entity_id",
+	"byte_hours", "bytes_in", "bytes_out", "writes", "deletes", "downloads",
+}
+
+// WriteCSV writes the reports as csv with a header row
+func WriteCSV(w io.Writer, reports []Report) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		err = cw.Write([]string{
+			r.Month, r.Tenant, r.EntityType, r.EntityID,
+			strconv.FormatInt(r.ByteHours, 10),
+			strconv.FormatInt(r.BytesIn, 10),
+			strconv.FormatInt(r.BytesOut, 10),
+			strconv.FormatInt(r.Writes, 10),
+			strconv.FormatInt(r.Deletes, 10),
+			strconv.FormatInt(r.Downloads, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
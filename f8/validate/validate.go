@@ -0,0 +1,136 @@
+// Package validate checks the names that end up as paths and primary keys
+//
+// Entity types, entity ids and bucket names become directories of the
+// storage (<storage>/<type>/<id>/<bucket>) and columns of composite
+// primary keys, so they are kept to a portable subset
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/phanirithvij/fate/f8/errs"
+)
+
+const (
+	// MaxEntityTypeLength the longest entity type (table name) allowed
+	//
+	// Postgres truncates identifiers longer than this
+	MaxEntityTypeLength = 63
+	// MaxEntityIDLength the longest entity id allowed
+	MaxEntityIDLength = 128
+	// MaxBucketNameLength the longest bucket name allowed
+	MaxBucketNameLength = 63
+	// MaxPathLength the longest file path allowed
+	MaxPathLength = 4096
+	// MaxPathElementLength the longest file or directory name allowed
+	MaxPathElementLength = 255
+)
+
+var (
+	entityTypeRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	// a leading dot is left for the hidden buckets (eg. .thumbnails)
+	nameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+	// reservedTypes would collide with the storage directory or api routes
+	reservedTypes = map[string]bool{
+		"objects": true,
+		"public":  true,
+		"migrate": true,
+	}
+	// reservedNames can't be created on windows
+	reservedNames = map[string]bool{
+		"CON": true, "PRN": true, "AUX": true, "NUL": true,
+		"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+		"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+		"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+		"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	}
+)
+
+// invalid returns an errs.ErrInvalidName error
+func invalid(format string, a ...interface{}) error {
+	return errs.New(errs.ErrInvalidName, fmt.Sprintf(format, a...))
+}
+
+// reserved whether the name is a windows device name, with or without an extension
+func reserved(name string) bool {
+	return reservedNames[strings.ToUpper(strings.SplitN(name, ".", 2)[0])]
+}
+
+// EntityType checks an entity type
+//
+// Lowercase letters, digits and underscores starting with a letter
+func EntityType(t string) error {
+	switch {
+	case t == "":
+		return invalid("Entity type was empty")
+	case len(t) > MaxEntityTypeLength:
+		return invalid("Entity type %q is longer than %d characters", t, MaxEntityTypeLength)
+	case !entityTypeRe.MatchString(t):
+		return invalid("Entity type %q may only contain lowercase letters, digits and '_' and must start with a letter", t)
+	case reservedTypes[t] || reserved(t):
+		return invalid("Entity type %q is reserved", t)
+	}
+	return nil
+}
+
+// EntityID checks an entity id
+//
+// Letters, digits, '.', '_' and '-' starting with a letter or a digit
+func EntityID(id string) error {
+	return name("Entity id", id, MaxEntityIDLength)
+}
+
+// Tenant checks the name of a tenant
+//
+// Same rules as the entity ids
+func Tenant(t string) error {
+	return name("Tenant", t, MaxEntityIDLength)
+}
+
+// BucketName checks the name of a bucket
+//
+// Letters, digits, '.', '_' and '-' starting with a letter or a digit
+func BucketName(bID string) error {
+	return name("Bucket name", bID, MaxBucketNameLength)
+}
+
+func name(what, s string, max int) error {
+	switch {
+	case s == "":
+		return invalid("%s was empty", what)
+	case len(s) > max:
+		return invalid("%s %q is longer than %d characters", what, s, max)
+	case !nameRe.MatchString(s):
+		return invalid("%s %q may only contain letters, digits, '.', '_' and '-' and must start with a letter or a digit", what, s)
+	case reserved(s):
+		return invalid("%s %q is reserved", what, s)
+	}
+	return nil
+}
+
+// Path checks a file path
+//
+// Rejects `..` elements, control characters and overlong names
+func Path(p string) error {
+	if p == "" {
+		return errs.New(errs.ErrInvalidPath, "Path was empty")
+	}
+	if len(p) > MaxPathLength {
+		return errs.New(errs.ErrInvalidPath, fmt.Sprintf("Path is longer than %d characters", MaxPathLength))
+	}
+	if strings.IndexFunc(p, func(r rune) bool { return r < 0x20 || r == 0x7f }) != -1 {
+		return errs.New(errs.ErrInvalidPath, fmt.Sprintf("Path %q contains control characters", p))
+	}
+	for _, elem := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return errs.New(errs.ErrInvalidPath, fmt.Sprintf("Path %q points outside of its parent", p))
+		}
+		if len(elem) > MaxPathElementLength {
+			return errs.New(errs.ErrInvalidPath, fmt.Sprintf("Path %q has a name longer than %d characters", p, MaxPathElementLength))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package validate_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/validate"
+)
+
+func TestEntityType(t *testing.T) {
+	for _, ok := range []string{"users", "org_members", "a1", strings.Repeat("a", validate.MaxEntityTypeLength)} {
+		if err := validate.EntityType(ok); err != nil {
+			t.Errorf("%q: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{
+		"", "Users", "1users", "_users", "users-x", "users.x", "user s", "../users", "users/x",
+		"objects", "public", "migrate", "con", "nul", "com1",
+		strings.Repeat("a", validate.MaxEntityTypeLength+1),
+	} {
+		if err := validate.EntityType(bad); !errors.Is(err, errs.ErrInvalidName) {
+			t.Errorf("%q: got %v want %v", bad, err, errs.ErrInvalidName)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	checks := map[string]struct {
+		check func(string) error
+		max   int
+	}{
+		"entity id":   {validate.EntityID, validate.MaxEntityIDLength},
+		"tenant":      {validate.Tenant, validate.MaxEntityIDLength},
+		"bucket name": {validate.BucketName, validate.MaxBucketNameLength},
+	}
+	for what, c := range checks {
+		for _, ok := range []string{"alice", "Alice", "0", "a.b", "a_b", "a-b", "a..b", "console", "CON1", strings.Repeat("a", c.max)} {
+			if err := c.check(ok); err != nil {
+				t.Errorf("%s %q: %v", what, ok, err)
+			}
+		}
+		for _, bad := range []string{
+			"", ".", "..", ".hidden", "-a", "_a", "a b", "a/b", `a\b`, "../a", "a\x00", "ä",
+			"CON", "con", "Aux.txt", "LPT9", "nul.tar.gz",
+			strings.Repeat("a", c.max+1),
+		} {
+			if err := c.check(bad); !errors.Is(err, errs.ErrInvalidName) {
+				t.Errorf("%s %q: got %v want %v", what, bad, err, errs.ErrInvalidName)
+			}
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	long := strings.Repeat("a", validate.MaxPathElementLength)
+	for _, ok := range []string{
+		"a.txt", "/a.txt", "notes/a.txt", "notes/", "./a.txt", "a..b", "...", ".hidden/a",
+		"a b/ä.txt", long, strings.Repeat(long+"/", validate.MaxPathLength/(len(long)+1)),
+	} {
+		if err := validate.Path(ok); err != nil {
+			t.Errorf("%.40q: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{
+		"", "..", "../a", "a/..", "a/../b", "/../a", `..\a`, `a\..\b`, "a/../../etc/passwd",
+		"a\x00b", "a\nb", "a\tb", "a\x7fb", long + "a", "a/" + long + "a/b",
+		strings.Repeat("a/", validate.MaxPathLength/2+1),
+	} {
+		if err := validate.Path(bad); !errors.Is(err, errs.ErrInvalidPath) {
+			t.Errorf("%.40q: got %v want %v", bad, err, errs.ErrInvalidPath)
+		}
+	}
+}
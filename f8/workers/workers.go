@@ -0,0 +1,175 @@
+// Package workers runs the file work of the syncs, imports and exports in parallel
+//
+// Walking a large tree is cheap, reading the files it holds is not. Map
+// reads them on a few goroutines while the caller writes the rows or the
+// archive entries one at a time, in the order of the tree, as the database
+// and the archive writers need.
+//
+//	results := workers.Map(ctx, opts, files, func(ctx context.Context, f File) (Sniffed, error) {
+//		return sniff(f)
+//	})
+//	defer results.Close()
+//	for {
+//		s, err := results.Next()
+//		if errors.Is(err, io.EOF) {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		err = record(s)
+//		...
+//		results.Done(s.Size)
+//	}
+package workers
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultConcurrency the default number of tasks run at once
+//
+// The tasks wait on the disk more than on the cpu
+const DefaultConcurrency = 8
+
+// Options the knobs of a Map
+type Options struct {
+	// Concurrency the most tasks run at once, DefaultConcurrency if 0,
+	// 1 runs them one after the other
+	Concurrency int
+	// Progress called after every Done, from the goroutine calling it
+	Progress func(Progress)
+}
+
+// Progress how far a Map got
+type Progress struct {
+	// Done the items handled by the caller, Total the number of items
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	// Bytes the sum of the sizes given to Done
+	Bytes int64 `json:"bytes"`
+}
+
+// concurrency the number of tasks run at once
+func (o Options) concurrency() int {
+	if o.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return o.Concurrency
+}
+
+// result the outcome of a task
+type result[Out any] struct {
+	out Out
+	err error
+}
+
+// Results the outcomes of the tasks of a Map, in the order of their items
+//
+// Next, Done and Close are called from a single goroutine.
+type Results[Out any] struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   Options
+	// slots the outcomes to come in order, Concurrency of them at most
+	slots chan chan result[Out]
+	wg    sync.WaitGroup
+
+	progress Progress
+}
+
+// Map runs f on the items with at most opts.Concurrency of them at once
+//
+// The tasks don't get more than Concurrency items ahead of the caller so
+// what they hold, eg. open files or buffers, stays bounded. Cancelling ctx
+// or calling Close stops starting new tasks and cancels the context given
+// to the running ones.
+func Map[In, Out any](ctx context.Context, opts Options, items []In, f func(ctx context.Context, in In) (Out, error)) *Results[Out] {
+	n := opts.concurrency()
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Results[Out]{
+		ctx:      ctx,
+		cancel:   cancel,
+		opts:     opts,
+		slots:    make(chan chan result[Out], n),
+		progress: Progress{Total: len(items)},
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(r.slots)
+		for _, in := range items {
+			slot := make(chan result[Out], 1)
+			select {
+			case r.slots <- slot:
+			case <-ctx.Done():
+				return
+			}
+			if n == 1 {
+				// the next one starts once this one is handed over
+				out, err := f(ctx, in)
+				slot <- result[Out]{out, err}
+				continue
+			}
+			r.wg.Add(1)
+			go func(in In) {
+				defer r.wg.Done()
+				out, err := f(ctx, in)
+				slot <- result[Out]{out, err}
+			}(in)
+		}
+	}()
+	return r
+}
+
+// Next returns the outcome of the next item, io.EOF once they're all done
+//
+// It waits for its task to finish, the error of the context once cancelled
+// before the next task was started.
+func (r *Results[Out]) Next() (Out, error) {
+	var zero Out
+	select {
+	case slot, ok := <-r.slots:
+		if !ok {
+			if err := r.ctx.Err(); err != nil {
+				return zero, err
+			}
+			return zero, io.EOF
+		}
+		// the task returns soon once cancelled, what it holds isn't lost
+		res := <-slot
+		return res.out, res.err
+	case <-r.ctx.Done():
+		return zero, r.ctx.Err()
+	}
+}
+
+// Done counts the item Next returned as handled, size its bytes
+func (r *Results[Out]) Done(size int64) {
+	r.progress.Done++
+	r.progress.Bytes += size
+	if r.opts.Progress != nil {
+		r.opts.Progress(r.progress)
+	}
+}
+
+// Progress how far the caller got
+func (r *Results[Out]) Progress() Progress {
+	return r.progress
+}
+
+// Close stops the tasks and waits for the running ones
+//
+// The outcomes Next didn't return are dropped, closed if they're io.Closers.
+func (r *Results[Out]) Close() {
+	r.cancel()
+	r.wg.Wait()
+	for slot := range r.slots {
+		res := <-slot
+		if c, ok := any(res.out).(io.Closer); ok && res.err == nil {
+			c.Close()
+		}
+	}
+}
@@ -1,17 +1,69 @@
 module github.com/phanirithvij/fate
 
-// +heroku goVersion go1.15
-go 1.15
+// +heroku goVersion go1.18
+go 1.18
 
 require (
 	github.com/asdine/storm v2.1.2+incompatible
+	github.com/disintegration/imaging v1.6.2
 	github.com/filebrowser/filebrowser/v2 v2.10.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang-jwt/jwt/v4 v4.5.0
 	github.com/google/uuid v1.1.2
+	github.com/jackc/pgconn v1.7.0
 	github.com/lib/pq v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.3
+	github.com/pkg/sftp v1.13.5
 	github.com/shibukawa/configdir v0.0.0-20170330084843-e180dbdc8da0
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/postgres v1.0.5
 	gorm.io/driver/sqlite v1.1.3
 	gorm.io/gorm v1.20.7
 )
 
+require (
+	github.com/GeertJohan/go.rice v1.0.0 // indirect
+	github.com/caddyserver/caddy v1.0.3 // indirect
+	github.com/cenkalti/backoff v2.1.1+incompatible // indirect
+	github.com/daaku/go.zipexe v1.0.1 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dsnet/compress v0.0.1 // indirect
+	github.com/flynn/go-shlex v0.0.0-20150515145356-3f9db97f8568 // indirect
+	github.com/go-acme/lego v2.5.0+incompatible // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/gorilla/mux v1.7.3 // indirect
+	github.com/gorilla/websocket v1.4.1 // indirect
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
+	github.com/jackc/pgio v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgproto3/v2 v2.0.5 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/jackc/pgtype v1.5.0 // indirect
+	github.com/jackc/pgx/v4 v4.9.0 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.1 // indirect
+	github.com/klauspost/cpuid v1.2.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/maruel/natural v0.0.0-20180416170133-dbcb3e2e8cf1 // indirect
+	github.com/marusama/semaphore/v2 v2.4.1 // indirect
+	github.com/mholt/archiver v3.1.1+incompatible // indirect
+	github.com/mholt/certmagic v0.6.2-0.20190624175158-6a42ef9fe8c2 // indirect
+	github.com/miekg/dns v1.1.3 // indirect
+	github.com/nwaples/rardecode v1.0.0 // indirect
+	github.com/pierrec/lz4 v0.0.0-20190131084431-473cd7ce01a1 // indirect
+	github.com/spf13/afero v1.2.2 // indirect
+	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce // indirect
+	github.com/ulikunitz/xz v0.5.6 // indirect
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	go.etcd.io/bbolt v1.3.3 // indirect
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
+	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
+	gopkg.in/square/go-jose.v2 v2.2.2 // indirect
+)
+
 replace github.com/filebrowser/filebrowser/v2 => github.com/phanirithvij/filebrowser/v2 v2.9.1-0.20201125121250-2d82696cf6bd
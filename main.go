@@ -2,14 +2,23 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/phanirithvij/fate/f8"
 	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/cache"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/config"
 	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/pace"
+	"github.com/phanirithvij/fate/f8/plan"
+	"github.com/phanirithvij/fate/f8/repository"
+	"github.com/phanirithvij/fate/f8/schema"
+	"github.com/phanirithvij/fate/f8/tenant"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -22,21 +31,11 @@ type User struct {
 	*entity.BaseEntity `gorm:"embedded"`
 	Name               string `json:"name" gorm:"not null"`
 	// Emails             []Email `json:"emails" gorm:"foreignKey:UserID;"`
-	Emails []Email `json:"emails" gorm:"polymorphic:User;"`
+	Emails []entity.Email `json:"emails" gorm:"polymorphic:Entity;"`
 	// PGSQL
 	// Emails pq.StringArray `gorm:"type:varchar(254)[]" json:"emails"`
 }
 
-// TODO Consider https://github.com/go-gorm/datatypes for metadata or details
-
-// Email email for the user
-type Email struct {
-	gorm.Model
-	Email    string `gorm:"uniqueindex:user_email_idx" json:"email"`
-	UserID   string `gorm:"uniqueindex:user_email_idx"`
-	UserType string
-}
-
 func (u User) String() string {
 	x, err := json.MarshalIndent(u, "", " ")
 	if err != nil {
@@ -50,126 +49,163 @@ func (u User) String() string {
 
 var (
 	db *gorm.DB
-)
 
-// postgres pgadmin javascript mime type unblock on windows
-// https://www.pgadmin.org/faq/
-// https://stackoverflow.com/questions/39228657/disable-chrome-strict-mime-type-checking#comment114712270_58133872
-
-const (
-	username = "postgres"
-	password = "522191"
-	hostname = "localhost"
-	port     = 5433
-	dbname   = "f8"
-	// port     = "5432"
+	// dbLatency the latency of every query run through db
+	dbLatency = pace.NewMonitor(0)
 )
 
-// Main entrypoint for hacky development tests
+// command a subcommand of fate
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []command{
+	{"serve", "serve the api and filebrowser", serve},
+	{"migrate", "create or update the database schema", migrateCmd},
+	{"user", "manage users, their ssh keys and passwords, fate user create|key|password", userCmd},
+	{"bucket", "inspect and repair buckets, fate bucket ls|mv|cp|rm|verify|quota", bucketCmd},
+	{"fsck", "check the database against the storage directory", fsck},
+	{"gc", "purge deleted files and buckets, clean up orphans", gc},
+	{"backup", "backup the database and the storage directory", backupCmd},
+	{"restore", "restore a backup", restore},
+	{"prune", "remove old backups", prune},
+	{"pull", "migrate entities from another deployment", pull},
+	{"import", "import existing directory trees as buckets", importCmd},
+	{"seed", "create fake users and files for development", seedCmd},
+	{"schema", "validate and apply the entity types manifest", schemaCmd},
+	{"entity", "create, delete and restore entities", entityCmd},
+	{"usage", "export the monthly usage reports", usageCmd},
+	{"stats", "show the entities storing the most and their growth", statsCmd},
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: fate <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun fate <command> -h for the flags of a command.")
+	fmt.Fprintln(os.Stderr, "Every command reads "+config.DefaultFile+" or -config and FATE_* variables.")
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Llongfile)
-
-	posgres := &f8.DBConfig{
-		PGdbname:     dbname,
-		PGhostname:   hostname,
-		PGpassword:   password,
-		PGport:       port,
-		PGusername:   username,
-		DatabaseMode: f8.Postgres,
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			c.run(os.Args[2:])
+			return
+		}
+	}
+	switch name {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command", name)
+		printUsage()
+		os.Exit(2)
 	}
-	db = posgres.PostGreSQLDB()
-	storage, err := f8.New(f8.DB(db))
+}
+
+// parse parses the flags of a command with the config layer
+func parse(fs *flag.FlagSet, args []string) *config.Config {
+	cfg, err := config.Parse(fs, args)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return cfg
+}
 
-	// TODO debug flag
-	if true {
-		// db = db.Debug()
+// open opens the storage of the config and sets db
+func open(cfg *config.Config) *f8.StorageConfig {
+	ids, err := cfg.IDGenerator()
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	// Not supported error
-	// db.DryRun = true
-	err = AutoMigrate()
+	clock.Use(nil, ids)
+	storage, err := cfg.Storage()
 	if err != nil {
-		log.Println("AutoMigrate failed")
 		log.Fatal(err)
 	}
-
-	user := new(User)
-	user.Emails = []Email{{Email: "pano@fm.dm"}, {Email: "dodo@gmm.ff"}}
-	// PGSQL
-	// user.Emails = pq.StringArray{"pano@fm.dm", "dodo@gmm.ff"}
-	user.Name = "Phano"
-	userID := "phano"
-	// userID := "phano" + strconv.FormatInt(time.Now().Unix(), 10)
-	user.BaseEntity, err = entity.Entity(
-		entity.ID(userID),
-		entity.StorageConfig(storage),
-		entity.TableName(user.TableName()),
-		// entity.BucketName("newDefault"),
-		entity.BucketName(""),
-		entity.BucketCount(3),
-		entity.DB(db),
-	)
-	fmt.Println(user)
-	err = user.Save()
-	fmt.Println(user)
-
-	// Now manuplate the entity's file system
-
-	// get the default bucket
-	buck, err := user.GetBucket("default")
+	db = storage.DB
+	err = pace.Instrument(db, dbLatency)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			fmt.Println("Bucket not found")
-		}
+		log.Fatal(err)
 	}
-	fmt.Println(buck)
-	// should be true
-	fmt.Println("bucket exists?", buck.Exists())
-	ok := user.DeleteBucket("default-1")
-	if ok {
-		fmt.Println("Deleted successfully")
-	}
-	// ok = buck.Delete()
-	// if ok {
-	// 	fmt.Println("Deleted successfully twice??")
-	// }
-	buck, err = user.GetBucket("default-1")
+	err = tenant.Register(db)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			fmt.Println("Bucket1 not found")
+		log.Fatal(err)
+	}
+	if storage.ReadDB != nil {
+		err = tenant.Register(storage.ReadDB)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	// should be false
-	fmt.Println("bucket exists?", buck.Exists())
-
-	ok = user.DeleteBucket("No such bucket")
-	if !ok {
-		fmt.Println("No, such bucket won't exist")
+	buckets.AdvisoryLocks(cfg.Database.AdvisoryLocks)
+	buckets.Concurrency(cfg.IOWorkers)
+	// every command uses the cache so the writes of the cli forget the values of a shared redis
+	c, err := cfg.Cache.Cache()
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	bucks := buckets.GetDeletedBuckets(db)
-	fmt.Println(len(bucks))
-
-	ok = buckets.CleanupBuckets(db)
-	if ok {
-		fmt.Println(len(bucks), "buckets permanently deleted successfully")
+	if c != nil {
+		cache.Use(c, time.Duration(cfg.Cache.TTL))
 	}
+	return storage
+}
 
-	if v := entity.EntityBucketMap; true {
-		// if v, ok := entity.EntityBucketMap[user.ID]; ok {
-		fmt.Println("Printing entity bucket map")
-		jss, err := json.MarshalIndent(v, "", "  ")
+// migrateCmd creates or updates the schema
+//
+//	fate migrate [-dry-run]
+//
+// With -dry-run it prints the statements it would run instead, they're
+// rolled back. MySQL commits its schema changes as it goes, don't use it there.
+func migrateCmd(args []string) {
+	fs := flag.NewFlagSet("fate migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the statements the migration would run")
+	cfg := parse(fs, args)
+	open(cfg)
+	var m *schema.Manifest
+	if cfg.Manifest != "" {
+		var err error
+		m, err = schema.Load(cfg.Manifest)
 		if err != nil {
-			fmt.Println(v)
-		} else {
-			fmt.Println(string(jss))
+			log.Fatal(err)
 		}
 	}
-
-	storage.StartBrowser()
+	migrate := func(tx *gorm.DB) error {
+		err := migrateSchema(tx)
+		if err != nil {
+			return fmt.Errorf("AutoMigrate failed %w", err)
+		}
+		if m != nil {
+			return schema.Apply(tx, m)
+		}
+		return nil
+	}
+	if *dryRun {
+		p, err := plan.Run(db, migrate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Print(os.Stdout)
+		return
+	}
+	err := migrate(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if m != nil {
+		log.Println("Applied", len(m.Entities), "entity types from", cfg.Manifest)
+	}
+	log.Println("Migrated the schema")
 }
 
 // TableName for the user
@@ -180,6 +216,20 @@ func (u User) TableName() string {
 	return "users"
 }
 
+// GetBase the user's base entity for the repository
+func (u *User) GetBase() *entity.BaseEntity {
+	return u.BaseEntity
+}
+
+// userRepository the repository of the users
+func userRepository(storage *f8.StorageConfig) *repository.Repository[*User] {
+	r, err := repository.New[*User](db, storage, repository.Preload("Emails"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return r
+}
+
 // Save a user
 //
 // Upserts the user
@@ -200,6 +250,10 @@ func (u *User) Save() error {
 
 // AutoMigrate the user's schema
 func AutoMigrate() (err error) {
+	return migrateSchema(db)
+}
+
+func migrateSchema(db *gorm.DB) (err error) {
 	u := &User{}
 	err = entity.AutoMigrate(db)
 	if err != nil {
@@ -207,6 +261,6 @@ func AutoMigrate() (err error) {
 	}
 	// PGSQL
 	// err = db.AutoMigrate(u)
-	err = db.AutoMigrate(u, &Email{})
+	err = db.AutoMigrate(u)
 	return err
 }
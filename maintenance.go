@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/backup"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/config"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/migrate"
+	"github.com/phanirithvij/fate/f8/plan"
+	"github.com/phanirithvij/fate/f8/schema"
+	"github.com/phanirithvij/fate/f8/stats"
+	"github.com/phanirithvij/fate/f8/usage"
+	"github.com/phanirithvij/fate/f8/workers"
+	"gorm.io/gorm"
+)
+
+// fsck checks the database against the storage directory
+//
+//	fate fsck
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fate fsck", flag.ExitOnError)
+	cfg := parse(fs, args)
+	storage := open(cfg)
+	report, err := buckets.Fsck(db, storage.StorageDir, cfg.Pacer(dbLatency))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		log.Println("[fsck]", p.EntityType, p.EntityID, p.BucketID, p.Path, p.Issue)
+	}
+	if !report.OK() {
+		log.Fatalf("Fsck found %d problems\n", len(report.Problems))
+	}
+	log.Println("Checked", report.Buckets, "buckets", report.Files, "files")
+}
+
+// gc applies the lifecycle rules, purges the soft deleted files and buckets
+// then prunes the audit log and the finished jobs
+//
+//	fate gc [-orphans] [-dry-run]
+//
+// With -orphans it then cleans up the files and buckets the database and
+// the storage directory disagree on. -dry-run prints the statements and
+// the removals the gc would run and reports the orphans, changing nothing
+func gc(args []string) {
+	fs := flag.NewFlagSet("fate gc", flag.ExitOnError)
+	orphans := fs.Bool("orphans", false, "clean up the orphaned files and buckets")
+	dryRun := fs.Bool("dry-run", false, "only print what the gc would change and report the orphans")
+	cfg := parse(fs, args)
+	storage := open(cfg)
+	err := schema.LoadRegistered(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		p, err := plan.Run(db, func(tx *gorm.DB) error {
+			return collectGarbage(tx, storage.StorageDir, cfg)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Print(os.Stdout)
+		collectOrphans(storage.StorageDir, cfg, true)
+		return
+	}
+	err = collectGarbage(db, storage.StorageDir, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *orphans {
+		collectOrphans(storage.StorageDir, cfg, false)
+	}
+}
+
+// collectGarbage runs the steps of the gc but the orphans, logging what they did
+func collectGarbage(db *gorm.DB, storageDir string, cfg *config.Config) error {
+	expired, err := schema.Expire(db, storageDir, cfg.Pacer(dbLatency))
+	if err != nil {
+		return err
+	}
+	log.Println("Expired", expired.Files, "files", expired.Bytes, "bytes")
+	report, err := buckets.GCOlderThan(db, storageDir, time.Duration(cfg.Maintenance.DeleteRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		return err
+	}
+	log.Println("Purged", report.Buckets, "buckets", report.Files, "files", report.Objects, "objects", report.Temps, "temps", report.Parts, "parts", report.Bytes, "bytes")
+	pruned, err := audit.New(db).Prune(time.Duration(cfg.Maintenance.AuditRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		return err
+	}
+	log.Println("Pruned", pruned, "audit entries")
+	snapshotted, err := stats.Snapshot(db)
+	if err != nil {
+		return err
+	}
+	log.Println("Took the stats snapshot of", snapshotted, "buckets")
+	pruned, err = stats.Prune(db, time.Duration(cfg.Maintenance.StatsRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		return err
+	}
+	log.Println("Pruned", pruned, "stats snapshots")
+	pruned, err = jobs.New(db).Prune(time.Duration(cfg.Jobs.Retention), cfg.Pacer(dbLatency))
+	if err != nil {
+		return err
+	}
+	log.Println("Pruned", pruned, "finished jobs")
+	return nil
+}
+
+// collectOrphans reports the orphans in the storage directory, cleaning them up unless dryRun
+func collectOrphans(storageDir string, cfg *config.Config, dryRun bool) {
+	report, err := buckets.CollectOrphans(db, storageDir, buckets.OrphanOptions{
+		DryRun: dryRun,
+		Pacer:  cfg.Pacer(dbLatency),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		log.Println("[gc]", p.EntityType, p.EntityID, p.BucketID, p.Path, p.Issue)
+	}
+	log.Println("Found", len(report.Problems), "orphans, fixed", report.Fixed)
+}
+
+// usageCmd writes the usage reports to stdout as csv or json
+//
+//	fate usage [-month 2026-10] [-tenant t] [-json]
+//
+// The reports are kept up to date by fate serve, -flush also samples the storage up to now
+func usageCmd(args []string) {
+	fs := flag.NewFlagSet("fate usage", flag.ExitOnError)
+	month := fs.String("month", usage.Month(clock.Now()), "the month of the reports, empty for every month")
+	tenant := fs.String("tenant", "", "only the reports of the tenant")
+	asJSON := fs.Bool("json", false, "write json instead of csv")
+	flush := fs.Bool("flush", false, "sample the storage up to now before exporting")
+	cfg := parse(fs, args)
+	open(cfg)
+	meter := usage.New(db)
+	if *flush {
+		err := meter.Flush()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	reports, err := meter.List(usage.Filter{Month: *month, Tenant: *tenant})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(reports)
+	} else {
+		err = usage.WriteCSV(os.Stdout, reports)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// statsCmd prints the entities storing the most or the stats of one
+//
+//	fate stats [-tenant t] [-type users] [-limit 20] [-json]
+//	fate stats [-days 30] [-largest 10] [-json] <entity_type> <entity_id>
+//
+// The history comes from the daily snapshots of the gc, -snapshot takes today's first
+func statsCmd(args []string) {
+	fs := flag.NewFlagSet("fate stats", flag.ExitOnError)
+	tenant := fs.String("tenant", "", "only the entities of the tenant")
+	entityType := fs.String("type", "", "only the entities of the type")
+	limit := fs.Int("limit", stats.DefaultLimit, "number of entities")
+	days := fs.Int("days", stats.DefaultDays, "days of history of an entity")
+	largest := fs.Int("largest", stats.DefaultLargest, "number of largest files of an entity")
+	asJSON := fs.Bool("json", false, "write json instead of a table")
+	snapshot := fs.Bool("snapshot", false, "take today's snapshot first")
+	cfg := parse(fs, args)
+	if fs.NArg() == 1 {
+		log.Fatal("Usage: fate stats [flags] [<entity_type> <entity_id>]")
+	}
+	open(cfg)
+	if *snapshot {
+		_, err := stats.Snapshot(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var out interface{}
+	if fs.NArg() == 0 {
+		top, err := stats.Entities(db, stats.Filter{Tenant: *tenant, EntityType: *entityType, Limit: *limit})
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = top
+		if !*asJSON {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			defer w.Flush()
+			fmt.Fprintln(w, "TYPE\tID\tTENANT\tBUCKETS\tFILES\tBYTES")
+			for _, e := range top {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", e.EntityType, e.EntityID, e.Tenant, e.Buckets, e.Files, e.Bytes)
+			}
+			return
+		}
+	} else {
+		d, err := stats.Entity(db, fs.Arg(0), fs.Arg(1), stats.Options{Days: *days, Largest: *largest})
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = d
+		if !*asJSON {
+			fmt.Printf("%s/%s %d buckets, %d files, %d bytes\n\n", d.Stats.EntityType, d.Stats.EntityID, d.Stats.Buckets, d.Stats.Files, d.Stats.Bytes)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			defer w.Flush()
+			fmt.Fprintln(w, "BUCKET\tFILES\tBYTES\tQUOTA")
+			for _, b := range d.Buckets {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", b.BucketID, b.Files, b.Bytes, b.Quota)
+			}
+			fmt.Fprintln(w, "\nLARGEST\tBUCKET\tBYTES")
+			for _, f := range d.Largest {
+				fmt.Fprintf(w, "%s\t%s\t%d\n", f.Path, f.BucketID, f.Size)
+			}
+			fmt.Fprintln(w, "\nDAY\tFILES\tBYTES")
+			for _, p := range d.History {
+				fmt.Fprintf(w, "%s\t%d\t%d\n", p.Day, p.Files, p.Bytes)
+			}
+			return
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// backupCmd backs up the database and the storage directory
+//
+//	fate backup [-incremental]
+func backupCmd(args []string) {
+	fs := flag.NewFlagSet("fate backup", flag.ExitOnError)
+	incremental := fs.Bool("incremental", false, "backup only the files changed since the last backup")
+	cfg := parse(fs, args)
+	storage := open(cfg)
+	err := schema.LoadRegistered(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tables := []string{"users"}
+	if types := schema.Types(); len(types) > 0 {
+		tables = append(tables, "entity_types")
+		for _, t := range types {
+			tables = append(tables, t.Name)
+		}
+	}
+	m, err := backup.Create(db, storage.StorageDir, cfg.BackupDir, backup.Options{
+		Incremental: *incremental,
+		Tables:      append(tables, backup.DefaultTables...),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Created", m.Kind, "backup", m.ID)
+}
+
+// prune removes the backups the retention policy doesn't keep
+//
+//	fate prune [-dry-run] [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n]
+func prune(args []string) {
+	fs := flag.NewFlagSet("fate prune", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	keepLast := fs.Int("keep-last", 0, "keep the last n backups")
+	keepDaily := fs.Int("keep-daily", 7, "keep the last backup of n days")
+	keepWeekly := fs.Int("keep-weekly", 4, "keep the last backup of n weeks")
+	keepMonthly := fs.Int("keep-monthly", 6, "keep the last backup of n months")
+	cfg := parse(fs, args)
+	report, err := backup.Prune(cfg.BackupDir, backup.Policy{
+		KeepLast:    *keepLast,
+		KeepDaily:   *keepDaily,
+		KeepWeekly:  *keepWeekly,
+		KeepMonthly: *keepMonthly,
+	}, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Kept", report.Kept, "referenced", report.Referenced, "removed", report.Removed)
+}
+
+// pull migrates entities from another deployment
+//
+//	fate pull -from https://old.example.com [-bwlimit bytes] [-state file] <entity_type> <entity_id>...
+//
+// The token is the configured migration token
+func pull(args []string) {
+	fs := flag.NewFlagSet("fate pull", flag.ExitOnError)
+	from := fs.String("from", "", "base url of the source deployment")
+	bwlimit := fs.Int64("bwlimit", 0, "bandwidth cap in bytes per second, 0 for none")
+	stateFile := fs.String("state", "fate-pull.json", "progress file for resuming")
+	cfg := parse(fs, args)
+	if *from == "" || fs.NArg() < 2 {
+		log.Fatal("Usage: fate pull -from url <entity_type> <entity_id>...")
+	}
+	storage := open(cfg)
+	c := &migrate.Client{
+		BaseURL:        *from,
+		Token:          cfg.MigrationToken,
+		BytesPerSecond: *bwlimit,
+		StateFile:      *stateFile,
+	}
+	for _, id := range fs.Args()[1:] {
+		report, err := c.Pull(db, storage.StorageDir, fs.Arg(0), id)
+		if err != nil {
+			log.Fatal("Pulling ", id, " failed, run again to resume: ", err)
+		}
+		log.Println("Pulled", fs.Arg(0), id, report.Files, "files", report.Bytes, "bytes", report.Skipped, "skipped")
+	}
+}
+
+// importCmd imports existing directory trees as buckets
+//
+//	fate import [-link] [-layout entity|flat|date] [-dry-run] [-progress 10s] <entity_type> <entity_id> <bucket> <dir>
+//
+// The entity must exist, the bucket is created if it's missing.
+// Running it again only imports the files which changed, an interrupt
+// stops it once the files written are saved. The progress is logged
+// every -progress. With -dry-run it prints the rows and files it would
+// write instead.
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("fate import", flag.ExitOnError)
+	link := fs.Bool("link", false, "hard link the files instead of copying them")
+	layout := fs.String("layout", "", "layout of the bucket if it's created, default entity")
+	dryRun := fs.Bool("dry-run", false, "only print what the import would change")
+	every := fs.Duration("progress", 10*time.Second, "log the progress this often, 0 never")
+	cfg := parse(fs, args)
+	if fs.NArg() < 4 {
+		log.Fatal("Usage: fate import [-link] [-layout name] [-dry-run] [-progress 10s] <entity_type> <entity_id> <bucket> <dir>")
+	}
+	storage := open(cfg)
+	opts := buckets.IngestOptions{Link: *link, Layout: *layout}
+	last := time.Now()
+	opts.Workers.Progress = func(p workers.Progress) {
+		if *every > 0 && time.Since(last) >= *every {
+			last = time.Now()
+			log.Println("Imported", p.Done, "of", p.Total, "files", p.Bytes, "bytes")
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var report *buckets.IngestReport
+	ingest := func(tx *gorm.DB) (err error) {
+		report, err = buckets.IngestContext(ctx, tx, storage.StorageDir, fs.Arg(0), fs.Arg(1), fs.Arg(2), fs.Arg(3), opts)
+		return err
+	}
+	if *dryRun {
+		p, err := plan.Run(db, ingest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Print(os.Stdout)
+		log.Println("Would import", fs.Arg(3), "into", fs.Arg(2), report.Files, "files", report.Bytes, "bytes", report.Dirs, "directories", report.Skipped, "skipped")
+		return
+	}
+	err := ingest(db)
+	if err != nil {
+		if report != nil {
+			log.Println("Imported", report.Files, "files before failing, run again to resume")
+		}
+		log.Fatal(err)
+	}
+	log.Println("Imported", fs.Arg(3), "into", fs.Arg(2), report.Files, "files", report.Bytes, "bytes", report.Dirs, "directories", report.Skipped, "skipped")
+}
+
+// restore restores a backup
+//
+//	fate restore [-verify-only] [id]
+//
+// The latest backup is used when no id is given.
+// With -verify-only the backup is restored into a throwaway database and directory
+// and checked, production data is never touched.
+func restore(args []string) {
+	fs := flag.NewFlagSet("fate restore", flag.ExitOnError)
+	verifyOnly := fs.Bool("verify-only", false, "restore into a temporary location, check it and throw it away")
+	cfg := parse(fs, args)
+	id := fs.Arg(0)
+	if id == "" {
+		var err error
+		id, err = backup.Latest(cfg.BackupDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := backup.RestoreOptions{Migrate: migrateSchema}
+	if *verifyOnly {
+		report, err := backup.Drill(cfg.BackupDir, id, opts)
+		if err != nil {
+			log.Fatal("Restore drill failed ", err)
+		}
+		for _, p := range report.Fsck.Problems {
+			log.Println("[fsck]", p.EntityType, p.EntityID, p.BucketID, p.Path, p.Issue)
+		}
+		if !report.OK() {
+			log.Fatalf("Restore drill of %s found %d problems\n", id, len(report.Fsck.Problems))
+		}
+		log.Printf("Restore drill of %s succeeded, %d files %d buckets in %v\n",
+			id, report.Restore.Files, report.Fsck.Buckets, report.Took)
+		return
+	}
+	storage := open(cfg)
+	report, err := backup.Restore(db, storage.StorageDir, cfg.BackupDir, id, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Restored", report.Backup, report.Files, "files", report.Rows)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/schema"
+	"github.com/phanirithvij/fate/f8/tenant"
+)
+
+// schemaCmd validates and applies the manifest of the entity types
+//
+//	fate schema validate [file]
+//	fate schema apply [file]
+//	fate schema ls
+//
+// The file defaults to the configured manifest
+func schemaCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: fate schema validate|apply [file] | ls")
+		os.Exit(2)
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("fate schema "+sub, flag.ExitOnError)
+	cfg := parse(fs, args[1:])
+	file := cfg.Manifest
+	if fs.NArg() > 0 {
+		file = fs.Arg(0)
+	}
+	switch sub {
+	case "validate", "apply":
+		if file == "" {
+			log.Fatal("No manifest, pass a file or set -manifest")
+		}
+		m, err := schema.Load(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = m.Validate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sub == "validate" {
+			log.Println(file, "declares", len(m.Entities), "valid entity types")
+			return
+		}
+		open(cfg)
+		err = AutoMigrate()
+		if err != nil {
+			log.Fatal("AutoMigrate failed ", err)
+		}
+		err = schema.Apply(db, m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Applied", len(m.Entities), "entity types from", file)
+	case "ls":
+		open(cfg)
+		err := schema.LoadRegistered(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TYPE\tBUCKETS\tRULES\tDESCRIPTION")
+		for _, t := range schema.Types() {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", t.Name, len(t.Buckets), len(t.Lifecycle), t.Description)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown schema command", sub)
+		os.Exit(2)
+	}
+}
+
+// entityCmd manages the entities of the declared types
+//
+//	fate entity create [-tenant t] <type> [id]
+//	fate entity delete <type> <id>
+//	fate entity restore <type> <id>
+//
+// Deleted entities can be restored with their buckets until the gc purges
+// them, after the configured delete_retention
+func entityCmd(args []string) {
+	const usage = "Usage: fate entity create [-tenant t] <type> [id] | delete|restore <type> <id>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("fate entity "+sub, flag.ExitOnError)
+	tenantName := fs.String("tenant", "", "tenant the created entity belongs to")
+	cfg := parse(fs, args[1:])
+	switch sub {
+	case "create":
+		if fs.NArg() < 1 {
+			log.Fatal(usage)
+		}
+	case "delete", "restore":
+		if fs.NArg() < 2 {
+			log.Fatal(usage)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	storage := open(cfg)
+	switch sub {
+	case "delete":
+		err := entity.Delete(db, fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Deleted", fs.Arg(0), fs.Arg(1), "restore it within", time.Duration(cfg.Maintenance.DeleteRetention))
+		return
+	case "restore":
+		report, err := entity.Restore(db, fs.Arg(1), entity.RestoreOptions{
+			Type:      fs.Arg(0),
+			Retention: time.Duration(cfg.Maintenance.DeleteRetention),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Restored", fs.Arg(0), fs.Arg(1), report.Buckets, "buckets", report.Files, "files")
+		return
+	}
+	err := schema.LoadRegistered(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, ok := schema.Lookup(fs.Arg(0))
+	if !ok {
+		log.Fatal("Unknown entity type ", fs.Arg(0), ", apply a manifest declaring it first")
+	}
+	tx := db
+	if *tenantName != "" {
+		tx = tenant.Scope(db, *tenantName)
+	}
+	rec, err := t.Create(tx, storage, fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, b := range rec.Buckets {
+		fmt.Println(t.Name, rec.ID, b.ID)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/seed"
+)
+
+// seedCmd creates fake users with random file trees for development
+//
+//	fate seed [-users n] [-buckets n] [-files n] [-depth n] [-max-size bytes] [-seed n]
+//
+// The users are named seed-<n>, existing ones are skipped
+func seedCmd(args []string) {
+	fs := flag.NewFlagSet("fate seed", flag.ExitOnError)
+	users := fs.Int("users", 10, "number of users to create")
+	count := fs.Int("buckets", 2, "number of buckets of every user")
+	files := fs.Int("files", 20, "number of files in every bucket")
+	depth := fs.Int("depth", 3, "deepest a file is nested")
+	maxSize := fs.Int64("max-size", 64<<10, "largest file in bytes")
+	rngSeed := fs.Int64("seed", time.Now().UnixNano(), "seed of the generator, the same seed gives the same data")
+	cfg := parse(fs, args)
+	storage := open(cfg)
+	repo := userRepository(storage)
+	err := AutoMigrate()
+	if err != nil {
+		log.Fatal("AutoMigrate failed ", err)
+	}
+
+	rng := rand.New(rand.NewSource(*rngSeed))
+	opts := seed.Options{Files: *files, MaxDepth: *depth, MaxSize: *maxSize}
+	total, created := seed.Report{}, 0
+	for i := 0; i < *users; i++ {
+		name := seed.Name(rng)
+		user := &User{Name: name, Emails: []entity.Email{{Email: seed.Email(rng, name)}}}
+		user.BaseEntity, err = entity.Entity(
+			entity.ID("seed-"+strconv.Itoa(i)),
+			entity.StorageConfig(storage),
+			entity.TableName(user.TableName()),
+			entity.BucketCount(*count),
+			entity.DB(db),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = repo.Create(user)
+		if err != nil {
+			log.Println("Skipping", user.ID, err)
+			continue
+		}
+		created++
+		user.OverwriteBuckets()
+		for _, b := range user.Buckets {
+			report, err := seed.Fill(b, rng, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			total.Files += report.Files
+			total.Bytes += report.Bytes
+		}
+	}
+	log.Println("Seeded", created, "users", total.Files, "files", total.Bytes, "bytes with seed", *rngSeed)
+}
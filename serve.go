@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/phanirithvij/fate/f8"
+	"github.com/phanirithvij/fate/f8/api"
+	"github.com/phanirithvij/fate/f8/audit"
+	"github.com/phanirithvij/fate/f8/browser"
+	"github.com/phanirithvij/fate/f8/buckets"
+	"github.com/phanirithvij/fate/f8/clock"
+	"github.com/phanirithvij/fate/f8/config"
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/errs"
+	"github.com/phanirithvij/fate/f8/events"
+	"github.com/phanirithvij/fate/f8/flags"
+	"github.com/phanirithvij/fate/f8/forward"
+	"github.com/phanirithvij/fate/f8/jobs"
+	"github.com/phanirithvij/fate/f8/metadata"
+	"github.com/phanirithvij/fate/f8/metrics"
+	"github.com/phanirithvij/fate/f8/mirror"
+	"github.com/phanirithvij/fate/f8/notify"
+	"github.com/phanirithvij/fate/f8/oidc"
+	"github.com/phanirithvij/fate/f8/ratelimit"
+	"github.com/phanirithvij/fate/f8/readonly"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/schema"
+	"github.com/phanirithvij/fate/f8/sftp"
+	"github.com/phanirithvij/fate/f8/stats"
+	"github.com/phanirithvij/fate/f8/usage"
+)
+
+// serve serves the api and filebrowser
+//
+//	fate serve [-warmup]
+//
+// The schema is migrated on start
+func serve(args []string) {
+	fs := flag.NewFlagSet("fate serve", flag.ExitOnError)
+	warmup := fs.Bool("warmup", false, "preload the caches before serving")
+	cfg := parse(fs, args)
+	storage := open(cfg)
+
+	err := AutoMigrate()
+	if err != nil {
+		log.Fatal("AutoMigrate failed ", err)
+	}
+	err = schema.LoadRegistered(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = metrics.InstrumentDB(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buckets.RegisterMetrics(db)
+
+	auditLog := audit.New(db)
+	events.Subscribe(auditLog.Sink())
+	var meter *usage.Meter
+	if every := time.Duration(cfg.Maintenance.UsageEvery); every > 0 {
+		meter = usage.New(db)
+		events.Subscribe(meter)
+		buckets.MeterDownloads(meter.Download)
+		go usageLoop(meter, every)
+	}
+	for _, sc := range cfg.Events {
+		sink, err := sc.Sink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		events.Subscribe(sink)
+	}
+
+	if *warmup {
+		report, err := entity.WarmUp(db, storage, entity.WarmOptions{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Warmed up %d buckets of %d entities in %v\n", report.Buckets, report.Entities, report.Took)
+	}
+
+	mirrors := mirror.New(db, storage.StorageDir)
+	for _, mc := range cfg.Mirrors {
+		report, err := mirrors.Add(mc.Target())
+		if err != nil {
+			log.Fatal("Mirroring ", mc.Bucket, " to ", mc.Dir, " failed ", err)
+		}
+		log.Println("Mirrored", mc.EntityType, mc.EntityID, mc.Bucket, "to", mc.Dir, report.Copied, "copied", report.Removed, "removed")
+	}
+	if len(cfg.Mirrors) > 0 {
+		events.Subscribe(mirrors)
+		if every := time.Duration(cfg.Maintenance.MirrorEvery); every > 0 {
+			go mirrorLoop(mirrors, every)
+		}
+	}
+
+	// filebrowser writes directly to the storage directory
+	watcher, err := buckets.Watch(db, storage.StorageDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer watcher.Close()
+
+	queue := jobs.New(db, jobs.Workers(cfg.Jobs.Workers), jobs.MaxAttempts(cfg.Jobs.MaxAttempts))
+	jobs.RegisterStorage(queue, storage.StorageDir)
+	queue.Handle(jobs.GC, gcJob(cfg, storage))
+	queue.Start()
+	defer queue.Stop()
+
+	if every := time.Duration(cfg.Maintenance.GCEvery); every > 0 {
+		go gcLoop(cfg, storage, every)
+	}
+
+	if cfg.ReadOnly {
+		readonly.Enable("Started in read-only mode", 0)
+		log.Println("[f8][WARNING]: Serving in read-only mode")
+	}
+	limits := ratelimit.New(cfg.RateLimit.Options())
+	userType := (&User{}).TableName()
+	opts := []api.Option{
+		api.Auth(api.BasicAuth(db, userType)),
+		api.MigrationToken(cfg.MigrationToken),
+		api.AdminToken(cfg.AdminToken),
+		api.Flags(flags.New(db)),
+		api.MaxUploadSize(cfg.MaxUploadSize),
+		api.TenantHeader(cfg.TenantHeader),
+		api.RateLimit(limits),
+		api.Audit(auditLog),
+		api.Jobs(queue),
+		api.Usage(meter),
+	}
+	if cfg.WebDAV {
+		opts = append(opts, api.WebDAV())
+	}
+	if cfg.SMTP.Addr != "" {
+		n := &notify.SMTP{Addr: cfg.SMTP.Addr, From: cfg.SMTP.From, Username: cfg.SMTP.Username, Password: cfg.SMTP.Password}
+		events.Subscribe(notify.NewSink(db, n))
+		opts = append(opts, api.Notifier(n, cfg.SMTP.VerifyURL))
+	}
+	server := api.New(storage, opts...)
+	if cfg.SFTP.Addr != "" {
+		key, err := sftp.LoadHostKey(cfg.SFTP.HostKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv, err := sftp.New(db, storage.StorageDir, sftp.HostKey(key), sftp.Audit(auditLog), sftp.EntityType(userType),
+			sftp.Passwords(checkPassword))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Serving the buckets over sftp on", cfg.SFTP.Addr)
+		go func() {
+			log.Fatal(srv.ListenAndServe(cfg.SFTP.Addr))
+		}()
+	}
+	for _, fw := range cfg.Forwards {
+		f := forward.New(fw.Listen, fw.Target, forward.Options{MaxConns: fw.MaxConns, IdleTimeout: time.Duration(fw.IdleTimeout)})
+		log.Println("Forwarding", fw.Listen, "to", fw.Target)
+		go func() {
+			log.Fatal(f.ListenAndServe())
+		}()
+	}
+	browserOpts := []browser.Option{
+		browser.Handle("^"+api.Prefix+"/", server),
+		browser.Handle("^/metrics$", metrics.Default),
+		browser.Middleware(limits.Middleware),
+		browser.Middleware(auditLog.Logins(browser.BaseURL+"/api/login", limits.ClientIP)),
+		browser.Middleware(func(next http.Handler) http.Handler {
+			// logging in only reads
+			return readonly.Middleware(next, browser.BaseURL+"/api/login", browser.BaseURL+"/api/renew")
+		}),
+		browser.Server(cfg.Server.Options()),
+	}
+	if cfg.OIDC.Issuer != "" {
+		oidcOpts := []oidc.Option{
+			oidc.EntityType(userType),
+			oidc.BaseURL(browser.BaseURL),
+			oidc.SessionTTL(time.Duration(cfg.OIDC.SessionTTL)),
+			oidc.Passwords(checkPassword),
+			oidc.Audit(auditLog),
+		}
+		if cfg.OIDC.Provision {
+			oidcOpts = append(oidcOpts, oidc.Provision(provisionUser(storage)))
+		}
+		o, err := oidc.New(db, cfg.OIDC.Config(), storage.Key(f8.KeyOIDCSession), oidcOpts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Logging into the filebrowser through", cfg.OIDC.Issuer)
+		browserOpts = append(browserOpts, browser.Middleware(o.Middleware), browser.ProxyAuth(oidc.DefaultHeader),
+			browser.Roles(func(username string) (roles.Role, error) {
+				return roles.Get(db, userType, username)
+			}))
+	}
+	// the bucket acls apply to the filebrowser too
+	browserOpts = append(browserOpts, browser.Middleware(server.Guard))
+	log.Fatal(storage.StartBrowser(browserOpts...))
+}
+
+// checkPassword checks the password of the entity, wrong passwords and locked out entities are false
+func checkPassword(entityType, entityID, password string) (bool, error) {
+	err := entity.NewPasswords(db, entityType, entityID).CheckPassword(password)
+	if errors.Is(err, errs.ErrUnauthenticated) || errors.Is(err, errs.ErrLocked) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// provisionUser creates the users of the oidc subjects logging in for the first time
+//
+// The emails the provider verified are verified
+func provisionUser(storage *f8.StorageConfig) oidc.ProvisionFunc {
+	repo := userRepository(storage)
+	return func(c oidc.Claims) (string, error) {
+		name := c.String("name")
+		for _, claim := range []string{"preferred_username", "login", "email", "sub"} {
+			if name != "" {
+				break
+			}
+			name = c.String(claim)
+		}
+		user := &User{Name: name}
+		if email := c.String("email"); email != "" && c.Bool("email_verified") {
+			now := clock.Now()
+			user.Emails = append(user.Emails, entity.Email{Email: email, Primary: true, VerifiedAt: &now})
+		}
+		var err error
+		user.BaseEntity, err = entity.Entity(
+			entity.StorageConfig(storage),
+			entity.TableName(user.TableName()),
+			entity.DB(db),
+		)
+		if err != nil {
+			return "", err
+		}
+		err = repo.Create(user)
+		if err != nil {
+			return "", err
+		}
+		return user.ID, nil
+	}
+}
+
+// usageLoop flushes the usage reports every d
+func usageLoop(m *usage.Meter, d time.Duration) {
+	for range time.Tick(d) {
+		err := m.Flush()
+		if err != nil {
+			log.Println("[f8][WARNING]: Flushing the usage reports failed", err)
+		}
+	}
+}
+
+// mirrorLoop resyncs the mirrors every d, they miss the events dropped under load
+func mirrorLoop(m *mirror.Mirror, d time.Duration) {
+	for range time.Tick(d) {
+		report := m.SyncAll()
+		if report.Copied > 0 || report.Removed > 0 {
+			log.Println("[f8][mirror]: Caught up", report.Copied, "copied", report.Removed, "removed")
+		}
+	}
+}
+
+// gcLoop runs the gc every d alongside the server
+//
+// The pacer sees the queries of the server and backs off at peak
+func gcLoop(cfg *config.Config, storage *f8.StorageConfig, d time.Duration) {
+	for range time.Tick(d) {
+		if readonly.Check() != nil {
+			continue
+		}
+		_, err := runGC(cfg, storage)
+		if err != nil {
+			log.Println("[f8][WARNING]: GC failed", err)
+		}
+	}
+}
+
+// gcJob the handler of the gc jobs the admins queue
+func gcJob(cfg *config.Config, storage *f8.StorageConfig) jobs.Handler {
+	return func(ctx context.Context, job *jobs.Job) (metadata.Metadata, error) {
+		if err := readonly.Check(); err != nil {
+			return nil, jobs.Permanent(err)
+		}
+		return runGC(cfg, storage)
+	}
+}
+
+// runGC expires, purges and prunes once, returning what it did
+//
+// Only the purge failing fails it, the other steps are logged
+func runGC(cfg *config.Config, storage *f8.StorageConfig) (metadata.Metadata, error) {
+	result := metadata.Metadata{}
+	expired, err := schema.Expire(db, storage.StorageDir, cfg.Pacer(dbLatency))
+	if err != nil {
+		log.Println("[f8][WARNING]: Lifecycle rules failed", err)
+	} else if expired.Files > 0 {
+		log.Println("[f8][gc]: Expired", expired.Files, "files", expired.Bytes, "bytes")
+		result["expired"] = expired.Files
+	}
+	report, err := buckets.GCOlderThan(db, storage.StorageDir, time.Duration(cfg.Maintenance.DeleteRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[f8][gc]: Purged", report.Buckets, "buckets", report.Files, "files", report.Objects, "objects", report.Temps, "temps", report.Parts, "parts")
+	result["buckets"], result["files"], result["bytes"] = report.Buckets, report.Files, report.Bytes
+	pruned, err := audit.New(db).Prune(time.Duration(cfg.Maintenance.AuditRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		log.Println("[f8][WARNING]: Pruning the audit log failed", err)
+	} else if pruned > 0 {
+		log.Println("[f8][gc]: Pruned", pruned, "audit entries")
+	}
+	_, err = stats.Snapshot(db)
+	if err != nil {
+		log.Println("[f8][WARNING]: Taking the stats snapshot failed", err)
+	}
+	pruned, err = stats.Prune(db, time.Duration(cfg.Maintenance.StatsRetention), cfg.Pacer(dbLatency))
+	if err != nil {
+		log.Println("[f8][WARNING]: Pruning the stats snapshots failed", err)
+	} else if pruned > 0 {
+		log.Println("[f8][gc]: Pruned", pruned, "stats snapshots")
+	}
+	pruned, err = jobs.New(db).Prune(time.Duration(cfg.Jobs.Retention), cfg.Pacer(dbLatency))
+	if err != nil {
+		log.Println("[f8][WARNING]: Pruning the finished jobs failed", err)
+	} else if pruned > 0 {
+		log.Println("[f8][gc]: Pruned", pruned, "finished jobs")
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/phanirithvij/fate/f8/fatetest"
+	"github.com/phanirithvij/fate/f8/oidc"
+)
+
+func TestProvisionUserParallel(t *testing.T) {
+	env := fatetest.New(t, fatetest.Models(&User{}))
+	prev := db
+	db = env.DB
+	t.Cleanup(func() { db = prev })
+	provision := provisionUser(env.Storage)
+
+	// the oidc callbacks of first logins run concurrently, run it with -race
+	const n = 16
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := provision(oidc.Claims{
+				"sub":            fmt.Sprintf("sub-%d", i),
+				"email":          fmt.Sprintf("user%d@example.com", i),
+				"email_verified": true,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if seen[id] {
+			t.Errorf("two logins were provisioned as %s", id)
+		}
+		seen[id] = true
+	}
+	var users, bucks int64
+	err := env.DB.Model(&User{}).Count(&users).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.DB.Table("buckets").Where("entity_type = ?", "users").Count(&bucks).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users != n || bucks != n {
+		t.Errorf("got %d users and %d buckets want %d of each", users, bucks, n)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phanirithvij/fate/f8/entity"
+	"github.com/phanirithvij/fate/f8/roles"
+	"github.com/phanirithvij/fate/f8/sftp"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// userCmd manages the users
+//
+//	fate user create -id phano -name Phano [-email a@b.c,d@e.f] [-buckets n] [-tenant t]
+//	fate user key add|ls|rm -id phano [-key id_ed25519.pub] [-fingerprint SHA256:...]
+//	fate user password set|unlock|rm -id phano
+//	fate user role get|set|ls [-id phano] [-role admin]
+func userCmd(args []string) {
+	if len(args) > 0 {
+		sub, ok := map[string]func([]string){
+			"create":   userCreate,
+			"key":      userKey,
+			"password": userPassword,
+			"role":     userRole,
+		}[args[0]]
+		if ok {
+			sub(args[1:])
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: fate user create -id id -name name [-email emails] [-buckets n], fate user key add|ls|rm -id id, fate user password set|unlock|rm -id id, fate user role get|set|ls [-id id] [-role role]")
+	os.Exit(2)
+}
+
+// userCreate creates a user with its buckets
+func userCreate(args []string) {
+	fs := flag.NewFlagSet("fate user create", flag.ExitOnError)
+	id := fs.String("id", "", "id of the user, a random one if empty")
+	name := fs.String("name", "", "name of the user")
+	emails := fs.String("email", "", "comma separated emails of the user")
+	count := fs.Int("buckets", 1, "number of buckets the user starts with")
+	tenantName := fs.String("tenant", "", "tenant the user belongs to")
+	cfg := parse(fs, args)
+	if *name == "" {
+		log.Fatal("Usage: fate user create -name name")
+	}
+	storage := open(cfg)
+	repo := userRepository(storage)
+
+	user := &User{Name: *name}
+	for _, e := range strings.Split(*emails, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			user.Emails = append(user.Emails, entity.Email{Email: e})
+		}
+	}
+	var err error
+	user.BaseEntity, err = entity.Entity(
+		entity.ID(*id),
+		entity.StorageConfig(storage),
+		entity.TableName(user.TableName()),
+		entity.BucketCount(*count),
+		entity.DB(db),
+		entity.Tenant(*tenantName),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = repo.Create(user)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(user)
+}
+
+// userKey manages the public keys the user logs in over sftp with
+func userKey(args []string) {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "ls" && args[0] != "rm") {
+		fmt.Fprintln(os.Stderr, "Usage: fate user key add|ls|rm -id id [-key file] [-fingerprint fingerprint]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("fate user key "+args[0], flag.ExitOnError)
+	id := fs.String("id", "", "id of the user")
+	keyFile := fs.String("key", "", "public key file to add in the authorized_keys format, - for stdin")
+	fingerprint := fs.String("fingerprint", "", "fingerprint of the key to remove, printed by ls")
+	cfg := parse(fs, args[1:])
+	if *id == "" {
+		log.Fatal("Usage: fate user key ", args[0], " -id id")
+	}
+	open(cfg)
+	entityType := (&User{}).TableName()
+	switch args[0] {
+	case "add":
+		var data []byte
+		var err error
+		switch *keyFile {
+		case "":
+			log.Fatal("Usage: fate user key add -id id -key file")
+		case "-":
+			data, err = ioutil.ReadAll(os.Stdin)
+		default:
+			data, err = ioutil.ReadFile(*keyFile)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := sftp.AddKey(db, entityType, *id, string(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Added", k.Fingerprint, k.Comment)
+	case "ls":
+		keys, err := sftp.Keys(db, entityType, *id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FINGERPRINT\tCOMMENT\tADDED")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", k.Fingerprint, k.Comment, k.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+	case "rm":
+		if *fingerprint == "" {
+			log.Fatal("Usage: fate user key rm -id id -fingerprint fingerprint")
+		}
+		err := sftp.RemoveKey(db, entityType, *id, *fingerprint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Removed", *fingerprint)
+	}
+}
+
+// userPassword sets, unlocks or removes the password the user logs in with
+//
+// The new password is read from stdin, without echoing it on a terminal
+func userPassword(args []string) {
+	if len(args) == 0 || (args[0] != "set" && args[0] != "unlock" && args[0] != "rm") {
+		fmt.Fprintln(os.Stderr, "Usage: fate user password set|unlock|rm -id id")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("fate user password "+args[0], flag.ExitOnError)
+	id := fs.String("id", "", "id of the user")
+	cfg := parse(fs, args[1:])
+	if *id == "" {
+		log.Fatal("Usage: fate user password ", args[0], " -id id")
+	}
+	open(cfg)
+	p := entity.NewPasswords(db, (&User{}).TableName(), *id)
+	var err error
+	switch args[0] {
+	case "set":
+		var password string
+		password, err = readPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = p.SetPassword(password)
+	case "unlock":
+		err = p.Unlock()
+	case "rm":
+		err = p.Remove()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Done")
+}
+
+// userRole shows or changes the role of a user, or lists the users with a role
+func userRole(args []string) {
+	if len(args) == 0 || (args[0] != "get" && args[0] != "set" && args[0] != "ls") {
+		fmt.Fprintln(os.Stderr, "Usage: fate user role get|set|ls [-id id] [-role admin|user|readonly]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("fate user role "+args[0], flag.ExitOnError)
+	id := fs.String("id", "", "id of the user")
+	role := fs.String("role", "", "role to set or list, admin, user, readonly or disabled")
+	cfg := parse(fs, args[1:])
+	if (*id == "" && args[0] != "ls") || (*role == "" && args[0] == "set") {
+		log.Fatal("Usage: fate user role ", args[0], " -id id [-role role]")
+	}
+	if *role == "" {
+		*role = string(roles.Admin)
+	}
+	open(cfg)
+	userType := (&User{}).TableName()
+	switch args[0] {
+	case "get":
+		r, err := roles.Get(db, userType, *id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(r)
+	case "set":
+		err := roles.Set(db, userType, *id, roles.Role(*role))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(*id, "is now", *role)
+	case "ls":
+		as, err := roles.List(db, roles.Role(*role))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, a := range as {
+			if a.EntityType == userType {
+				fmt.Println(a.EntityID)
+			}
+		}
+	}
+}
+
+// readPassword reads a line from stdin, prompting for it on a terminal
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}